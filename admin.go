@@ -0,0 +1,540 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/go-mod/cfg"
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/go-mod/protobufjson"
+	"github.com/cyverse-de/resource-usage-api/calculator"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/internal"
+	"github.com/cyverse-de/resource-usage-api/internal/summarizer"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/guregu/null"
+	"github.com/jmoiron/sqlx"
+	"github.com/knadh/koanf"
+	"github.com/nats-io/nats.go"
+)
+
+// exportPageSize is the number of rows fetched at a time by the export command.
+const exportPageSize = 1000
+
+// adminEnv contains the connections shared by the admin subcommands.
+type adminEnv struct {
+	context    context.Context
+	config     *koanf.Koanf
+	dbconn     *sqlx.DB
+	db         *db.Database
+	natsClient *nats.EncodedConn
+	userSuffix string
+	out        io.Writer
+}
+
+// fixUsername adds the user domain to the username if it's missing.
+func (e *adminEnv) fixUsername(username string) string {
+	if !strings.HasSuffix(username, e.userSuffix) {
+		return fmt.Sprintf("%s@%s", username, e.userSuffix)
+	}
+	return username
+}
+
+// newCalculator returns a CPU hours calculator configured the same way as the
+// service's.
+func (e *adminEnv) newCalculator() (*cpuhours.CPUHours, error) {
+	calculatorConfig, err := calculatorConfiguration(e.config)
+	if err != nil {
+		return nil, err
+	}
+	registry := calculator.NewRegistry()
+	if err = cpuhours.Register(registry, e.db, calculatorConfig); err != nil {
+		return nil, err
+	}
+	return cpuhours.New(e.db, e.natsClient, registry), nil
+}
+
+// adminCommand is a subcommand of the admin command.
+type adminCommand struct {
+	name        string
+	description string
+
+	// needsNATS is true if the command talks to QMS.
+	needsNATS bool
+
+	run func(env *adminEnv, args []string) error
+}
+
+var adminCommands = []adminCommand{
+	{
+		name:        "recalculate",
+		description: "Calculate the usage for an analysis, sending it to QMS with -apply",
+		needsNATS:   true,
+		run:         adminRecalculate,
+	},
+	{
+		name:        "backfill",
+		description: "Calculate the usage for a user's analyses in a time range that hasn't been recorded yet",
+		needsNATS:   true,
+		run:         adminBackfill,
+	},
+	{
+		name:        "adjust",
+		description: "Add (or, with a negative value, remove) usage for a user in QMS",
+		needsNATS:   true,
+		run:         adminAdjust,
+	},
+	{
+		name:        "reconcile",
+		description: "Compare a user's CPU hours in the database with their usage in QMS",
+		needsNATS:   true,
+		run:         adminReconcile,
+	},
+	{
+		name:        "export",
+		description: "Write the denormalized usage rows for all analyses as CSV, anonymized with -anonymize",
+		run:         adminExport,
+	},
+}
+
+// adminUsage prints the usage message for the admin command.
+func adminUsage(fs *flag.FlagSet) {
+	out := fs.Output()
+	fmt.Fprintf(out, "Usage: %s admin [flags] <command> [command flags]\n\nCommands:\n", serviceName)
+	for _, command := range adminCommands {
+		fmt.Fprintf(out, "  %-12s %s\n", command.name, command.description)
+	}
+	fmt.Fprintln(out, "\nFlags:")
+	fs.PrintDefaults()
+}
+
+// runAdmin runs an admin subcommand directly against the database and QMS,
+// without the HTTP or messaging paths, and returns the process exit code.
+func runAdmin(args []string) int {
+	fs := flag.NewFlagSet("admin", flag.ContinueOnError)
+	var (
+		configPath    = fs.String("config", cfg.DefaultConfigPath, "Full path to the configuration file")
+		dotEnvPath    = fs.String("dotenv-path", cfg.DefaultDotEnvPath, "Path to the dotenv file")
+		envPrefix     = fs.String("env-prefix", cfg.DefaultEnvPrefix, "The prefix for environment variables")
+		tlsCert       = fs.String("tlscert", gotelnats.DefaultTLSCertPath, "Path to the NATS TLS cert file")
+		tlsKey        = fs.String("tlskey", gotelnats.DefaultTLSKeyPath, "Path to the NATS TLS key file")
+		caCert        = fs.String("tlsca", gotelnats.DefaultTLSCAPath, "Path to the NATS TLS CA file")
+		credsPath     = fs.String("creds", gotelnats.DefaultCredsPath, "Path to the NATS creds file")
+		maxReconnects = fs.Int("max-reconnects", gotelnats.DefaultMaxReconnects, "Maximum number of reconnection attempts to NATS")
+		reconnectWait = fs.Int("reconnect-wait", gotelnats.DefaultReconnectWait, "Seconds to wait between reconnection attempts to NATS")
+		logLevel      = fs.String("log-level", "warn", "One of trace, debug, info, warn, error, fatal, or panic.")
+	)
+	fs.Usage = func() { adminUsage(fs) }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	var command *adminCommand
+	for i := range adminCommands {
+		if adminCommands[i].name == fs.Arg(0) {
+			command = &adminCommands[i]
+		}
+	}
+	if command == nil {
+		adminUsage(fs)
+		return 2
+	}
+
+	logging.SetupLogging(*logLevel)
+
+	config, err := cfg.Init(&cfg.Settings{
+		EnvPrefix:   *envPrefix,
+		ConfigPath:  *configPath,
+		DotEnvPath:  *dotEnvPath,
+		StrictMerge: false,
+		FileType:    cfg.YAML,
+	})
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	dbURI := config.String("db.uri")
+	if dbURI == "" {
+		log.Error("db.uri must be set in the configuration file")
+		return 1
+	}
+	dbconn, err := db.Connect(databaseConfig(config, dbURI))
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	defer dbconn.Close()
+
+	env := &adminEnv{
+		context:    context.Background(),
+		config:     config,
+		dbconn:     dbconn,
+		db:         db.New(dbconn),
+		userSuffix: config.String("users.domain"),
+		out:        os.Stdout,
+	}
+
+	if command.needsNATS {
+		nats.RegisterEncoder("protojson", protobufjson.NewCodec(protobufjson.WithEmitUnpopulated()))
+		nc, err := connectNATS(config.String("nats.cluster"), *credsPath, *caCert, *tlsCert, *tlsKey, *maxReconnects, *reconnectWait)
+		if err != nil {
+			log.Error(err)
+			return 1
+		}
+		defer nc.Close()
+		if env.natsClient, err = nats.NewEncodedConn(nc, "protojson"); err != nil {
+			log.Error(err)
+			return 1
+		}
+	}
+
+	if err = command.run(env, fs.Args()[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", command.name, err)
+		}
+		return 1
+	}
+	return 0
+}
+
+// parseTime parses a timestamp in RFC 3339 format or a date in YYYY-MM-DD
+// format.
+func parseTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// adminRecalculate calculates the usage for a single analysis.
+func adminRecalculate(env *adminEnv, args []string) error {
+	fs := flag.NewFlagSet("recalculate", flag.ContinueOnError)
+	analysisID := fs.String("analysis-id", "", "The ID of the analysis")
+	externalID := fs.String("external-id", "", "The external ID of one of the analysis's steps, instead of -analysis-id")
+	apply := fs.Bool("apply", false, "Send the usage to QMS instead of only printing it; usage that was already sent is counted again")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var err error
+	if *analysisID == "" && *externalID != "" {
+		if *analysisID, err = env.db.GetAnalysisIDByExternalID(env.context, *externalID); err != nil {
+			return err
+		}
+	}
+	if *analysisID == "" {
+		return errors.New("-analysis-id or -external-id must be set")
+	}
+
+	calc, err := env.newCalculator()
+	if err != nil {
+		return err
+	}
+
+	if !*apply {
+		cpuHours, _, err := calc.CPUHoursForAnalysis(env.context, *analysisID)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(env.out, "%s\t%s\n", *analysisID, cpuHours.Text('f'))
+		return nil
+	}
+
+	if err = calc.CalculateForAnalysisByID(env.context, *analysisID); err != nil {
+		return err
+	}
+	fmt.Fprintf(env.out, "%s\tsent\n", *analysisID)
+	return nil
+}
+
+// adminBackfill calculates the usage for the analyses that a user ran in a
+// time range. With -apply, calculation intents are used so that analyses
+// whose usage was already recorded aren't counted again, and progress is
+// checkpointed so that an interrupted backfill resumes after the last analysis
+// it processed. A backfill that's resumed without -to keeps the end of the
+// range it was started with.
+func adminBackfill(env *adminEnv, args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	username := fs.String("user", "", "The user whose analyses are backfilled")
+	fromValue := fs.String("from", "", "The start of the time range")
+	toValue := fs.String("to", "", "The end of the time range; defaults to now, or to the end of an unfinished backfill from the same start")
+	apply := fs.Bool("apply", false, "Send the usage to QMS instead of only printing it")
+	restart := fs.Bool("restart", false, "Start the backfill over instead of resuming from its checkpoint")
+	checkpointEvery := fs.Int("checkpoint-every", 100, "The number of analyses processed between checkpoints")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *username == "" || *fromValue == "" {
+		return errors.New("-user and -from must be set")
+	}
+	if *checkpointEvery <= 0 {
+		return errors.New("-checkpoint-every must be positive")
+	}
+
+	from, err := parseTime(*fromValue)
+	if err != nil {
+		return err
+	}
+
+	userID, err := env.db.UserID(env.context, env.fixUsername(*username))
+	if err != nil {
+		return err
+	}
+
+	// The database stores timestamps to the microsecond, and the checkpoint is
+	// looked up by its range, so the default end is truncated to match.
+	to := time.Now().Truncate(time.Second)
+	if *toValue != "" {
+		if to, err = parseTime(*toValue); err != nil {
+			return err
+		}
+	} else if *apply && !*restart {
+		unfinished, err := env.db.UnfinishedBackfillCheckpoint(env.context, userID, from)
+		if err != nil {
+			return err
+		}
+		if unfinished != nil {
+			to = unfinished.RangeEnd
+		}
+	}
+
+	if !*apply {
+		analyses, err := env.db.AdminAllCalculableAnalyses(env.context, userID, from, to)
+		if err != nil {
+			return err
+		}
+		for _, analysis := range analyses {
+			cpuHours, err := cpuhours.ReservedCPUHours(analysis.StartDate, analysis.EndDate, analysis.MillicoresReserved)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(env.out, "%s\t%s\n", analysis.ID, cpuHours.Text('f'))
+		}
+		return nil
+	}
+
+	checkpoint, err := env.db.StartBackfillCheckpoint(env.context, userID, from, to)
+	if err != nil {
+		return err
+	}
+	if *restart {
+		if err = env.db.ResetBackfillCheckpoint(env.context, checkpoint); err != nil {
+			return err
+		}
+	}
+	if checkpoint.CompletedOn.Valid {
+		fmt.Fprintf(env.out, "the backfill of this range completed at %s; use -restart to run it again\n", checkpoint.CompletedOn.Time.Format(time.RFC3339))
+		return nil
+	}
+	if checkpoint.LastAnalysisID.Valid {
+		fmt.Fprintf(
+			env.out,
+			"resuming after analysis %s (%d already processed), up to %s\n",
+			checkpoint.LastAnalysisID.String,
+			checkpoint.Processed,
+			checkpoint.RangeEnd.Format(time.RFC3339),
+		)
+	}
+
+	analyses, err := env.db.BackfillAnalyses(env.context, checkpoint)
+	if err != nil {
+		return err
+	}
+
+	calc, err := env.newCalculator()
+	if err != nil {
+		return err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	workerID, err := env.db.RegisterWorker(env.context, "admin@"+hostname, time.Now().Add(time.Hour))
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := env.db.UnregisterWorker(env.context, workerID); err != nil {
+			log.Error(err)
+		}
+	}()
+	if err = env.db.ActivateWorker(env.context, workerID); err != nil {
+		return err
+	}
+	calc.SetOwner(workerID)
+
+	unsaved := 0
+	for _, analysis := range analyses {
+		if err = calc.CalculateForAnalysisByID(env.context, analysis.ID); err != nil {
+			// Record the progress made so far so that the next run starts with
+			// the analysis that failed.
+			if unsaved > 0 {
+				if saveErr := env.db.UpdateBackfillCheckpoint(env.context, checkpoint); saveErr != nil {
+					log.Error(saveErr)
+				}
+			}
+			return fmt.Errorf("analysis %s: %w", analysis.ID, err)
+		}
+		fmt.Fprintf(env.out, "%s\tdone\n", analysis.ID)
+
+		checkpoint.LastEndDate = null.TimeFrom(analysis.EndDate)
+		checkpoint.LastAnalysisID = null.StringFrom(analysis.ID)
+		checkpoint.Processed++
+		unsaved++
+		if unsaved >= *checkpointEvery {
+			if err = env.db.UpdateBackfillCheckpoint(env.context, checkpoint); err != nil {
+				return err
+			}
+			unsaved = 0
+		}
+	}
+
+	if err = env.db.UpdateBackfillCheckpoint(env.context, checkpoint); err != nil {
+		return err
+	}
+	if err = env.db.CompleteBackfillCheckpoint(env.context, checkpoint); err != nil {
+		return err
+	}
+	fmt.Fprintf(env.out, "backfill complete: %d analyses processed\n", checkpoint.Processed)
+	return nil
+}
+
+// adminAdjust adds usage for a user in QMS.
+func adminAdjust(env *adminEnv, args []string) error {
+	fs := flag.NewFlagSet("adjust", flag.ContinueOnError)
+	username := fs.String("user", "", "The user whose usage is adjusted")
+	value := fs.String("value", "", "The amount to add; negative values remove usage")
+	resourceType := fs.String("resource-type", cpuhours.ResourceType, "The resource type to adjust")
+	unit := fs.String("unit", cpuhours.Unit, "The unit of the resource type")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *username == "" || *value == "" {
+		return errors.New("-user and -value must be set")
+	}
+
+	amount, _, err := apd.NewFromString(*value)
+	if err != nil {
+		return err
+	}
+
+	calc, err := env.newCalculator()
+	if err != nil {
+		return err
+	}
+
+	user := env.fixUsername(*username)
+	record := &calculator.UsageRecord{ResourceType: *resourceType, Unit: *unit, Value: amount}
+	if err = calc.AddUsageRecord(env.context, user, record); err != nil {
+		return err
+	}
+	fmt.Fprintf(env.out, "%s\t%s\t%s %s\n", user, *resourceType, amount.Text('f'), *unit)
+	return nil
+}
+
+// adminReconcile compares a user's current CPU hours total in the database
+// with their CPU hours usage in QMS.
+func adminReconcile(env *adminEnv, args []string) error {
+	fs := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	username := fs.String("user", "", "The user to reconcile")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *username == "" {
+		return errors.New("-user must be set")
+	}
+	user := env.fixUsername(*username)
+
+	local := apd.New(0, 0)
+	total, err := env.db.CurrentCPUHoursForUser(env.context, user)
+	if err == nil {
+		local = &total.Total
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	s := &summarizer.SubscriptionSummarizer{Context: env.context, User: user, Client: env.natsClient}
+	summary := s.LoadSummary()
+	if summary == nil || summary.CPUUsage == nil {
+		return errors.New("unable to load the user's usage from QMS")
+	}
+	remote := &summary.CPUUsage.Total
+
+	difference := apd.New(0, 0)
+	if _, err = apd.BaseContext.WithPrecision(15).Sub(difference, local, remote); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(env.out, "database\t%s\nqms\t%s\ndifference\t%s\n", local.Text('f'), remote.Text('f'), difference.Text('f'))
+	return nil
+}
+
+// adminExport writes every denormalized usage row as CSV, or the anonymized
+// research rows with -anonymize.
+func adminExport(env *adminEnv, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	output := fs.String("output", "", "The file to write to; defaults to standard output")
+	anonymize := fs.Bool("anonymize", false, "Write the anonymized research export, using the salt in export.anonymize.salt")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	var anonymizer *internal.Anonymizer
+	if *anonymize {
+		if anonymizer = researchAnonymizer(env.config); anonymizer == nil {
+			return errors.New("export.anonymize.salt must be set in the configuration to use -anonymize")
+		}
+	}
+
+	out := env.out
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	w := csv.NewWriter(out)
+	for offset := 0; ; offset += exportPageSize {
+		var count int
+		if anonymizer != nil {
+			rows, err := env.db.AdminResearchUsage(env.context, "", exportPageSize, offset)
+			if err != nil {
+				return err
+			}
+			if err = internal.WriteAnonymizedUsageCSV(w, anonymizer.Anonymize(rows), offset == 0); err != nil {
+				return err
+			}
+			count = len(rows)
+		} else {
+			rows, err := env.db.AdminFlatUsage(env.context, "", exportPageSize, offset)
+			if err != nil {
+				return err
+			}
+			if err = internal.WriteFlatUsageCSV(w, rows, offset == 0); err != nil {
+				return err
+			}
+			count = len(rows)
+		}
+		if count < exportPageSize {
+			break
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
@@ -2,10 +2,13 @@ package amqp
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
+	"time"
 
 	"github.com/cyverse-de/messaging/v9"
 	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/ops"
+	"github.com/cyverse-de/resource-usage-api/transport"
 	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
 )
@@ -19,29 +22,90 @@ type Configuration struct {
 	ExchangeType  string
 	Queue         string
 	PrefetchCount int
-}
 
-type analysisUpdateJob struct {
-	UUID     string `json:"uuid"`
-	CondorID string `json:"condor_id"` // not actually used for anything...yet.
+	// Workers is the maximum number of messages that are handled at the same
+	// time. Values less than 1 are treated as 1.
+	Workers int
+
+	// PublishTimeout is how long to wait for the broker to confirm a
+	// published message.
+	PublishTimeout time.Duration
+
+	// MaxAttempts is the number of times a message that fails with a
+	// transient error is processed before it's dead-lettered.
+	MaxAttempts int
+
+	// DeadLetterExchange and DeadLetterQueue are where messages that can't be
+	// processed are sent. They default to the queue name with .dlx and
+	// .dead-letters appended.
+	DeadLetterExchange string
+	DeadLetterQueue    string
+
+	// Bindings are additional subscriptions, each with its own handler. Job
+	// status updates are always consumed from Queue.
+	Bindings []Binding
+
+	// Archiver records each job status update that's consumed, if it's set.
+	Archiver transport.Archiver
+
+	// Backpressure is consulted before each successfully handled message is
+	// acknowledged, if it's set.
+	Backpressure Backpressure
+
+	// Events is told about each message that's dead-lettered, if it's set.
+	Events *ops.Publisher
 }
 
-type analysisUpdateMsg struct {
-	Job     analysisUpdateJob  `json:"Job"`
-	State   messaging.JobState `json:"State"`
-	Message string             `json:"Message"`
-	SentOn  string             `json:"SentOn"`
-	Sender  string             `json:"Sender"`
+// Backpressure tells the consumers to slow down. Holding back a message's
+// acknowledgement keeps its worker slot busy and counts against the prefetch
+// limit, so fewer messages are delivered until the delay is lifted.
+type Backpressure interface {
+	// AckDelay returns how long to wait before acknowledging a message. Zero
+	// means that it's acknowledged right away.
+	AckDelay() time.Duration
 }
 
-type HandlerFn func(context context.Context, externalID string, state messaging.JobState)
+// requeueDelay is how long to wait before retrying a message that failed with
+// a transient error, so that a brief outage doesn't turn into a redelivery loop.
+const requeueDelay = 5 * time.Second
 
+// MessageHandlerFn processes a single message received through a binding. The
+// return value is interpreted the same way as for transport.HandlerFn.
+type MessageHandlerFn func(context context.Context, routingKey string, body []byte) error
+
+// Binding subscribes a handler to messages published to an exchange with any of
+// a set of routing keys. Each binding is consumed from its own queue.
+type Binding struct {
+	// Name identifies the binding. The binding's queue is named after the
+	// service's queue and the binding name unless Queue is set.
+	Name string
+
+	Exchange     string
+	ExchangeType string
+	Queue        string
+	Keys         []string
+	Handler      MessageHandlerFn
+}
+
+// AMQP consumes job status updates from and publishes messages to RabbitMQ.
 type AMQP struct {
-	client  *messaging.Client
-	handler HandlerFn
+	client             *messaging.Client
+	publisher          *publisher
+	workers            chan struct{}
+	queue              string
+	maxAttempts        int
+	deadLetterExchange string
+	deadLetterQueue    string
+	backpressure       Backpressure
+	events             *ops.Publisher
 }
 
-func New(config *Configuration, handler HandlerFn) (*AMQP, error) {
+var _ transport.Transport = (*AMQP)(nil)
+
+// New connects to the AMQP broker and starts consuming job status updates,
+// passing them to the handler, along with the messages for any additional
+// bindings.
+func New(config *Configuration, handler transport.HandlerFn) (*AMQP, error) {
 	log.Debug("creating a new AMQP client")
 	client, err := messaging.NewClient(config.URI, config.Reconnect)
 	if err != nil {
@@ -49,75 +113,210 @@ func New(config *Configuration, handler HandlerFn) (*AMQP, error) {
 	}
 	log.Debug("done creating a new AMQP client")
 
+	workers := config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
 	a := &AMQP{
-		client:  client,
-		handler: handler,
+		client:             client,
+		publisher:          newPublisher(config.URI, config.Exchange, config.PublishTimeout),
+		workers:            make(chan struct{}, workers),
+		queue:              config.Queue,
+		maxAttempts:        config.MaxAttempts,
+		deadLetterExchange: config.DeadLetterExchange,
+		deadLetterQueue:    config.DeadLetterQueue,
+		backpressure:       config.Backpressure,
+		events:             config.Events,
+	}
+	if a.maxAttempts < 1 {
+		a.maxAttempts = defaultMaxAttempts
+	}
+	if a.deadLetterExchange == "" {
+		a.deadLetterExchange = config.Queue + ".dlx"
+	}
+	if a.deadLetterQueue == "" {
+		a.deadLetterQueue = config.Queue + ".dead-letters"
 	}
 
-	if err = a.client.SetupPublishing(config.Exchange); err != nil {
+	if err = a.setupDeadLettering(); err != nil {
 		return nil, err
 	}
 
 	go a.client.Listen()
 
-	log.Debug("adding a consumer")
-	client.AddConsumer(
-		config.Exchange,
-		config.ExchangeType,
-		config.Queue,
-		messaging.UpdatesKey,
-		a.recv,
-		config.PrefetchCount,
-	)
-	log.Debug("done adding a consumer")
+	bindings := append([]Binding{
+		{
+			Exchange:     config.Exchange,
+			ExchangeType: config.ExchangeType,
+			Queue:        config.Queue,
+			Keys:         []string{messaging.UpdatesKey},
+			Handler:      jobUpdateHandler(handler, config.Archiver),
+		},
+	}, config.Bindings...)
+
+	for _, binding := range bindings {
+		queue := binding.Queue
+		if queue == "" {
+			queue = fmt.Sprintf("%s.%s", config.Queue, binding.Name)
+		}
+		exchange := binding.Exchange
+		if exchange == "" {
+			exchange = config.Exchange
+		}
+		exchangeType := binding.ExchangeType
+		if exchangeType == "" {
+			exchangeType = config.ExchangeType
+		}
+
+		log.Debugf("adding a consumer for queue %s", queue)
+		client.AddConsumerMulti(
+			exchange,
+			exchangeType,
+			queue,
+			binding.Keys,
+			a.consumer(queue, binding.Handler),
+			config.PrefetchCount,
+		)
+		log.Debugf("done adding a consumer for queue %s", queue)
+	}
 
 	return a, err
 }
 
-func (a *AMQP) recv(context context.Context, delivery amqp.Delivery) {
-	var (
-		update analysisUpdateMsg
-		err    error
-	)
+// jobUpdateHandler adapts a transport.HandlerFn to a MessageHandlerFn that parses job
+// status update messages, archiving them first if the archiver isn't nil.
+func jobUpdateHandler(handler transport.HandlerFn, archiver transport.Archiver) MessageHandlerFn {
+	return func(context context.Context, _ string, body []byte) error {
+		var log = log.WithContext(context)
 
-	var log = log.WithContext(context)
+		log.Infof("%s is the body", string(body))
 
-	if err = delivery.Ack(false); err != nil {
-		log.Error(err)
+		update, err := transport.ParseJobUpdate(body)
+		if err != nil {
+			return err
+		}
+
+		if archiver != nil {
+			if err = archiver.Archive(context, update, body); err != nil {
+				log.Errorf("unable to archive the job status update: %s", err)
+			}
+		}
+
+		log.Debugf("UUID is %s", update.Job.UUID)
+		log.Debugf("state is %s", update.State)
+
+		return handler(context, update.Job.UUID, update.State)
+	}
+}
+
+// consumer returns the messaging handler for a queue, which passes each
+// delivery to the handler and settles it based on the result.
+func (a *AMQP) consumer(queue string, handler MessageHandlerFn) messaging.MessageHandler {
+	return func(context context.Context, delivery amqp.Delivery) {
+		// Wait for a free worker slot. The messaging library delivers each message
+		// in its own goroutine, so this bounds the number handled concurrently.
+		a.workers <- struct{}{}
+		defer func() { <-a.workers }()
+
+		err := handler(context, routingKey(&delivery), delivery.Body)
+		if err == nil {
+			a.holdAck(context, queue)
+		}
+		a.settle(context, queue, delivery, err)
+	}
+}
+
+// routingKey returns the routing key that the delivery was originally
+// published with. Retries are republished to the default exchange with the
+// queue name as the routing key, so the original one is taken from the header
+// that was added when the message was first retried.
+func routingKey(delivery *amqp.Delivery) string {
+	if key := headerString(delivery.Headers, originalRoutingKeyHeader); key != "" {
+		return key
+	}
+	return delivery.RoutingKey
+}
+
+// holdAck waits for as long as the backpressure says to before a message is
+// acknowledged.
+func (a *AMQP) holdAck(context context.Context, queue string) {
+	if a.backpressure == nil {
+		return
+	}
+	delay := a.backpressure.AckDelay()
+	if delay <= 0 {
 		return
 	}
 
-	redelivered := delivery.Redelivered
-	if err = json.Unmarshal(delivery.Body, &update); err != nil {
-		log.Error(err)
-		if err = delivery.Reject(!redelivered); err != nil {
+	log.WithContext(context).WithFields(logrus.Fields{"queue": queue}).Debugf("applying backpressure, holding the acknowledgement for %s", delay)
+	select {
+	case <-context.Done():
+	case <-time.After(delay):
+	}
+}
+
+// settle acknowledges, retries, or dead-letters the delivery depending on the
+// error returned while processing it.
+func (a *AMQP) settle(context context.Context, queue string, delivery amqp.Delivery, err error) {
+	var log = log.WithContext(context).WithFields(logrus.Fields{"queue": queue})
+
+	if err == nil {
+		if err = delivery.Ack(false); err != nil {
 			log.Error(err)
 		}
 		return
 	}
 
-	log.Debugf("UUID is %s", update.Job.UUID)
-	log.Debugf("state is %s", update.State)
-	log.Debugf("%+v", update)
+	failures := attempts(&delivery) + 1
 
-	log.Infof("%s is the body", string(delivery.Body))
-
-	if update.State == "" {
-		log.Error("state was unset, dropping message")
+	if transport.IsPermanent(err) || failures >= a.maxAttempts {
+		log.Errorf("dead-lettering message after %d attempts: %s", failures, err)
+		if dlErr := a.deadLetter(context, queue, &delivery, failures, err); dlErr != nil {
+			log.Errorf("unable to dead-letter message, requeuing it: %s", dlErr)
+			a.requeue(context, &delivery)
+			return
+		}
+		a.events.Publish(context, ops.DeadLettered, map[string]interface{}{
+			"queue":       queue,
+			"routing_key": routingKey(&delivery),
+			"attempts":    failures,
+			"reason":      err.Error(),
+		})
+		if err = delivery.Ack(false); err != nil {
+			log.Error(err)
+		}
 		return
 	}
-	if update.Job.UUID == "" {
-		log.Error("external ID was unset, dropping message")
+
+	log.Errorf("retrying message after transient error (attempt %d of %d): %s", failures, a.maxAttempts, err)
+	time.Sleep(requeueDelay)
+	if rErr := a.retry(context, queue, &delivery, failures); rErr != nil {
+		log.Errorf("unable to republish message for retry, requeuing it: %s", rErr)
+		a.requeue(context, &delivery)
 		return
 	}
+	if err = delivery.Ack(false); err != nil {
+		log.Error(err)
+	}
+}
 
-	a.handler(context, update.Job.UUID, update.State)
+// requeue returns the delivery to the queue without changing it. This is the
+// fallback for when a copy of the message can't be published.
+func (a *AMQP) requeue(context context.Context, delivery *amqp.Delivery) {
+	time.Sleep(requeueDelay)
+	if err := delivery.Nack(false, true); err != nil {
+		log.WithContext(context).Error(err)
+	}
 }
 
+// Send publishes a message and waits for the broker to confirm it. An error is
+// returned if the message couldn't be published or wasn't confirmed, in which
+// case the caller is responsible for retrying.
 func (a *AMQP) Send(context context.Context, routingKey string, data []byte) error {
 	var log = log.WithFields(logrus.Fields{"context": "sending usage to QMS"}).WithContext(context)
 	log.Debugf("routing key: %s, message: %s", routingKey, string(data))
-	return a.client.PublishContext(context, routingKey, data)
+	return a.publisher.publish(context, routingKey, data)
 }
 
 func (a *AMQP) Listen() {
@@ -125,5 +324,6 @@ func (a *AMQP) Listen() {
 }
 
 func (a *AMQP) Close() {
+	a.publisher.close()
 	a.client.Close()
 }
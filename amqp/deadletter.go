@@ -0,0 +1,208 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// The headers used to track retries and dead-lettered messages.
+const (
+	attemptsHeader           = "x-attempts"
+	deadLetterReasonHeader   = "x-dead-letter-reason"
+	deadLetteredOnHeader     = "x-dead-lettered-on"
+	originalExchangeHeader   = "x-original-exchange"
+	originalRoutingKeyHeader = "x-original-routing-key"
+	originalQueueHeader      = "x-original-queue"
+)
+
+// defaultMaxAttempts is used when the maximum number of attempts isn't configured.
+const defaultMaxAttempts = 5
+
+// DeadLetter is a message that couldn't be processed.
+type DeadLetter struct {
+	Body               string    `json:"body"`
+	Reason             string    `json:"reason"`
+	Attempts           int       `json:"attempts"`
+	OriginalExchange   string    `json:"original_exchange"`
+	OriginalRoutingKey string    `json:"original_routing_key"`
+	OriginalQueue      string    `json:"original_queue"`
+	DeadLetteredOn     time.Time `json:"dead_lettered_on"`
+}
+
+// setupDeadLettering declares the dead-letter exchange and queue.
+func (a *AMQP) setupDeadLettering() error {
+	return a.publisher.withChannel(func(channel *amqp.Channel) error {
+		if err := channel.ExchangeDeclare(a.deadLetterExchange, "fanout", true, false, false, false, nil); err != nil {
+			return err
+		}
+		if _, err := channel.QueueDeclare(a.deadLetterQueue, true, false, false, false, nil); err != nil {
+			return err
+		}
+		return channel.QueueBind(a.deadLetterQueue, "", a.deadLetterExchange, false, nil)
+	})
+}
+
+// headerString returns the value of a string header, or an empty string.
+func headerString(headers amqp.Table, name string) string {
+	if v, ok := headers[name].(string); ok {
+		return v
+	}
+	return ""
+}
+
+// attempts returns the number of times processing the delivery has already
+// failed.
+func attempts(delivery *amqp.Delivery) int {
+	switch v := delivery.Headers[attemptsHeader].(type) {
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case int:
+		return v
+	default:
+		return 0
+	}
+}
+
+// copyHeaders returns a copy of the delivery's headers that can be modified.
+func copyHeaders(delivery *amqp.Delivery) amqp.Table {
+	headers := amqp.Table{}
+	for k, v := range delivery.Headers {
+		headers[k] = v
+	}
+	return headers
+}
+
+// republish returns a copy of the delivery that can be published again.
+func republish(delivery *amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:      headers,
+		ContentType:  delivery.ContentType,
+		DeliveryMode: amqp.Persistent,
+		Timestamp:    time.Now(),
+		Body:         delivery.Body,
+	}
+}
+
+// retry puts a copy of the delivery back on the queue it was consumed from with
+// the attempt count incremented.
+func (a *AMQP) retry(context context.Context, queue string, delivery *amqp.Delivery, failures int) error {
+	headers := copyHeaders(delivery)
+	headers[attemptsHeader] = int32(failures)
+	if headerString(headers, originalExchangeHeader) == "" {
+		headers[originalExchangeHeader] = delivery.Exchange
+		headers[originalRoutingKeyHeader] = delivery.RoutingKey
+	}
+
+	// Publishing to the default exchange routes the message straight to the
+	// queue with the same name as the routing key.
+	return a.publisher.publishTo(context, "", queue, republish(delivery, headers))
+}
+
+// deadLetter publishes a copy of the delivery to the dead-letter exchange,
+// recording why it was dead-lettered and the queue it was consumed from.
+func (a *AMQP) deadLetter(context context.Context, queue string, delivery *amqp.Delivery, failures int, reason error) error {
+	headers := copyHeaders(delivery)
+	headers[attemptsHeader] = int32(failures)
+	headers[originalQueueHeader] = queue
+	headers[deadLetterReasonHeader] = reason.Error()
+	headers[deadLetteredOnHeader] = time.Now().UTC().Format(time.RFC3339)
+	if headerString(headers, originalExchangeHeader) == "" {
+		headers[originalExchangeHeader] = delivery.Exchange
+		headers[originalRoutingKeyHeader] = delivery.RoutingKey
+	}
+
+	return a.publisher.publishTo(context, a.deadLetterExchange, "", republish(delivery, headers))
+}
+
+// newDeadLetter converts a message from the dead-letter queue to a *DeadLetter.
+func newDeadLetter(delivery *amqp.Delivery) *DeadLetter {
+	deadLetteredOn, _ := time.Parse(time.RFC3339, headerString(delivery.Headers, deadLetteredOnHeader))
+	return &DeadLetter{
+		Body:               string(delivery.Body),
+		Reason:             headerString(delivery.Headers, deadLetterReasonHeader),
+		Attempts:           attempts(delivery),
+		OriginalExchange:   headerString(delivery.Headers, originalExchangeHeader),
+		OriginalRoutingKey: headerString(delivery.Headers, originalRoutingKeyHeader),
+		OriginalQueue:      headerString(delivery.Headers, originalQueueHeader),
+		DeadLetteredOn:     deadLetteredOn,
+	}
+}
+
+// DeadLetters returns up to limit messages from the dead-letter queue without
+// removing them from it.
+func (a *AMQP) DeadLetters(context context.Context, limit int) ([]DeadLetter, error) {
+	deadLetters := make([]DeadLetter, 0)
+
+	err := a.publisher.withChannel(func(channel *amqp.Channel) error {
+		var lastTag uint64
+
+		for len(deadLetters) < limit {
+			delivery, ok, err := channel.Get(a.deadLetterQueue, false)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			lastTag = delivery.DeliveryTag
+			deadLetters = append(deadLetters, *newDeadLetter(&delivery))
+		}
+
+		// Put everything back.
+		if lastTag != 0 {
+			return channel.Nack(lastTag, true, true)
+		}
+		return nil
+	})
+
+	return deadLetters, err
+}
+
+// ReplayDeadLetters moves up to limit messages from the dead-letter queue back
+// to the queues they were consumed from with their attempt counts reset.
+// Returns the number of messages that were replayed.
+func (a *AMQP) ReplayDeadLetters(context context.Context, limit int) (int, error) {
+	var replayed int
+
+	err := a.publisher.withChannel(func(channel *amqp.Channel) error {
+		for replayed < limit {
+			delivery, ok, err := channel.Get(a.deadLetterQueue, false)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
+
+			queue := headerString(delivery.Headers, originalQueueHeader)
+			if queue == "" {
+				queue = a.queue
+			}
+
+			headers := copyHeaders(&delivery)
+			delete(headers, attemptsHeader)
+			delete(headers, deadLetterReasonHeader)
+			delete(headers, deadLetteredOnHeader)
+
+			if err = a.publisher.publishTo(context, "", queue, republish(&delivery, headers)); err != nil {
+				if nerr := delivery.Nack(false, true); nerr != nil {
+					log.WithContext(context).Error(nerr)
+				}
+				return fmt.Errorf("unable to replay a dead-lettered message: %w", err)
+			}
+
+			if err = delivery.Ack(false); err != nil {
+				return err
+			}
+			replayed++
+		}
+		return nil
+	})
+
+	return replayed, err
+}
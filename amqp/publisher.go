@@ -0,0 +1,211 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/cyverse-de/resource-usage-api/faults"
+	"github.com/streadway/amqp"
+	"go.opentelemetry.io/otel"
+)
+
+// defaultPublishTimeout is used when no publish timeout is configured.
+const defaultPublishTimeout = 10 * time.Second
+
+// ErrNotConfirmed is returned when the broker negatively acknowledges a
+// published message.
+var ErrNotConfirmed = errors.New("the AMQP broker did not confirm the message")
+
+// publisher publishes messages on its own connection with publisher confirms
+// enabled. The connection and channel are re-established as needed.
+type publisher struct {
+	uri      string
+	exchange string
+	timeout  time.Duration
+
+	mutex         sync.Mutex
+	connection    *amqp.Connection
+	channel       *amqp.Channel
+	confirmations chan amqp.Confirmation
+	closed        chan *amqp.Error
+}
+
+func newPublisher(uri, exchange string, timeout time.Duration) *publisher {
+	if timeout <= 0 {
+		timeout = defaultPublishTimeout
+	}
+	return &publisher{
+		uri:      uri,
+		exchange: exchange,
+		timeout:  timeout,
+	}
+}
+
+// connect establishes the connection and a channel in confirm mode. Must be
+// called with the mutex held.
+func (p *publisher) connect() error {
+	p.disconnect()
+
+	connection, err := amqp.Dial(p.uri)
+	if err != nil {
+		return err
+	}
+
+	channel, err := connection.Channel()
+	if err != nil {
+		connection.Close()
+		return err
+	}
+
+	if err = channel.Confirm(false); err != nil {
+		connection.Close()
+		return err
+	}
+
+	p.connection = connection
+	p.channel = channel
+	p.confirmations = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+	p.closed = channel.NotifyClose(make(chan *amqp.Error, 1))
+
+	return nil
+}
+
+// disconnect closes the connection if there is one. Must be called with the
+// mutex held.
+func (p *publisher) disconnect() {
+	if p.connection != nil {
+		p.connection.Close()
+	}
+	p.connection = nil
+	p.channel = nil
+	p.confirmations = nil
+	p.closed = nil
+}
+
+// isOpen returns true if the channel exists and hasn't been closed. Must be
+// called with the mutex held.
+func (p *publisher) isOpen() bool {
+	if p.channel == nil {
+		return false
+	}
+	select {
+	case <-p.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// newPublishing returns a persistent JSON message with the trace context from
+// the context injected into its headers.
+func newPublishing(context context.Context, data []byte) amqp.Publishing {
+	headers := amqp.Table{}
+	otel.GetTextMapPropagator().Inject(context, messaging.AMQPHeaderCarrier(headers))
+
+	return amqp.Publishing{
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		ContentType:  "application/json",
+		Timestamp:    time.Now(),
+		Body:         data,
+	}
+}
+
+// publishOnce publishes a message and waits for it to be confirmed. Must be
+// called with the mutex held.
+func (p *publisher) publishOnce(context context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	if !p.isOpen() {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	if err := faults.Inject(faults.AMQPPublish); err != nil {
+		return err
+	}
+
+	err := p.channel.Publish(exchange, routingKey, false, false, msg)
+	if err != nil {
+		p.disconnect()
+		return err
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case confirmation, ok := <-p.confirmations:
+		if !ok {
+			p.disconnect()
+			return fmt.Errorf("the AMQP channel closed before the message was confirmed")
+		}
+		if !confirmation.Ack {
+			return ErrNotConfirmed
+		}
+		return nil
+	case err := <-p.closed:
+		p.disconnect()
+		return fmt.Errorf("the AMQP channel closed before the message was confirmed: %v", err)
+	case <-timer.C:
+		// The confirmation may still arrive later, so the channel can't be
+		// reused without mixing up delivery tags.
+		p.disconnect()
+		return fmt.Errorf("timed out after %s waiting for the AMQP broker to confirm the message", p.timeout)
+	case <-context.Done():
+		p.disconnect()
+		return context.Err()
+	}
+}
+
+// publish publishes a message to the publisher's exchange and waits for it to
+// be confirmed.
+func (p *publisher) publish(context context.Context, routingKey string, data []byte) error {
+	return p.publishTo(context, p.exchange, routingKey, newPublishing(context, data))
+}
+
+// publishTo publishes a message to an exchange and waits for it to be
+// confirmed, reconnecting and trying again once if the first attempt fails
+// because of a connection problem.
+func (p *publisher) publishTo(context context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	err := p.publishOnce(context, exchange, routingKey, msg)
+	if err == nil || errors.Is(err, ErrNotConfirmed) || context.Err() != nil {
+		return err
+	}
+
+	log.WithContext(context).Warnf("retrying publish after error: %s", err)
+	return p.publishOnce(context, exchange, routingKey, msg)
+}
+
+// withChannel calls fn with a new channel on the publisher's connection. The
+// channel is closed when fn returns.
+func (p *publisher) withChannel(fn func(channel *amqp.Channel) error) error {
+	p.mutex.Lock()
+	if !p.isOpen() {
+		if err := p.connect(); err != nil {
+			p.mutex.Unlock()
+			return err
+		}
+	}
+	channel, err := p.connection.Channel()
+	p.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	defer channel.Close()
+
+	return fn(channel)
+}
+
+// close closes the publisher's connection.
+func (p *publisher) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.disconnect()
+}
@@ -0,0 +1,142 @@
+// Package anomaly detects users whose daily CPU usage spikes far above their
+// usual accrual, such as compromised accounts running crypto-miners.
+//
+// Once per interval, the detector compares each user's accrual on the most
+// recent complete UTC day with their average daily accrual over a trailing
+// baseline period. Users whose accrual is at least the configured multiple of
+// their baseline, and at least a minimum number of CPU hours, are recorded as
+// anomalies and optionally published so that an operator can be alerted.
+package anomaly
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/periodic"
+	"github.com/cyverse-de/resource-usage-api/transport"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "anomaly"})
+
+// Config contains the settings for anomaly detection.
+type Config struct {
+	// Interval is how often the most recent complete day is checked.
+	Interval time.Duration
+
+	// BaselineDays is the number of days before the checked day that the
+	// baseline is averaged over.
+	BaselineDays int
+
+	// Factor is the multiple of the baseline at which accrual is anomalous.
+	Factor float64
+
+	// MinHours is the accrual below which a day is never anomalous, so that
+	// users with tiny baselines aren't flagged for ordinary use.
+	MinHours float64
+
+	// RoutingKey is the routing key that anomalies are published with. They
+	// aren't published if it's empty.
+	RoutingKey string
+}
+
+// Event is published for each newly detected anomaly.
+type Event struct {
+	Username string    `json:"username"`
+	Day      time.Time `json:"day"`
+	Usage    float64   `json:"usage"`
+	Baseline float64   `json:"baseline"`
+}
+
+// Detector records and publishes anomalous daily accrual.
+type Detector struct {
+	periodic.Task[*Config]
+
+	db        *db.Database
+	transport transport.Transport
+}
+
+// New returns a new *Detector. The transport may be nil if anomalies aren't
+// published.
+func New(config *Config, database *db.Database, t transport.Transport) *Detector {
+	return &Detector{
+		Task:      periodic.NewTask(config),
+		db:        database,
+		transport: t,
+	}
+}
+
+// anomalous returns true if the usage is anomalous compared with the baseline.
+func anomalous(config *Config, usage, baseline float64) bool {
+	return usage >= config.MinHours && usage >= baseline*config.Factor
+}
+
+// Detect checks the UTC day beginning at day for anomalies, records the ones
+// that haven't been recorded yet, and publishes them.
+func (d *Detector) Detect(context context.Context, day time.Time) error {
+	log := log.WithContext(context).WithFields(logrus.Fields{"context": "detecting anomalies", "day": day.Format(time.DateOnly)})
+
+	config := d.Config()
+
+	usages, err := d.db.DailyUsageWithBaselines(context, day, config.BaselineDays)
+	if err != nil {
+		return err
+	}
+
+	for _, usage := range usages {
+		value, err := usage.Usage.Float64()
+		if err != nil {
+			return err
+		}
+		baseline, err := usage.Baseline.Float64()
+		if err != nil {
+			return err
+		}
+		if !anomalous(config, value, baseline) {
+			continue
+		}
+
+		added, err := d.db.AddAnomaly(context, usage.UserID, day, &usage.Usage, &usage.Baseline)
+		if err != nil {
+			return err
+		}
+		if !added {
+			continue
+		}
+		log.Warnf("%s accrued %f CPU hours against a baseline of %f per day", usage.Username, value, baseline)
+
+		if err = d.publish(context, config.RoutingKey, &Event{Username: usage.Username, Day: day, Usage: value, Baseline: baseline}); err != nil {
+			log.Errorf("unable to publish the anomaly for %s: %s", usage.Username, err)
+		}
+	}
+
+	return nil
+}
+
+// publish sends the anomaly event if a routing key is configured.
+func (d *Detector) publish(context context.Context, routingKey string, event *Event) error {
+	if routingKey == "" || d.transport == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return d.transport.Send(context, routingKey, data)
+}
+
+// detectYesterday checks the most recent complete day.
+func (d *Detector) detectYesterday(context context.Context) error {
+	return d.Detect(context, time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -1))
+}
+
+// Run checks the most recent complete day every configured interval until the
+// context is canceled.
+func (d *Detector) Run(context context.Context) {
+	d.RunEvery(context, log, func(config *Config) time.Duration { return config.Interval }, d.detectYesterday)
+}
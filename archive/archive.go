@@ -0,0 +1,73 @@
+// Package archive keeps a record of every job status update consumed by the
+// service, for auditing and so that missed completions can be found and
+// replayed. Archived updates are pruned once they're older than the retention
+// period.
+package archive
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/periodic"
+	"github.com/cyverse-de/resource-usage-api/transport"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "archive"})
+
+// Config contains the settings for the job status update archive.
+type Config struct {
+	// Retention is how long archived updates are kept. They're kept forever if
+	// it's zero.
+	Retention time.Duration
+
+	// Interval is how often old updates are pruned.
+	Interval time.Duration
+}
+
+// Archive records job status updates in the database.
+type Archive struct {
+	periodic.Task[*Config]
+
+	db *db.Database
+}
+
+var _ transport.Archiver = (*Archive)(nil)
+
+// New returns a new *Archive.
+func New(config *Config, db *db.Database) *Archive {
+	return &Archive{
+		Task: periodic.NewTask(config),
+		db:   db,
+	}
+}
+
+// Archive records a job status update and its raw message body.
+func (a *Archive) Archive(context context.Context, update *transport.JobUpdate, body []byte) error {
+	return a.db.ArchiveJobEvent(context, update.Job.UUID, string(update.State), body)
+}
+
+// Prune deletes the updates that are older than the retention period.
+func (a *Archive) Prune(context context.Context) error {
+	retention := a.Config().Retention
+	if retention <= 0 {
+		return nil
+	}
+
+	pruned, err := a.db.PruneArchivedJobEvents(context, time.Now().Add(-retention))
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		log.WithContext(context).Infof("pruned %d archived job status updates", pruned)
+	}
+
+	return nil
+}
+
+// Run prunes the archive once per interval until the context is canceled.
+func (a *Archive) Run(context context.Context) {
+	a.RunEvery(context, log, func(config *Config) time.Duration { return config.Interval }, a.Prune)
+}
@@ -0,0 +1,204 @@
+// Package authz decides which callers may make which requests, based on a
+// policy read from the configuration.
+//
+// A policy is a list of rules. Each rule names the identities it applies to,
+// the scopes it grants them, and optionally the routes and the users whose
+// usage it covers. A request is allowed if any rule grants its scope to the
+// caller for its route and user, and is otherwise decided by the policy's
+// default.
+package authz
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Scope is the kind of access that a request needs.
+type Scope string
+
+const (
+	// ScopeRead covers reading a user's usage through the user routes.
+	ScopeRead Scope = "read"
+
+	// ScopeWrite covers changing a user's settings through the user routes.
+	ScopeWrite Scope = "write"
+
+	// ScopeAdminRead covers reading through the admin routes.
+	ScopeAdminRead Scope = "admin:read"
+
+	// ScopeAdminWrite covers changing anything through the admin routes,
+	// including adjusting users' usage.
+	ScopeAdminWrite Scope = "admin:write"
+)
+
+// ValidScope returns true if the scope is one of the Scope constants.
+func ValidScope(scope Scope) bool {
+	switch scope {
+	case ScopeRead, ScopeWrite, ScopeAdminRead, ScopeAdminWrite:
+		return true
+	}
+	return false
+}
+
+// The defaults that decide the requests that no rule allows.
+const (
+	DefaultAllow = "allow"
+	DefaultDeny  = "deny"
+)
+
+// Self is the username in a rule that stands for the user that the caller is
+// acting for.
+const Self = "self"
+
+// Anonymous is the identity of callers that didn't present a client
+// certificate and aren't acting for a user.
+const Anonymous = "anonymous"
+
+// Rule grants scopes to identities.
+//
+// Identities are written as service:<name> for the common name of a client
+// certificate, user:<username> for the user that a service is acting for, or
+// anonymous. A name of * matches any service or user, and * on its own
+// matches every caller.
+//
+// Routes are route paths without the version prefix, such as
+// /:username/cpu/total. A route ending in * matches every route that starts
+// with the rest of it. The rule covers every route if there are none.
+//
+// Usernames are the users whose usage the rule covers. Self stands for the
+// user that the caller is acting for, and * for every user. The rule covers
+// every user if there are none. Requests that aren't about a single user are
+// only covered by rules without usernames or with *.
+type Rule struct {
+	Name       string
+	Identities []string
+	Scopes     []Scope
+	Routes     []string
+	Usernames  []string
+}
+
+// Policy is a set of rules, along with whether the requests that none of them
+// allow are allowed anyway.
+type Policy struct {
+	Default string
+	Rules   []Rule
+}
+
+// Request is what's known about a request when it's authorized. The usernames
+// are fully qualified.
+type Request struct {
+	Service    string
+	ActingUser string
+	Scope      Scope
+	Route      string
+	Username   string
+}
+
+// identities returns the identities that the caller matches.
+func (r *Request) identities() []string {
+	identities := []string{"*"}
+	if r.Service != "" {
+		identities = append(identities, "service:*", "service:"+r.Service)
+	}
+	if r.ActingUser != "" {
+		identities = append(identities, "user:*", "user:"+r.ActingUser)
+	}
+	if r.Service == "" && r.ActingUser == "" {
+		identities = append(identities, Anonymous)
+	}
+	return identities
+}
+
+// Validate returns an error describing the first problem with the policy, or
+// nil if there aren't any.
+func (p *Policy) Validate() error {
+	if p.Default != DefaultAllow && p.Default != DefaultDeny {
+		return fmt.Errorf("the default must be %s or %s", DefaultAllow, DefaultDeny)
+	}
+	for i, rule := range p.Rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("%d", i)
+		}
+		if len(rule.Identities) == 0 {
+			return fmt.Errorf("rule %s has no identities", name)
+		}
+		if len(rule.Scopes) == 0 {
+			return fmt.Errorf("rule %s has no scopes", name)
+		}
+		for _, scope := range rule.Scopes {
+			if !ValidScope(scope) {
+				return fmt.Errorf("rule %s has an unknown scope: %s", name, scope)
+			}
+		}
+	}
+	return nil
+}
+
+// matchesAny returns true if the value is in the list.
+func matchesAny(list []string, values ...string) bool {
+	for _, item := range list {
+		for _, value := range values {
+			if item == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// coversRoute returns true if the rule covers the route.
+func (rule *Rule) coversRoute(route string) bool {
+	if len(rule.Routes) == 0 {
+		return true
+	}
+	for _, pattern := range rule.Routes {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(route, prefix) {
+				return true
+			}
+		} else if route == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// coversUser returns true if the rule covers the user that the request is
+// about. The usernames in the rule must be fully qualified.
+func (rule *Rule) coversUser(r *Request) bool {
+	if len(rule.Usernames) == 0 || matchesAny(rule.Usernames, "*") {
+		return true
+	}
+	if r.Username == "" {
+		return false
+	}
+	if r.ActingUser != "" && r.Username == r.ActingUser && matchesAny(rule.Usernames, Self) {
+		return true
+	}
+	return matchesAny(rule.Usernames, r.Username)
+}
+
+// grants returns true if the rule grants the scope.
+func (rule *Rule) grants(scope Scope) bool {
+	for _, s := range rule.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows returns true if the policy allows the request, along with the name
+// of the rule that allowed it. The name is empty if the request was allowed by
+// the default.
+func (p *Policy) Allows(r *Request) (bool, string) {
+	identities := r.identities()
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if matchesAny(rule.Identities, identities...) && rule.grants(r.Scope) && rule.coversRoute(r.Route) && rule.coversUser(r) {
+			return true, rule.Name
+		}
+	}
+	return p.Default == DefaultAllow, ""
+}
@@ -0,0 +1,167 @@
+// Package backlog tracks the depth of the work item queue and tells the message
+// consumers to slow down when too many work items are waiting, so that the
+// database isn't buried during event storms.
+//
+// The counts are refreshed on every replica, since each one decides for itself
+// whether to hold back its acknowledgements. They're published as expvar
+// variables alongside the service's other metrics.
+package backlog
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/periodic"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "backlog"})
+
+// The work queue metrics. They're served with the other expvar variables on
+// the diagnostics port.
+var (
+	pendingItems = expvar.NewInt("work_items_pending")
+	claimedItems = expvar.NewInt("work_items_claimed")
+	failedItems  = expvar.NewInt("work_items_failed")
+	backpressure = expvar.NewInt("work_items_backpressure")
+)
+
+// Config contains the settings for the backlog monitor.
+type Config struct {
+	// Interval is how often the work items are counted.
+	Interval time.Duration
+
+	// Threshold is the number of pending work items above which backpressure
+	// is applied. Zero never applies it.
+	Threshold int64
+
+	// AckDelay is how long the consumers hold each message's acknowledgement
+	// while backpressure is applied.
+	AckDelay time.Duration
+}
+
+// Status is the most recent count of the work items, along with whether
+// backpressure is being applied because of it.
+type Status struct {
+	db.WorkItemCounts
+	Threshold  int64      `json:"threshold"`
+	AckDelay   string     `json:"ack_delay"`
+	Overloaded bool       `json:"overloaded"`
+	CountedOn  *time.Time `json:"counted_on"`
+}
+
+// Monitor periodically counts the work items and decides whether backpressure
+// should be applied.
+type Monitor struct {
+	mutex     sync.Mutex
+	config    *Config
+	db        *db.Database
+	counts    db.WorkItemCounts
+	countedOn time.Time
+}
+
+// New returns a new *Monitor.
+func New(config *Config, database *db.Database) *Monitor {
+	return &Monitor{
+		config: config,
+		db:     database,
+	}
+}
+
+// SetConfig replaces the monitor's settings. A new threshold applies as soon
+// as it's set, and a new interval takes effect after the next count.
+func (m *Monitor) SetConfig(config *Config) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.config = config
+	m.setBackpressureGauge()
+}
+
+func (m *Monitor) getConfig() *Config {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.config
+}
+
+// overloaded returns true if the last count is past the threshold. The mutex
+// must be held.
+func (m *Monitor) overloaded() bool {
+	return m.config.Threshold > 0 && m.counts.Pending > m.config.Threshold
+}
+
+// setBackpressureGauge updates the backpressure metric. The mutex must be held.
+func (m *Monitor) setBackpressureGauge() {
+	if m.overloaded() {
+		backpressure.Set(1)
+	} else {
+		backpressure.Set(0)
+	}
+}
+
+// Status returns the most recent count of the work items.
+func (m *Monitor) Status() *Status {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	status := &Status{
+		WorkItemCounts: m.counts,
+		Threshold:      m.config.Threshold,
+		AckDelay:       m.config.AckDelay.String(),
+		Overloaded:     m.overloaded(),
+	}
+	if !m.countedOn.IsZero() {
+		countedOn := m.countedOn
+		status.CountedOn = &countedOn
+	}
+	return status
+}
+
+// AckDelay returns how long a consumer should hold a message's acknowledgement
+// before sending it. It's zero unless backpressure is being applied.
+func (m *Monitor) AckDelay() time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.overloaded() {
+		return 0
+	}
+	return m.config.AckDelay
+}
+
+// Count counts the work items and updates the metrics.
+func (m *Monitor) Count(context context.Context) error {
+	counts, err := m.db.CountWorkItems(context)
+	if err != nil {
+		return err
+	}
+
+	pendingItems.Set(counts.Pending)
+	claimedItems.Set(counts.Claimed)
+	failedItems.Set(counts.Failed)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	wasOverloaded := m.overloaded()
+	m.counts, m.countedOn = *counts, time.Now()
+	m.setBackpressureGauge()
+
+	switch overloaded := m.overloaded(); {
+	case overloaded && !wasOverloaded:
+		log.WithContext(context).Warnf("%d work items are pending, which is more than %d; applying backpressure", counts.Pending, m.config.Threshold)
+	case !overloaded && wasOverloaded:
+		log.WithContext(context).Infof("%d work items are pending; no longer applying backpressure", counts.Pending)
+	}
+
+	return nil
+}
+
+// Run counts the work items every configured interval until the context is
+// canceled.
+func (m *Monitor) Run(context context.Context) {
+	periodic.Run(context, log, nil, func() time.Duration { return m.getConfig().Interval }, m.Count)
+}
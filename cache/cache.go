@@ -0,0 +1,92 @@
+// Package cache contains a small in-process cache with expiring entries.
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+type entry[V any] struct {
+	value     V
+	expiresOn time.Time
+}
+
+// TTL is a cache whose entries expire a fixed amount of time after they're
+// added. It's safe for concurrent use.
+type TTL[K comparable, V any] struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mutex   sync.Mutex
+	entries map[K]entry[V]
+}
+
+// NewTTL returns a new *TTL whose entries expire after ttl. Once the cache
+// holds maxEntries entries, expired entries are removed to make room, and if
+// none have expired an arbitrary entry is removed.
+func NewTTL[K comparable, V any](ttl time.Duration, maxEntries int) *TTL[K, V] {
+	return &TTL[K, V]{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[K]entry[V]),
+	}
+}
+
+// Get returns the cached value for the key and true, or the zero value and
+// false if the key isn't cached or its entry has expired.
+func (t *TTL[K, V]) Get(key K) (V, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	e, ok := t.entries[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	if time.Now().After(e.expiresOn) {
+		delete(t.entries, key)
+		var zero V
+		return zero, false
+	}
+	return e.value, true
+}
+
+// Set caches the value for the key.
+func (t *TTL[K, V]) Set(key K, value V) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if _, ok := t.entries[key]; !ok && t.maxEntries > 0 && len(t.entries) >= t.maxEntries {
+		t.evict()
+	}
+
+	t.entries[key] = entry[V]{
+		value:     value,
+		expiresOn: time.Now().Add(t.ttl),
+	}
+}
+
+// Invalidate removes the key from the cache.
+func (t *TTL[K, V]) Invalidate(key K) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.entries, key)
+}
+
+// evict removes the expired entries, or an arbitrary entry if none have
+// expired. Must be called with the mutex held.
+func (t *TTL[K, V]) evict() {
+	now := time.Now()
+	for k, e := range t.entries {
+		if now.After(e.expiresOn) {
+			delete(t.entries, k)
+		}
+	}
+	if len(t.entries) < t.maxEntries {
+		return
+	}
+	for k := range t.entries {
+		delete(t.entries, k)
+		return
+	}
+}
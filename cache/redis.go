@@ -0,0 +1,109 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "cache"})
+
+// invalidationChannel is the pub/sub channel that invalidated keys are
+// announced on, so that each replica can drop its own copies.
+const invalidationChannel = "invalidations"
+
+// Redis is a cache shared by every replica of the service. Keys are prefixed
+// so that the cache can share a Redis instance with other services.
+type Redis struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+// NewRedis connects to the Redis instance at the URI. Entries expire after ttl.
+func NewRedis(uri, prefix string, ttl time.Duration) (*Redis, error) {
+	opts, err := redis.ParseURL(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Redis{
+		client: redis.NewClient(opts),
+		prefix: prefix + ":",
+		ttl:    ttl,
+	}, nil
+}
+
+// Get returns the cached value for the key and true, or nil and false if the
+// key isn't cached.
+func (r *Redis) Get(context context.Context, key string) ([]byte, bool, error) {
+	value, err := r.client.Get(context, r.prefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
+}
+
+// Set caches the value for the key.
+func (r *Redis) Set(context context.Context, key string, value []byte) error {
+	return r.client.Set(context, r.prefix+key, value, r.ttl).Err()
+}
+
+// Invalidate removes the keys from the cache and announces that they were
+// invalidated.
+func (r *Redis) Invalidate(context context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = r.prefix + key
+	}
+	if err := r.client.Del(context, prefixed...).Err(); err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		if err := r.client.Publish(context, r.prefix+invalidationChannel, key).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Subscribe calls fn with each key that's invalidated by any replica until the
+// context is canceled.
+func (r *Redis) Subscribe(context context.Context, fn func(key string)) {
+	pubsub := r.client.Subscribe(context, r.prefix+invalidationChannel)
+	defer pubsub.Close()
+
+	messages := pubsub.Channel()
+	for {
+		select {
+		case <-context.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				log.Error("the Redis invalidation subscription closed")
+				return
+			}
+			fn(msg.Payload)
+		}
+	}
+}
+
+// Close disconnects from Redis.
+func (r *Redis) Close() {
+	if err := r.client.Close(); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,143 @@
+// Package calculator defines the interface for calculating the resources used
+// by an analysis, along with a registry that selects the calculators to use
+// based on the analysis's job type.
+package calculator
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/guregu/null"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "calculator"})
+
+// UsageRecord is an amount of a single resource type consumed by an analysis.
+type UsageRecord struct {
+	ResourceType string
+	Unit         string
+	Value        *apd.Decimal
+
+	// Method names the calculation that produced the record, such as a CPU
+	// hours calculation mode. It's empty for usage that wasn't calculated.
+	Method string
+
+	// EffectiveDate is the time that the usage is attributed to. If it's zero,
+	// the usage is attributed to the time that it's sent to QMS.
+	EffectiveDate time.Time
+
+	// Cluster identifies where the usage was incurred, such as the system ID
+	// of the analysis's job type or the name of a Slurm cluster. It's empty if
+	// that isn't known.
+	Cluster string
+}
+
+// NullEffectiveDate returns the record's effective date as a nullable time,
+// which is unset if the record doesn't have one.
+func (r *UsageRecord) NullEffectiveDate() null.Time {
+	return null.NewTime(r.EffectiveDate, !r.EffectiveDate.IsZero())
+}
+
+// Calculator calculates the resources consumed by a completed analysis.
+type Calculator interface {
+	Calculate(context context.Context, analysis *db.Analysis) ([]UsageRecord, error)
+}
+
+// CalculatorFunc adapts an ordinary function to the Calculator interface.
+type CalculatorFunc func(context context.Context, analysis *db.Analysis) ([]UsageRecord, error)
+
+// Calculate calls f(context, analysis).
+func (f CalculatorFunc) Calculate(context context.Context, analysis *db.Analysis) ([]UsageRecord, error) {
+	return f(context, analysis)
+}
+
+// WithFallback returns a Calculator that uses the primary calculator, and uses
+// the fallback calculator if the primary one fails.
+func WithFallback(primary, fallback Calculator) Calculator {
+	return CalculatorFunc(func(context context.Context, analysis *db.Analysis) ([]UsageRecord, error) {
+		records, err := primary.Calculate(context, analysis)
+		if err == nil {
+			return records, nil
+		}
+		log.WithContext(context).Warnf("calculation failed for analysis %s, using the fallback: %s", analysis.ID, err)
+		return fallback.Calculate(context, analysis)
+	})
+}
+
+// Registry keeps track of the calculators for each resource type, optionally
+// overridden for individual job types.
+type Registry struct {
+	defaults  map[string]Calculator
+	overrides map[string]map[string]Calculator
+}
+
+// NewRegistry returns a new, empty *Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		defaults:  make(map[string]Calculator),
+		overrides: make(map[string]map[string]Calculator),
+	}
+}
+
+// RegisterDefault sets the calculator used for a resource type for every job
+// type that doesn't have its own calculator for it.
+func (r *Registry) RegisterDefault(resourceType string, calculator Calculator) {
+	r.defaults[resourceType] = calculator
+}
+
+// Register sets the calculator used for a resource type for a single job type.
+func (r *Registry) Register(jobType, resourceType string, calculator Calculator) {
+	if _, ok := r.overrides[jobType]; !ok {
+		r.overrides[jobType] = make(map[string]Calculator)
+	}
+	r.overrides[jobType][resourceType] = calculator
+}
+
+// ResourceTypes returns the sorted names of the resource types with a
+// calculator for the job type.
+func (r *Registry) ResourceTypes(jobType string) []string {
+	var resourceTypes []string
+
+	for resourceType := range r.defaults {
+		resourceTypes = append(resourceTypes, resourceType)
+	}
+	for resourceType := range r.overrides[jobType] {
+		if _, ok := r.defaults[resourceType]; !ok {
+			resourceTypes = append(resourceTypes, resourceType)
+		}
+	}
+
+	sort.Strings(resourceTypes)
+	return resourceTypes
+}
+
+// Lookup returns the calculator for the job type and resource type, or nil if
+// there isn't one.
+func (r *Registry) Lookup(jobType, resourceType string) Calculator {
+	if calculator, ok := r.overrides[jobType][resourceType]; ok {
+		return calculator
+	}
+	return r.defaults[resourceType]
+}
+
+// Calculate runs every calculator that applies to the analysis's job type and
+// returns all of the resulting usage records.
+func (r *Registry) Calculate(context context.Context, analysis *db.Analysis) ([]UsageRecord, error) {
+	var records []UsageRecord
+
+	for _, resourceType := range r.ResourceTypes(analysis.JobType) {
+		calculated, err := r.Lookup(analysis.JobType, resourceType).Calculate(context, analysis)
+		if err != nil {
+			return nil, fmt.Errorf("unable to calculate %s for analysis %s: %w", resourceType, analysis.ID, err)
+		}
+		records = append(records, calculated...)
+	}
+
+	return records, nil
+}
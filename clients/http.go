@@ -0,0 +1,93 @@
+package clients
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// HTTPConfig contains the settings for the HTTP client shared by the client
+// libraries. Zero values keep the defaults of http.DefaultTransport.
+type HTTPConfig struct {
+	// Timeout is the longest a request may take, including reading the
+	// response body. Zero means no limit.
+	Timeout time.Duration
+
+	// DialTimeout is the longest that connecting to a server may take.
+	DialTimeout time.Duration
+
+	// TLSHandshakeTimeout is the longest that a TLS handshake may take.
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout is the longest to wait for a server's response
+	// headers after sending a request. Zero means no limit.
+	ResponseHeaderTimeout time.Duration
+
+	// IdleConnTimeout is how long an idle connection is kept in the pool.
+	IdleConnTimeout time.Duration
+
+	// MaxIdleConns is the largest number of idle connections kept across all
+	// hosts.
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost is the largest number of idle connections kept for
+	// each host.
+	MaxIdleConnsPerHost int
+
+	// Proxy is the URL of the proxy that requests are sent through. If it's
+	// empty, the proxy is taken from the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY
+	// environment variables.
+	Proxy string
+}
+
+// NewHTTPClient returns an HTTP client with the given settings whose requests
+// are traced.
+func NewHTTPClient(config *HTTPConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.DialTimeout > 0 {
+		dialer := &net.Dialer{Timeout: config.DialTimeout, KeepAlive: 30 * time.Second}
+		transport.DialContext = dialer.DialContext
+	}
+	if config.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	}
+	if config.ResponseHeaderTimeout > 0 {
+		transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	}
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = config.IdleConnTimeout
+	}
+	if config.MaxIdleConns > 0 {
+		transport.MaxIdleConns = config.MaxIdleConns
+	}
+	if config.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	}
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{
+		Transport: otelhttp.NewTransport(transport),
+		Timeout:   config.Timeout,
+	}, nil
+}
+
+// ConfigureHTTP replaces the HTTP client shared by the client libraries. It
+// must be called before any of the clients are used.
+func ConfigureHTTP(config *HTTPConfig) error {
+	c, err := NewHTTPClient(config)
+	if err != nil {
+		return err
+	}
+	client = c
+	return nil
+}
@@ -13,8 +13,9 @@ import (
 // A regular expression used to remove suffixes from usernames.
 var usernameSuffixRegexp = regexp.MustCompile("@.*$")
 
-// An HTTP client to be used by all of the client libraries.
-var client = http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
+// An HTTP client to be used by all of the client libraries. ConfigureHTTP
+// replaces it with one that has the configured settings.
+var client = &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)}
 
 // HTTPError represents an error returned by an HTTP service
 type HTTPError struct {
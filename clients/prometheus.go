@@ -0,0 +1,106 @@
+package clients
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PrometheusAPI represents an instance of a Prometheus HTTP API client.
+type PrometheusAPI struct {
+	baseURL *url.URL
+}
+
+// PrometheusAPIClient returns a new PrometheusAPI instance.
+func PrometheusAPIClient(baseURL string) (*PrometheusAPI, error) {
+
+	//  Parse the raw base URL.
+	url, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Ensure that the base URL path doesn't end with a slash.
+	url.Path = strings.TrimSuffix(url.Path, "/")
+
+	return &PrometheusAPI{baseURL: url}, nil
+}
+
+// prometheusQueryResponse is the response body returned by the Prometheus
+// instant query endpoint for vector results.
+type prometheusQueryResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []interface{}     `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// QueryScalar evaluates an instant query at the given time and returns the
+// value of the single sample in the resulting vector. An error is returned if
+// the query doesn't produce exactly one sample.
+func (c *PrometheusAPI) QueryScalar(ctx context.Context, query string, at time.Time) (float64, error) {
+	var qr prometheusQueryResponse
+
+	// Build the request.
+	requestURL := BuildURL(c.baseURL, "api", "v1", "query")
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("time", strconv.FormatInt(at.Unix(), 10))
+	requestURL.RawQuery = params.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, requestURL.String(), nil)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to build the request for %s", requestURL)
+	}
+
+	// Get the response.
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to send the request to %s", requestURL)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, NewHTTPError(resp.StatusCode, fmt.Sprintf("%s returned %d", requestURL, resp.StatusCode))
+	}
+
+	// Read the response body.
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to read the response from %s", requestURL)
+	}
+
+	// Unmarshal the response body.
+	if err = json.Unmarshal(body, &qr); err != nil {
+		return 0, errors.Wrapf(err, "unable to parse the response from %s", requestURL)
+	}
+
+	if qr.Status != "success" {
+		return 0, fmt.Errorf("prometheus query failed: %s", qr.Error)
+	}
+	if qr.Data.ResultType != "vector" || len(qr.Data.Result) != 1 {
+		return 0, fmt.Errorf("prometheus query returned %d samples, expected 1", len(qr.Data.Result))
+	}
+	if len(qr.Data.Result[0].Value) != 2 {
+		return 0, fmt.Errorf("prometheus query returned a malformed sample")
+	}
+
+	rawValue, ok := qr.Data.Result[0].Value[1].(string)
+	if !ok {
+		return 0, fmt.Errorf("prometheus query returned a non-string sample value")
+	}
+
+	return strconv.ParseFloat(rawValue, 64)
+}
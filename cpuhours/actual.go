@@ -0,0 +1,117 @@
+package cpuhours
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"text/template"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/calculator"
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/db"
+)
+
+// Mode determines how the CPU hours for an analysis are calculated.
+type Mode string
+
+const (
+	// ModeReserved calculates CPU hours as the reserved cores multiplied by
+	// the wall-clock run time of the analysis.
+	ModeReserved Mode = "reserved"
+
+	// ModeActual calculates CPU hours from the CPU time actually consumed by
+	// the analysis's containers, as reported by Prometheus.
+	ModeActual Mode = "actual"
+)
+
+// DefaultActualUsageQuery is the PromQL template used to look up the number of
+// CPU seconds consumed by the containers of a VICE analysis. It's evaluated at
+// the analysis end date.
+const DefaultActualUsageQuery = `sum(
+	max_over_time(container_cpu_usage_seconds_total{namespace="{{.Namespace}}",container!="",container!="POD"}[{{.Range}}])
+	* on(namespace, pod) group_left()
+	max by (namespace, pod) (kube_pod_labels{namespace="{{.Namespace}}",label_analysis_id="{{.AnalysisID}}"})
+)`
+
+// ActualUsageConfig contains the settings needed to calculate CPU hours from
+// actual container usage.
+type ActualUsageConfig struct {
+	// Client is used to query Prometheus.
+	Client *clients.PrometheusAPI
+
+	// Namespace is the Kubernetes namespace the VICE pods run in.
+	Namespace string
+
+	// Query is a text/template for the PromQL query. It's given the
+	// Namespace, AnalysisID, and Range fields.
+	Query string
+}
+
+type actualUsageQueryParams struct {
+	Namespace  string
+	AnalysisID string
+	Range      string
+}
+
+// actualUsage is the calculator for ModeActual.
+type actualUsage struct {
+	client    *clients.PrometheusAPI
+	namespace string
+	query     *template.Template
+}
+
+func newActualUsage(config *ActualUsageConfig) (*actualUsage, error) {
+	queryText := config.Query
+	if queryText == "" {
+		queryText = DefaultActualUsageQuery
+	}
+
+	tmpl, err := template.New("actual-usage").Parse(queryText)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse the actual usage query: %w", err)
+	}
+
+	return &actualUsage{
+		client:    config.Client,
+		namespace: config.Namespace,
+		query:     tmpl,
+	}, nil
+}
+
+// Calculate returns the CPU hours actually consumed by the analysis's containers.
+func (a *actualUsage) Calculate(context context.Context, analysis *db.Analysis) ([]calculator.UsageRecord, error) {
+	var buf bytes.Buffer
+
+	startTime, endTime := analysisRunTimes(analysis)
+
+	// The range selector has to cover the entire run of the analysis.
+	rangeSeconds := int64(math.Ceil(endTime.Sub(startTime).Seconds()))
+	if rangeSeconds < 1 {
+		rangeSeconds = 1
+	}
+
+	params := &actualUsageQueryParams{
+		Namespace:  a.namespace,
+		AnalysisID: analysis.ID,
+		Range:      fmt.Sprintf("%ds", rangeSeconds),
+	}
+	if err := a.query.Execute(&buf, params); err != nil {
+		return nil, err
+	}
+
+	cpuSeconds, err := a.client.QueryScalar(context, buf.String(), endTime)
+	if err != nil {
+		return nil, err
+	}
+
+	cpuHours, err := apd.New(0, 0).SetFloat64(cpuSeconds / 3600)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("actual cpu hours for analysis %s is %s", analysis.ID, cpuHours.String())
+
+	return calculatedRecord(cpuHours, ModeActual), nil
+}
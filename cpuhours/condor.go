@@ -0,0 +1,135 @@
+package cpuhours
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/calculator"
+	"github.com/cyverse-de/resource-usage-api/db"
+)
+
+// ModeCondor calculates CPU hours from the HTCondor job ad history, using the
+// wall-clock time accumulated across every execution attempt of the job
+// multiplied by the number of CPUs it requested.
+const ModeCondor Mode = "condor"
+
+// CondorConfig contains the settings needed to read HTCondor job history.
+type CondorConfig struct {
+	// HistoryPath is the path to the condor_history executable.
+	HistoryPath string
+
+	// Pool is the optional address of the HTCondor central manager.
+	Pool string
+
+	// Schedd is the optional name of the schedd whose history is read.
+	Schedd string
+}
+
+// condorUsage is the calculator for ModeCondor.
+type condorUsage struct {
+	db     *db.Database
+	config *CondorConfig
+}
+
+func newCondorUsage(database *db.Database, config *CondorConfig) *condorUsage {
+	return &condorUsage{
+		db:     database,
+		config: config,
+	}
+}
+
+// history returns the CPU seconds recorded in the job ads whose IpcUuid
+// attribute matches the external ID.
+func (c *condorUsage) history(context context.Context, externalID string) (float64, int, error) {
+	var stdout, stderr bytes.Buffer
+
+	args := []string{
+		"-constraint", fmt.Sprintf("IpcUuid == %s", strconv.Quote(externalID)),
+		"-af", "RemoteWallClockTime", "RequestCpus",
+	}
+	if c.config.Pool != "" {
+		args = append(args, "-pool", c.config.Pool)
+	}
+	if c.config.Schedd != "" {
+		args = append(args, "-name", c.config.Schedd)
+	}
+
+	cmd := exec.CommandContext(context, c.config.HistoryPath, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, 0, fmt.Errorf("condor_history failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	var (
+		cpuSeconds float64
+		ads        int
+	)
+
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return 0, 0, fmt.Errorf("unexpected condor_history output: %q", scanner.Text())
+		}
+
+		wallClock, err := strconv.ParseFloat(fields[0], 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid RemoteWallClockTime %q: %w", fields[0], err)
+		}
+
+		requestCPUs, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid RequestCpus %q: %w", fields[1], err)
+		}
+
+		cpuSeconds += wallClock * requestCPUs
+		ads++
+	}
+
+	return cpuSeconds, ads, scanner.Err()
+}
+
+// Calculate returns the CPU hours recorded by HTCondor for every step of the
+// analysis.
+func (c *condorUsage) Calculate(context context.Context, analysis *db.Analysis) ([]calculator.UsageRecord, error) {
+	externalIDs, err := c.db.ExternalIDs(context, analysis.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		totalSeconds float64
+		totalAds     int
+	)
+	for _, externalID := range externalIDs {
+		cpuSeconds, ads, err := c.history(context, externalID)
+		if err != nil {
+			return nil, err
+		}
+		totalSeconds += cpuSeconds
+		totalAds += ads
+	}
+
+	if totalAds == 0 {
+		return nil, fmt.Errorf("no HTCondor job history found for analysis %s", analysis.ID)
+	}
+
+	cpuHours, err := apd.New(0, 0).SetFloat64(totalSeconds / 3600)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("HTCondor cpu hours for analysis %s is %s", analysis.ID, cpuHours.String())
+
+	return calculatedRecord(cpuHours, ModeCondor), nil
+}
@@ -2,7 +2,9 @@ package cpuhours
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/apd"
@@ -10,119 +12,367 @@ import (
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/go-mod/subjects"
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/resource-usage-api/calculator"
 	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/faults"
 	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/guregu/null"
 	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var log = logging.Log.WithFields(logrus.Fields{"package": "cpuhours"})
 
+const otelName = "github.com/cyverse-de/resource-usage-api/cpuhours"
+
+// endSpan records the error on the span, if there is one, and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// The resource type and unit reported by the CPU hours calculators.
+const (
+	ResourceType = "cpu.hours"
+	Unit         = "cpu hours"
+)
+
+// ErrNoStartDate is returned when an analysis has no start date, which means
+// that its CPU hours can never be calculated.
+var ErrNoStartDate = errors.New("start date is null")
+
+// ErrNoEndDate is returned when an analysis's end date still hasn't been
+// recorded after waiting for it. Unlike ErrNoStartDate, the calculation may
+// succeed if it's retried later.
+var ErrNoEndDate = errors.New("end date is null")
+
+// How often the end date of an analysis is checked for while waiting for it
+// to be recorded, and how long to wait before giving up.
+const (
+	endDatePollInterval = 5 * time.Second
+	endDateWait         = 2 * time.Minute
+)
+
 type CPUHours struct {
-	db *db.Database
-	nc *nats.EncodedConn
+	db       *db.Database
+	nc       *nats.EncodedConn
+	registry *calculator.Registry
+	ownerID  string
+	mirror   Mirror
+	enforcer Enforcer
+	messages *usageMessages
+	dryRun   bool
+
+	retryPublishes bool
+	holdRuntime    time.Duration
+
+	invalidatorMutex sync.Mutex
+	invalidator      Invalidator
 }
 
-func New(db *db.Database, nc *nats.EncodedConn) *CPUHours {
-	return &CPUHours{
-		db: db,
-		nc: nc,
-	}
+// Configuration contains the optional settings for the CPU hours calculators.
+type Configuration struct {
+	// Modes maps job type names to calculation modes. Job types that aren't
+	// listed use ModeReserved.
+	Modes map[string]Mode
+
+	// ActualUsage is required if any job type uses ModeActual.
+	ActualUsage *ActualUsageConfig
+
+	// Condor is required if any job type uses ModeCondor.
+	Condor *CondorConfig
 }
 
-// CPUHoursForAnalysis returns the CPU hours total for the analysis as a decimal value.
-func (c *CPUHours) CPUHoursForAnalysis(context context.Context, analysisID string) (*apd.Decimal, *db.Analysis, error) {
+// Register adds the CPU hours calculators to the registry. The reserved cores
+// calculator is the default for every job type. Job types configured to use
+// another mode fall back to the reserved cores calculator if their own
+// calculator fails.
+func Register(registry *calculator.Registry, database *db.Database, config *Configuration) error {
+	reserved := newReservedUsage(database)
+	registry.RegisterDefault(ResourceType, reserved)
+
+	if config == nil {
+		return nil
+	}
+
 	var (
-		endTime  time.Time
-		analysis *db.Analysis
-		err      error
+		actual *actualUsage
+		condor *condorUsage
+		err    error
 	)
-	log = log.WithFields(logrus.Fields{"context": "calculating CPU hours", "analysisID": analysisID})
 
-	log.Debug("getting millicores reserved")
-	millicoresReserved, err := c.db.MillicoresReserved(context, analysisID)
-	if err != nil {
-		return nil, nil, err
+	if config.ActualUsage != nil && config.ActualUsage.Client != nil {
+		if actual, err = newActualUsage(config.ActualUsage); err != nil {
+			return err
+		}
+	}
+
+	if config.Condor != nil {
+		condor = newCondorUsage(database, config.Condor)
+	}
+
+	for jobType, mode := range config.Modes {
+		switch mode {
+		case ModeReserved:
+		case ModeActual:
+			if actual == nil {
+				return fmt.Errorf("job type %s uses the %s mode, but actual usage isn't configured", jobType, mode)
+			}
+			registry.Register(jobType, ResourceType, calculator.WithFallback(actual, reserved))
+		case ModeCondor:
+			if condor == nil {
+				return fmt.Errorf("job type %s uses the %s mode, but HTCondor isn't configured", jobType, mode)
+			}
+			registry.Register(jobType, ResourceType, calculator.WithFallback(condor, reserved))
+		default:
+			return fmt.Errorf("unknown calculation mode %s for job type %s", mode, jobType)
+		}
 	}
-	log.Debug("done getting millicores reserved")
+
+	return nil
+}
+
+// New returns a new *CPUHours that uses the calculators in the registry.
+func New(db *db.Database, nc *nats.EncodedConn, registry *calculator.Registry) *CPUHours {
+	return &CPUHours{
+		db:       db,
+		nc:       nc,
+		registry: registry,
+	}
+}
+
+// analysisRunTimes returns the UTC start and end times of a completed analysis.
+func analysisRunTimes(analysis *db.Analysis) (time.Time, time.Time) {
+	return analysis.StartDate.Time.UTC(), analysis.EndDate.Time.UTC()
+}
+
+// cpuHoursRecord wraps a CPU hours value in a single-element list of usage records.
+func cpuHoursRecord(cpuHours *apd.Decimal) []calculator.UsageRecord {
+	return []calculator.UsageRecord{
+		{
+			ResourceType: ResourceType,
+			Unit:         Unit,
+			Value:        cpuHours,
+		},
+	}
+}
+
+// calculatedRecord wraps a CPU hours value calculated with the given mode in a
+// single-element list of usage records.
+func calculatedRecord(cpuHours *apd.Decimal, mode Mode) []calculator.UsageRecord {
+	records := cpuHoursRecord(cpuHours)
+	records[0].Method = string(mode)
+	return records
+}
+
+// completedAnalysis returns the analysis once its end date has been recorded.
+// It waits up to endDateWait for the end date, and returns ErrNoEndDate if it
+// still hasn't been recorded by then so that the calculation can be retried
+// later without holding up the worker in the meantime.
+func (c *CPUHours) completedAnalysis(context context.Context, analysisID string) (*db.Analysis, error) {
+	log := log.WithFields(logrus.Fields{"context": "getting analysis", "analysisID": analysisID}).WithContext(context)
+
+	deadline := time.NewTimer(endDateWait)
+	defer deadline.Stop()
 
 	for {
 		log.Debug("getting analysis info")
-		analysis, err = c.db.AnalysisWithoutUser(context, analysisID)
+		analysis, err := c.db.AnalysisWithoutUser(context, analysisID)
 		if err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 		log.Debug("done getting analysis info")
 
 		if !analysis.StartDate.Valid {
-			return nil, nil, fmt.Errorf("start date is null")
+			return nil, ErrNoStartDate
 		}
 
 		// It's possible for this to be reached before the database is updated with the actual
 		// end date. If that's the case, wait a bit and try again.
-		if !analysis.EndDate.Valid {
-			time.Sleep(5 * time.Second)
-			continue
+		if analysis.EndDate.Valid {
+			return analysis, nil
+		}
 
-		} else {
-			endTime = analysis.EndDate.Time.UTC()
-			break
+		select {
+		case <-context.Done():
+			return nil, context.Err()
+		case <-deadline.C:
+			return nil, ErrNoEndDate
+		case <-time.After(endDatePollInterval):
 		}
 	}
+}
 
-	startTime := analysis.StartDate.Time.UTC()
-
-	log.Infof("start date: %s, end date: %s", startTime.String(), endTime.String())
-
-	timeSpent, err := apd.New(0, 0).SetFloat64(endTime.Sub(startTime).Hours())
+// CPUHoursForAnalysis returns the CPU hours total for the analysis as a decimal
+// value, with the app's billing weight applied.
+func (c *CPUHours) CPUHoursForAnalysis(context context.Context, analysisID string) (*apd.Decimal, *db.Analysis, error) {
+	analysis, err := c.completedAnalysis(context, analysisID)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	mcReserved := apd.New(0, 0).SetInt64(millicoresReserved)
-	cpuHours := apd.New(0, 0)
-	mc2cores := apd.New(1000, 0)
-
-	bc := apd.BaseContext.WithPrecision(15)
-	_, err = bc.Mul(cpuHours, mcReserved, timeSpent)
+	records, err := c.registry.Lookup(analysis.JobType, ResourceType).Calculate(context, analysis)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	_, err = bc.Quo(cpuHours, cpuHours, mc2cores)
-	if err != nil {
+	if _, err = applyBillingWeight(context, c.db, analysis, records); err != nil {
 		return nil, nil, err
 	}
 
-	log.Infof("run time is %s hours; millicores reserved is %s; cpu hours is %s", timeSpent.String(), mcReserved.String(), cpuHours.String())
+	total := apd.New(0, 0)
+	for _, record := range records {
+		if _, err = apd.BaseContext.WithPrecision(15).Add(total, total, record.Value); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return total, analysis, nil
+}
 
-	return cpuHours, analysis, nil
+// AddUsage sends an update to QMS adding the given number of CPU hours to the
+// user's usage.
+func (c *CPUHours) AddUsage(context context.Context, username string, cpuHours *apd.Decimal) error {
+	return c.AddUsageRecord(context, username, &cpuHoursRecord(cpuHours)[0])
 }
 
-func (c *CPUHours) addEvent(context context.Context, analysis *db.Analysis, cpuHours *apd.Decimal) error {
-	var err error
+// AddUsageRecord sends an update to QMS adding the usage record to the user's
+// usage of the record's resource type.
+func (c *CPUHours) AddUsageRecord(context context.Context, username string, record *calculator.UsageRecord) error {
+	return c.addUsageRecord(context, username, "", record)
+}
+
+// addUsageRecord sends the part of the usage record that isn't covered by the
+// user's supplements to QMS and mirrors it, or parks the whole record if
+// accrual is frozen for the user. The analysis ID is empty for usage that
+// didn't come from an analysis.
+func (c *CPUHours) addUsageRecord(context context.Context, username, analysisID string, record *calculator.UsageRecord) (err error) {
+	context, span := otel.Tracer(otelName).Start(context, "add usage record", trace.WithAttributes(
+		attribute.String("user", username),
+		attribute.String("analysis.id", analysisID),
+		attribute.String("resource_type", record.ResourceType),
+	))
+	defer func() { endSpan(span, err) }()
+
+	if c.dryRun {
+		log.WithContext(context).WithFields(logrus.Fields{
+			"context":      "dry run",
+			"user":         username,
+			"analysisID":   analysisID,
+			"resourceType": record.ResourceType,
+		}).Infof("dry run: would add %s %s", record.Value.String(), record.Unit)
+		return nil
+	}
 
-	floatValue, err := cpuHours.Float64()
+	frozen, err := c.db.UserFrozen(context, username)
 	if err != nil {
 		return err
 	}
+	if frozen {
+		return c.park(context, username, analysisID, record)
+	}
 
-	username, err := c.db.Username(context, analysis.UserID)
+	// Supplementary allocations are used up before the base total. Only usage
+	// is drawn from them; negative records, e.g. adjustments that give hours
+	// back, are sent to QMS as they are.
+	if record.Value.Sign() > 0 {
+		if record, err = c.drawSupplements(context, username, analysisID, record); err != nil {
+			return err
+		}
+	}
+	if record.Value.Sign() == 0 {
+		return nil
+	}
+
+	if err = c.publish(context, username, analysisID, record); err != nil {
+		if unconfirmed(err) {
+			dropUnconfirmed(context, username, analysisID, record, err)
+			return nil
+		}
+		if c.retryPublishes && context.Err() == nil {
+			return c.queueRetry(context, username, analysisID, record, err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// publish sends the usage record to QMS, then records it locally, invalidates
+// the user's cached totals, mirrors it, publishes a usage message for it, and
+// checks the user's quotas.
+func (c *CPUHours) publish(context context.Context, username, analysisID string, record *calculator.UsageRecord) error {
+	update, committed, err := c.sendUpdate(context, username, "ADD", record)
 	if err != nil {
 		return err
 	}
 
+	event := &UsageEvent{
+		Username:     username,
+		AnalysisID:   analysisID,
+		ResourceType: record.ResourceType,
+		Unit:         record.Unit,
+		Value:        record.Value,
+		RecordedOn:   update.EffectiveDate.AsTime(),
+		Cluster:      record.Cluster,
+	}
+	c.recordSentUsage(context, event)
+	c.invalidate(context, username)
+	c.mirrorUsage(context, event, committed)
+	c.publishAddedUsage(context, event)
+	c.enforce(context, event)
+
+	return nil
+}
+
+// recordSentUsage records usage that QMS accepted, which keeps the usage
+// cached with the user's quotas current and lets historical totals include it.
+// Errors are logged for the same reason as in mirrorUsage.
+func (c *CPUHours) recordSentUsage(context context.Context, event *UsageEvent) {
+	sent := &db.SentUsage{
+		Username:      event.Username,
+		AnalysisID:    event.AnalysisID,
+		ResourceType:  event.ResourceType,
+		EffectiveDate: event.RecordedOn,
+	}
+	sent.Value.Set(event.Value)
+	if err := c.db.RecordSentUsage(context, sent); err != nil {
+		log.WithContext(context).Errorf("unable to record the usage sent for %s: %s", event.Username, err)
+	}
+}
+
+// sendUpdate sends an update applying the usage record to the user's usage in
+// QMS with the named operation. Returns the update that was sent and the update
+// that QMS reported as committed. Errors that leave it unknown whether QMS
+// applied the update are returned as an *unconfirmedError.
+func (c *CPUHours) sendUpdate(context context.Context, username, operation string, record *calculator.UsageRecord) (*qms.Update, *qms.Update, error) {
+	floatValue, err := record.Value.Float64()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	effectiveDate := timestamppb.Now()
+	if !record.EffectiveDate.IsZero() {
+		effectiveDate = timestamppb.New(record.EffectiveDate)
+	}
+
 	update := &qms.Update{
 		ValueType:     "usages",
 		Value:         floatValue,
-		EffectiveDate: timestamppb.Now(),
+		EffectiveDate: effectiveDate,
 		Operation: &qms.UpdateOperation{
-			Name: "ADD",
+			Name: operation,
 		},
 		ResourceType: &qms.ResourceType{
-			Name: "cpu.hours",
-			Unit: "cpu hours",
+			Name: record.ResourceType,
+			Unit: record.Unit,
 		},
 		User: &qms.QMSUser{
 			Username: username,
@@ -131,36 +381,206 @@ func (c *CPUHours) addEvent(context context.Context, analysis *db.Analysis, cpuH
 
 	request := pbinit.NewAddUpdateRequest(update)
 	response := pbinit.NewQMSAddUpdateResponse()
-	_, span := pbinit.InitQMSAddUpdateRequest(request, subjects.QMSAddUserUpdate)
-	defer span.End()
+	_, requestSpan := pbinit.InitQMSAddUpdateRequest(request, subjects.QMSAddUserUpdate)
+	defer requestSpan.End()
 
-	log = log.WithFields(logrus.Fields{"context": "adding event", "analysisID": analysis.ID})
+	log := log.WithFields(logrus.Fields{"context": "sending update", "user": username, "resourceType": record.ResourceType, "operation": operation}).WithContext(context)
 
-	log.Debug("adding cpu usage event")
+	log.Debug("sending usage update")
+	if err = faults.Inject(faults.QMSUpdate); err != nil {
+		return nil, nil, err
+	}
 	if err = gotelnats.Request(context, c.nc, subjects.QMSAddUserUpdate, request, response); err != nil {
+		return nil, nil, requestError(err)
+	}
+	log.Debug("after sending usage update")
+
+	return update, response.Update, nil
+}
+
+// SetOwner sets the ID of the registered worker that owns the calculations
+// performed by this instance. Once set, a calculation intent is recorded for
+// each analysis before its usage is calculated, so that calculations that are
+// interrupted can be taken over by another worker.
+func (c *CPUHours) SetOwner(ownerID string) {
+	c.ownerID = ownerID
+}
+
+// SetDryRun enables or disables dry-run mode. In dry-run mode, usages are
+// calculated and logged, but nothing is sent to QMS or mirrored, and no
+// calculation intents are recorded.
+func (c *CPUHours) SetDryRun(dryRun bool) {
+	c.dryRun = dryRun
+}
+
+// CalculateForAnalysisByID runs every registered calculator for the analysis
+// and sends the resulting usages to QMS.
+func (c *CPUHours) CalculateForAnalysisByID(context context.Context, analysisID string) (err error) {
+	context, span := otel.Tracer(otelName).Start(context, "calculate usage for analysis", trace.WithAttributes(
+		attribute.String("analysis.id", analysisID),
+	))
+	defer func() { endSpan(span, err) }()
+
+	if c.ownerID == "" || c.dryRun {
+		return c.calculate(context, analysisID)
+	}
+
+	claim, err := c.db.BeginCalculationIntent(context, analysisID, c.ownerID)
+	if err != nil {
+		return err
+	}
+	if claim == nil {
+		log.WithContext(context).WithFields(logrus.Fields{"context": "calculation intent", "analysisID": analysisID}).
+			Info("calculation is already complete or claimed by an active worker, skipping")
+		return nil
+	}
+
+	return c.calculateClaimed(context, claim)
+}
+
+// calculateClaimed performs a calculation that this worker has claimed. The
+// claim is released if the calculation fails, so that it can be retried.
+func (c *CPUHours) calculateClaimed(context context.Context, claim *db.CalculationClaim) error {
+	log := log.WithFields(logrus.Fields{"context": "calculation intent", "analysisID": claim.AnalysisID}).WithContext(context)
+
+	if err := c.calculate(context, claim.AnalysisID); err != nil {
+		if rerr := c.db.ReleaseCalculationIntent(context, claim); rerr != nil {
+			log.Error(rerr)
+		}
 		return err
 	}
-	log.Debug("after add cpu usage event")
 
+	completed, err := c.db.CompleteCalculationIntent(context, claim)
+	if err != nil {
+		return err
+	}
+	if !completed {
+		log.Warn("the calculation was claimed by another worker before it was completed")
+	}
 	return nil
 }
 
-func (c *CPUHours) CalculateForAnalysisByID(context context.Context, analysisID string) error {
-	var (
-		cpuHours *apd.Decimal
-		analysis *db.Analysis
-		err      error
-	)
+// calculate runs every registered calculator for the analysis and sends the
+// resulting usages to QMS.
+func (c *CPUHours) calculate(context context.Context, analysisID string) error {
+	analysis, err := c.completedAnalysis(context, analysisID)
+	if err != nil {
+		return err
+	}
+
+	records, err := c.registry.Calculate(context, analysis)
+	if err != nil {
+		return err
+	}
+	for i := range records {
+		if records[i].Cluster == "" {
+			records[i].Cluster = analysis.SystemID
+		}
+	}
+
+	weight, err := applyBillingWeight(context, c.db, analysis, records)
+	if err != nil {
+		return err
+	}
+
+	username, err := c.db.Username(context, analysis.UserID)
+	if err != nil {
+		return err
+	}
+
+	if !c.dryRun {
+		if err = c.recordProvenance(context, analysis, records, weight); err != nil {
+			return err
+		}
+	}
+
+	if records, err = c.splitAcrossPeriods(context, analysis, records); err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		if err = c.addAnalysisUsageRecord(context, username, analysisID, &record); err != nil {
+			return err
+		}
+	}
+
+	if !c.dryRun {
+		c.releaseHold(context, analysisID)
+	}
 
-	cpuHours, analysis, err = c.CPUHoursForAnalysis(context, analysisID)
+	return nil
+}
+
+// addAnalysisUsageRecord adds one of the usage records calculated for an
+// analysis unless it was already handed off by an earlier calculation of the
+// same analysis. A calculation that fails part of the way through its records
+// is retried from the start, and without the check the records that had
+// already been sent would be added to the user's usage again.
+func (c *CPUHours) addAnalysisUsageRecord(context context.Context, username, analysisID string, record *calculator.UsageRecord) error {
+	if c.dryRun {
+		return c.addUsageRecord(context, username, analysisID, record)
+	}
+
+	key := &db.UsageRecordKey{AnalysisID: analysisID, ResourceType: record.ResourceType, EffectiveDate: record.EffectiveDate}
+	published, err := c.db.UsageRecordPublished(context, key)
 	if err != nil {
 		return err
 	}
+	if published {
+		log.WithContext(context).WithFields(logrus.Fields{
+			"context":       "add usage record",
+			"user":          username,
+			"analysisID":    analysisID,
+			"resourceType":  record.ResourceType,
+			"effectiveDate": record.EffectiveDate,
+		}).Info("skipping a usage record that was already published")
+		return nil
+	}
 
-	return c.addEvent(context, analysis, cpuHours)
+	if err = c.addUsageRecord(context, username, analysisID, record); err != nil {
+		return err
+	}
+
+	return c.db.MarkUsageRecordPublished(context, key)
+}
+
+// recordProvenance stores the inputs that each of the analysis's usage records
+// was calculated from, including the billing weight that was applied to the
+// CPU hours records, if there was one.
+func (c *CPUHours) recordProvenance(context context.Context, analysis *db.Analysis, records []calculator.UsageRecord, weight *apd.Decimal) error {
+	millicoresReserved, err := c.db.MillicoresReserved(context, analysis.ID)
+	if err != nil {
+		return err
+	}
+	startTime, endTime := analysisRunTimes(analysis)
+
+	for _, record := range records {
+		provenance := &db.CalculationProvenance{
+			AnalysisID:         analysis.ID,
+			ResourceType:       record.ResourceType,
+			Unit:               record.Unit,
+			Value:              *record.Value,
+			CalculationMode:    record.Method,
+			MillicoresReserved: millicoresReserved,
+			StartDate:          startTime,
+			EndDate:            endTime,
+			CodeVersion:        codeVersion,
+			Cluster:            null.NewString(record.Cluster, record.Cluster != ""),
+		}
+		if record.ResourceType == ResourceType {
+			provenance.BillingWeight = weight
+		}
+		if err = c.db.AddCalculationProvenance(context, provenance); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 func (c *CPUHours) CalculateForAnalysis(context context.Context, externalID string) error {
+	log := log.WithFields(logrus.Fields{"externalID": externalID}).WithContext(context)
+
 	log.Debug("getting analysis id")
 	analysisID, err := c.db.GetAnalysisIDByExternalID(context, externalID)
 	if err != nil {
@@ -0,0 +1,87 @@
+package cpuhours
+
+import (
+	"context"
+
+	"github.com/cyverse-de/resource-usage-api/calculator"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/sirupsen/logrus"
+)
+
+// park stores a usage record for a user whose accrual is frozen.
+func (c *CPUHours) park(context context.Context, username, analysisID string, record *calculator.UsageRecord) error {
+	log.WithContext(context).WithFields(logrus.Fields{
+		"context":      "frozen accrual",
+		"user":         username,
+		"analysisID":   analysisID,
+		"resourceType": record.ResourceType,
+	}).Infof("accrual is frozen, parking %s %s", record.Value.String(), record.Unit)
+
+	return c.db.ParkUsageRecord(context, username, analysisID, record.ResourceType, record.Unit, record.Value, record.NullEffectiveDate(), record.Cluster)
+}
+
+// ReplayParkedUsage applies the usage records parked for a user while their
+// accrual was frozen, oldest first. Each record is claimed by removing it
+// before it's applied, so replays that run at the same time never apply the
+// same record twice, and it's put back if it can't be applied. Records are
+// parked again if the user has been frozen since. Returns the number of
+// records applied.
+//
+// In dry-run mode the records are only logged and are left parked.
+func (c *CPUHours) ReplayParkedUsage(context context.Context, userID string) (int, error) {
+	username, err := c.db.Username(context, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.dryRun {
+		records, err := c.db.ParkedUsageRecords(context, userID)
+		if err != nil {
+			return 0, err
+		}
+		for i := range records {
+			if err = c.addUsageRecord(context, username, records[i].AnalysisID.String, parkedUsageRecord(&records[i])); err != nil {
+				return i, err
+			}
+		}
+		return len(records), nil
+	}
+
+	var replayed int
+	for {
+		// A record applied for a user who has been frozen again is parked
+		// again, so stop rather than claiming it over and over.
+		frozen, err := c.db.UserFrozen(context, username)
+		if err != nil || frozen {
+			return replayed, err
+		}
+
+		parked, err := c.db.ClaimParkedUsageRecord(context, userID)
+		if err != nil {
+			return replayed, err
+		}
+		if parked == nil {
+			return replayed, nil
+		}
+
+		if err = c.addUsageRecord(context, username, parked.AnalysisID.String, parkedUsageRecord(parked)); err != nil {
+			if rErr := c.db.RestoreParkedUsageRecord(context, parked); rErr != nil {
+				log.WithContext(context).Errorf("unable to put back parked usage record %s: %s", parked.ID, rErr)
+			}
+			return replayed, err
+		}
+		replayed++
+	}
+}
+
+// parkedUsageRecord converts a parked usage record back to the usage record
+// that was parked.
+func parkedUsageRecord(parked *db.ParkedUsageRecord) *calculator.UsageRecord {
+	return &calculator.UsageRecord{
+		ResourceType:  parked.ResourceType,
+		Unit:          parked.Unit,
+		Value:         &parked.Value,
+		EffectiveDate: parked.EffectiveDate.Time,
+		Cluster:       parked.Cluster,
+	}
+}
@@ -0,0 +1,79 @@
+package cpuhours
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/sirupsen/logrus"
+)
+
+// SetHoldRuntime sets the run time that holds are estimated for. Each hold is
+// the analysis's reserved cores multiplied by this run time, and it expires
+// once the run time has passed, so that the holds of analyses whose usage is
+// never calculated don't count against the user forever. Zero disables holds.
+func (c *CPUHours) SetHoldRuntime(runtime time.Duration) {
+	c.holdRuntime = runtime
+}
+
+// PlaceHoldForAnalysis places a hold for the estimated CPU hours of a newly
+// launched analysis. It does nothing if holds are disabled or the analysis
+// already has a hold.
+func (c *CPUHours) PlaceHoldForAnalysis(context context.Context, externalID string) error {
+	if c.holdRuntime <= 0 {
+		return nil
+	}
+
+	log := log.WithFields(logrus.Fields{"context": "placing hold", "externalID": externalID}).WithContext(context)
+
+	analysisID, err := c.db.GetAnalysisIDByExternalID(context, externalID)
+	if err != nil {
+		return err
+	}
+	analysis, err := c.db.AnalysisWithoutUser(context, analysisID)
+	if err != nil {
+		return err
+	}
+	millicoresReserved, err := c.db.MillicoresReserved(context, analysisID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	estimate, err := ReservedCPUHours(now, now.Add(c.holdRuntime), millicoresReserved)
+	if err != nil {
+		return err
+	}
+
+	if c.dryRun {
+		log.Infof("dry run: would place a hold of %s %s for analysis %s", estimate.String(), Unit, analysisID)
+		return nil
+	}
+
+	hold := &db.Hold{
+		AnalysisID:   analysisID,
+		UserID:       analysis.UserID,
+		ResourceType: ResourceType,
+		Amount:       *estimate,
+		ExpiresOn:    now.Add(c.holdRuntime),
+	}
+	placed, err := c.db.PlaceHold(context, hold)
+	if err != nil {
+		return err
+	}
+	if placed {
+		log.Infof("placed a hold of %s %s for analysis %s", estimate.String(), Unit, analysisID)
+	}
+
+	return nil
+}
+
+// releaseHold releases the hold for an analysis whose actual usage has been
+// recorded. The usage has already been recorded at this point, so errors are
+// logged rather than returned; the hold expires on its own if it can't be
+// released.
+func (c *CPUHours) releaseHold(context context.Context, analysisID string) {
+	if _, err := c.db.ReleaseHold(context, analysisID); err != nil {
+		log.WithContext(context).Errorf("unable to release the hold for analysis %s: %s", analysisID, err)
+	}
+}
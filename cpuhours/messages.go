@@ -0,0 +1,158 @@
+package cpuhours
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/transport"
+)
+
+// MessageMode selects what is published on the usage routing key when usage
+// is added for a user.
+type MessageMode string
+
+const (
+	// MessagesDelta publishes the signed amount that each update changed the
+	// user's usage by, so that consumers can apply the updates incrementally.
+	MessagesDelta MessageMode = "delta"
+)
+
+// ValidMessageMode returns true if the mode is one of the supported modes.
+// The user's total isn't known here, because analysis usage is added to it by
+// QMS, so there's no mode that publishes totals.
+func ValidMessageMode(mode MessageMode) bool {
+	return mode == MessagesDelta
+}
+
+// messageTypeDelta is the type of the usage messages.
+const messageTypeDelta = "delta"
+
+// UsageMessage is the body of the messages published on the usage routing
+// key. The value is the change in the user's usage. Every message for a user
+// and resource type has a sequence number one greater than the one before it,
+// so consumers can apply them in order, ignore the ones they've already applied,
+// and detect the ones they've missed.
+type UsageMessage struct {
+	Type          string       `json:"type"`
+	Sequence      int64        `json:"sequence"`
+	Username      string       `json:"username"`
+	AnalysisID    string       `json:"analysis_id,omitempty"`
+	ResourceType  string       `json:"resource_type"`
+	Unit          string       `json:"unit"`
+	Value         *apd.Decimal `json:"value"`
+	EffectiveDate time.Time    `json:"effective_date"`
+	Cluster       string       `json:"cluster,omitempty"`
+}
+
+// MessageConfig contains the settings for the usage messages.
+type MessageConfig struct {
+	// Mode selects what's published when usage is added.
+	Mode MessageMode
+
+	// RoutingKey is the routing key that the messages are published with.
+	RoutingKey string
+}
+
+// usageMessages publishes usage messages once a transport has been set.
+type usageMessages struct {
+	mutex     sync.Mutex
+	config    MessageConfig
+	transport transport.Transport
+}
+
+// SetMessages enables the usage messages. They're published once a transport
+// has been set with SetMessageTransport.
+func (c *CPUHours) SetMessages(config *MessageConfig) {
+	c.messages = &usageMessages{config: *config}
+}
+
+// SetMessageTransport sets the transport that usage messages are published
+// on. It can be called after usage updates have started.
+func (c *CPUHours) SetMessageTransport(t transport.Transport) {
+	if c.messages == nil {
+		return
+	}
+	c.messages.mutex.Lock()
+	defer c.messages.mutex.Unlock()
+	c.messages.transport = t
+}
+
+// publishAddedUsage publishes a message for usage that was added for a user,
+// if usage messages are enabled. The message contains the amount that was
+// added. The usage has
+// already been recorded by QMS at this point, so errors are logged rather
+// than returned for the same reason as in mirrorUsage.
+func (c *CPUHours) publishAddedUsage(context context.Context, event *UsageEvent) {
+	if c.messages == nil {
+		return
+	}
+
+	message := &db.QueuedUsageMessage{
+		Type:          messageTypeDelta,
+		Username:      event.Username,
+		AnalysisID:    event.AnalysisID,
+		ResourceType:  event.ResourceType,
+		Unit:          event.Unit,
+		EffectiveDate: event.RecordedOn,
+		Cluster:       event.Cluster,
+	}
+	message.Value.Set(event.Value)
+
+	if err := c.publishMessage(context, message); err != nil {
+		log.WithContext(context).Errorf("unable to publish the usage message for %s: %s", event.Username, err)
+	}
+}
+
+// publishMessage assigns the message its sequence number, queues it, and then
+// publishes it. A message that can't be published stays queued, and the
+// RetryQueue publishes it again, so consumers never see a gap in the sequence
+// numbers that isn't eventually filled. Messages queued before a transport has
+// been set are left for the RetryQueue as well.
+func (c *CPUHours) publishMessage(context context.Context, message *db.QueuedUsageMessage) error {
+	if err := c.db.QueueUsageMessage(context, message); err != nil {
+		return err
+	}
+
+	if _, err := c.sendMessage(context, message); err != nil {
+		return fmt.Errorf("message %d is queued to be published again: %w", message.Sequence, err)
+	}
+	return nil
+}
+
+// sendMessage publishes a queued usage message and removes it from the queue.
+// Returns false without an error if no transport has been set yet.
+func (c *CPUHours) sendMessage(context context.Context, queued *db.QueuedUsageMessage) (bool, error) {
+	c.messages.mutex.Lock()
+	t, routingKey := c.messages.transport, c.messages.config.RoutingKey
+	c.messages.mutex.Unlock()
+	if t == nil {
+		return false, nil
+	}
+
+	message := &UsageMessage{
+		Type:          queued.Type,
+		Sequence:      queued.Sequence,
+		Username:      queued.Username,
+		AnalysisID:    queued.AnalysisID,
+		ResourceType:  queued.ResourceType,
+		Unit:          queued.Unit,
+		Value:         &queued.Value,
+		EffectiveDate: queued.EffectiveDate,
+		Cluster:       queued.Cluster,
+	}
+
+	data, err := json.Marshal(message)
+	if err != nil {
+		return false, err
+	}
+	if err = t.Send(context, routingKey, data); err != nil {
+		return false, err
+	}
+
+	return true, c.db.DeleteUsageMessage(context, queued.ID)
+}
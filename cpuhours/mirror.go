@@ -0,0 +1,106 @@
+package cpuhours
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/p/go/qms"
+)
+
+// UsageEvent describes usage that was sent to QMS.
+type UsageEvent struct {
+	Username     string       `json:"username"`
+	AnalysisID   string       `json:"analysis_id,omitempty"`
+	ResourceType string       `json:"resource_type"`
+	Unit         string       `json:"unit"`
+	Value        *apd.Decimal `json:"value"`
+	RecordedOn   time.Time    `json:"recorded_on"`
+	Cluster      string       `json:"cluster,omitempty"`
+}
+
+// Mirror receives a copy of every usage update once QMS has accepted it.
+type Mirror interface {
+	// MirrorUsage is called with the usage record that was sent to QMS.
+	MirrorUsage(context context.Context, event *UsageEvent) error
+
+	// MirrorUpdate is called with the update that QMS reported as committed.
+	MirrorUpdate(context context.Context, update *qms.Update) error
+}
+
+// SetMirror sets the Mirror that receives a copy of every usage update.
+func (c *CPUHours) SetMirror(mirror Mirror) {
+	c.mirror = mirror
+}
+
+// mirrorUsage passes the usage update to the mirror, if there is one. The usage
+// has already been recorded by QMS at this point, so errors are logged rather
+// than returned; returning them would cause the usage to be counted twice when
+// the calculation is retried.
+func (c *CPUHours) mirrorUsage(context context.Context, event *UsageEvent, update *qms.Update) {
+	if c.mirror == nil {
+		return
+	}
+
+	log := log.WithContext(context)
+
+	if err := c.mirror.MirrorUsage(context, event); err != nil {
+		log.Errorf("unable to mirror the usage event for %s: %s", event.Username, err)
+	}
+	if update == nil {
+		return
+	}
+	if err := c.mirror.MirrorUpdate(context, update); err != nil {
+		log.Errorf("unable to mirror the committed update for %s: %s", event.Username, err)
+	}
+}
+
+// Enforcer is notified of every usage update once QMS has accepted it so that
+// it can act when the user exceeds a quota.
+type Enforcer interface {
+	Enforce(context context.Context, event *UsageEvent) error
+}
+
+// SetEnforcer sets the Enforcer that's notified of every usage update.
+func (c *CPUHours) SetEnforcer(enforcer Enforcer) {
+	c.enforcer = enforcer
+}
+
+// enforce passes the usage update to the enforcer, if there is one. Errors are
+// logged for the same reason as in mirrorUsage.
+func (c *CPUHours) enforce(context context.Context, event *UsageEvent) {
+	if c.enforcer == nil {
+		return
+	}
+	if err := c.enforcer.Enforce(context, event); err != nil {
+		log.WithContext(context).Errorf("unable to check the quotas for %s: %s", event.Username, err)
+	}
+}
+
+// Invalidator drops the cached totals and summaries for a user once usage has
+// been added for them, so that the next request reads the new usage.
+type Invalidator interface {
+	InvalidateTotals(context context.Context, username string) error
+}
+
+// SetInvalidator sets the Invalidator that's notified of every usage update.
+// It can be called after usage updates have started.
+func (c *CPUHours) SetInvalidator(invalidator Invalidator) {
+	c.invalidatorMutex.Lock()
+	defer c.invalidatorMutex.Unlock()
+	c.invalidator = invalidator
+}
+
+// invalidate drops the user's cached totals, if there's an invalidator.
+// Errors are logged for the same reason as in mirrorUsage.
+func (c *CPUHours) invalidate(context context.Context, username string) {
+	c.invalidatorMutex.Lock()
+	invalidator := c.invalidator
+	c.invalidatorMutex.Unlock()
+	if invalidator == nil {
+		return
+	}
+	if err := invalidator.InvalidateTotals(context, username); err != nil {
+		log.WithContext(context).Errorf("unable to invalidate the cached totals for %s: %s", username, err)
+	}
+}
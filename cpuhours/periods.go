@@ -0,0 +1,81 @@
+package cpuhours
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/calculator"
+	"github.com/cyverse-de/resource-usage-api/db"
+)
+
+// splitRecord divides a usage record for an analysis that ran from start to
+// end among the effective periods that begin at the boundaries, in proportion
+// to the time the analysis spent in each one. Each part is attributed to the
+// start of its share of the run, so that it lands in the right period. The
+// last part takes whatever rounding leaves over, so the parts always add up to
+// the original value.
+func splitRecord(record *calculator.UsageRecord, start, end time.Time, boundaries []time.Time) ([]calculator.UsageRecord, error) {
+	if len(boundaries) == 0 || !end.After(start) {
+		return []calculator.UsageRecord{*record}, nil
+	}
+
+	bc := apd.BaseContext.WithPrecision(15)
+	runTime := apd.New(end.Sub(start).Nanoseconds(), 0)
+	remaining := apd.New(0, 0).Set(record.Value)
+
+	parts := make([]calculator.UsageRecord, 0, len(boundaries)+1)
+	segmentStart := start
+	for _, boundary := range boundaries {
+		share := apd.New(0, 0)
+		if _, err := bc.Mul(share, record.Value, apd.New(boundary.Sub(segmentStart).Nanoseconds(), 0)); err != nil {
+			return nil, err
+		}
+		if _, err := bc.Quo(share, share, runTime); err != nil {
+			return nil, err
+		}
+		if _, err := bc.Sub(remaining, remaining, share); err != nil {
+			return nil, err
+		}
+
+		part := *record
+		part.Value = share
+		part.EffectiveDate = segmentStart
+		parts = append(parts, part)
+		segmentStart = boundary
+	}
+
+	last := *record
+	last.Value = remaining
+	last.EffectiveDate = segmentStart
+	parts = append(parts, last)
+
+	return parts, nil
+}
+
+// splitAcrossPeriods splits the analysis's usage records among the user's
+// effective periods when the analysis started in one period and ended in a
+// later one. Records for analyses that ran within a single period are returned
+// unchanged and are attributed to the time they're sent.
+func (c *CPUHours) splitAcrossPeriods(context context.Context, analysis *db.Analysis, records []calculator.UsageRecord) ([]calculator.UsageRecord, error) {
+	start, end := analysisRunTimes(analysis)
+
+	var split []calculator.UsageRecord
+	for i := range records {
+		boundaries, err := c.db.PeriodStartsBetween(context, analysis.UserID, records[i].ResourceType, db.DefaultAllocationSource, start, end)
+		if err != nil {
+			return nil, err
+		}
+		if len(boundaries) > 0 {
+			log.WithContext(context).Infof("analysis %s spans %d effective period boundaries, splitting its %s", analysis.ID, len(boundaries), records[i].ResourceType)
+		}
+
+		parts, err := splitRecord(&records[i], start, end, boundaries)
+		if err != nil {
+			return nil, err
+		}
+		split = append(split, parts...)
+	}
+
+	return split, nil
+}
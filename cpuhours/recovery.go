@@ -0,0 +1,112 @@
+package cpuhours
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/leader"
+	"github.com/cyverse-de/resource-usage-api/ops"
+	"github.com/cyverse-de/resource-usage-api/periodic"
+	"github.com/sirupsen/logrus"
+)
+
+// RecoveryConfig contains the settings for the task that takes over
+// calculations abandoned by workers that went away.
+type RecoveryConfig struct {
+	// WorkerID and WorkerName identify this process's worker registration.
+	WorkerID   string
+	WorkerName string
+
+	// Lifetime is how long the worker registration lasts without a refresh.
+	Lifetime time.Duration
+
+	// Interval is how often the registration is refreshed and orphaned
+	// calculations are looked for. It should be well under Lifetime.
+	Interval time.Duration
+
+	// MaxAttempts is the number of times a calculation is attempted before
+	// it's left for an administrator to look at.
+	MaxAttempts int
+}
+
+// Recovery keeps this process's worker registration alive, purges expired
+// workers, and re-runs calculations whose owners have expired.
+type Recovery struct {
+	config *RecoveryConfig
+	db     *db.Database
+	calc   *CPUHours
+	leader *leader.Elector
+	events *ops.Publisher
+}
+
+// NewRecovery returns a new *Recovery.
+func NewRecovery(config *RecoveryConfig, database *db.Database, calc *CPUHours) *Recovery {
+	return &Recovery{
+		config: config,
+		db:     database,
+		calc:   calc,
+	}
+}
+
+// SetLeader sets the election that decides whether this instance purges
+// expired workers. Without one, every instance purges them.
+func (r *Recovery) SetLeader(elector *leader.Elector) {
+	r.leader = elector
+}
+
+// SetEvents sets the publisher that the expiration of workers is reported to.
+func (r *Recovery) SetEvents(events *ops.Publisher) {
+	r.events = events
+}
+
+// Recover performs a single pass of the recovery task.
+func (r *Recovery) Recover(context context.Context) error {
+	log := log.WithFields(logrus.Fields{"context": "calculation recovery", "workerID": r.config.WorkerID}).WithContext(context)
+
+	if _, err := r.db.RefreshWorkerRegistration(context, r.config.WorkerID, r.config.WorkerName, r.config.Lifetime); err != nil {
+		return err
+	}
+
+	if r.leader.IsLeader() {
+		purged, err := r.db.PurgeExpiredWorkers(context)
+		if err != nil {
+			return err
+		}
+		if len(purged) > 0 {
+			log.Infof("purged %d expired workers", len(purged))
+		}
+		for _, worker := range purged {
+			r.events.Publish(context, ops.WorkerExpired, map[string]interface{}{
+				"worker_id":   worker.ID,
+				"worker_name": worker.Name,
+				"forced":      false,
+			})
+		}
+	}
+
+	// Dry runs don't record calculation intents, so there's nothing to take over.
+	if r.calc.dryRun {
+		return nil
+	}
+
+	claims, err := r.db.ClaimOrphanedCalculationIntents(context, r.config.WorkerID, r.config.MaxAttempts)
+	if err != nil {
+		return err
+	}
+
+	for i := range claims {
+		log.Infof("taking over the calculation for analysis %s", claims[i].AnalysisID)
+		if err = r.calc.calculateClaimed(context, &claims[i]); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// Run performs a recovery pass every configured interval until the context is
+// canceled.
+func (r *Recovery) Run(context context.Context) {
+	periodic.Run(context, log, nil, func() time.Duration { return r.config.Interval }, r.Recover)
+}
@@ -0,0 +1,71 @@
+package cpuhours
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/calculator"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/sirupsen/logrus"
+)
+
+// reservedUsage is the calculator for ModeReserved.
+type reservedUsage struct {
+	db *db.Database
+}
+
+func newReservedUsage(database *db.Database) *reservedUsage {
+	return &reservedUsage{db: database}
+}
+
+// Calculate returns the reserved cores multiplied by the run time of the analysis.
+func (r *reservedUsage) Calculate(context context.Context, analysis *db.Analysis) ([]calculator.UsageRecord, error) {
+	log := log.WithFields(logrus.Fields{"context": "calculating CPU hours", "analysisID": analysis.ID})
+
+	log.Debug("getting millicores reserved")
+	millicoresReserved, err := r.db.MillicoresReserved(context, analysis.ID)
+	if err != nil {
+		return nil, err
+	}
+	log.Debug("done getting millicores reserved")
+
+	startTime, endTime := analysisRunTimes(analysis)
+
+	log.Infof("start date: %s, end date: %s", startTime.String(), endTime.String())
+
+	cpuHours, err := ReservedCPUHours(startTime, endTime, millicoresReserved)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("run time is %s; millicores reserved is %d; cpu hours is %s", endTime.Sub(startTime).String(), millicoresReserved, cpuHours.String())
+
+	return calculatedRecord(cpuHours, ModeReserved), nil
+}
+
+// ReservedCPUHours returns the CPU hours for a run time with the given number
+// of millicores reserved.
+func ReservedCPUHours(startTime, endTime time.Time, millicoresReserved int64) (*apd.Decimal, error) {
+	timeSpent, err := apd.New(0, 0).SetFloat64(endTime.Sub(startTime).Hours())
+	if err != nil {
+		return nil, err
+	}
+
+	mcReserved := apd.New(0, 0).SetInt64(millicoresReserved)
+	cpuHours := apd.New(0, 0)
+	mc2cores := apd.New(1000, 0)
+
+	bc := apd.BaseContext.WithPrecision(15)
+	_, err = bc.Mul(cpuHours, mcReserved, timeSpent)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = bc.Quo(cpuHours, cpuHours, mc2cores)
+	if err != nil {
+		return nil, err
+	}
+
+	return cpuHours, nil
+}
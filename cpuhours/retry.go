@@ -0,0 +1,278 @@
+package cpuhours
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"time"
+
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/resource-usage-api/calculator"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/periodic"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+// The metrics for the usage records waiting to be sent to QMS again. They're
+// served with the other expvar variables on the diagnostics port.
+var (
+	retryQueueDepth = expvar.NewInt("usage_publish_retry_queue_depth")
+	retriesQueued   = expvar.NewInt("usage_publish_retries_queued")
+	retriesSent     = expvar.NewInt("usage_publish_retries_sent")
+	retriesFailed   = expvar.NewInt("usage_publish_retries_failed")
+
+	updatesUnconfirmed = expvar.NewInt("usage_publish_updates_unconfirmed")
+)
+
+// unconfirmedError is returned when an update was sent to QMS but no answer
+// came back, e.g. because the request timed out. QMS may have applied the
+// update, so sending it again could count the usage twice.
+type unconfirmedError struct {
+	err error
+}
+
+func (e *unconfirmedError) Error() string {
+	return "QMS didn't confirm the update, which may have been applied: " + e.err.Error()
+}
+
+func (e *unconfirmedError) Unwrap() error {
+	return e.err
+}
+
+// unconfirmed returns true if the error means that QMS may have applied the
+// update.
+func unconfirmed(err error) bool {
+	var u *unconfirmedError
+	return errors.As(err, &u)
+}
+
+// requestError wraps an error from sending an update to QMS in an
+// unconfirmedError unless the update definitely wasn't applied: it wasn't
+// delivered to QMS at all, or QMS answered with an error.
+func requestError(err error) error {
+	var serviceErr *gotelnats.DEServiceError
+	switch {
+	case errors.As(err, &serviceErr),
+		errors.Is(err, nats.ErrNoResponders),
+		errors.Is(err, nats.ErrConnectionClosed),
+		errors.Is(err, nats.ErrConnectionDraining),
+		errors.Is(err, nats.ErrInvalidConnection),
+		errors.Is(err, nats.ErrBadSubject),
+		errors.Is(err, nats.ErrMaxPayload):
+		return err
+	default:
+		return &unconfirmedError{err: err}
+	}
+}
+
+// dropUnconfirmed logs an update that QMS may have applied. It isn't sent
+// again, because that could count the usage twice, so it's logged with what's
+// needed to reconcile it by hand.
+func dropUnconfirmed(context context.Context, username, analysisID string, record *calculator.UsageRecord, err error) {
+	updatesUnconfirmed.Add(1)
+	log.WithContext(context).WithFields(logrus.Fields{
+		"context":      "unconfirmed update",
+		"user":         username,
+		"analysisID":   analysisID,
+		"resourceType": record.ResourceType,
+	}).Errorf("not sending %s %s again: %s", record.Value.String(), record.Unit, err)
+}
+
+// SetRetryPublishes enables or disables queuing usage records that couldn't be
+// sent to QMS. When it's enabled, a send that QMS definitely didn't apply is
+// stored for a RetryQueue to send again rather than being returned as an error.
+func (c *CPUHours) SetRetryPublishes(retryPublishes bool) {
+	c.retryPublishes = retryPublishes
+}
+
+// queueRetry stores a usage record that couldn't be sent to QMS so that it's
+// sent again later. It's only called for records that QMS definitely didn't
+// apply. The send error is returned if the record can't be stored.
+func (c *CPUHours) queueRetry(context context.Context, username, analysisID string, record *calculator.UsageRecord, sendErr error) error {
+	log.WithContext(context).WithFields(logrus.Fields{
+		"context":      "queuing retry",
+		"user":         username,
+		"analysisID":   analysisID,
+		"resourceType": record.ResourceType,
+	}).Warnf("unable to send the usage to QMS, queuing it to be sent again: %s", sendErr)
+
+	if err := c.db.QueuePublishRetry(context, username, analysisID, record.ResourceType, record.Unit, record.Value, record.NullEffectiveDate(), record.Cluster, sendErr.Error()); err != nil {
+		log.WithContext(context).Errorf("unable to queue the usage to be sent again: %s", err)
+		return sendErr
+	}
+	retriesQueued.Add(1)
+
+	return nil
+}
+
+// RetryConfig contains the settings for the task that sends the queued usage
+// records to QMS again.
+type RetryConfig struct {
+	// Interval is how often the queue is checked for records that are due.
+	Interval time.Duration
+
+	// BaseDelay is how long a record waits after its first failed retry. The
+	// delay doubles with each failure after that.
+	BaseDelay time.Duration
+
+	// MaxDelay is the longest a record waits between retries.
+	MaxDelay time.Duration
+
+	// BatchSize is the largest number of records sent in a single pass.
+	BatchSize int
+}
+
+// RetryQueue sends the usage records that couldn't be sent to QMS again until
+// QMS accepts them. It also publishes the usage messages that couldn't be
+// published.
+type RetryQueue struct {
+	periodic.Task[*RetryConfig]
+
+	db   *db.Database
+	calc *CPUHours
+}
+
+// NewRetryQueue returns a new *RetryQueue.
+func NewRetryQueue(config *RetryConfig, database *db.Database, calc *CPUHours) *RetryQueue {
+	return &RetryQueue{
+		Task: periodic.NewTask(config),
+		db:   database,
+		calc: calc,
+	}
+}
+
+// retryDelay returns how long to wait before the next attempt after the given
+// number of failed attempts.
+func retryDelay(config *RetryConfig, attempts int) time.Duration {
+	delay := config.BaseDelay
+	for i := 0; i < attempts && delay < config.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > config.MaxDelay {
+		delay = config.MaxDelay
+	}
+	return delay
+}
+
+// retry sends a single queued usage record again. Records for users whose
+// accrual has been frozen since they were queued are parked instead.
+func (r *RetryQueue) retry(context context.Context, retry *db.PublishRetry) error {
+	record := &calculator.UsageRecord{
+		ResourceType:  retry.ResourceType,
+		Unit:          retry.Unit,
+		Value:         &retry.Value,
+		EffectiveDate: retry.EffectiveDate.Time,
+		Cluster:       retry.Cluster,
+	}
+
+	frozen, err := r.db.UserFrozen(context, retry.Username)
+	if err != nil {
+		return err
+	}
+	if frozen {
+		err = r.calc.park(context, retry.Username, retry.AnalysisID.String, record)
+	} else {
+		err = r.calc.publish(context, retry.Username, retry.AnalysisID.String, record)
+	}
+	if err != nil {
+		return err
+	}
+
+	return r.db.DeletePublishRetry(context, retry.ID)
+}
+
+// Retry sends the queued usage records that are due. Records that fail again
+// are rescheduled with a longer delay, unless QMS may have applied them, in
+// which case they're removed from the queue.
+func (r *RetryQueue) Retry(context context.Context) error {
+	log := log.WithFields(logrus.Fields{"context": "retrying usage publishes"}).WithContext(context)
+
+	config := r.Config()
+
+	retries, err := r.db.DuePublishRetries(context, config.BatchSize)
+	if err != nil {
+		return err
+	}
+
+	for i := range retries {
+		retry := &retries[i]
+		err = r.retry(context, retry)
+		if unconfirmed(err) {
+			dropUnconfirmed(context, retry.Username, retry.AnalysisID.String, &calculator.UsageRecord{
+				ResourceType: retry.ResourceType,
+				Unit:         retry.Unit,
+				Value:        &retry.Value,
+			}, err)
+			if err = r.db.DeletePublishRetry(context, retry.ID); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			retriesFailed.Add(1)
+			next := time.Now().Add(retryDelay(config, retry.Attempts))
+			log.Warnf("unable to send queued usage %s for %s, trying again at %s: %s", retry.ID, retry.Username, next.Format(time.RFC3339), err)
+			if err = r.db.PublishRetryFailed(context, retry.ID, next, err.Error()); err != nil {
+				return err
+			}
+			continue
+		}
+		retriesSent.Add(1)
+	}
+
+	if err = r.retryMessages(context, config); err != nil {
+		return err
+	}
+
+	depth, err := r.db.PublishRetryCount(context)
+	if err != nil {
+		return err
+	}
+	retryQueueDepth.Set(depth)
+	if depth > 0 {
+		log.Infof("%d usage records are waiting to be sent to QMS", depth)
+	}
+
+	return nil
+}
+
+// retryMessages publishes the usage messages that are due again. Messages that
+// fail again are rescheduled with a longer delay, the same as usage records.
+func (r *RetryQueue) retryMessages(context context.Context, config *RetryConfig) error {
+	if r.calc.messages == nil {
+		return nil
+	}
+
+	log := log.WithFields(logrus.Fields{"context": "retrying usage messages"}).WithContext(context)
+
+	messages, err := r.db.DueUsageMessages(context, config.BatchSize)
+	if err != nil {
+		return err
+	}
+
+	for i := range messages {
+		message := &messages[i]
+		sent, err := r.calc.sendMessage(context, message)
+		if err == nil && !sent {
+			// There's no transport to publish on yet, so nothing else can be
+			// sent in this pass either.
+			return nil
+		}
+		if err != nil {
+			next := time.Now().Add(retryDelay(config, message.Attempts))
+			log.Warnf("unable to publish usage message %d for %s, trying again at %s: %s", message.Sequence, message.Username, next.Format(time.RFC3339), err)
+			if err = r.db.UsageMessageFailed(context, message.ID, next, err.Error()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Run sends the due usage records every configured interval until the context
+// is canceled.
+func (r *RetryQueue) Run(context context.Context) {
+	r.RunEvery(context, log, func(config *RetryConfig) time.Duration { return config.Interval }, r.Retry)
+}
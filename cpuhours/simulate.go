@@ -0,0 +1,95 @@
+package cpuhours
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/calculator"
+	"github.com/cyverse-de/resource-usage-api/db"
+)
+
+// Simulator calculates the CPU hours of completed analyses under calculation
+// modes other than the configured ones, without recording or sending anything.
+// It's used to see what a change in the calculation modes would do before
+// it's made.
+type Simulator struct {
+	db          *db.Database
+	modes       map[string]Mode
+	calculators map[Mode]calculator.Calculator
+}
+
+// NewSimulator returns a *Simulator that can use every mode that the
+// configuration has the settings for. The reserved mode is always available.
+func NewSimulator(database *db.Database, config *Configuration) (*Simulator, error) {
+	reserved := newReservedUsage(database)
+	s := &Simulator{
+		db:          database,
+		modes:       make(map[string]Mode),
+		calculators: map[Mode]calculator.Calculator{ModeReserved: reserved},
+	}
+
+	if config == nil {
+		return s, nil
+	}
+	for jobType, mode := range config.Modes {
+		s.modes[jobType] = mode
+	}
+
+	// The other modes fall back to the reserved mode, as they do when usage is
+	// recorded.
+	if config.ActualUsage != nil && config.ActualUsage.Client != nil {
+		actual, err := newActualUsage(config.ActualUsage)
+		if err != nil {
+			return nil, err
+		}
+		s.calculators[ModeActual] = calculator.WithFallback(actual, reserved)
+	}
+	if config.Condor != nil {
+		s.calculators[ModeCondor] = calculator.WithFallback(newCondorUsage(database, config.Condor), reserved)
+	}
+
+	return s, nil
+}
+
+// Available returns true if the simulator can calculate CPU hours with the
+// mode.
+func (s *Simulator) Available(mode Mode) bool {
+	_, ok := s.calculators[mode]
+	return ok
+}
+
+// ConfiguredMode returns the mode that's used to record usage for the job
+// type.
+func (s *Simulator) ConfiguredMode(jobType string) Mode {
+	if mode, ok := s.modes[jobType]; ok {
+		return mode
+	}
+	return ModeReserved
+}
+
+// Calculate returns the CPU hours for the analysis using the mode, with the
+// app's billing weight applied as it is when usage is recorded.
+func (s *Simulator) Calculate(context context.Context, analysis *db.Analysis, mode Mode) (*apd.Decimal, error) {
+	calc, ok := s.calculators[mode]
+	if !ok {
+		return nil, fmt.Errorf("the %s calculation mode isn't configured", mode)
+	}
+
+	records, err := calc.Calculate(context, analysis)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = applyBillingWeight(context, s.db, analysis, records); err != nil {
+		return nil, err
+	}
+
+	total := apd.New(0, 0)
+	for _, record := range records {
+		if _, err = apd.BaseContext.WithPrecision(15).Add(total, total, record.Value); err != nil {
+			return nil, err
+		}
+	}
+
+	return total, nil
+}
@@ -0,0 +1,105 @@
+package cpuhours
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/calculator"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/sirupsen/logrus"
+)
+
+// drawSupplements covers as much of the usage record as it can from the
+// supplements that the user has for its resource type at the time the usage
+// is attributed to, drawing from the one that expires first. Returns the
+// record for the part of the usage that's left over for the base total, which
+// has a zero value if the supplements covered all of it.
+//
+// The draws for a record of an analysis are stored with the record's key. If
+// the record is calculated again, e.g. because sending it to QMS failed, what
+// was already drawn for it counts towards covering it, and the supplements it
+// was drawn from aren't drawn from again.
+func (c *CPUHours) drawSupplements(context context.Context, username, analysisID string, record *calculator.UsageRecord) (*calculator.UsageRecord, error) {
+	at := record.EffectiveDate
+	if at.IsZero() {
+		at = time.Now().UTC()
+	}
+
+	bc := apd.BaseContext.WithPrecision(15)
+	remaining := apd.New(0, 0).Set(record.Value)
+
+	var key *db.UsageRecordKey
+	drawn := make(map[string]bool)
+	if analysisID != "" {
+		key = &db.UsageRecordKey{AnalysisID: analysisID, ResourceType: record.ResourceType, EffectiveDate: record.EffectiveDate}
+		draws, err := c.db.SupplementDraws(context, key)
+		if err != nil {
+			return nil, err
+		}
+		for i := range draws {
+			drawn[draws[i].SupplementID] = true
+			if _, err = bc.Sub(remaining, remaining, &draws[i].Amount); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	supplements, err := c.db.AvailableSupplements(context, username, record.ResourceType, at)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, supplement := range supplements {
+		if remaining.Sign() <= 0 {
+			break
+		}
+		if drawn[supplement.ID] {
+			continue
+		}
+
+		available := apd.New(0, 0)
+		if _, err = bc.Sub(available, &supplement.Amount, &supplement.Consumed); err != nil {
+			return nil, err
+		}
+		draw := apd.New(0, 0).Set(remaining)
+		if available.Cmp(remaining) < 0 {
+			draw = available
+		}
+
+		// A supplement that was drawn from or revoked since it was listed is
+		// skipped rather than retried. The usage it would have covered counts
+		// towards the base total instead, so it's never covered twice.
+		var consumed bool
+		if key != nil {
+			consumed, err = c.db.ConsumeSupplementForRecord(context, supplement.ID, draw, key)
+		} else {
+			consumed, err = c.db.ConsumeSupplement(context, supplement.ID, draw)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !consumed {
+			continue
+		}
+
+		log.WithContext(context).WithFields(logrus.Fields{
+			"context":      "drawing supplements",
+			"user":         username,
+			"resourceType": record.ResourceType,
+			"supplementID": supplement.ID,
+		}).Infof("drew %s %s from a supplement", draw.String(), record.Unit)
+
+		if _, err = bc.Sub(remaining, remaining, draw); err != nil {
+			return nil, err
+		}
+	}
+
+	if remaining.Sign() < 0 {
+		remaining = apd.New(0, 0)
+	}
+
+	remainder := *record
+	remainder.Value = remaining
+	return &remainder, nil
+}
@@ -0,0 +1,35 @@
+package cpuhours
+
+import "runtime/debug"
+
+// codeVersion identifies the build that calculated a usage value. It's the VCS
+// revision when the binary was built from a checkout, and the module version
+// otherwise.
+var codeVersion = buildVersion()
+
+// buildVersion returns the version of the running binary from its build
+// information.
+func buildVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+
+	var revision, modified string
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value
+		}
+	}
+	if revision != "" {
+		if modified == "true" {
+			revision += "-dirty"
+		}
+		return revision
+	}
+
+	return info.Main.Version
+}
@@ -0,0 +1,43 @@
+package cpuhours
+
+import (
+	"context"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/calculator"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/sirupsen/logrus"
+)
+
+// applyBillingWeight multiplies the CPU hours records calculated for the
+// analysis by the billing weight that was in effect for its app when it ended.
+// Returns the weight that was applied, or nil if the app had none, in which
+// case the records are left alone.
+func applyBillingWeight(context context.Context, database *db.Database, analysis *db.Analysis, records []calculator.UsageRecord) (*apd.Decimal, error) {
+	_, endTime := analysisRunTimes(analysis)
+	weight, err := database.BillingWeightForApp(context, analysis.AppID, endTime)
+	if err != nil || weight == nil {
+		return nil, err
+	}
+
+	bc := apd.BaseContext.WithPrecision(15)
+	for i := range records {
+		if records[i].ResourceType != ResourceType {
+			continue
+		}
+		weighted := apd.New(0, 0)
+		if _, err = bc.Mul(weighted, records[i].Value, &weight.Weight); err != nil {
+			return nil, err
+		}
+		records[i].Value = weighted
+	}
+
+	log.WithContext(context).WithFields(logrus.Fields{
+		"context":    "billing weight",
+		"analysisID": analysis.ID,
+		"appID":      analysis.AppID,
+		"weightID":   weight.ID,
+	}).Infof("applied a billing weight of %s for the %s %s", weight.Weight.String(), weight.TargetType, weight.TargetID)
+
+	return &weight.Weight, nil
+}
@@ -0,0 +1,203 @@
+// Package cron parses cron expressions and finds the times that they match.
+//
+// Expressions have the standard five fields: minute, hour, day of the month,
+// month, and day of the week. Each field may be a *, a number, a range such as
+// 1-5, or a comma-separated list of them, and any of those may be followed by a
+// step such as */15. Months and days of the week may also be given by their
+// three-letter English names, and Sunday may be given as 0 or 7. As in most
+// cron implementations, a time matches if either the day of the month or the
+// day of the week matches when both are restricted. The @yearly, @monthly,
+// @weekly, @daily, and @hourly shorthands are also accepted.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shorthands are the expressions that the @ shorthands stand for.
+var shorthands = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var monthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var dayNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+// maxSearchYears bounds how far ahead Next looks for a matching time, so that
+// expressions that never match, such as February 30th, don't loop forever.
+const maxSearchYears = 5
+
+// Schedule is a parsed cron expression.
+type Schedule struct {
+	expression string
+
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+
+	// anyDay and anyWeekday are true if the day of the month or the day of
+	// the week field is *, which changes how the two are combined.
+	anyDay     bool
+	anyWeekday bool
+}
+
+// Parse parses a cron expression.
+func Parse(expression string) (*Schedule, error) {
+	fields := strings.Fields(strings.ToLower(expression))
+	if len(fields) == 1 {
+		if expanded, ok := shorthands[fields[0]]; ok {
+			fields = strings.Fields(expanded)
+		}
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields", expression)
+	}
+
+	s := &Schedule{
+		expression: expression,
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+	}
+
+	var err error
+	if s.minutes, err = parseField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("invalid minute in %q: %w", expression, err)
+	}
+	if s.hours, err = parseField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("invalid hour in %q: %w", expression, err)
+	}
+	if s.days, err = parseField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("invalid day of the month in %q: %w", expression, err)
+	}
+	if s.months, err = parseField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("invalid month in %q: %w", expression, err)
+	}
+	if s.weekdays, err = parseField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("invalid day of the week in %q: %w", expression, err)
+	}
+
+	// Sunday can be either 0 or 7.
+	if s.weekdays&(1<<7) != 0 {
+		s.weekdays |= 1
+	}
+
+	return s, nil
+}
+
+// parseValue parses a single value in a field, which may be a name.
+func parseValue(value string, names map[string]int) (int, error) {
+	if n, ok := names[value]; ok {
+		return n, nil
+	}
+	return strconv.Atoi(value)
+}
+
+// parseField returns the bit set of the values that a field matches.
+func parseField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			part = part[:i]
+		}
+
+		start, end := min, max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = parseValue(bounds[0], names); err != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+			if end, err = parseValue(bounds[1], names); err != nil {
+				return 0, fmt.Errorf("invalid range %q", part)
+			}
+		default:
+			var err error
+			if start, err = parseValue(part, names); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			end = start
+			if step > 1 {
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return 0, fmt.Errorf("%q is outside of %d-%d", part, min, max)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// String returns the expression that the schedule was parsed from.
+func (s *Schedule) String() string {
+	return s.expression
+}
+
+// dayMatches returns true if the day that t falls on matches the schedule.
+func (s *Schedule) dayMatches(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// Next returns the first time after t that matches the schedule, in t's
+// location. It returns the zero time if nothing matches within the next few
+// years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.Year() + maxSearchYears
+
+	for t.Year() <= limit {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
@@ -0,0 +1,96 @@
+// Package datausage keeps a local copy of each user's data store usage so that
+// the summary endpoints don't need to call data-usage-api while handling a
+// request.
+//
+// Once per interval, the syncer fetches the current data store usage from
+// data-usage-api for every user with a current total or a stored data usage
+// total, and stores it in the database. The usage of a single user can also be
+// refreshed as soon as a data store event reports that it changed.
+package datausage
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/periodic"
+	"github.com/guregu/null"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "datausage"})
+
+// Config contains the settings for data usage synchronization.
+type Config struct {
+	// Interval is how often data store usage is fetched for every user.
+	Interval time.Duration
+}
+
+// Syncer copies data store usage from data-usage-api into the database.
+type Syncer struct {
+	periodic.Task[*Config]
+
+	db     *db.Database
+	client *clients.DataUsageAPI
+
+	userDomain string
+}
+
+// New returns a new *Syncer.
+func New(config *Config, db *db.Database, client *clients.DataUsageAPI) *Syncer {
+	return &Syncer{
+		Task:   periodic.NewTask(config),
+		db:     db,
+		client: client,
+	}
+}
+
+// Refresh fetches and stores the data store usage for one user.
+func (s *Syncer) Refresh(context context.Context, user *db.User) error {
+	usage, err := s.client.GetUsageSummary(context, user.Username)
+	if err != nil {
+		return err
+	}
+
+	var measuredOn null.Time
+	if usage.Time != nil {
+		measuredOn = null.TimeFrom(*usage.Time)
+	}
+
+	return s.db.SetDataUsageTotal(context, user.ID, usage.Total, measuredOn)
+}
+
+// Sync refreshes the stored data store usage for every user it's kept for.
+// Failures for individual users are logged and don't stop the others from
+// being refreshed.
+func (s *Syncer) Sync(context context.Context) error {
+	log := log.WithContext(context)
+
+	users, err := s.db.DataUsageRefreshUsers(context)
+	if err != nil {
+		return err
+	}
+
+	var refreshed int
+	for i := range users {
+		if context.Err() != nil {
+			return context.Err()
+		}
+		if err = s.Refresh(context, &users[i]); err != nil {
+			log.Errorf("unable to refresh the data usage for %s: %s", users[i].Username, err)
+			continue
+		}
+		refreshed++
+	}
+	log.Debugf("refreshed the data usage for %d of %d users", refreshed, len(users))
+
+	return nil
+}
+
+// Run synchronizes data store usage once per interval until the context is
+// canceled.
+func (s *Syncer) Run(context context.Context) {
+	s.RunEvery(context, log, func(config *Config) time.Duration { return config.Interval }, s.Sync)
+}
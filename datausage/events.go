@@ -0,0 +1,69 @@
+package datausage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/transport"
+	"github.com/sirupsen/logrus"
+)
+
+// DataStoreEvent is the part of a data store event that's needed to refresh
+// the data store usage of the user it's about. Usernames without a domain are
+// qualified with the one set with SetUserDomain.
+type DataStoreEvent struct {
+	Username string `json:"username"`
+}
+
+// SetUserDomain sets the domain that's appended to the usernames in data store
+// events that don't have one.
+func (s *Syncer) SetUserDomain(domain string) {
+	s.userDomain = domain
+}
+
+// HandleEvent refreshes the data store usage of the user that a data store
+// event is about, so that the stored usage doesn't wait for the next
+// synchronization to catch up. Events for users that the service doesn't know
+// about are ignored. Its signature matches amqp.MessageHandlerFn so that it
+// can be used as the handler for an AMQP binding.
+func (s *Syncer) HandleEvent(context context.Context, routingKey string, body []byte) error {
+	var event DataStoreEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		return transport.Permanent(fmt.Errorf("unable to parse the data store event: %w", err))
+	}
+	if event.Username == "" {
+		return transport.Permanent(errors.New("the data store event has no username"))
+	}
+
+	username := event.Username
+	if s.userDomain != "" && !strings.Contains(username, "@") {
+		username = fmt.Sprintf("%s@%s", username, s.userDomain)
+	}
+
+	log := log.WithContext(context).WithFields(logrus.Fields{
+		"context":    "data store event",
+		"routingKey": routingKey,
+		"user":       username,
+	})
+
+	userID, err := s.db.UserID(context, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		log.Debug("ignoring a data store event for an unknown user")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = s.Refresh(context, &db.User{ID: userID, Username: username}); err != nil {
+		return err
+	}
+	log.Debug("refreshed the data usage after a data store event")
+
+	return nil
+}
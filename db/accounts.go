@@ -0,0 +1,401 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// The operations recorded in the account change audit log.
+const (
+	AccountRename = "rename"
+	AccountMerge  = "merge"
+)
+
+// AccountChange is an audit record for moving usage from one user to another.
+type AccountChange struct {
+	ID                string    `db:"id" json:"id"`
+	Operation         string    `db:"operation" json:"operation"`
+	FromUserID        string    `db:"from_user_id" json:"from_user_id"`
+	FromUsername      string    `db:"from_username" json:"from_username"`
+	ToUserID          string    `db:"to_user_id" json:"to_user_id"`
+	ToUsername        string    `db:"to_username" json:"to_username"`
+	PerformedBy       string    `db:"performed_by" json:"performed_by"`
+	PerformedOn       time.Time `db:"performed_on" json:"performed_on"`
+	TotalsMoved       int64     `db:"totals_moved" json:"totals_moved"`
+	TotalsMerged      int64     `db:"totals_merged" json:"totals_merged"`
+	EventsMoved       int64     `db:"events_moved" json:"events_moved"`
+	IngestedJobsMoved int64     `db:"ingested_jobs_moved" json:"ingested_jobs_moved"`
+	RecordsMoved      int64     `db:"records_moved" json:"records_moved"`
+}
+
+// UserHasTotals returns true if the user has any CPU hours totals, current or
+// otherwise.
+func (d *Database) UserHasTotals(context context.Context, userID string) (bool, error) {
+	var exists bool
+
+	const q = `
+		SELECT EXISTS (SELECT 1 FROM cpu_usage_totals WHERE user_id = $1);
+	`
+
+	err := d.db.QueryRowxContext(context, q, userID).Scan(&exists)
+	return exists, err
+}
+
+// rowsAffected executes a statement and returns the number of rows it changed.
+func (d *Database) rowsAffected(context context.Context, q string, args ...interface{}) (int64, error) {
+	result, err := d.db.ExecContext(context, q, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// MoveUserEvents reassigns all of the usage events, and therefore the work
+// items, created for one user to another. Returns the number of events moved.
+func (d *Database) MoveUserEvents(context context.Context, fromUserID, toUserID string) (int64, error) {
+	const q = `
+		UPDATE cpu_usage_events
+		SET created_by = $2
+		WHERE created_by = $1;
+	`
+	return d.rowsAffected(context, q, fromUserID, toUserID)
+}
+
+// MoveUserTotals reassigns all of one user's CPU hours totals to another.
+// Returns the number of totals moved.
+func (d *Database) MoveUserTotals(context context.Context, fromUserID, toUserID string) (int64, error) {
+	const q = `
+		UPDATE cpu_usage_totals
+		SET user_id = $2
+		WHERE user_id = $1;
+	`
+	return d.rowsAffected(context, q, fromUserID, toUserID)
+}
+
+// MoveSlurmIngestedJobs reassigns the Slurm jobs ingested for one user to
+// another. Returns the number of jobs moved.
+func (d *Database) MoveSlurmIngestedJobs(context context.Context, fromUserID, toUserID string) (int64, error) {
+	const q = `
+		UPDATE slurm_ingested_jobs
+		SET user_id = $2
+		WHERE user_id = $1;
+	`
+	return d.rowsAffected(context, q, fromUserID, toUserID)
+}
+
+// userRecordMoves are the statements that move the records kept for the user
+// $1 to the user $2, other than the events, totals, ingested Slurm jobs and
+// usage messages, which are moved separately. Records that a user can only
+// have one of are kept from the destination user where both users have one,
+// except for overdrafts, which are added together.
+var userRecordMoves = []string{
+	`WITH moved AS (
+		DELETE FROM cpu_usage_frozen_users WHERE user_id = $1
+		RETURNING frozen_by, frozen_on, reason
+	)
+	INSERT INTO cpu_usage_frozen_users (user_id, frozen_by, frozen_on, reason)
+	SELECT $2, frozen_by, frozen_on, reason FROM moved
+	ON CONFLICT (user_id) DO NOTHING;`,
+
+	`UPDATE cpu_usage_parked_records SET user_id = $2 WHERE user_id = $1;`,
+
+	`WITH moved AS (
+		DELETE FROM cpu_usage_overdrafts WHERE user_id = $1
+		RETURNING resource_type, period_start, overdraft
+	)
+	INSERT INTO cpu_usage_overdrafts (user_id, resource_type, period_start, overdraft)
+	SELECT $2, resource_type, period_start, overdraft FROM moved
+	ON CONFLICT (user_id, resource_type, period_start) DO UPDATE
+	SET overdraft = cpu_usage_overdrafts.overdraft + EXCLUDED.overdraft,
+		last_modified = CURRENT_TIMESTAMP;`,
+
+	`WITH dropped AS (
+		DELETE FROM cpu_usage_anomalies f
+		WHERE f.user_id = $1
+		AND EXISTS (SELECT 1 FROM cpu_usage_anomalies t WHERE t.user_id = $2 AND t.day = f.day)
+		RETURNING f.id
+	)
+	UPDATE cpu_usage_anomalies
+	SET user_id = $2
+	WHERE user_id = $1
+	AND id NOT IN (SELECT id FROM dropped);`,
+
+	`WITH moved AS (
+		DELETE FROM data_usage_totals WHERE user_id = $1
+		RETURNING total, measured_on, refreshed_on
+	)
+	INSERT INTO data_usage_totals (user_id, total, measured_on, refreshed_on)
+	SELECT $2, total, measured_on, refreshed_on FROM moved
+	ON CONFLICT (user_id) DO NOTHING;`,
+
+	`WITH moved AS (
+		DELETE FROM qms_usage_drift WHERE user_id = $1
+		RETURNING resource_type, local_total, qms_total, difference, detected_on, checked_on
+	)
+	INSERT INTO qms_usage_drift (user_id, resource_type, local_total, qms_total, difference, detected_on, checked_on)
+	SELECT $2, resource_type, local_total, qms_total, difference, detected_on, checked_on FROM moved
+	ON CONFLICT (user_id, resource_type) DO NOTHING;`,
+
+	`UPDATE usage_publish_retries SET user_id = $2 WHERE user_id = $1;`,
+
+	`WITH moved AS (
+		DELETE FROM usage_digest_preferences WHERE user_id = $1
+		RETURNING opted_out, locale, modified_on
+	)
+	INSERT INTO usage_digest_preferences (user_id, opted_out, locale, modified_on)
+	SELECT $2, opted_out, locale, modified_on FROM moved
+	ON CONFLICT (user_id) DO NOTHING;`,
+
+	`WITH moved AS (
+		DELETE FROM usage_digests WHERE user_id = $1
+		RETURNING week, hours, sent_on
+	)
+	INSERT INTO usage_digests (user_id, week, hours, sent_on)
+	SELECT $2, week, hours, sent_on FROM moved
+	ON CONFLICT (user_id, week) DO NOTHING;`,
+
+	`UPDATE cpu_usage_supplements SET user_id = $2 WHERE user_id = $1;`,
+
+	`UPDATE cpu_usage_holds SET user_id = $2 WHERE user_id = $1;`,
+
+	`WITH moved AS (
+		DELETE FROM qms_quotas WHERE user_id = $1
+		RETURNING resource_type, quota, usage, plan_name, effective_start, effective_end, fetched_on
+	)
+	INSERT INTO qms_quotas (user_id, resource_type, quota, usage, plan_name, effective_start, effective_end, fetched_on)
+	SELECT $2, resource_type, quota, usage, plan_name, effective_start, effective_end, fetched_on FROM moved
+	ON CONFLICT (user_id, resource_type) DO NOTHING;`,
+
+	`WITH moved AS (
+		DELETE FROM cpu_usage_reset_schedules WHERE user_id = $1
+		RETURNING expression, next_run, last_run, scheduled_by, scheduled_on
+	)
+	INSERT INTO cpu_usage_reset_schedules (user_id, expression, next_run, last_run, scheduled_by, scheduled_on)
+	SELECT $2, expression, next_run, last_run, scheduled_by, scheduled_on FROM moved
+	ON CONFLICT (user_id) DO NOTHING;`,
+
+	`WITH moved AS (
+		DELETE FROM backfill_checkpoints WHERE user_id = $1
+		RETURNING range_start, range_end, last_end_date, last_analysis_id, processed, started_on, updated_on, completed_on
+	)
+	INSERT INTO backfill_checkpoints
+		(user_id, range_start, range_end, last_end_date, last_analysis_id, processed, started_on, updated_on, completed_on)
+	SELECT $2, range_start, range_end, last_end_date, last_analysis_id, processed, started_on, updated_on, completed_on
+	FROM moved
+	ON CONFLICT (user_id, range_start, range_end) DO NOTHING;`,
+
+	`UPDATE qms_sent_usage SET user_id = $2 WHERE user_id = $1;`,
+}
+
+// MoveUserRecords moves the records kept for one user to another, other than
+// their events, totals and ingested Slurm jobs: freezes and parked usage,
+// overdrafts, anomalies, data usage, drift, publish retries, digests and their
+// preferences, supplements, holds, quotas, reset schedules, backfill
+// checkpoints, the usage sent to QMS, and queued usage messages. Returns the
+// number of records moved.
+func (d *Database) MoveUserRecords(context context.Context, fromUserID, toUserID string) (int64, error) {
+	var moved int64
+	for _, q := range userRecordMoves {
+		count, err := d.rowsAffected(context, q, fromUserID, toUserID)
+		if err != nil {
+			return moved, err
+		}
+		moved += count
+	}
+
+	count, err := d.moveUsageMessages(context, fromUserID, toUserID)
+	if err != nil {
+		return moved, err
+	}
+	return moved + count, nil
+}
+
+// moveUsageMessages moves the usage messages still queued for one user to
+// another. The messages are given the destination user's next sequence
+// numbers, in the order they were queued, so that the destination user's
+// sequence stays free of gaps and duplicates. The source user's sequences are
+// removed. Returns the number of messages moved.
+func (d *Database) moveUsageMessages(context context.Context, fromUserID, toUserID string) (int64, error) {
+	const moveQuery = `
+		WITH base AS (
+			SELECT resource_type, sequence
+			FROM usage_message_sequences
+			WHERE user_id = $2
+		),
+		moved AS (
+			SELECT
+				m.id,
+				COALESCE(b.sequence, 0) + row_number() OVER (PARTITION BY m.resource_type ORDER BY m.sequence) sequence
+			FROM usage_message_outbox m
+			LEFT JOIN base b ON b.resource_type = m.resource_type
+			WHERE m.user_id = $1
+		)
+		UPDATE usage_message_outbox o
+		SET user_id = $2,
+			sequence = moved.sequence
+		FROM moved
+		WHERE o.id = moved.id;
+	`
+	moved, err := d.rowsAffected(context, moveQuery, fromUserID, toUserID)
+	if err != nil {
+		return 0, err
+	}
+
+	const sequenceQuery = `
+		INSERT INTO usage_message_sequences (user_id, resource_type, sequence)
+		SELECT user_id, resource_type, max(sequence)
+		FROM usage_message_outbox
+		WHERE user_id = $1
+		GROUP BY user_id, resource_type
+		ON CONFLICT (user_id, resource_type) DO UPDATE
+		SET sequence = GREATEST(usage_message_sequences.sequence, EXCLUDED.sequence);
+	`
+	if _, err = d.db.ExecContext(context, sequenceQuery, toUserID); err != nil {
+		return 0, err
+	}
+
+	const deleteQuery = `
+		DELETE FROM usage_message_sequences WHERE user_id = $1;
+	`
+	if _, err = d.db.ExecContext(context, deleteQuery, fromUserID); err != nil {
+		return 0, err
+	}
+
+	return moved, nil
+}
+
+// MergeCurrentTotals adds one user's current totals to another's. Where the
+// destination user has a current total for the same resource type and
+// allocation source, the source total is added to it and the source total is
+// set to zero. Source totals without a match are moved to the destination
+// user. Returns the number of totals merged and moved. Historical totals are
+// left in place because their effective periods can overlap.
+func (d *Database) MergeCurrentTotals(context context.Context, fromUserID, toUserID string) (int64, int64, error) {
+	const addQuery = `
+		UPDATE cpu_usage_totals t
+		SET total = t.total + f.total,
+			last_modified = CURRENT_TIMESTAMP
+		FROM cpu_usage_totals f
+		WHERE f.user_id = $1
+		AND t.user_id = $2
+		AND f.resource_type = t.resource_type
+		AND f.allocation_source = t.allocation_source
+		AND f.effective_range @> CURRENT_TIMESTAMP::timestamp
+		AND t.effective_range @> CURRENT_TIMESTAMP::timestamp;
+	`
+	merged, err := d.rowsAffected(context, addQuery, fromUserID, toUserID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	const zeroQuery = `
+		UPDATE cpu_usage_totals f
+		SET total = 0,
+			last_modified = CURRENT_TIMESTAMP
+		WHERE f.user_id = $1
+		AND f.effective_range @> CURRENT_TIMESTAMP::timestamp
+		AND EXISTS (
+			SELECT 1 FROM cpu_usage_totals t
+			WHERE t.user_id = $2
+			AND t.resource_type = f.resource_type
+			AND t.allocation_source = f.allocation_source
+			AND t.effective_range @> CURRENT_TIMESTAMP::timestamp
+		);
+	`
+	if _, err = d.rowsAffected(context, zeroQuery, fromUserID, toUserID); err != nil {
+		return 0, 0, err
+	}
+
+	const moveQuery = `
+		UPDATE cpu_usage_totals f
+		SET user_id = $2
+		WHERE f.user_id = $1
+		AND f.effective_range @> CURRENT_TIMESTAMP::timestamp
+		AND NOT EXISTS (
+			SELECT 1 FROM cpu_usage_totals t
+			WHERE t.user_id = $2
+			AND t.resource_type = f.resource_type
+			AND t.allocation_source = f.allocation_source
+			AND t.effective_range @> CURRENT_TIMESTAMP::timestamp
+		);
+	`
+	moved, err := d.rowsAffected(context, moveQuery, fromUserID, toUserID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return merged, moved, nil
+}
+
+// AddAccountChange records an account change in the audit log, filling in its
+// ID and timestamp.
+func (d *Database) AddAccountChange(context context.Context, change *AccountChange) error {
+	const q = `
+		INSERT INTO cpu_usage_account_changes
+			(operation, from_user_id, to_user_id, performed_by, totals_moved, totals_merged, events_moved, ingested_jobs_moved, records_moved)
+		VALUES
+			($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, performed_on;
+	`
+	return d.db.QueryRowxContext(
+		context,
+		q,
+		change.Operation,
+		change.FromUserID,
+		change.ToUserID,
+		change.PerformedBy,
+		change.TotalsMoved,
+		change.TotalsMerged,
+		change.EventsMoved,
+		change.IngestedJobsMoved,
+		change.RecordsMoved,
+	).Scan(&change.ID, &change.PerformedOn)
+}
+
+// AccountChanges returns a page of the account change audit log, most recent
+// first.
+func (d *Database) AccountChanges(context context.Context, limit, offset int) ([]AccountChange, error) {
+	var changes []AccountChange
+
+	const q = `
+		SELECT
+			c.id,
+			c.operation,
+			c.from_user_id,
+			f.username AS from_username,
+			c.to_user_id,
+			t.username AS to_username,
+			c.performed_by,
+			c.performed_on,
+			c.totals_moved,
+			c.totals_merged,
+			c.events_moved,
+			c.ingested_jobs_moved,
+			c.records_moved
+		FROM cpu_usage_account_changes c
+		JOIN users f ON c.from_user_id = f.id
+		JOIN users t ON c.to_user_id = t.id
+		ORDER BY c.performed_on DESC, c.id
+		LIMIT $1 OFFSET $2;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var change AccountChange
+		if err = rows.StructScan(&change); err != nil {
+			return changes, err
+		}
+		changes = append(changes, change)
+	}
+
+	if err = rows.Err(); err != nil {
+		return changes, err
+	}
+
+	return changes, nil
+}
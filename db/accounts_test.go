@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMoveUserRecords(t *testing.T) {
+	tx := testTx(t)
+	ctx := context.Background()
+	d := New(tx)
+
+	fromID := testUser(t, tx, "move-from-test")
+	toID := testUser(t, tx, "move-to-test")
+
+	if _, err := d.FreezeUser(ctx, fromID, "test", "testing"); err != nil {
+		t.Fatal(err)
+	}
+
+	const overdraft = `
+		INSERT INTO cpu_usage_overdrafts (user_id, resource_type, period_start, overdraft)
+		VALUES ($1, 'cpu.hours', '2026-01-01', $2);
+	`
+	if _, err := tx.Exec(overdraft, fromID, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(overdraft, toID, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	effectiveDate := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, username := range []string{"move-to-test", "move-from-test", "move-from-test"} {
+		message := &QueuedUsageMessage{
+			Type:          "delta",
+			Username:      username,
+			ResourceType:  "cpu.hours",
+			Unit:          "cpu hours",
+			EffectiveDate: effectiveDate,
+		}
+		message.Value.SetInt64(1)
+		if err := d.QueueUsageMessage(ctx, message); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	moved, err := d.MoveUserRecords(ctx, fromID, toID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 4 {
+		t.Errorf("expected 4 records to be moved, got %d", moved)
+	}
+
+	if frozen, err := d.UserFrozen(ctx, "move-to-test"); err != nil || !frozen {
+		t.Errorf("expected the destination user to be frozen: %v, %v", frozen, err)
+	}
+	if frozen, err := d.UserFrozen(ctx, "move-from-test"); err != nil || frozen {
+		t.Errorf("expected the source user not to be frozen: %v, %v", frozen, err)
+	}
+
+	var total int64
+	if err = tx.Get(&total, `SELECT overdraft FROM cpu_usage_overdrafts WHERE user_id = $1`, toID); err != nil {
+		t.Fatal(err)
+	}
+	if total != 5 {
+		t.Errorf("expected the overdrafts to be added together, got %d", total)
+	}
+
+	var sequences []int64
+	if err = tx.Select(&sequences, `SELECT sequence FROM usage_message_outbox WHERE user_id = $1 ORDER BY sequence`, toID); err != nil {
+		t.Fatal(err)
+	}
+	if len(sequences) != 3 || sequences[0] != 1 || sequences[1] != 2 || sequences[2] != 3 {
+		t.Errorf("expected the messages to be numbered 1 to 3, got %v", sequences)
+	}
+
+	var next int64
+	if err = tx.Get(&next, `SELECT sequence FROM usage_message_sequences WHERE user_id = $1`, toID); err != nil {
+		t.Fatal(err)
+	}
+	if next != 3 {
+		t.Errorf("expected the destination sequence to be 3, got %d", next)
+	}
+
+	var remaining int
+	if err = tx.Get(&remaining, `SELECT count(*) FROM usage_message_sequences WHERE user_id = $1`, fromID); err != nil {
+		t.Fatal(err)
+	}
+	if remaining != 0 {
+		t.Errorf("expected the source sequences to be removed, got %d", remaining)
+	}
+}
@@ -2,9 +2,12 @@ package db
 
 import (
 	"context"
+	"fmt"
 	"time"
 
+	"github.com/cockroachdb/apd"
 	"github.com/guregu/null"
+	"github.com/lib/pq"
 )
 
 type Analysis struct {
@@ -133,3 +136,299 @@ func (d *Database) AdminAllCalculableAnalyses(context context.Context, userID st
 
 	return analyses, nil
 }
+
+// AppReservation is the typical reservation of an app's analyses: the average
+// millicores reserved and the average run time in hours of the ones that have
+// ended. Analyses is the number of analyses that the averages are taken over.
+type AppReservation struct {
+	Analyses           int64   `db:"analyses"`
+	MillicoresReserved float64 `db:"millicores_reserved"`
+	RuntimeHours       float64 `db:"runtime_hours"`
+}
+
+// AppReservation returns the typical reservation of the app's analyses.
+// Analyses is zero if none of them have ended.
+func (d *Database) AppReservation(context context.Context, appID string) (*AppReservation, error) {
+	var reservation AppReservation
+
+	const q = `
+		SELECT
+			count(*) analyses,
+			COALESCE(avg(j.millicores_reserved), 0) millicores_reserved,
+			COALESCE(avg(EXTRACT(EPOCH FROM (j.end_date - j.start_date)) / 3600), 0) runtime_hours
+		FROM jobs j
+		WHERE j.app_id = $1
+		AND j.millicores_reserved != 0
+		AND j.start_date IS NOT NULL
+		AND j.end_date IS NOT NULL;
+	`
+
+	err := d.db.QueryRowxContext(context, q, appID).StructScan(&reservation)
+	return &reservation, err
+}
+
+// ExternalIDs returns the external IDs of all of the steps of an analysis.
+func (d *Database) ExternalIDs(context context.Context, analysisID string) ([]string, error) {
+	var externalIDs []string
+	const q = `
+		SELECT s.external_id
+		FROM job_steps s
+		WHERE s.job_id = $1
+		AND s.external_id IS NOT NULL
+		ORDER BY s.step_number;
+	`
+	rows, err := d.db.QueryxContext(context, q, analysisID)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var externalID string
+		if err = rows.Scan(&externalID); err != nil {
+			return nil, err
+		}
+		externalIDs = append(externalIDs, externalID)
+	}
+
+	if err = rows.Err(); err != nil {
+		return externalIDs, err
+	}
+
+	return externalIDs, nil
+}
+
+// AnalysisUsage is a completed analysis along with the CPU hours it reserved.
+type AnalysisUsage struct {
+	ID                 string      `db:"id" json:"id"`
+	Name               string      `db:"name" json:"name"`
+	AppID              string      `db:"app_id" json:"app_id"`
+	AppName            string      `db:"app_name" json:"app_name"`
+	JobType            string      `db:"job_type" json:"job_type"`
+	Status             string      `db:"status" json:"status"`
+	StartDate          time.Time   `db:"start_date" json:"start_date"`
+	EndDate            time.Time   `db:"end_date" json:"end_date"`
+	MillicoresReserved int64       `db:"millicores_reserved" json:"millicores_reserved"`
+	Hours              apd.Decimal `db:"hours" json:"hours"`
+	Cluster            string      `db:"cluster" json:"cluster"`
+}
+
+// The orderings supported by UserAnalysisUsage.
+const (
+	AnalysisUsageByEndDate = "end_date"
+	AnalysisUsageByHours   = "hours"
+)
+
+var analysisUsageOrderings = map[string]string{
+	AnalysisUsageByEndDate: "j.end_date DESC, j.id",
+	AnalysisUsageByHours:   "hours DESC, j.end_date DESC, j.id",
+}
+
+// UserAnalysisUsage returns a page of the user's completed analyses that
+// reserved CPUs and ended in the period, with the CPU hours each one reserved.
+// Unset bounds leave that end of the period open. The sort order must be one
+// of the AnalysisUsageBy constants; both sort in descending order. The cluster
+// that an analysis ran on is the system ID of its job type, and only the
+// analyses that ran on the cluster are returned if it isn't empty.
+func (d *Database) UserAnalysisUsage(
+	context context.Context,
+	userID string,
+	from, to null.Time,
+	cluster, sort string,
+	limit, offset int,
+) ([]AnalysisUsage, error) {
+	var analyses []AnalysisUsage
+
+	ordering, ok := analysisUsageOrderings[sort]
+	if !ok {
+		return nil, fmt.Errorf("unsupported analysis usage ordering: %s", sort)
+	}
+
+	q := fmt.Sprintf(`
+		SELECT
+			j.id,
+			j.job_name name,
+			j.app_id,
+			j.app_name,
+			t.name job_type,
+			j.status,
+			j.start_date,
+			j.end_date,
+			j.millicores_reserved,
+			(EXTRACT(EPOCH FROM (j.end_date - j.start_date)) / 3600.0)
+				* j.millicores_reserved / 1000.0 hours,
+			t.system_id cluster
+		FROM jobs j
+		JOIN job_types t ON j.job_type_id = t.id
+		WHERE j.user_id = $1
+		AND j.millicores_reserved != 0
+		AND j.start_date IS NOT NULL
+		AND j.end_date IS NOT NULL
+		AND ($2::timestamp IS NULL OR j.end_date >= $2::timestamp)
+		AND ($3::timestamp IS NULL OR j.end_date < $3::timestamp)
+		AND ($6 = '' OR t.system_id = $6)
+		ORDER BY %s
+		LIMIT $4
+		OFFSET $5;
+	`, ordering)
+
+	rows, err := d.db.QueryxContext(context, q, userID, from, to, limit, offset, cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var analysis AnalysisUsage
+		if err = rows.StructScan(&analysis); err != nil {
+			return analyses, err
+		}
+		analyses = append(analyses, analysis)
+	}
+
+	if err = rows.Err(); err != nil {
+		return analyses, err
+	}
+
+	return analyses, nil
+}
+
+// SimulatedAnalysis is a completed analysis along with its owner's username
+// and the CPU hours that were last calculated for it. Charged is nil if no
+// calculation was recorded.
+type SimulatedAnalysis struct {
+	Analysis
+	Username string       `db:"username"`
+	Charged  *apd.Decimal `db:"charged"`
+}
+
+// SimulationAnalyses returns up to limit completed analyses that reserved CPUs
+// and ended at or after start and before end, ordered by username and end
+// date. Only the analyses of the named users are returned if usernames isn't
+// empty.
+func (d *Database) SimulationAnalyses(context context.Context, start, end time.Time, usernames []string, limit int) ([]SimulatedAnalysis, error) {
+	var analyses []SimulatedAnalysis
+
+	const q = `
+		SELECT
+			j.id,
+			j.app_id,
+			j.start_date,
+			j.end_date,
+			j.status,
+			j.deleted,
+			j.submission,
+			j.user_id,
+			j.subdomain,
+			t.name job_type,
+			t.system_id,
+			u.username,
+			(
+				SELECT p.value
+				FROM cpu_calculation_provenance p
+				WHERE p.analysis_id = j.id
+				AND p.resource_type = $3
+				ORDER BY p.calculated_on DESC
+				LIMIT 1
+			) charged
+		FROM jobs j
+		JOIN job_types t ON j.job_type_id = t.id
+		JOIN users u ON j.user_id = u.id
+		WHERE j.millicores_reserved != 0
+		AND j.start_date IS NOT NULL
+		AND j.end_date IS NOT NULL
+		AND j.end_date >= $1::timestamp
+		AND j.end_date < $2::timestamp
+		AND (cardinality($4::text[]) = 0 OR u.username = ANY($4::text[]))
+		ORDER BY u.username, j.end_date, j.id
+		LIMIT $5;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, start, end, DefaultResourceType, pq.Array(usernames), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var analysis SimulatedAnalysis
+		if err = rows.StructScan(&analysis); err != nil {
+			return analyses, err
+		}
+		analyses = append(analyses, analysis)
+	}
+
+	if err = rows.Err(); err != nil {
+		return analyses, err
+	}
+
+	return analyses, nil
+}
+
+// AnalysisHours is the CPU hours that an analysis reserved, along with the CPU
+// hours that were last charged for it. Hours is nil if the analysis hasn't
+// both started and ended, and Charged is nil if no calculation was recorded.
+type AnalysisHours struct {
+	ID                 string       `db:"id" json:"id"`
+	Username           string       `db:"username" json:"username"`
+	Status             string       `db:"status" json:"status"`
+	StartDate          null.Time    `db:"start_date" json:"start_date"`
+	EndDate            null.Time    `db:"end_date" json:"end_date"`
+	MillicoresReserved int64        `db:"millicores_reserved" json:"millicores_reserved"`
+	Hours              *apd.Decimal `db:"hours" json:"hours"`
+	Charged            *apd.Decimal `db:"charged" json:"charged"`
+	Cluster            string       `db:"cluster" json:"cluster"`
+}
+
+// AnalysisHoursByID returns the CPU hours of the analyses with the given IDs.
+// Analyses that don't exist are left out, so the result may be shorter than
+// the list of IDs.
+func (d *Database) AnalysisHoursByID(context context.Context, ids []string) ([]AnalysisHours, error) {
+	var analyses []AnalysisHours
+
+	const q = `
+		SELECT
+			j.id,
+			u.username,
+			j.status,
+			j.start_date,
+			j.end_date,
+			j.millicores_reserved,
+			CASE WHEN j.start_date IS NOT NULL AND j.end_date IS NOT NULL THEN
+				(EXTRACT(EPOCH FROM (j.end_date - j.start_date)) / 3600.0)
+					* j.millicores_reserved / 1000.0
+			END hours,
+			(
+				SELECT p.value
+				FROM cpu_calculation_provenance p
+				WHERE p.analysis_id = j.id
+				AND p.resource_type = $2
+				ORDER BY p.calculated_on DESC
+				LIMIT 1
+			) charged,
+			t.system_id cluster
+		FROM jobs j
+		JOIN job_types t ON j.job_type_id = t.id
+		JOIN users u ON j.user_id = u.id
+		WHERE j.id = ANY($1::uuid[]);
+	`
+
+	rows, err := d.db.QueryxContext(context, q, pq.Array(ids), DefaultResourceType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var analysis AnalysisHours
+		if err = rows.StructScan(&analysis); err != nil {
+			return analyses, err
+		}
+		analyses = append(analyses, analysis)
+	}
+
+	if err = rows.Err(); err != nil {
+		return analyses, err
+	}
+
+	return analyses, nil
+}
@@ -0,0 +1,217 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/guregu/null"
+)
+
+// FlatUsageRow is a fully denormalized record of the CPU hours consumed by
+// a single analysis, intended for ingestion by BI tools.
+type FlatUsageRow struct {
+	AnalysisID  string      `db:"analysis_id" json:"analysis_id"`
+	Username    string      `db:"username" json:"username"`
+	AppID       string      `db:"app_id" json:"app_id"`
+	AppName     string      `db:"app_name" json:"app_name"`
+	JobType     string      `db:"job_type" json:"job_type"`
+	StartDate   time.Time   `db:"start_date" json:"start_date"`
+	EndDate     time.Time   `db:"end_date" json:"end_date"`
+	Millicores  int64       `db:"millicores_reserved" json:"millicores_reserved"`
+	Hours       apd.Decimal `db:"hours" json:"hours"`
+	PeriodStart null.Time   `db:"period_start" json:"period_start"`
+	PeriodEnd   null.Time   `db:"period_end" json:"period_end"`
+	Cluster     string      `db:"cluster" json:"cluster"`
+}
+
+// AdminFlatUsage returns a page of denormalized usage rows for all completed
+// analyses that reserved CPU, ordered by end date. The period columns are
+// taken from the user's CPU usage total that was effective when the analysis
+// ended for the default resource type and allocation source, and are null if
+// no such total exists. Only the analyses that ran on the cluster, which is the
+// system ID of the job type, are returned if it isn't empty.
+func (d *Database) AdminFlatUsage(context context.Context, cluster string, limit, offset int) ([]FlatUsageRow, error) {
+	var rows []FlatUsageRow
+
+	const q = `
+		SELECT
+			j.id analysis_id,
+			u.username,
+			j.app_id,
+			j.app_name,
+			t.name job_type,
+			j.start_date,
+			j.end_date,
+			j.millicores_reserved,
+			(EXTRACT(EPOCH FROM (j.end_date - j.start_date)) / 3600.0)
+				* j.millicores_reserved / 1000.0 hours,
+			lower(c.effective_range) period_start,
+			upper(c.effective_range) period_end,
+			t.system_id cluster
+		FROM jobs j
+		JOIN users u ON j.user_id = u.id
+		JOIN job_types t ON j.job_type_id = t.id
+		LEFT JOIN cpu_usage_totals c
+			ON c.user_id = j.user_id
+			AND c.resource_type = $3
+			AND c.allocation_source = $4
+			AND c.effective_range @> j.end_date::timestamp
+		WHERE j.millicores_reserved != 0
+		AND j.start_date IS NOT NULL
+		AND j.end_date IS NOT NULL
+		AND ($5 = '' OR t.system_id = $5)
+		ORDER BY j.end_date, j.id
+		LIMIT $1
+		OFFSET $2;
+	`
+
+	dbRows, err := d.db.QueryxContext(context, q, limit, offset, DefaultResourceType, DefaultAllocationSource, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	for dbRows.Next() {
+		var r FlatUsageRow
+		if err = dbRows.StructScan(&r); err != nil {
+			return nil, err
+		}
+		rows = append(rows, r)
+	}
+
+	if err = dbRows.Err(); err != nil {
+		return rows, err
+	}
+
+	return rows, nil
+}
+
+// ResearchUsageRow is a record of the CPU hours consumed by a single analysis
+// for the anonymized research export. AppUsers is the number of distinct users
+// who ran the app in the whole export, which is used to suppress rarely used
+// apps that could identify their users.
+type ResearchUsageRow struct {
+	Username   string      `db:"username"`
+	AppID      string      `db:"app_id"`
+	AppName    string      `db:"app_name"`
+	JobType    string      `db:"job_type"`
+	StartDate  time.Time   `db:"start_date"`
+	EndDate    time.Time   `db:"end_date"`
+	Millicores int64       `db:"millicores_reserved"`
+	Hours      apd.Decimal `db:"hours"`
+	Cluster    string      `db:"cluster"`
+	AppUsers   int64       `db:"app_users"`
+}
+
+// AdminResearchUsage returns a page of usage rows for the anonymized research
+// export, covering the same analyses in the same order as AdminFlatUsage.
+func (d *Database) AdminResearchUsage(context context.Context, cluster string, limit, offset int) ([]ResearchUsageRow, error) {
+	var rows []ResearchUsageRow
+
+	const q = `
+		WITH app_users AS (
+			SELECT
+				j.app_id,
+				count(DISTINCT j.user_id) users
+			FROM jobs j
+			JOIN job_types t ON j.job_type_id = t.id
+			WHERE j.millicores_reserved != 0
+			AND j.start_date IS NOT NULL
+			AND j.end_date IS NOT NULL
+			AND ($3 = '' OR t.system_id = $3)
+			GROUP BY j.app_id
+		)
+		SELECT
+			u.username,
+			j.app_id,
+			j.app_name,
+			t.name job_type,
+			j.start_date,
+			j.end_date,
+			j.millicores_reserved,
+			(EXTRACT(EPOCH FROM (j.end_date - j.start_date)) / 3600.0)
+				* j.millicores_reserved / 1000.0 hours,
+			t.system_id cluster,
+			a.users app_users
+		FROM jobs j
+		JOIN users u ON j.user_id = u.id
+		JOIN job_types t ON j.job_type_id = t.id
+		JOIN app_users a ON j.app_id = a.app_id
+		WHERE j.millicores_reserved != 0
+		AND j.start_date IS NOT NULL
+		AND j.end_date IS NOT NULL
+		AND ($3 = '' OR t.system_id = $3)
+		ORDER BY j.end_date, j.id
+		LIMIT $1
+		OFFSET $2;
+	`
+
+	dbRows, err := d.db.QueryxContext(context, q, limit, offset, cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer dbRows.Close()
+
+	for dbRows.Next() {
+		var r ResearchUsageRow
+		if err = dbRows.StructScan(&r); err != nil {
+			return nil, err
+		}
+		rows = append(rows, r)
+	}
+
+	if err = dbRows.Err(); err != nil {
+		return rows, err
+	}
+
+	return rows, nil
+}
+
+// UsageStats summarizes the current totals of every user for a resource type
+// and allocation source. Active users are the ones whose current total is
+// greater than zero, and the percentiles are taken over their totals. The
+// percentiles are null if there are no active users.
+type UsageStats struct {
+	Total       float64    `db:"total" json:"total"`
+	Users       int64      `db:"users" json:"users"`
+	ActiveUsers int64      `db:"active_users" json:"active_users"`
+	Mean        null.Float `db:"mean" json:"mean"`
+	P25         null.Float `db:"p25" json:"p25"`
+	Median      null.Float `db:"median" json:"median"`
+	P75         null.Float `db:"p75" json:"p75"`
+	P90         null.Float `db:"p90" json:"p90"`
+	P95         null.Float `db:"p95" json:"p95"`
+	P99         null.Float `db:"p99" json:"p99"`
+	Max         null.Float `db:"max" json:"max"`
+}
+
+// AdminCurrentUsageStats returns aggregate statistics over every user's
+// current total for the resource type and allocation source.
+func (d *Database) AdminCurrentUsageStats(context context.Context, resourceType, allocationSource string) (*UsageStats, error) {
+	var stats UsageStats
+
+	const q = `
+		SELECT
+			COALESCE(sum(t.total), 0)::float8 total,
+			count(*) users,
+			count(*) FILTER (WHERE t.total > 0) active_users,
+			(avg(t.total) FILTER (WHERE t.total > 0))::float8 mean,
+			percentile_cont(0.25) WITHIN GROUP (ORDER BY t.total) FILTER (WHERE t.total > 0) p25,
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY t.total) FILTER (WHERE t.total > 0) median,
+			percentile_cont(0.75) WITHIN GROUP (ORDER BY t.total) FILTER (WHERE t.total > 0) p75,
+			percentile_cont(0.9) WITHIN GROUP (ORDER BY t.total) FILTER (WHERE t.total > 0) p90,
+			percentile_cont(0.95) WITHIN GROUP (ORDER BY t.total) FILTER (WHERE t.total > 0) p95,
+			percentile_cont(0.99) WITHIN GROUP (ORDER BY t.total) FILTER (WHERE t.total > 0) p99,
+			(max(t.total) FILTER (WHERE t.total > 0))::float8 max
+		FROM cpu_usage_totals t
+		WHERE t.resource_type = $1
+		AND t.allocation_source = $2
+		AND t.effective_range @> CURRENT_TIMESTAMP::timestamp;
+	`
+
+	if err := d.db.QueryRowxContext(context, q, resourceType, allocationSource).StructScan(&stats); err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+)
+
+// DailyUsage is the reserved CPU hours a user accrued on a day compared with
+// their average daily accrual over the preceding baseline period.
+type DailyUsage struct {
+	UserID   string      `db:"user_id" json:"user_id"`
+	Username string      `db:"username" json:"username"`
+	Usage    apd.Decimal `db:"usage" json:"usage"`
+	Baseline apd.Decimal `db:"baseline" json:"baseline"`
+}
+
+// Anomaly is a day on which a user's accrual was unusually high.
+type Anomaly struct {
+	ID         string      `db:"id" json:"id"`
+	UserID     string      `db:"user_id" json:"user_id"`
+	Username   string      `db:"username" json:"username"`
+	Day        time.Time   `db:"day" json:"day"`
+	Usage      apd.Decimal `db:"usage" json:"usage"`
+	Baseline   apd.Decimal `db:"baseline" json:"baseline"`
+	DetectedOn time.Time   `db:"detected_on" json:"detected_on"`
+}
+
+// DailyUsageWithBaselines returns the reserved CPU hours accrued on the UTC day
+// beginning at day by each user who ran analyses that ended on it, along with
+// their average daily accrual over the baselineDays days before it. Analyses
+// are attributed to the day that they ended.
+func (d *Database) DailyUsageWithBaselines(context context.Context, day time.Time, baselineDays int) ([]DailyUsage, error) {
+	var usages []DailyUsage
+
+	const q = `
+		WITH daily AS (
+			SELECT
+				j.user_id,
+				date_trunc('day', j.end_date) AS day,
+				SUM(j.millicores_reserved / 1000.0 * EXTRACT(EPOCH FROM (j.end_date - j.start_date)) / 3600) AS usage
+			FROM jobs j
+			WHERE j.millicores_reserved != 0
+			AND j.start_date IS NOT NULL
+			AND j.end_date IS NOT NULL
+			AND j.end_date >= $1::timestamp - $2::integer * interval '1 day'
+			AND j.end_date < $1::timestamp + interval '1 day'
+			GROUP BY j.user_id, date_trunc('day', j.end_date)
+		)
+		SELECT
+			d.user_id,
+			u.username,
+			d.usage,
+			COALESCE(b.total, 0) / $2 AS baseline
+		FROM daily d
+		JOIN users u ON d.user_id = u.id
+		LEFT JOIN (
+			SELECT user_id, SUM(usage) AS total
+			FROM daily
+			WHERE day < $1::timestamp
+			GROUP BY user_id
+		) b ON b.user_id = d.user_id
+		WHERE d.day = $1::timestamp;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, day, baselineDays)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var usage DailyUsage
+		if err = rows.StructScan(&usage); err != nil {
+			return usages, err
+		}
+		usages = append(usages, usage)
+	}
+
+	if err = rows.Err(); err != nil {
+		return usages, err
+	}
+
+	return usages, nil
+}
+
+// AddAnomaly records an anomaly. Returns false if one was already recorded for
+// the user on that day.
+func (d *Database) AddAnomaly(context context.Context, userID string, day time.Time, usage, baseline *apd.Decimal) (bool, error) {
+	const q = `
+		INSERT INTO cpu_usage_anomalies
+			(user_id, day, usage, baseline)
+		VALUES
+			($1, $2, $3, $4)
+		ON CONFLICT (user_id, day) DO NOTHING;
+	`
+	count, err := d.rowsAffected(context, q, userID, day, usage, baseline)
+	return count > 0, err
+}
+
+// Anomalies returns a page of the recorded anomalies, most recent first.
+func (d *Database) Anomalies(context context.Context, limit, offset int) ([]Anomaly, error) {
+	var anomalies []Anomaly
+
+	const q = `
+		SELECT
+			a.id,
+			a.user_id,
+			u.username,
+			a.day,
+			a.usage,
+			a.baseline,
+			a.detected_on
+		FROM cpu_usage_anomalies a
+		JOIN users u ON a.user_id = u.id
+		ORDER BY a.day DESC, a.usage DESC, a.id
+		LIMIT $1 OFFSET $2;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var anomaly Anomaly
+		if err = rows.StructScan(&anomaly); err != nil {
+			return anomalies, err
+		}
+		anomalies = append(anomalies, anomaly)
+	}
+
+	if err = rows.Err(); err != nil {
+		return anomalies, err
+	}
+
+	return anomalies, nil
+}
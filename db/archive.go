@@ -0,0 +1,100 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// ArchivedJobEvent is a job status update that was consumed by the service.
+type ArchivedJobEvent struct {
+	ID         string          `db:"id" json:"id"`
+	ExternalID string          `db:"external_id" json:"external_id"`
+	State      string          `db:"state" json:"state"`
+	ReceivedOn time.Time       `db:"received_on" json:"received_on"`
+	Payload    json.RawMessage `db:"payload" json:"payload"`
+}
+
+// ArchiveJobEvent records a consumed job status update along with the raw
+// message body, which must be JSON.
+func (d *Database) ArchiveJobEvent(context context.Context, externalID, state string, payload []byte) error {
+	const q = `
+		INSERT INTO job_event_archive
+			(external_id, state, payload)
+		VALUES
+			($1, $2, $3);
+	`
+	_, err := d.db.ExecContext(context, q, externalID, state, string(payload))
+	return err
+}
+
+// ArchivedJobEvents returns a page of the archived job status updates, most
+// recent first. Only the updates for the external ID are returned if it isn't
+// empty.
+func (d *Database) ArchivedJobEvents(context context.Context, externalID string, limit, offset int) ([]ArchivedJobEvent, error) {
+	var events []ArchivedJobEvent
+
+	const q = `
+		SELECT
+			id,
+			external_id,
+			state,
+			received_on,
+			payload
+		FROM job_event_archive
+		WHERE $1 = '' OR external_id = $1
+		ORDER BY received_on DESC, id
+		LIMIT $2 OFFSET $3;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, externalID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var event ArchivedJobEvent
+		if err = rows.StructScan(&event); err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+
+	if err = rows.Err(); err != nil {
+		return events, err
+	}
+
+	return events, nil
+}
+
+// LatestArchivedJobState returns the most recently archived state out of the
+// given states for the external ID. Returns sql.ErrNoRows if none of them were
+// archived.
+func (d *Database) LatestArchivedJobState(context context.Context, externalID string, states []string) (string, error) {
+	var state string
+
+	const q = `
+		SELECT state
+		FROM job_event_archive
+		WHERE external_id = $1
+		AND state = ANY($2)
+		ORDER BY received_on DESC
+		LIMIT 1;
+	`
+
+	err := d.db.QueryRowxContext(context, q, externalID, pq.Array(states)).Scan(&state)
+	return state, err
+}
+
+// PruneArchivedJobEvents deletes the job status updates archived before the
+// cutoff. Returns the number that were deleted.
+func (d *Database) PruneArchivedJobEvents(context context.Context, cutoff time.Time) (int64, error) {
+	const q = `
+		DELETE FROM job_event_archive
+		WHERE received_on < $1;
+	`
+	return d.rowsAffected(context, q, cutoff)
+}
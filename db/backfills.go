@@ -0,0 +1,208 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+// BackfillCheckpoint records how far a backfill of a user's analyses in a time
+// range has gotten. Analyses are backfilled in the order of their end dates and
+// IDs, so every analysis up to and including the last one has been processed.
+type BackfillCheckpoint struct {
+	UserID         string      `db:"user_id"`
+	RangeStart     time.Time   `db:"range_start"`
+	RangeEnd       time.Time   `db:"range_end"`
+	LastEndDate    null.Time   `db:"last_end_date"`
+	LastAnalysisID null.String `db:"last_analysis_id"`
+	Processed      int64       `db:"processed"`
+	StartedOn      time.Time   `db:"started_on"`
+	UpdatedOn      time.Time   `db:"updated_on"`
+	CompletedOn    null.Time   `db:"completed_on"`
+}
+
+// backfillCheckpointColumns are the columns selected for a BackfillCheckpoint.
+const backfillCheckpointColumns = `
+	user_id,
+	range_start,
+	range_end,
+	last_end_date,
+	last_analysis_id,
+	processed,
+	started_on,
+	updated_on,
+	completed_on
+`
+
+// StartBackfillCheckpoint returns the checkpoint for a backfill of the user's
+// analyses in the time range, creating one if the backfill hasn't been started
+// before.
+func (d *Database) StartBackfillCheckpoint(context context.Context, userID string, from, to time.Time) (*BackfillCheckpoint, error) {
+	const insert = `
+		INSERT INTO backfill_checkpoints
+			(user_id, range_start, range_end)
+		VALUES
+			($1, $2, $3)
+		ON CONFLICT (user_id, range_start, range_end) DO NOTHING;
+	`
+	if _, err := d.db.ExecContext(context, insert, userID, from, to); err != nil {
+		return nil, err
+	}
+
+	var checkpoint BackfillCheckpoint
+	q := `SELECT` + backfillCheckpointColumns + `
+		FROM backfill_checkpoints
+		WHERE user_id = $1
+		AND range_start = $2
+		AND range_end = $3;
+	`
+	if err := d.db.QueryRowxContext(context, q, userID, from, to).StructScan(&checkpoint); err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+// UnfinishedBackfillCheckpoint returns the most recently started checkpoint
+// for a backfill of the user's analyses from the start of a time range that
+// hasn't completed, or nil if there isn't one. It's used to find the end of
+// the range when an interrupted backfill is resumed without one.
+func (d *Database) UnfinishedBackfillCheckpoint(context context.Context, userID string, from time.Time) (*BackfillCheckpoint, error) {
+	var checkpoint BackfillCheckpoint
+	q := `SELECT` + backfillCheckpointColumns + `
+		FROM backfill_checkpoints
+		WHERE user_id = $1
+		AND range_start = $2
+		AND completed_on IS NULL
+		ORDER BY started_on DESC
+		LIMIT 1;
+	`
+	err := d.db.QueryRowxContext(context, q, userID, from).StructScan(&checkpoint)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &checkpoint, nil
+}
+
+// UpdateBackfillCheckpoint records the last analysis that the backfill
+// processed, along with the number it has processed in total.
+func (d *Database) UpdateBackfillCheckpoint(context context.Context, checkpoint *BackfillCheckpoint) error {
+	const q = `
+		UPDATE backfill_checkpoints
+		SET last_end_date = $4,
+			last_analysis_id = $5,
+			processed = $6,
+			updated_on = CURRENT_TIMESTAMP
+		WHERE user_id = $1
+		AND range_start = $2
+		AND range_end = $3;
+	`
+	_, err := d.db.ExecContext(
+		context,
+		q,
+		checkpoint.UserID,
+		checkpoint.RangeStart,
+		checkpoint.RangeEnd,
+		checkpoint.LastEndDate,
+		checkpoint.LastAnalysisID,
+		checkpoint.Processed,
+	)
+	return err
+}
+
+// CompleteBackfillCheckpoint marks the backfill as finished.
+func (d *Database) CompleteBackfillCheckpoint(context context.Context, checkpoint *BackfillCheckpoint) error {
+	const q = `
+		UPDATE backfill_checkpoints
+		SET completed_on = CURRENT_TIMESTAMP,
+			updated_on = CURRENT_TIMESTAMP
+		WHERE user_id = $1
+		AND range_start = $2
+		AND range_end = $3;
+	`
+	_, err := d.db.ExecContext(context, q, checkpoint.UserID, checkpoint.RangeStart, checkpoint.RangeEnd)
+	return err
+}
+
+// ResetBackfillCheckpoint discards the progress recorded for the backfill, so
+// that it starts over from the beginning of its range.
+func (d *Database) ResetBackfillCheckpoint(context context.Context, checkpoint *BackfillCheckpoint) error {
+	const q = `
+		UPDATE backfill_checkpoints
+		SET last_end_date = NULL,
+			last_analysis_id = NULL,
+			processed = 0,
+			started_on = CURRENT_TIMESTAMP,
+			updated_on = CURRENT_TIMESTAMP,
+			completed_on = NULL
+		WHERE user_id = $1
+		AND range_start = $2
+		AND range_end = $3;
+	`
+	_, err := d.db.ExecContext(context, q, checkpoint.UserID, checkpoint.RangeStart, checkpoint.RangeEnd)
+	if err != nil {
+		return err
+	}
+
+	checkpoint.LastEndDate = null.Time{}
+	checkpoint.LastAnalysisID = null.String{}
+	checkpoint.Processed = 0
+	checkpoint.CompletedOn = null.Time{}
+	return nil
+}
+
+// BackfillAnalyses returns the user's calculable analyses in the time range,
+// ordered by their end dates and IDs. If the checkpoint has recorded an
+// analysis, only the analyses that come after it are returned.
+func (d *Database) BackfillAnalyses(context context.Context, checkpoint *BackfillCheckpoint) ([]CalculableAnalysis, error) {
+	var analyses []CalculableAnalysis
+
+	const q = `
+		SELECT
+			j.id,
+			j.start_date,
+			j.end_date,
+			j.millicores_reserved
+		FROM jobs j
+		WHERE j.user_id = $1
+		AND j.millicores_reserved != 0
+		AND j.start_date IS NOT NULL
+		AND j.end_date IS NOT NULL
+		AND j.start_date >= $2::timestamp
+		AND j.end_date <= $3::timestamp
+		AND ($4::timestamp IS NULL OR (j.end_date, j.id) > ($4::timestamp, $5::uuid))
+		ORDER BY j.end_date, j.id;
+	`
+	rows, err := d.db.QueryxContext(
+		context,
+		q,
+		checkpoint.UserID,
+		checkpoint.RangeStart,
+		checkpoint.RangeEnd,
+		checkpoint.LastEndDate,
+		checkpoint.LastAnalysisID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var a CalculableAnalysis
+		if err = rows.StructScan(&a); err != nil {
+			return analyses, err
+		}
+		analyses = append(analyses, a)
+	}
+
+	if err = rows.Err(); err != nil {
+		return analyses, err
+	}
+
+	return analyses, nil
+}
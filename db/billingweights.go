@@ -0,0 +1,174 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/guregu/null"
+)
+
+// The kinds of things that a billing weight can apply to.
+const (
+	BillingWeightApp  = "app"
+	BillingWeightTool = "tool"
+)
+
+// BillingWeight is a multiplier applied to the CPU hours calculated for the
+// analyses of an app, or of the apps that use a tool, while it's in effect.
+// A weight of 0.5 bills the analyses at half of their CPU hours, and a weight
+// of 2 bills them at double. EndsOn is unset for weights without an end.
+type BillingWeight struct {
+	ID         string      `db:"id" json:"id"`
+	TargetType string      `db:"target_type" json:"target_type"`
+	TargetID   string      `db:"target_id" json:"target_id"`
+	Weight     apd.Decimal `db:"weight" json:"weight"`
+	StartsOn   time.Time   `db:"starts_on" json:"starts_on"`
+	EndsOn     null.Time   `db:"ends_on" json:"ends_on"`
+	Reason     string      `db:"reason" json:"reason"`
+	CreatedBy  string      `db:"created_by" json:"created_by"`
+	CreatedOn  time.Time   `db:"created_on" json:"created_on"`
+	RevokedBy  null.String `db:"revoked_by" json:"revoked_by"`
+	RevokedOn  null.Time   `db:"revoked_on" json:"revoked_on"`
+}
+
+// billingWeightColumns are the columns selected for a BillingWeight.
+const billingWeightColumns = `
+	w.id,
+	w.target_type,
+	w.target_id,
+	w.weight,
+	w.starts_on,
+	w.ends_on,
+	w.reason,
+	w.created_by,
+	w.created_on,
+	w.revoked_by,
+	w.revoked_on
+`
+
+// AddBillingWeight adds a billing weight and returns its ID. The weight isn't
+// added if it would overlap an unrevoked weight for the same app or tool, in
+// which case the ID is empty.
+func (d *Database) AddBillingWeight(context context.Context, weight *BillingWeight) (string, error) {
+	var id string
+
+	const q = `
+		INSERT INTO billing_weights
+			(target_type, target_id, weight, starts_on, ends_on, reason, created_by)
+		SELECT $1, $2, $3, $4, $5, $6, $7
+		WHERE NOT EXISTS (
+			SELECT 1
+			FROM billing_weights w
+			WHERE w.target_type = $1
+			AND w.target_id = $2
+			AND w.revoked_on IS NULL
+			AND ($5::timestamp IS NULL OR w.starts_on < $5::timestamp)
+			AND (w.ends_on IS NULL OR w.ends_on > $4::timestamp)
+		)
+		RETURNING id;
+	`
+
+	err := d.db.QueryRowxContext(
+		context,
+		q,
+		weight.TargetType,
+		weight.TargetID,
+		&weight.Weight,
+		weight.StartsOn,
+		weight.EndsOn,
+		weight.Reason,
+		weight.CreatedBy,
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return id, err
+}
+
+// RevokeBillingWeight stops a billing weight from being applied to analyses
+// that are calculated from now on. Returns false if there's no such weight or
+// it was already revoked.
+func (d *Database) RevokeBillingWeight(context context.Context, id, revokedBy string) (bool, error) {
+	const q = `
+		UPDATE billing_weights
+		SET revoked_by = $2,
+			revoked_on = CURRENT_TIMESTAMP
+		WHERE id = $1
+		AND revoked_on IS NULL;
+	`
+	count, err := d.rowsAffected(context, q, id, revokedBy)
+	return count > 0, err
+}
+
+// BillingWeights returns every billing weight, including the revoked and
+// expired ones, ordered by what they apply to and when they start. Only the
+// weights for the app or tool are returned if the target type and ID are set.
+func (d *Database) BillingWeights(context context.Context, targetType, targetID string) ([]BillingWeight, error) {
+	var weights []BillingWeight
+
+	q := `SELECT` + billingWeightColumns + `
+		FROM billing_weights w
+		WHERE ($1 = '' OR w.target_type = $1)
+		AND ($2 = '' OR w.target_id = $2)
+		ORDER BY w.target_type, w.target_id, w.starts_on, w.id;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, targetType, targetID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var weight BillingWeight
+		if err = rows.StructScan(&weight); err != nil {
+			return weights, err
+		}
+		weights = append(weights, weight)
+	}
+
+	if err = rows.Err(); err != nil {
+		return weights, err
+	}
+
+	return weights, nil
+}
+
+// BillingWeightForApp returns the unrevoked billing weight in effect at the
+// given time for the analyses of an app, or nil if there isn't one. A weight
+// for the app itself takes precedence over the weights for its tools, and the
+// largest of the weights for its tools is used if it uses more than one.
+func (d *Database) BillingWeightForApp(context context.Context, appID string, at time.Time) (*BillingWeight, error) {
+	var weight BillingWeight
+
+	q := `SELECT` + billingWeightColumns + `
+		FROM billing_weights w
+		WHERE w.revoked_on IS NULL
+		AND w.starts_on <= $2
+		AND (w.ends_on IS NULL OR w.ends_on > $2)
+		AND (
+			(w.target_type = 'app' AND w.target_id = $1)
+			OR (w.target_type = 'tool' AND w.target_id IN (
+				SELECT t.tool_id::text
+				FROM app_versions v
+				JOIN app_steps s ON s.app_version_id = v.id
+				JOIN tasks t ON s.task_id = t.id
+				WHERE v.app_id::text = $1
+			))
+		)
+		ORDER BY w.target_type = 'app' DESC, w.weight DESC, w.id
+		LIMIT 1;
+	`
+
+	err := d.db.QueryRowxContext(context, q, appID, at).StructScan(&weight)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &weight, nil
+}
@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/cache"
+)
+
+// maxCachedTotals bounds the number of users whose totals are cached locally.
+const maxCachedTotals = 10000
+
+// totalsKeyPrefix is the prefix of the shared cache keys for totals.
+const totalsKeyPrefix = "totals:"
+
+// TotalsCache caches the current CPU hours totals for users, locally and
+// optionally in a cache shared by all replicas. The local TTL bounds how stale
+// a total can be when it's updated by another replica without going through
+// the shared cache. A nil *TotalsCache doesn't cache anything.
+type TotalsCache struct {
+	totals *cache.TTL[string, CPUHours]
+	shared *cache.Redis
+}
+
+// NewTotalsCache returns a new *TotalsCache whose local entries expire after
+// ttl. A ttl of zero disables the local cache.
+func NewTotalsCache(ttl time.Duration) *TotalsCache {
+	t := &TotalsCache{}
+	if ttl > 0 {
+		t.totals = cache.NewTTL[string, CPUHours](ttl, maxCachedTotals)
+	}
+	return t
+}
+
+// SetShared sets the cache shared by all replicas.
+func (t *TotalsCache) SetShared(shared *cache.Redis) {
+	t.shared = shared
+}
+
+// CurrentCPUHoursForUser returns the user's current CPU hours total from the
+// cache, loading it from the database if it isn't cached.
+func (t *TotalsCache) CurrentCPUHoursForUser(context context.Context, d *Database, username string) (*CPUHours, error) {
+	if t == nil {
+		return d.CurrentCPUHoursForUser(context, username)
+	}
+
+	if t.totals != nil {
+		if cpuHours, ok := t.totals.Get(username); ok {
+			return &cpuHours, nil
+		}
+	}
+
+	if t.shared != nil {
+		value, ok, err := t.shared.Get(context, totalsKeyPrefix+username)
+		if err != nil {
+			log.WithContext(context).Errorf("unable to read the shared totals cache: %s", err)
+		}
+		if ok {
+			var cpuHours CPUHours
+			if err = json.Unmarshal(value, &cpuHours); err == nil {
+				t.setLocal(username, &cpuHours)
+				return &cpuHours, nil
+			}
+			log.WithContext(context).Errorf("unable to decode a cached total: %s", err)
+		}
+	}
+
+	cpuHours, err := d.CurrentCPUHoursForUser(context, username)
+	if err != nil {
+		return nil, err
+	}
+	t.setLocal(username, cpuHours)
+
+	if t.shared != nil {
+		value, err := json.Marshal(cpuHours)
+		if err == nil {
+			err = t.shared.Set(context, totalsKeyPrefix+username, value)
+		}
+		if err != nil {
+			log.WithContext(context).Errorf("unable to update the shared totals cache: %s", err)
+		}
+	}
+
+	return cpuHours, nil
+}
+
+// setLocal adds a total to the local cache if it's enabled.
+func (t *TotalsCache) setLocal(username string, cpuHours *CPUHours) {
+	if t.totals != nil {
+		t.totals.Set(username, *cpuHours)
+	}
+}
+
+// invalidateLocal removes the user's total from the local cache.
+func (t *TotalsCache) invalidateLocal(username string) {
+	if t.totals != nil {
+		t.totals.Invalidate(username)
+	}
+}
+
+// Invalidate removes the user's total from the cache. It should be called
+// whenever the user's total is changed by this instance. Other replicas are
+// told to drop their copies through the shared cache.
+func (t *TotalsCache) Invalidate(context context.Context, username string) error {
+	if t == nil {
+		return nil
+	}
+
+	t.invalidateLocal(username)
+
+	if t.shared != nil {
+		return t.shared.Invalidate(context, totalsKeyPrefix+username)
+	}
+	return nil
+}
+
+// HandleInvalidation drops the local copy of a total that was invalidated
+// through the shared cache. It's meant to be passed to cache.Redis.Subscribe.
+func (t *TotalsCache) HandleInvalidation(key string) {
+	if username, ok := strings.CutPrefix(key, totalsKeyPrefix); ok {
+		t.invalidateLocal(username)
+	}
+}
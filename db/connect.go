@@ -0,0 +1,115 @@
+package db
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/uptrace/opentelemetry-go-extra/otelsql"
+	"github.com/uptrace/opentelemetry-go-extra/otelsqlx"
+	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
+
+	// The supported database drivers.
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/lib/pq"
+)
+
+// The supported database drivers.
+const (
+	DriverPQ  = "postgres"
+	DriverPGX = "pgx"
+)
+
+// ConnectionConfig contains the settings for the database connection pool.
+type ConnectionConfig struct {
+	// Driver is either DriverPQ or DriverPGX. Defaults to DriverPQ.
+	Driver string
+
+	// URI is the connection string, either as a URL or as key=value pairs.
+	URI string
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// StatementTimeout is the maximum time a statement may run before the
+	// server cancels it. Zero leaves the server's setting alone.
+	StatementTimeout time.Duration
+
+	// ApplicationName is reported to the server so that the service's
+	// connections can be identified in pg_stat_activity.
+	ApplicationName string
+}
+
+// withRuntimeParams adds the run-time parameters to the connection string.
+// Both drivers pass unrecognized parameters on to the server.
+func withRuntimeParams(uri string, params map[string]string) (string, error) {
+	if len(params) == 0 {
+		return uri, nil
+	}
+
+	if strings.Contains(uri, "://") {
+		u, err := url.Parse(uri)
+		if err != nil {
+			return "", err
+		}
+		query := u.Query()
+		for k, v := range params {
+			query.Set(k, v)
+		}
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		v := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(params[k])
+		uri = fmt.Sprintf("%s %s='%s'", uri, k, v)
+	}
+	return uri, nil
+}
+
+// Connect opens and configures the database connection pool.
+func Connect(config *ConnectionConfig) (*sqlx.DB, error) {
+	driver := config.Driver
+	if driver == "" {
+		driver = DriverPQ
+	}
+	if driver != DriverPQ && driver != DriverPGX {
+		return nil, fmt.Errorf("unsupported database driver %s", driver)
+	}
+
+	params := make(map[string]string)
+	if config.ApplicationName != "" {
+		params["application_name"] = config.ApplicationName
+	}
+	if config.StatementTimeout > 0 {
+		params["statement_timeout"] = fmt.Sprintf("%d", config.StatementTimeout.Milliseconds())
+	}
+
+	uri, err := withRuntimeParams(config.URI, params)
+	if err != nil {
+		return nil, err
+	}
+
+	dbconn, err := otelsqlx.Connect(driver, uri, otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
+	if err != nil {
+		return nil, err
+	}
+
+	dbconn.SetMaxOpenConns(config.MaxOpenConns)
+	dbconn.SetMaxIdleConns(config.MaxIdleConns)
+	dbconn.SetConnMaxLifetime(config.ConnMaxLifetime)
+	dbconn.SetConnMaxIdleTime(config.ConnMaxIdleTime)
+
+	return dbconn, nil
+}
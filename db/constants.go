@@ -6,3 +6,33 @@ const CPUHoursAdd EventType = "cpu.hours.add"
 const CPUHoursSubtract EventType = "cpu.hours.subtract"
 const CPUHoursReset EventType = "cpu.hours.reset"
 const CPUHoursCalculate EventType = "cpu.hours.calculate"
+
+// The resource type and allocation source of a total when none is specified.
+const DefaultResourceType = "cpu.hours"
+const DefaultAllocationSource = "default"
+
+// The resource types that totals and usage events can be recorded for.
+const (
+	ResourceTypeCPUHours   = "cpu.hours"
+	ResourceTypeGPUHours   = "gpu.hours"
+	ResourceTypeMemGBHours = "mem.gbhours"
+	ResourceTypeDataBytes  = "data.bytes"
+)
+
+// ResourceTypes lists the supported resource types.
+var ResourceTypes = []string{
+	ResourceTypeCPUHours,
+	ResourceTypeGPUHours,
+	ResourceTypeMemGBHours,
+	ResourceTypeDataBytes,
+}
+
+// ValidResourceType returns true if the resource type is supported.
+func ValidResourceType(resourceType string) bool {
+	for _, t := range ResourceTypes {
+		if t == resourceType {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+// DataUsageTotal is a user's data store usage as last fetched from
+// data-usage-api.
+type DataUsageTotal struct {
+	UserID      string    `db:"user_id" json:"user_id"`
+	Username    string    `db:"username" json:"username"`
+	Total       int64     `db:"total" json:"total"`
+	MeasuredOn  null.Time `db:"measured_on" json:"measured_on"`
+	RefreshedOn time.Time `db:"refreshed_on" json:"refreshed_on"`
+}
+
+// SetDataUsageTotal stores the user's data store usage, replacing the total
+// that was stored before.
+func (d *Database) SetDataUsageTotal(context context.Context, userID string, total int64, measuredOn null.Time) error {
+	const q = `
+		INSERT INTO data_usage_totals
+			(user_id, total, measured_on)
+		VALUES
+			($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET total = EXCLUDED.total,
+			measured_on = EXCLUDED.measured_on,
+			refreshed_on = CURRENT_TIMESTAMP;
+	`
+	_, err := d.db.ExecContext(context, q, userID, total, measuredOn)
+	return err
+}
+
+// DataUsageTotalForUser returns the user's stored data store usage.
+func (d *Database) DataUsageTotalForUser(context context.Context, username string) (*DataUsageTotal, error) {
+	const q = `
+		SELECT
+			d.user_id,
+			u.username,
+			d.total,
+			d.measured_on,
+			d.refreshed_on
+		FROM data_usage_totals d
+		JOIN users u ON d.user_id = u.id
+		WHERE u.username = $1;
+	`
+	var total DataUsageTotal
+	err := d.db.QueryRowxContext(context, q, username).StructScan(&total)
+	return &total, err
+}
+
+// DataUsageRefreshUsers returns the users whose data store usage is kept up to
+// date: those with a current total for any resource type and those whose data
+// store usage has been stored before.
+func (d *Database) DataUsageRefreshUsers(context context.Context) ([]User, error) {
+	var users []User
+
+	const q = `
+		SELECT u.id, u.username
+		FROM users u
+		WHERE EXISTS (
+			SELECT 1 FROM cpu_usage_totals t
+			WHERE t.user_id = u.id
+			AND t.effective_range @> CURRENT_TIMESTAMP::timestamp
+		)
+		OR EXISTS (
+			SELECT 1 FROM data_usage_totals d
+			WHERE d.user_id = u.id
+		)
+		ORDER BY u.username;
+	`
+
+	rows, err := d.db.QueryxContext(context, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		if err = rows.StructScan(&user); err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
+}
@@ -8,18 +8,35 @@ import (
 	"github.com/cockroachdb/apd"
 	"github.com/cyverse-de/resource-usage-api/logging"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
 var log = logging.Log // nolint
 
+// CPUHours is a usage total for a user over an effective period. A user can
+// have several concurrent totals, one per resource type and allocation source.
 type CPUHours struct {
-	ID             string      `db:"id" json:"id"`
-	UserID         string      `db:"user_id" json:"user_id"`
-	Username       string      `db:"username" json:"username"`
-	Total          apd.Decimal `db:"total" json:"total"`
-	EffectiveStart time.Time   `db:"effective_start" json:"effective_start"`
-	EffectiveEnd   time.Time   `db:"effective_end" json:"effective_end"`
-	LastModified   time.Time   `db:"last_modified" json:"last_modified"`
+	ID               string      `db:"id" json:"id"`
+	UserID           string      `db:"user_id" json:"user_id"`
+	Username         string      `db:"username" json:"username"`
+	ResourceType     string      `db:"resource_type" json:"resource_type"`
+	AllocationSource string      `db:"allocation_source" json:"allocation_source"`
+	Total            apd.Decimal `db:"total" json:"total"`
+	EffectiveStart   time.Time   `db:"effective_start" json:"effective_start"`
+	EffectiveEnd     time.Time   `db:"effective_end" json:"effective_end"`
+	LastModified     time.Time   `db:"last_modified" json:"last_modified"`
+}
+
+// withDefaults fills in the default resource type and allocation source if
+// they're unset.
+func (c *CPUHours) withDefaults() *CPUHours {
+	if c.ResourceType == "" {
+		c.ResourceType = DefaultResourceType
+	}
+	if c.AllocationSource == "" {
+		c.AllocationSource = DefaultAllocationSource
+	}
+	return c
 }
 
 // User has information about a user from the DE's database.
@@ -39,7 +56,7 @@ type Database struct {
 }
 
 func New(db DatabaseAccessor) *Database {
-	return &Database{db: db}
+	return &Database{db: withFaults(db)}
 }
 
 func (d *Database) Username(context context.Context, userID string) (string, error) {
@@ -76,7 +93,47 @@ func (d *Database) UserID(context context.Context, username string) (string, err
 	return userID, nil
 }
 
+// UserIDs returns the IDs of the users with the given usernames, keyed by
+// username. Usernames that don't belong to a user are left out.
+func (d *Database) UserIDs(context context.Context, usernames []string) (map[string]string, error) {
+	userIDs := make(map[string]string)
+
+	const q = `
+		SELECT id, username
+		FROM users
+		WHERE username = ANY($1);
+	`
+
+	rows, err := d.db.QueryxContext(context, q, pq.Array(usernames))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		if err = rows.StructScan(&user); err != nil {
+			return userIDs, err
+		}
+		userIDs[user.Username] = user.ID
+	}
+
+	if err = rows.Err(); err != nil {
+		return userIDs, err
+	}
+
+	return userIDs, nil
+}
+
+// CurrentCPUHoursForUser returns the user's current total for the default
+// resource type and allocation source.
 func (d *Database) CurrentCPUHoursForUser(context context.Context, username string) (*CPUHours, error) {
+	return d.CurrentTotalForUser(context, username, DefaultResourceType, DefaultAllocationSource)
+}
+
+// CurrentTotalForUser returns the user's current total for a resource type and
+// allocation source.
+func (d *Database) CurrentTotalForUser(context context.Context, username, resourceType, allocationSource string) (*CPUHours, error) {
 	var cpuHours CPUHours
 
 	const q = `
@@ -85,34 +142,172 @@ func (d *Database) CurrentCPUHoursForUser(context context.Context, username stri
 			t.total,
 			t.user_id,
 			u.username,
+			t.resource_type,
+			t.allocation_source,
 			lower(t.effective_range) effective_start,
 			upper(t.effective_range) effective_end,
 			t.last_modified
 		FROM cpu_usage_totals t
 		JOIN users u ON t.user_id = u.id
 		WHERE u.username = $1
+		AND t.resource_type = $2
+		AND t.allocation_source = $3
 		AND t.effective_range @> CURRENT_TIMESTAMP::timestamp
 		LIMIT 1;
 	`
-	err := d.db.QueryRowxContext(context, q, username).StructScan(&cpuHours)
+	err := d.db.QueryRowxContext(context, q, username, resourceType, allocationSource).StructScan(&cpuHours)
 	if err != nil {
 		return nil, err
 	}
 	return &cpuHours, err
 }
 
+// CurrentTotalsForUser returns all of the user's current totals, across every
+// resource type and allocation source.
+func (d *Database) CurrentTotalsForUser(context context.Context, username string) ([]CPUHours, error) {
+	var totals []CPUHours
+
+	const q = `
+		SELECT 
+			t.id,
+			t.total,
+			t.user_id,
+			u.username,
+			t.resource_type,
+			t.allocation_source,
+			lower(t.effective_range) effective_start,
+			upper(t.effective_range) effective_end,
+			t.last_modified
+		FROM cpu_usage_totals t
+		JOIN users u ON t.user_id = u.id
+		WHERE u.username = $1
+		AND t.effective_range @> CURRENT_TIMESTAMP::timestamp
+		ORDER BY t.resource_type, t.allocation_source;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, username)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var h CPUHours
+		if err = rows.StructScan(&h); err != nil {
+			return nil, err
+		}
+		totals = append(totals, h)
+	}
+
+	if err = rows.Err(); err != nil {
+		return totals, err
+	}
+
+	return totals, nil
+}
+
+// RecentTotalsForUser returns the user's totals for a resource type and
+// allocation source for the limit most recent effective periods that have
+// started, the current one first.
+func (d *Database) RecentTotalsForUser(context context.Context, username, resourceType, allocationSource string, limit int) ([]CPUHours, error) {
+	var totals []CPUHours
+
+	const q = `
+		SELECT
+			t.id,
+			t.total,
+			t.user_id,
+			u.username,
+			t.resource_type,
+			t.allocation_source,
+			lower(t.effective_range) effective_start,
+			upper(t.effective_range) effective_end,
+			t.last_modified
+		FROM cpu_usage_totals t
+		JOIN users u ON t.user_id = u.id
+		WHERE u.username = $1
+		AND t.resource_type = $2
+		AND t.allocation_source = $3
+		AND lower(t.effective_range) <= CURRENT_TIMESTAMP::timestamp
+		ORDER BY effective_start DESC
+		LIMIT $4;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, username, resourceType, allocationSource, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var h CPUHours
+		if err = rows.StructScan(&h); err != nil {
+			return totals, err
+		}
+		totals = append(totals, h)
+	}
+
+	if err = rows.Err(); err != nil {
+		return totals, err
+	}
+
+	return totals, nil
+}
+
+// PeriodStartsBetween returns the starts of the user's effective periods for
+// the resource type and allocation source that fall strictly between start and
+// end, earliest first.
+func (d *Database) PeriodStartsBetween(context context.Context, userID, resourceType, allocationSource string, start, end time.Time) ([]time.Time, error) {
+	var starts []time.Time
+
+	const q = `
+		SELECT lower(t.effective_range) effective_start
+		FROM cpu_usage_totals t
+		WHERE t.user_id = $1
+		AND t.resource_type = $2
+		AND t.allocation_source = $3
+		AND lower(t.effective_range) > $4
+		AND lower(t.effective_range) < $5
+		ORDER BY effective_start;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, userID, resourceType, allocationSource, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var periodStart time.Time
+		if err = rows.Scan(&periodStart); err != nil {
+			return starts, err
+		}
+		starts = append(starts, periodStart)
+	}
+
+	if err = rows.Err(); err != nil {
+		return starts, err
+	}
+
+	return starts, nil
+}
+
+// InsertCurrentCPUHoursForUser adds a new total for the user. The default
+// resource type and allocation source are used if they're unset.
 func (d *Database) InsertCurrentCPUHoursForUser(context context.Context, cpuHours *CPUHours) error {
 	const q = `
 		INSERT INTO cpu_usage_totals
-			(total, user_id, effective_range)
+			(total, user_id, resource_type, allocation_source, effective_range)
 		VALUES
-			($1, $2, tsrange($3, $4, '[)'));
+			($1, $2, $3, $4, tsrange($5, $6, '[)'));
 	`
+	cpuHours.withDefaults()
 	_, err := d.db.ExecContext(
 		context,
 		q,
 		cpuHours.Total,
 		cpuHours.UserID,
+		cpuHours.ResourceType,
+		cpuHours.AllocationSource,
 		cpuHours.EffectiveStart,
 		cpuHours.EffectiveEnd,
 	)
@@ -132,6 +327,8 @@ func (d *Database) AllCPUHoursForUser(context context.Context, username string)
 			t.total,
 			t.user_id,
 			u.username,
+			t.resource_type,
+			t.allocation_source,
 			lower(t.effective_range) effective_start,
 			upper(t.effective_range) effective_end,
 			t.last_modified
@@ -170,6 +367,8 @@ func (d *Database) AdminAllCurrentCPUHours(context context.Context) ([]CPUHours,
 			t.total,
 			t.user_id,
 			u.username,
+			t.resource_type,
+			t.allocation_source,
 			lower(t.effective_range) effective_start,
 			upper(t.effective_range) effective_end,
 			t.last_modified
@@ -208,6 +407,8 @@ func (d *Database) AdminAllCPUHours(context context.Context) ([]CPUHours, error)
 			t.total,
 			t.user_id,
 			u.username,
+			t.resource_type,
+			t.allocation_source,
 			lower(t.effective_range) effective_start,
 			upper(t.effective_range) effective_end,
 			t.last_modified
@@ -236,19 +437,27 @@ func (d *Database) AdminAllCPUHours(context context.Context) ([]CPUHours, error)
 	return cpuHours, nil
 }
 
+// UpdateCPUHoursTotal sets the value of the user's current total for the
+// resource type and allocation source of totalObj. The default resource type
+// and allocation source are used if they're unset.
 func (d *Database) UpdateCPUHoursTotal(context context.Context, totalObj *CPUHours) error {
 	const q = `
 		UPDATE cpu_usage_totals
 		SET total = $2
 		WHERE user_id = $1
+		AND resource_type = $3
+		AND allocation_source = $4
 		AND effective_range @> CURRENT_TIMESTAMP::timestamp;
 	`
 
+	totalObj.withDefaults()
 	_, err := d.db.ExecContext(
 		context,
 		q,
 		totalObj.UserID,
 		totalObj.Total,
+		totalObj.ResourceType,
+		totalObj.AllocationSource,
 	)
 	return err
 }
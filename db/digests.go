@@ -0,0 +1,205 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/guregu/null"
+)
+
+// DigestPreference is whether a user receives the weekly usage digest, and
+// the locale that the digest and other notifications are written for. The
+// locale is null if the user hasn't chosen one.
+type DigestPreference struct {
+	OptedOut   bool        `db:"opted_out" json:"opted_out"`
+	Locale     null.String `db:"locale" json:"locale"`
+	ModifiedOn null.Time   `db:"modified_on" json:"modified_on"`
+}
+
+// WeeklyUsage is a user who ran analyses that ended during a week, along with
+// the user's preferred locale. Hours isn't read from the database; it's set
+// once the CPU hours for the analyses have been calculated.
+type WeeklyUsage struct {
+	UserID   string      `db:"user_id" json:"user_id"`
+	Username string      `db:"username" json:"username"`
+	Hours    apd.Decimal `db:"hours" json:"hours"`
+	Locale   null.String `db:"locale" json:"locale"`
+}
+
+// DigestAnalysis is an analysis that's included in a user's weekly digest.
+type DigestAnalysis struct {
+	ID      string `db:"id" json:"id"`
+	Name    string `db:"name" json:"name"`
+	AppName string `db:"app_name" json:"app_name"`
+}
+
+// DigestPreferenceForUser returns the user's digest preference. Users who
+// haven't set one receive the digest.
+func (d *Database) DigestPreferenceForUser(context context.Context, userID string) (*DigestPreference, error) {
+	var preference DigestPreference
+
+	const q = `
+		SELECT opted_out, locale, modified_on
+		FROM usage_digest_preferences
+		WHERE user_id = $1;
+	`
+
+	err := d.db.QueryRowxContext(context, q, userID).StructScan(&preference)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &DigestPreference{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &preference, nil
+}
+
+// SetDigestOptOut records whether the user has opted out of the weekly usage
+// digest.
+func (d *Database) SetDigestOptOut(context context.Context, userID string, optedOut bool) error {
+	const q = `
+		INSERT INTO usage_digest_preferences
+			(user_id, opted_out)
+		VALUES
+			($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET opted_out = EXCLUDED.opted_out,
+			modified_on = CURRENT_TIMESTAMP;
+	`
+	_, err := d.db.ExecContext(context, q, userID, optedOut)
+	return err
+}
+
+// SetLocale records the locale that the user's notifications are written for.
+// A null locale clears the user's choice.
+func (d *Database) SetLocale(context context.Context, userID string, locale null.String) error {
+	const q = `
+		INSERT INTO usage_digest_preferences
+			(user_id, locale)
+		VALUES
+			($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET locale = EXCLUDED.locale,
+			modified_on = CURRENT_TIMESTAMP;
+	`
+	_, err := d.db.ExecContext(context, q, userID, locale)
+	return err
+}
+
+// DigestRecipients returns each user who ran analyses that ended during the
+// week beginning at week, excluding the users who have opted out of the digest
+// and the ones who have already been sent the digest for the week.
+func (d *Database) DigestRecipients(context context.Context, week time.Time) ([]WeeklyUsage, error) {
+	var usages []WeeklyUsage
+
+	const q = `
+		SELECT DISTINCT
+			j.user_id,
+			u.username,
+			p.locale
+		FROM jobs j
+		JOIN users u ON j.user_id = u.id
+		LEFT JOIN usage_digest_preferences p ON j.user_id = p.user_id
+		WHERE j.millicores_reserved != 0
+		AND j.start_date IS NOT NULL
+		AND j.end_date IS NOT NULL
+		AND j.end_date >= $1::timestamp
+		AND j.end_date < $1::timestamp + interval '7 days'
+		AND NOT COALESCE(p.opted_out, false)
+		AND NOT EXISTS (
+			SELECT 1 FROM usage_digests s
+			WHERE s.user_id = j.user_id
+			AND s.week = $1::date
+		)
+		ORDER BY u.username;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, week)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var usage WeeklyUsage
+		if err = rows.StructScan(&usage); err != nil {
+			return usages, err
+		}
+		usages = append(usages, usage)
+	}
+
+	if err = rows.Err(); err != nil {
+		return usages, err
+	}
+
+	return usages, nil
+}
+
+// DigestAnalyses returns the user's analyses that ended during the week
+// beginning at week, in the order they ended.
+func (d *Database) DigestAnalyses(context context.Context, userID string, week time.Time) ([]DigestAnalysis, error) {
+	var analyses []DigestAnalysis
+
+	const q = `
+		SELECT
+			j.id,
+			j.job_name name,
+			j.app_name
+		FROM jobs j
+		WHERE j.user_id = $1
+		AND j.millicores_reserved != 0
+		AND j.start_date IS NOT NULL
+		AND j.end_date IS NOT NULL
+		AND j.end_date >= $2::timestamp
+		AND j.end_date < $2::timestamp + interval '7 days'
+		ORDER BY j.end_date, j.id;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, userID, week)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var analysis DigestAnalysis
+		if err = rows.StructScan(&analysis); err != nil {
+			return analyses, err
+		}
+		analyses = append(analyses, analysis)
+	}
+
+	if err = rows.Err(); err != nil {
+		return analyses, err
+	}
+
+	return analyses, nil
+}
+
+// AddDigest records that the digest for the week beginning at week is being
+// sent to the user. It returns false if it has already been recorded.
+func (d *Database) AddDigest(context context.Context, userID string, week time.Time, hours *apd.Decimal) (bool, error) {
+	const q = `
+		INSERT INTO usage_digests
+			(user_id, week, hours)
+		VALUES
+			($1, $2, $3)
+		ON CONFLICT (user_id, week) DO NOTHING;
+	`
+	count, err := d.rowsAffected(context, q, userID, week, hours)
+	return count > 0, err
+}
+
+// DeleteDigest removes the record of a digest that couldn't be sent, so that
+// it's sent on the next pass.
+func (d *Database) DeleteDigest(context context.Context, userID string, week time.Time) error {
+	const q = `
+		DELETE FROM usage_digests WHERE user_id = $1 AND week = $2;
+	`
+	_, err := d.db.ExecContext(context, q, userID, week)
+	return err
+}
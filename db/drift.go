@@ -0,0 +1,97 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+)
+
+// UsageDrift is a user's current total that differs from the usage recorded
+// for them in QMS. The difference is the local total minus the QMS total.
+type UsageDrift struct {
+	UserID       string      `db:"user_id" json:"user_id"`
+	Username     string      `db:"username" json:"username"`
+	ResourceType string      `db:"resource_type" json:"resource_type"`
+	LocalTotal   apd.Decimal `db:"local_total" json:"local_total"`
+	QMSTotal     apd.Decimal `db:"qms_total" json:"qms_total"`
+	Difference   apd.Decimal `db:"difference" json:"difference"`
+	DetectedOn   time.Time   `db:"detected_on" json:"detected_on"`
+	CheckedOn    time.Time   `db:"checked_on" json:"checked_on"`
+}
+
+// SetUsageDrift records that the user's total for the resource type differs
+// from their usage in QMS. The detection time is kept if the drift was already
+// recorded. Returns true if it wasn't.
+func (d *Database) SetUsageDrift(context context.Context, userID, resourceType string, localTotal, qmsTotal, difference *apd.Decimal) (bool, error) {
+	var detected bool
+
+	// The detection and check times are only equal for a new row.
+	const q = `
+		INSERT INTO qms_usage_drift
+			(user_id, resource_type, local_total, qms_total, difference)
+		VALUES
+			($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id, resource_type) DO UPDATE
+		SET local_total = EXCLUDED.local_total,
+			qms_total = EXCLUDED.qms_total,
+			difference = EXCLUDED.difference,
+			checked_on = CURRENT_TIMESTAMP
+		RETURNING detected_on = checked_on;
+	`
+	err := d.db.QueryRowxContext(context, q, userID, resourceType, localTotal, qmsTotal, difference).Scan(&detected)
+	return detected, err
+}
+
+// ClearUsageDrift removes the recorded drift for the user and resource type
+// once their total matches QMS again.
+func (d *Database) ClearUsageDrift(context context.Context, userID, resourceType string) error {
+	const q = `
+		DELETE FROM qms_usage_drift
+		WHERE user_id = $1
+		AND resource_type = $2;
+	`
+	_, err := d.db.ExecContext(context, q, userID, resourceType)
+	return err
+}
+
+// UsageDrifts returns a page of the recorded drift, largest difference first.
+func (d *Database) UsageDrifts(context context.Context, limit, offset int) ([]UsageDrift, error) {
+	var drifts []UsageDrift
+
+	const q = `
+		SELECT
+			q.user_id,
+			u.username,
+			q.resource_type,
+			q.local_total,
+			q.qms_total,
+			q.difference,
+			q.detected_on,
+			q.checked_on
+		FROM qms_usage_drift q
+		JOIN users u ON q.user_id = u.id
+		ORDER BY abs(q.difference) DESC, u.username, q.resource_type
+		LIMIT $1 OFFSET $2;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var drift UsageDrift
+		if err = rows.StructScan(&drift); err != nil {
+			return drifts, err
+		}
+		drifts = append(drifts, drift)
+	}
+
+	if err = rows.Err(); err != nil {
+		return drifts, err
+	}
+
+	return drifts, nil
+}
@@ -8,10 +8,21 @@ package db
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/cockroachdb/apd"
 	"github.com/guregu/null"
+	"github.com/lib/pq"
+)
+
+// The priority levels for work items. Unclaimed work items with higher
+// priorities are returned first. Work items enqueued in bulk by administrators
+// use PriorityBackfill.
+const (
+	PriorityBackfill    = -100
+	PriorityNormal      = 0
+	PriorityInteractive = 100
 )
 
 type CPUUsageEvent struct {
@@ -22,6 +33,57 @@ type CPUUsageEvent struct {
 	Value         apd.Decimal `db:"value" json:"value"`
 	CreatedBy     string      `db:"created_by" json:"created_by"`
 	LastModified  string      `db:"last_modified" json:"last_modified"`
+	Priority      int         `db:"priority" json:"priority"`
+
+	// ResourceType and AllocationSource identify the total that the event
+	// applies to. The defaults are used if they're unset.
+	ResourceType     string `db:"resource_type" json:"resource_type"`
+	AllocationSource string `db:"allocation_source" json:"allocation_source"`
+
+	// Voided events are kept for auditing but no longer count towards the
+	// user's usage. If the event had already been applied when it was voided,
+	// CompensatingEventID is the event that reverses it.
+	Voided              bool        `db:"voided" json:"voided"`
+	VoidedBy            null.String `db:"voided_by" json:"voided_by"`
+	VoidedOn            null.Time   `db:"voided_on" json:"voided_on"`
+	CompensatingEventID null.String `db:"compensating_event_id" json:"compensating_event_id"`
+
+	// DedupKey identifies the change that the event records. An event isn't
+	// added if another event already has the same key, so that retries and
+	// redelivered messages can't record the same change twice. Events without
+	// a key are always added.
+	DedupKey null.String `db:"dedup_key" json:"dedup_key"`
+
+	// Reason explains why an administrator enqueued the event.
+	Reason null.String `db:"reason" json:"reason"`
+
+	// Cluster identifies where the usage that the event records was incurred,
+	// e.g. the DE's Kubernetes cluster, OSG, or a partner HPC system.
+	Cluster null.String `db:"cluster" json:"cluster"`
+}
+
+// EventDedupKey returns the deduplication key for the sequence'th event of the
+// given type recorded for an analysis.
+func EventDedupKey(analysisID string, eventType EventType, sequence int) string {
+	return fmt.Sprintf("%s/%s/%d", analysisID, eventType, sequence)
+}
+
+// ResetDedupKey returns the deduplication key for a scheduled reset of the
+// user's CPU hours at the given time.
+func ResetDedupKey(userID string, at time.Time) string {
+	return fmt.Sprintf("reset/%s/%s", userID, at.UTC().Format(time.RFC3339))
+}
+
+// withDefaults fills in the default resource type and allocation source if
+// they're unset.
+func (e *CPUUsageEvent) withDefaults() *CPUUsageEvent {
+	if e.ResourceType == "" {
+		e.ResourceType = DefaultResourceType
+	}
+	if e.AllocationSource == "" {
+		e.AllocationSource = DefaultAllocationSource
+	}
+	return e
 }
 
 type CPUUsageWorkItem struct {
@@ -38,25 +100,89 @@ type CPUUsageWorkItem struct {
 }
 
 // AddCPUUsageEvent adds a new usage event to the database with the default values for
-// the work queue fields.
-func (d *Database) AddCPUUsageEvent(context context.Context, event *CPUUsageEvent) error {
+// the work queue fields. Returns false if the event has the same deduplication key as
+// an existing event, in which case it isn't added.
+func (d *Database) AddCPUUsageEvent(context context.Context, event *CPUUsageEvent) (bool, error) {
+	count, err := d.InsertCPUUsageEvents(context, []CPUUsageEvent{*event})
+	return count > 0, err
+}
+
+// InsertCPUUsageEvents adds usage events to the database with the default values for
+// the work queue fields in a single statement, so that large batches don't need a
+// round trip per event. Either all of the events are added or none of them are,
+// except for the events with the same deduplication keys as existing events, which
+// are skipped. Returns the number of events added.
+func (d *Database) InsertCPUUsageEvents(context context.Context, events []CPUUsageEvent) (int64, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	var (
+		recordDates    = make([]string, len(events))
+		effectiveDates = make([]string, len(events))
+		eventTypes     = make([]string, len(events))
+		values         = make([]string, len(events))
+		createdBy      = make([]string, len(events))
+		priorities     = make([]int64, len(events))
+		resourceTypes  = make([]string, len(events))
+		sources        = make([]string, len(events))
+		dedupKeys      = make([]string, len(events))
+		reasons        = make([]string, len(events))
+		clusters       = make([]string, len(events))
+	)
+	for i, event := range events {
+		event.withDefaults()
+		recordDates[i] = event.RecordDate.Format(time.RFC3339Nano)
+		effectiveDates[i] = event.EffectiveDate.Format(time.RFC3339Nano)
+		eventTypes[i] = string(event.EventType)
+		values[i] = event.Value.Text('f')
+		createdBy[i] = event.CreatedBy
+		priorities[i] = int64(event.Priority)
+		resourceTypes[i] = event.ResourceType
+		sources[i] = event.AllocationSource
+		dedupKeys[i] = event.DedupKey.String
+		reasons[i] = event.Reason.String
+		clusters[i] = event.Cluster.String
+	}
+
 	const q = `
 		INSERT INTO cpu_usage_events
-			(record_date, effective_date, event_type_id, value, created_by) 
-		VALUES 
-			($1, $2, (SELECT id FROM cpu_usage_event_types WHERE name = $3), $4, $5);
+			(record_date, effective_date, event_type_id, value, created_by, priority, resource_type, allocation_source, dedup_key, reason, cluster)
+		SELECT
+			e.record_date,
+			e.effective_date,
+			(SELECT id FROM cpu_usage_event_types WHERE name = e.event_type),
+			e.value,
+			e.created_by,
+			e.priority,
+			e.resource_type,
+			e.allocation_source,
+			NULLIF(e.dedup_key, ''),
+			NULLIF(e.reason, ''),
+			NULLIF(e.cluster, '')
+		FROM unnest(
+			$1::timestamp[], $2::timestamp[], $3::text[], $4::numeric[],
+			$5::uuid[], $6::integer[], $7::text[], $8::text[], $9::text[],
+			$10::text[], $11::text[]
+		) AS e(record_date, effective_date, event_type, value, created_by, priority, resource_type, allocation_source, dedup_key, reason, cluster)
+		ON CONFLICT (dedup_key) DO NOTHING;
 	`
 
-	_, err := d.db.ExecContext(
+	return d.rowsAffected(
 		context,
 		q,
-		event.RecordDate,
-		event.EffectiveDate,
-		event.EventType,
-		event.Value,
-		event.CreatedBy,
+		pq.Array(recordDates),
+		pq.Array(effectiveDates),
+		pq.Array(eventTypes),
+		pq.Array(values),
+		pq.Array(createdBy),
+		pq.Array(priorities),
+		pq.Array(resourceTypes),
+		pq.Array(sources),
+		pq.Array(dedupKeys),
+		pq.Array(reasons),
+		pq.Array(clusters),
 	)
-	return err
 }
 
 // ClaimEvent marks an CPU usage event in the database as claimed for work by the entity
@@ -85,20 +211,26 @@ func (d *Database) ProcessingEvent(context context.Context, id string) error {
 	return err
 }
 
-// FinishedProcessingEvent marks an event as processed.
-func (d *Database) FinishedProcessingEvent(context context.Context, id string) error {
+// FinishedProcessingEvent marks an event as processed and records the user's
+// total after the event was applied to it, so that the change to the total can
+// be traced back to the event.
+func (d *Database) FinishedProcessingEvent(context context.Context, id string, resultingTotal *apd.Decimal) error {
 	const q = `
 		UPDATE cpu_usage_events
 		SET processing = false,
-			processed = true
+			processed = true,
+			processed_on = CURRENT_TIMESTAMP,
+			resulting_total = $2
 		WHERE id = $1;
 	`
-	_, err := d.db.ExecContext(context, q, id)
+	_, err := d.db.ExecContext(context, q, id, resultingTotal)
 	return err
 }
 
 // UnclaimedUnprocessedEvents returns a listing of the CPUUsageWorkItem for records that are not
 // claimed, processed, being processed, expired, and have not reached the maximum number of attempts.
+// Records with higher priorities are listed first, and records with the same priority are listed
+// oldest first.
 func (d *Database) UnclaimedUnprocessedEvents(context context.Context) ([]CPUUsageWorkItem, error) {
 	var workItems []CPUUsageWorkItem
 
@@ -119,15 +251,27 @@ func (d *Database) UnclaimedUnprocessedEvents(context context.Context) ([]CPUUsa
 			c.processing,
 			c.processed_on,
 			c.max_processing_attempts,
-			c.attempts
+			c.attempts,
+			c.priority,
+			c.resource_type,
+			c.allocation_source,
+			c.voided,
+			c.voided_by,
+			c.voided_on,
+			c.compensating_event_id,
+			c.dedup_key,
+			c.reason,
+			c.cluster
 		FROM cpu_usage_events c
 		JOIN users u ON c.created_by = u.id
 		JOIN cpu_usage_event_types e ON c.event_type_id = e.id
 		WHERE NOT c.claimed
 		AND NOT c.processed
 		AND NOT c.processing
+		AND NOT c.voided
 		AND c.attempts < c.max_processing_attempts
-		AND CURRENT_TIMESTAMP >= COALESCE(c.claim_expires_on, to_timestamp(0));
+		AND CURRENT_TIMESTAMP >= COALESCE(c.claim_expires_on, to_timestamp(0))
+		ORDER BY c.priority DESC, c.record_date, c.id;
 	`
 
 	rows, err := d.db.QueryxContext(context, q)
@@ -171,7 +315,17 @@ func (d *Database) ListEvents(context context.Context) ([]CPUUsageWorkItem, erro
 			c.processing,
 			c.processed_on,
 			c.max_processing_attempts,
-			c.attempts
+			c.attempts,
+			c.priority,
+			c.resource_type,
+			c.allocation_source,
+			c.voided,
+			c.voided_by,
+			c.voided_on,
+			c.compensating_event_id,
+			c.dedup_key,
+			c.reason,
+			c.cluster
 		FROM cpu_usage_events c
 		JOIN users u ON c.created_by = u.id
 		JOIN cpu_usage_event_types e ON c.event_type_id = e.id;
@@ -218,7 +372,17 @@ func (d *Database) ListAllUserEvents(context context.Context, username string) (
 			c.processing,
 			c.processed_on,
 			c.max_processing_attempts,
-			c.attempts
+			c.attempts,
+			c.priority,
+			c.resource_type,
+			c.allocation_source,
+			c.voided,
+			c.voided_by,
+			c.voided_on,
+			c.compensating_event_id,
+			c.dedup_key,
+			c.reason,
+			c.cluster
 		FROM cpu_usage_events c
 		JOIN users u ON c.created_by = u.id
 		JOIN cpu_usage_event_types e ON c.event_type_id = e.id
@@ -266,7 +430,17 @@ func (d *Database) Event(context context.Context, id string) (*CPUUsageWorkItem,
 			c.processing,
 			c.processed_on,
 			c.max_processing_attempts,
-			c.attempts
+			c.attempts,
+			c.priority,
+			c.resource_type,
+			c.allocation_source,
+			c.voided,
+			c.voided_by,
+			c.voided_on,
+			c.compensating_event_id,
+			c.dedup_key,
+			c.reason,
+			c.cluster
 		FROM cpu_usage_events c
 		JOIN cpu_usage_event_types e ON c.event_type_id = e.id
 		WHERE c.id = $1;
@@ -294,7 +468,8 @@ func (d *Database) UpdateEvent(context context.Context, workItem *CPUUsageWorkIt
 			processing = $12,
 			processed_on = $13,
 			max_processing_attempts = $14,
-			attempts = $15
+			attempts = $15,
+			priority = $16
 		WHERE id = $1;
 	`
 
@@ -316,6 +491,7 @@ func (d *Database) UpdateEvent(context context.Context, workItem *CPUUsageWorkIt
 		workItem.ProcessedOn,
 		workItem.MaxProcessingAttempts,
 		workItem.Attempts,
+		workItem.Priority,
 	)
 	return err
 }
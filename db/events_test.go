@@ -0,0 +1,157 @@
+package db
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/guregu/null"
+	"github.com/jmoiron/sqlx"
+)
+
+// testDBEnv names the environment variable with the connection string for a
+// database with the DE schema and this service's migrations applied. The
+// tests that need a database are skipped if it isn't set. Each test runs in a
+// transaction that's rolled back, so the database is left unchanged.
+const testDBEnv = "RESOURCE_USAGE_API_TEST_DB"
+
+// testTx returns a transaction on the test database, skipping the test if no
+// test database is configured.
+func testTx(t *testing.T) *sqlx.Tx {
+	t.Helper()
+
+	uri := os.Getenv(testDBEnv)
+	if uri == "" {
+		t.Skipf("%s isn't set", testDBEnv)
+	}
+
+	dbconn, err := sqlx.Connect(DriverPQ, uri)
+	if err != nil {
+		t.Fatalf("unable to connect to the test database: %s", err)
+	}
+	t.Cleanup(func() { dbconn.Close() })
+
+	tx, err := dbconn.Beginx()
+	if err != nil {
+		t.Fatalf("unable to start a transaction: %s", err)
+	}
+	t.Cleanup(func() { _ = tx.Rollback() })
+
+	return tx
+}
+
+// testUser adds a user in the transaction and returns its ID.
+func testUser(t *testing.T, tx *sqlx.Tx, username string) string {
+	t.Helper()
+
+	var userID string
+	if err := tx.QueryRowx(`INSERT INTO users (username) VALUES ($1) RETURNING id`, username).Scan(&userID); err != nil {
+		t.Fatalf("unable to add a user: %s", err)
+	}
+	return userID
+}
+
+func TestInsertCPUUsageEvents(t *testing.T) {
+	tx := testTx(t)
+	ctx := context.Background()
+	d := New(tx)
+
+	userID := testUser(t, tx, "insert-events-test@example.org")
+	now := time.Now().UTC().Truncate(time.Microsecond)
+
+	events := []CPUUsageEvent{
+		{
+			RecordDate:    now,
+			EffectiveDate: now,
+			EventType:     CPUHoursAdd,
+			Value:         *apd.New(15, -1),
+			CreatedBy:     userID,
+			DedupKey:      null.StringFrom("insert-events-test/1"),
+		},
+		{
+			RecordDate:    now,
+			EffectiveDate: now,
+			EventType:     CPUHoursSubtract,
+			Value:         *apd.New(5, -1),
+			CreatedBy:     userID,
+			DedupKey:      null.StringFrom("insert-events-test/2"),
+			Cluster:       null.StringFrom("example"),
+		},
+	}
+
+	count, err := d.InsertCPUUsageEvents(ctx, events)
+	if err != nil {
+		t.Fatalf("unable to insert the events: %s", err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 events to be inserted, got %d", count)
+	}
+
+	// The same events are skipped the second time because of their keys.
+	count, err = d.InsertCPUUsageEvents(ctx, events)
+	if err != nil {
+		t.Fatalf("unable to insert the events again: %s", err)
+	}
+	if count != 0 {
+		t.Fatalf("expected the duplicate events to be skipped, got %d inserted", count)
+	}
+
+	var stored []struct {
+		CreatedBy        string      `db:"created_by"`
+		ResourceType     string      `db:"resource_type"`
+		AllocationSource string      `db:"allocation_source"`
+		Value            apd.Decimal `db:"value"`
+		Cluster          null.String `db:"cluster"`
+	}
+	const q = `
+		SELECT created_by, resource_type, allocation_source, value, cluster
+		FROM cpu_usage_events
+		WHERE created_by = $1
+		ORDER BY dedup_key;
+	`
+	if err = tx.Select(&stored, q, userID); err != nil {
+		t.Fatalf("unable to read the events back: %s", err)
+	}
+	if len(stored) != 2 {
+		t.Fatalf("expected 2 stored events, got %d", len(stored))
+	}
+	for i, event := range stored {
+		if event.CreatedBy != userID {
+			t.Errorf("event %d: expected created_by %s, got %s", i, userID, event.CreatedBy)
+		}
+		if event.ResourceType != DefaultResourceType || event.AllocationSource != DefaultAllocationSource {
+			t.Errorf("event %d: expected the default total, got %s/%s", i, event.ResourceType, event.AllocationSource)
+		}
+		if event.Value.Cmp(&events[i].Value) != 0 {
+			t.Errorf("event %d: expected value %s, got %s", i, events[i].Value.String(), event.Value.String())
+		}
+	}
+	if stored[0].Cluster.Valid || stored[1].Cluster.String != "example" {
+		t.Errorf("expected clusters (null, example), got (%v, %v)", stored[0].Cluster, stored[1].Cluster)
+	}
+}
+
+func TestAddCPUUsageEvent(t *testing.T) {
+	tx := testTx(t)
+	ctx := context.Background()
+	d := New(tx)
+
+	userID := testUser(t, tx, "add-event-test@example.org")
+	now := time.Now().UTC()
+
+	added, err := d.AddCPUUsageEvent(ctx, &CPUUsageEvent{
+		RecordDate:    now,
+		EffectiveDate: now,
+		EventType:     CPUHoursAdd,
+		Value:         *apd.New(1, 0),
+		CreatedBy:     userID,
+	})
+	if err != nil {
+		t.Fatalf("unable to add the event: %s", err)
+	}
+	if !added {
+		t.Fatal("expected the event to be added")
+	}
+}
@@ -0,0 +1,38 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/cyverse-de/resource-usage-api/faults"
+	"github.com/jmoiron/sqlx"
+)
+
+// faultyAccessor injects faults into the statements that are committed as soon
+// as they're executed, which is every statement executed outside of a
+// transaction. Transactions are committed by their callers, which inject
+// faults themselves.
+type faultyAccessor struct {
+	DatabaseAccessor
+}
+
+// ExecContext fails without executing the statement when a fault is injected.
+func (f *faultyAccessor) ExecContext(context context.Context, q string, args ...interface{}) (sql.Result, error) {
+	if err := faults.Inject(faults.DBCommit); err != nil {
+		return nil, err
+	}
+	return f.DatabaseAccessor.ExecContext(context, q, args...)
+}
+
+// withFaults returns the accessor wrapped so that faults are injected into its
+// statements, unless this build doesn't inject faults or the accessor is a
+// transaction.
+func withFaults(db DatabaseAccessor) DatabaseAccessor {
+	if !faults.Enabled {
+		return db
+	}
+	if _, ok := db.(*sqlx.Tx); ok {
+		return db
+	}
+	return &faultyAccessor{db}
+}
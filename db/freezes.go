@@ -0,0 +1,238 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/guregu/null"
+)
+
+// FrozenUser records that accrual is frozen for a user.
+type FrozenUser struct {
+	UserID   string    `db:"user_id" json:"user_id"`
+	Username string    `db:"username" json:"username"`
+	FrozenBy string    `db:"frozen_by" json:"frozen_by"`
+	FrozenOn time.Time `db:"frozen_on" json:"frozen_on"`
+	Reason   string    `db:"reason" json:"reason"`
+}
+
+// ParkedUsageRecord is a usage record that arrived while accrual was frozen
+// for its user.
+type ParkedUsageRecord struct {
+	ID           string      `db:"id" json:"id"`
+	UserID       string      `db:"user_id" json:"user_id"`
+	AnalysisID   null.String `db:"analysis_id" json:"analysis_id"`
+	ResourceType string      `db:"resource_type" json:"resource_type"`
+	Unit         string      `db:"unit" json:"unit"`
+	Value        apd.Decimal `db:"value" json:"value"`
+	ParkedOn     time.Time   `db:"parked_on" json:"parked_on"`
+
+	// EffectiveDate is the time that the usage is attributed to in QMS. It's
+	// unset if the usage is attributed to the time it's applied.
+	EffectiveDate null.Time `db:"effective_date" json:"effective_date"`
+
+	// Cluster is the cluster that the usage was recorded on. It's empty if the
+	// cluster isn't known.
+	Cluster string `db:"cluster" json:"cluster"`
+}
+
+// FreezeUser freezes accrual for a user. Returns false if it was already
+// frozen.
+func (d *Database) FreezeUser(context context.Context, userID, frozenBy, reason string) (bool, error) {
+	const q = `
+		INSERT INTO cpu_usage_frozen_users
+			(user_id, frozen_by, reason)
+		VALUES
+			($1, $2, $3)
+		ON CONFLICT (user_id) DO NOTHING;
+	`
+	count, err := d.rowsAffected(context, q, userID, frozenBy, reason)
+	return count > 0, err
+}
+
+// UnfreezeUser unfreezes accrual for a user. Returns false if it wasn't
+// frozen.
+func (d *Database) UnfreezeUser(context context.Context, userID string) (bool, error) {
+	const q = `
+		DELETE FROM cpu_usage_frozen_users WHERE user_id = $1;
+	`
+	count, err := d.rowsAffected(context, q, userID)
+	return count > 0, err
+}
+
+// UserFrozen returns true if accrual is frozen for the user.
+func (d *Database) UserFrozen(context context.Context, username string) (bool, error) {
+	var frozen bool
+
+	const q = `
+		SELECT EXISTS (
+			SELECT 1
+			FROM cpu_usage_frozen_users f
+			JOIN users u ON f.user_id = u.id
+			WHERE u.username = $1
+		);
+	`
+
+	err := d.db.QueryRowxContext(context, q, username).Scan(&frozen)
+	return frozen, err
+}
+
+// FrozenUsers returns every user whose accrual is frozen.
+func (d *Database) FrozenUsers(context context.Context) ([]FrozenUser, error) {
+	var users []FrozenUser
+
+	const q = `
+		SELECT
+			f.user_id,
+			u.username,
+			f.frozen_by,
+			f.frozen_on,
+			f.reason
+		FROM cpu_usage_frozen_users f
+		JOIN users u ON f.user_id = u.id
+		ORDER BY f.frozen_on;
+	`
+
+	rows, err := d.db.QueryxContext(context, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user FrozenUser
+		if err = rows.StructScan(&user); err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
+}
+
+// ParkUsageRecord stores a usage record for a frozen user so that it can be
+// applied once the user is unfrozen. The analysis ID, effective date and
+// cluster may be empty.
+func (d *Database) ParkUsageRecord(context context.Context, username, analysisID, resourceType, unit string, value *apd.Decimal, effectiveDate null.Time, cluster string) error {
+	const q = `
+		INSERT INTO cpu_usage_parked_records
+			(user_id, analysis_id, resource_type, unit, value, effective_date, cluster)
+		VALUES
+			((SELECT id FROM users WHERE username = $1), NULLIF($2, '')::uuid, $3, $4, $5, $6, $7);
+	`
+	_, err := d.db.ExecContext(context, q, username, analysisID, resourceType, unit, value, effectiveDate, cluster)
+	return err
+}
+
+// ParkedUsageRecords returns the usage records parked for a user, oldest
+// first.
+func (d *Database) ParkedUsageRecords(context context.Context, userID string) ([]ParkedUsageRecord, error) {
+	var records []ParkedUsageRecord
+
+	const q = `
+		SELECT
+			id,
+			user_id,
+			analysis_id,
+			resource_type,
+			unit,
+			value,
+			parked_on,
+			effective_date,
+			cluster
+		FROM cpu_usage_parked_records
+		WHERE user_id = $1
+		ORDER BY parked_on, id;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var record ParkedUsageRecord
+		if err = rows.StructScan(&record); err != nil {
+			return records, err
+		}
+		records = append(records, record)
+	}
+
+	if err = rows.Err(); err != nil {
+		return records, err
+	}
+
+	return records, nil
+}
+
+// ClaimParkedUsageRecord removes the user's oldest parked usage record and
+// returns it, so that the caller is the only one that applies it. Records that
+// another caller is claiming at the same time are skipped. Returns nil if there
+// are no records left to claim.
+func (d *Database) ClaimParkedUsageRecord(context context.Context, userID string) (*ParkedUsageRecord, error) {
+	var record ParkedUsageRecord
+
+	const q = `
+		DELETE FROM cpu_usage_parked_records
+		WHERE id = (
+			SELECT id
+			FROM cpu_usage_parked_records
+			WHERE user_id = $1
+			ORDER BY parked_on, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING
+			id,
+			user_id,
+			analysis_id,
+			resource_type,
+			unit,
+			value,
+			parked_on,
+			effective_date,
+			cluster;
+	`
+
+	err := d.db.QueryRowxContext(context, q, userID).StructScan(&record)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// RestoreParkedUsageRecord puts back a parked usage record that was claimed but
+// couldn't be applied, keeping its ID and the time it was parked so that it's
+// still applied in the same order.
+func (d *Database) RestoreParkedUsageRecord(context context.Context, record *ParkedUsageRecord) error {
+	const q = `
+		INSERT INTO cpu_usage_parked_records
+			(id, user_id, analysis_id, resource_type, unit, value, parked_on, effective_date, cluster)
+		VALUES
+			($1, $2, $3, $4, $5, $6, $7, $8, $9);
+	`
+	_, err := d.db.ExecContext(
+		context, q,
+		record.ID,
+		record.UserID,
+		record.AnalysisID,
+		record.ResourceType,
+		record.Unit,
+		&record.Value,
+		record.ParkedOn,
+		record.EffectiveDate,
+		record.Cluster,
+	)
+	return err
+}
@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+)
+
+// TotalForUserAt returns the user's total for a resource type and allocation
+// source whose effective period contains the given moment. The total is its
+// current value, not the value it had at that moment.
+func (d *Database) TotalForUserAt(context context.Context, username, resourceType, allocationSource string, at time.Time) (*CPUHours, error) {
+	var cpuHours CPUHours
+
+	const q = `
+		SELECT
+			t.id,
+			t.total,
+			t.user_id,
+			u.username,
+			t.resource_type,
+			t.allocation_source,
+			lower(t.effective_range) effective_start,
+			upper(t.effective_range) effective_end,
+			t.last_modified
+		FROM cpu_usage_totals t
+		JOIN users u ON t.user_id = u.id
+		WHERE u.username = $1
+		AND t.resource_type = $2
+		AND t.allocation_source = $3
+		AND t.effective_range @> $4::timestamp
+		LIMIT 1;
+	`
+	err := d.db.QueryRowxContext(context, q, username, resourceType, allocationSource, at).StructScan(&cpuHours)
+	if err != nil {
+		return nil, err
+	}
+	return &cpuHours, nil
+}
+
+// LedgerEntry is a processed usage event as it affected a user's total.
+// ResultingTotal is nil if the total after the event wasn't recorded.
+type LedgerEntry struct {
+	ID             string       `db:"id"`
+	EventType      EventType    `db:"event_type"`
+	Value          apd.Decimal  `db:"value"`
+	ResultingTotal *apd.Decimal `db:"resulting_total"`
+	ProcessedOn    time.Time    `db:"processed_on"`
+}
+
+// Ledger returns the events that had been applied to the total by the given
+// moment, in the order they were applied. Voided events are included, since
+// they counted until their compensating events were applied.
+func (d *Database) Ledger(context context.Context, total *CPUHours, asOf time.Time) ([]LedgerEntry, error) {
+	var entries []LedgerEntry
+
+	const q = `
+		SELECT
+			c.id,
+			e.name event_type,
+			c.value,
+			c.resulting_total,
+			c.processed_on
+		FROM cpu_usage_events c
+		JOIN cpu_usage_event_types e ON c.event_type_id = e.id
+		WHERE c.created_by = $1
+		AND c.resource_type = $2
+		AND c.allocation_source = $3
+		AND c.processed
+		AND c.processed_on <= $4::timestamp
+		AND c.effective_date >= $5::timestamp
+		AND c.effective_date < $6::timestamp
+		ORDER BY c.processed_on, c.record_date, c.id;
+	`
+	rows, err := d.db.QueryxContext(
+		context,
+		q,
+		total.UserID,
+		total.ResourceType,
+		total.AllocationSource,
+		asOf,
+		total.EffectiveStart,
+		total.EffectiveEnd,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry LedgerEntry
+		if err = rows.StructScan(&entry); err != nil {
+			return entries, err
+		}
+		entries = append(entries, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return entries, err
+	}
+
+	return entries, nil
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/guregu/null"
+)
+
+// Hold is an estimate of the usage of an analysis that's still running. It
+// counts against the user's available quota until the analysis's actual usage
+// is recorded or the hold expires, so that users can't launch more work than
+// their quota covers.
+type Hold struct {
+	AnalysisID   string      `db:"analysis_id" json:"analysis_id"`
+	UserID       string      `db:"user_id" json:"user_id"`
+	Username     string      `db:"username" json:"username"`
+	ResourceType string      `db:"resource_type" json:"resource_type"`
+	Amount       apd.Decimal `db:"amount" json:"amount"`
+	PlacedOn     time.Time   `db:"placed_on" json:"placed_on"`
+	ExpiresOn    time.Time   `db:"expires_on" json:"expires_on"`
+	ReleasedOn   null.Time   `db:"released_on" json:"released_on"`
+}
+
+// PlaceHold places a hold for an analysis. Returns false if the analysis
+// already has one, which happens when several status updates for it arrive.
+func (d *Database) PlaceHold(context context.Context, hold *Hold) (bool, error) {
+	const q = `
+		INSERT INTO cpu_usage_holds
+			(analysis_id, user_id, resource_type, amount, expires_on)
+		VALUES
+			($1, $2, $3, $4, $5)
+		ON CONFLICT (analysis_id) DO NOTHING;
+	`
+	count, err := d.rowsAffected(context, q, hold.AnalysisID, hold.UserID, hold.ResourceType, &hold.Amount, hold.ExpiresOn)
+	return count > 0, err
+}
+
+// ReleaseHold releases the hold for an analysis once its actual usage has been
+// recorded. Returns false if the analysis has no unreleased hold.
+func (d *Database) ReleaseHold(context context.Context, analysisID string) (bool, error) {
+	const q = `
+		UPDATE cpu_usage_holds
+		SET released_on = CURRENT_TIMESTAMP
+		WHERE analysis_id = $1
+		AND released_on IS NULL;
+	`
+	count, err := d.rowsAffected(context, q, analysisID)
+	return count > 0, err
+}
+
+// ActiveHolds returns the user's holds that haven't been released or expired,
+// oldest first.
+func (d *Database) ActiveHolds(context context.Context, username string) ([]Hold, error) {
+	var holds []Hold
+
+	const q = `
+		SELECT
+			h.analysis_id,
+			h.user_id,
+			u.username,
+			h.resource_type,
+			h.amount,
+			h.placed_on,
+			h.expires_on,
+			h.released_on
+		FROM cpu_usage_holds h
+		JOIN users u ON h.user_id = u.id
+		WHERE u.username = $1
+		AND h.released_on IS NULL
+		AND h.expires_on > CURRENT_TIMESTAMP
+		ORDER BY h.placed_on, h.analysis_id;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hold Hold
+		if err = rows.StructScan(&hold); err != nil {
+			return holds, err
+		}
+		holds = append(holds, hold)
+	}
+
+	if err = rows.Err(); err != nil {
+		return holds, err
+	}
+
+	return holds, nil
+}
+
+// HeldAmount returns the total of the user's holds for the resource type that
+// haven't been released or expired.
+func (d *Database) HeldAmount(context context.Context, username, resourceType string) (*apd.Decimal, error) {
+	var held apd.Decimal
+
+	const q = `
+		SELECT COALESCE(sum(h.amount), 0)
+		FROM cpu_usage_holds h
+		JOIN users u ON h.user_id = u.id
+		WHERE u.username = $1
+		AND h.resource_type = $2
+		AND h.released_on IS NULL
+		AND h.expires_on > CURRENT_TIMESTAMP;
+	`
+
+	err := d.db.QueryRowxContext(context, q, username, resourceType).Scan(&held)
+	return &held, err
+}
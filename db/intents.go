@@ -0,0 +1,143 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// IntentState is the state of a calculation intent.
+type IntentState string
+
+const (
+	IntentPending   IntentState = "pending"
+	IntentCompleted IntentState = "completed"
+)
+
+// CalculationClaim is a worker's claim on the calculation for an analysis.
+// The token identifies the claim, so that a worker whose claim was taken over
+// can't complete or release the calculation.
+type CalculationClaim struct {
+	AnalysisID string `db:"analysis_id"`
+	Token      string `db:"claim_token"`
+}
+
+// BeginCalculationIntent claims the calculation of the usage for an analysis
+// for the worker. Returns nil if the calculation has already been completed or
+// is claimed by an active worker, including this one, in which case the caller
+// should not perform the calculation.
+func (d *Database) BeginCalculationIntent(context context.Context, analysisID, ownerID string) (*CalculationClaim, error) {
+	var claim CalculationClaim
+
+	const q = `
+		INSERT INTO cpu_calculation_intents AS i
+			(analysis_id, owner_id, state, claim_token)
+		VALUES
+			($1, $2, $3, gen_random_uuid())
+		ON CONFLICT (analysis_id) DO UPDATE
+		SET owner_id = EXCLUDED.owner_id,
+			claim_token = EXCLUDED.claim_token,
+			last_modified = CURRENT_TIMESTAMP
+		WHERE i.state = $3
+		AND (
+			i.claim_token IS NULL
+			OR i.owner_id IS NULL
+			OR i.owner_id NOT IN (
+				SELECT id FROM cpu_usage_workers
+				WHERE active
+				AND CURRENT_TIMESTAMP < COALESCE(activation_expires_on, to_timestamp(0))
+			)
+		)
+		RETURNING i.analysis_id, i.claim_token;
+	`
+	err := d.db.QueryRowxContext(context, q, analysisID, ownerID, IntentPending).StructScan(&claim)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &claim, nil
+}
+
+// CompleteCalculationIntent records that the claimed calculation has been
+// completed. Returns false if the claim was taken over by another worker.
+func (d *Database) CompleteCalculationIntent(context context.Context, claim *CalculationClaim) (bool, error) {
+	const q = `
+		UPDATE cpu_calculation_intents
+		SET state = $3,
+			claim_token = NULL,
+			last_modified = CURRENT_TIMESTAMP
+		WHERE analysis_id = $1
+		AND claim_token = $2;
+	`
+	count, err := d.rowsAffected(context, q, claim.AnalysisID, claim.Token, IntentCompleted)
+	return count > 0, err
+}
+
+// ReleaseCalculationIntent gives up a claim on a calculation that failed so
+// that it can be retried, counting the failed attempt. Nothing is changed if
+// the claim was taken over by another worker.
+func (d *Database) ReleaseCalculationIntent(context context.Context, claim *CalculationClaim) error {
+	const q = `
+		UPDATE cpu_calculation_intents
+		SET owner_id = NULL,
+			claim_token = NULL,
+			attempts = attempts + 1,
+			last_modified = CURRENT_TIMESTAMP
+		WHERE analysis_id = $1
+		AND claim_token = $2;
+	`
+	_, err := d.db.ExecContext(context, q, claim.AnalysisID, claim.Token)
+	return err
+}
+
+// ClaimOrphanedCalculationIntents claims the pending calculations that aren't
+// claimed or whose owner is no longer an active worker, skipping those that
+// have already failed maxAttempts times. Returns the claims.
+func (d *Database) ClaimOrphanedCalculationIntents(context context.Context, ownerID string, maxAttempts int) ([]CalculationClaim, error) {
+	var claims []CalculationClaim
+
+	const q = `
+		UPDATE cpu_calculation_intents
+		SET owner_id = $1,
+			claim_token = gen_random_uuid(),
+			last_modified = CURRENT_TIMESTAMP
+		WHERE analysis_id IN (
+			SELECT analysis_id
+			FROM cpu_calculation_intents
+			WHERE state = $2
+			AND attempts < $3
+			AND (
+				claim_token IS NULL
+				OR owner_id IS NULL
+				OR owner_id NOT IN (
+					SELECT id FROM cpu_usage_workers
+					WHERE active
+					AND CURRENT_TIMESTAMP < COALESCE(activation_expires_on, to_timestamp(0))
+				)
+			)
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING analysis_id, claim_token;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, ownerID, IntentPending, maxAttempts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var claim CalculationClaim
+		if err = rows.StructScan(&claim); err != nil {
+			return nil, err
+		}
+		claims = append(claims, claim)
+	}
+
+	if err = rows.Err(); err != nil {
+		return claims, err
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+)
+
+// QueuedUsageMessage is a usage message that has been assigned its sequence
+// number and is waiting to be published. Messages stay queued until they're
+// published, so a message that can't be published is sent again rather than
+// leaving a gap in the sequence.
+type QueuedUsageMessage struct {
+	ID            string      `db:"id" json:"id"`
+	Type          string      `db:"type" json:"type"`
+	Sequence      int64       `db:"sequence" json:"sequence"`
+	Username      string      `db:"username" json:"username"`
+	AnalysisID    string      `db:"analysis_id" json:"analysis_id"`
+	ResourceType  string      `db:"resource_type" json:"resource_type"`
+	Unit          string      `db:"unit" json:"unit"`
+	Value         apd.Decimal `db:"value" json:"value"`
+	EffectiveDate time.Time   `db:"effective_date" json:"effective_date"`
+	Cluster       string      `db:"cluster" json:"cluster"`
+	Attempts      int         `db:"attempts" json:"attempts"`
+	LastError     string      `db:"last_error" json:"last_error"`
+	NextAttempt   time.Time   `db:"next_attempt" json:"next_attempt"`
+	CreatedOn     time.Time   `db:"created_on" json:"created_on"`
+}
+
+// QueueUsageMessage assigns the message the next sequence number for the
+// user's usage of its resource type and queues it to be published, in a
+// single statement. The numbers start at one and are shared by every instance
+// of the service, so they're never handed out twice even when several
+// instances publish for the same user. The message's ID and sequence number
+// are updated.
+func (d *Database) QueueUsageMessage(context context.Context, message *QueuedUsageMessage) error {
+	const q = `
+		WITH next AS (
+			INSERT INTO usage_message_sequences (user_id, resource_type, sequence)
+			SELECT u.id, $2, 1
+			FROM users u
+			WHERE u.username = $1
+			ON CONFLICT (user_id, resource_type) DO UPDATE
+			SET sequence = usage_message_sequences.sequence + 1
+			RETURNING user_id, sequence
+		)
+		INSERT INTO usage_message_outbox
+			(user_id, resource_type, sequence, type, analysis_id, unit, value, effective_date, cluster)
+		SELECT n.user_id, $2, n.sequence, $3, NULLIF($4, '')::uuid, $5, $8, $6, $7
+		FROM next n
+		RETURNING id, sequence;
+	`
+
+	return d.db.QueryRowxContext(
+		context, q,
+		message.Username,
+		message.ResourceType,
+		message.Type,
+		message.AnalysisID,
+		message.Unit,
+		message.EffectiveDate,
+		message.Cluster,
+		&message.Value,
+	).Scan(&message.ID, &message.Sequence)
+}
+
+// DueUsageMessages returns up to limit of the queued usage messages that are
+// due to be published again, in the order they were queued.
+func (d *Database) DueUsageMessages(context context.Context, limit int) ([]QueuedUsageMessage, error) {
+	var messages []QueuedUsageMessage
+
+	const q = `
+		SELECT
+			m.id,
+			m.type,
+			m.sequence,
+			u.username,
+			COALESCE(m.analysis_id::text, '') analysis_id,
+			m.resource_type,
+			m.unit,
+			m.value,
+			m.effective_date,
+			m.cluster,
+			m.attempts,
+			m.last_error,
+			m.next_attempt,
+			m.created_on
+		FROM usage_message_outbox m
+		JOIN users u ON m.user_id = u.id
+		WHERE m.next_attempt <= CURRENT_TIMESTAMP
+		ORDER BY m.created_on, m.sequence
+		LIMIT $1;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var message QueuedUsageMessage
+		if err = rows.StructScan(&message); err != nil {
+			return messages, err
+		}
+		messages = append(messages, message)
+	}
+
+	if err = rows.Err(); err != nil {
+		return messages, err
+	}
+
+	return messages, nil
+}
+
+// UsageMessageFailed records another failed attempt to publish a queued usage
+// message and schedules the next one.
+func (d *Database) UsageMessageFailed(context context.Context, id string, nextAttempt time.Time, lastError string) error {
+	const q = `
+		UPDATE usage_message_outbox
+		SET attempts = attempts + 1,
+			next_attempt = $2,
+			last_error = $3
+		WHERE id = $1;
+	`
+	_, err := d.db.ExecContext(context, q, id, nextAttempt, lastError)
+	return err
+}
+
+// DeleteUsageMessage removes a queued usage message once it's been published.
+func (d *Database) DeleteUsageMessage(context context.Context, id string) error {
+	const q = `
+		DELETE FROM usage_message_outbox WHERE id = $1;
+	`
+	_, err := d.db.ExecContext(context, q, id)
+	return err
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+)
+
+// Overdraft is the amount of a resource that a user has consumed past their
+// quota during a subscription period.
+type Overdraft struct {
+	ResourceType string      `db:"resource_type" json:"resource_type"`
+	PeriodStart  time.Time   `db:"period_start" json:"period_start"`
+	Overdraft    apd.Decimal `db:"overdraft" json:"overdraft"`
+	LastModified time.Time   `db:"last_modified" json:"last_modified"`
+}
+
+// SetOverdraft records the user's overdraft for a resource type during the
+// subscription period that began at periodStart.
+func (d *Database) SetOverdraft(context context.Context, username, resourceType string, periodStart time.Time, overdraft *apd.Decimal) error {
+	const q = `
+		INSERT INTO cpu_usage_overdrafts
+			(user_id, resource_type, period_start, overdraft)
+		VALUES
+			((SELECT id FROM users WHERE username = $1), $2, $3, $4)
+		ON CONFLICT (user_id, resource_type, period_start) DO UPDATE
+		SET overdraft = EXCLUDED.overdraft,
+			last_modified = CURRENT_TIMESTAMP;
+	`
+	_, err := d.db.ExecContext(context, q, username, resourceType, periodStart, overdraft)
+	return err
+}
+
+// Overdrafts returns the user's overdrafts for the subscription period that
+// began at periodStart, one per resource type.
+func (d *Database) Overdrafts(context context.Context, username string, periodStart time.Time) ([]Overdraft, error) {
+	var overdrafts []Overdraft
+
+	const q = `
+		SELECT
+			o.resource_type,
+			o.period_start,
+			o.overdraft,
+			o.last_modified
+		FROM cpu_usage_overdrafts o
+		JOIN users u ON o.user_id = u.id
+		WHERE u.username = $1
+		AND o.period_start = $2
+		ORDER BY o.resource_type;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, username, periodStart)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var overdraft Overdraft
+		if err = rows.StructScan(&overdraft); err != nil {
+			return overdrafts, err
+		}
+		overdrafts = append(overdrafts, overdraft)
+	}
+
+	if err = rows.Err(); err != nil {
+		return overdrafts, err
+	}
+
+	return overdrafts, nil
+}
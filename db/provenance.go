@@ -0,0 +1,101 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/guregu/null"
+)
+
+// CalculationProvenance records the inputs that produced a usage value for an
+// analysis, so that the charge can be explained later. BillingWeight is nil if
+// no billing weight was applied to the value.
+type CalculationProvenance struct {
+	ID                 string       `db:"id" json:"id"`
+	AnalysisID         string       `db:"analysis_id" json:"analysis_id"`
+	ResourceType       string       `db:"resource_type" json:"resource_type"`
+	Unit               string       `db:"unit" json:"unit"`
+	Value              apd.Decimal  `db:"value" json:"value"`
+	CalculationMode    string       `db:"calculation_mode" json:"calculation_mode"`
+	MillicoresReserved int64        `db:"millicores_reserved" json:"millicores_reserved"`
+	StartDate          time.Time    `db:"start_date" json:"start_date"`
+	EndDate            time.Time    `db:"end_date" json:"end_date"`
+	CodeVersion        string       `db:"code_version" json:"code_version"`
+	CalculatedOn       time.Time    `db:"calculated_on" json:"calculated_on"`
+	Cluster            null.String  `db:"cluster" json:"cluster"`
+	BillingWeight      *apd.Decimal `db:"billing_weight" json:"billing_weight"`
+}
+
+// AddCalculationProvenance records the inputs of a calculation. The ID and
+// calculation time are assigned by the database.
+func (d *Database) AddCalculationProvenance(context context.Context, p *CalculationProvenance) error {
+	const q = `
+		INSERT INTO cpu_calculation_provenance
+			(analysis_id, resource_type, unit, value, calculation_mode, millicores_reserved, start_date, end_date, code_version, cluster, billing_weight)
+		VALUES
+			($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11);
+	`
+	_, err := d.db.ExecContext(
+		context,
+		q,
+		p.AnalysisID,
+		p.ResourceType,
+		p.Unit,
+		&p.Value,
+		p.CalculationMode,
+		p.MillicoresReserved,
+		p.StartDate,
+		p.EndDate,
+		p.CodeVersion,
+		p.Cluster,
+		p.BillingWeight,
+	)
+	return err
+}
+
+// CalculationProvenanceForAnalysis returns every recorded calculation for the
+// analysis, most recent first.
+func (d *Database) CalculationProvenanceForAnalysis(context context.Context, analysisID string) ([]CalculationProvenance, error) {
+	var provenance []CalculationProvenance
+
+	const q = `
+		SELECT
+			id,
+			analysis_id,
+			resource_type,
+			unit,
+			value,
+			calculation_mode,
+			millicores_reserved,
+			start_date,
+			end_date,
+			code_version,
+			calculated_on,
+			cluster,
+			billing_weight
+		FROM cpu_calculation_provenance
+		WHERE analysis_id = $1
+		ORDER BY calculated_on DESC, resource_type;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, analysisID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p CalculationProvenance
+		if err = rows.StructScan(&p); err != nil {
+			return provenance, err
+		}
+		provenance = append(provenance, p)
+	}
+
+	if err = rows.Err(); err != nil {
+		return provenance, err
+	}
+
+	return provenance, nil
+}
@@ -0,0 +1,36 @@
+package db
+
+import "context"
+
+// UsageRecordPublished returns true if the usage record was already handed off
+// for the analysis, i.e. sent to QMS, queued for a retry, or parked.
+func (d *Database) UsageRecordPublished(context context.Context, key *UsageRecordKey) (bool, error) {
+	var published bool
+
+	const q = `
+		SELECT EXISTS(
+			SELECT 1
+			FROM cpu_usage_record_publications
+			WHERE analysis_id = $1
+			AND resource_type = $2
+			AND effective_date = $3
+		);
+	`
+
+	err := d.db.QueryRowxContext(context, q, key.AnalysisID, key.ResourceType, key.effectiveDate()).Scan(&published)
+	return published, err
+}
+
+// MarkUsageRecordPublished records that the usage record was handed off for
+// the analysis, so that it isn't sent again if the analysis is recalculated.
+// Marking a record that's already marked does nothing.
+func (d *Database) MarkUsageRecordPublished(context context.Context, key *UsageRecordKey) error {
+	const q = `
+		INSERT INTO cpu_usage_record_publications (analysis_id, resource_type, effective_date)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (analysis_id, resource_type, effective_date) DO NOTHING;
+	`
+
+	_, err := d.db.ExecContext(context, q, key.AnalysisID, key.ResourceType, key.effectiveDate())
+	return err
+}
@@ -0,0 +1,244 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+)
+
+// Quota is a user's quota for a resource type as it was last fetched from QMS.
+// Usage is the user's usage of the resource type that QMS reported then, plus
+// the usage that's been sent to QMS since.
+type Quota struct {
+	UserID         string      `db:"user_id" json:"user_id"`
+	Username       string      `db:"username" json:"username"`
+	ResourceType   string      `db:"resource_type" json:"resource_type"`
+	Quota          apd.Decimal `db:"quota" json:"quota"`
+	Usage          apd.Decimal `db:"usage" json:"usage"`
+	PlanName       string      `db:"plan_name" json:"plan_name"`
+	EffectiveStart time.Time   `db:"effective_start" json:"effective_start"`
+	EffectiveEnd   time.Time   `db:"effective_end" json:"effective_end"`
+	FetchedOn      time.Time   `db:"fetched_on" json:"fetched_on"`
+}
+
+// SaveQuota stores the user's quota for a resource type, replacing the one
+// that was stored before. The user ID is looked up from the username, so
+// nothing is stored for users that aren't in the database.
+func (d *Database) SaveQuota(context context.Context, quota *Quota) error {
+	const q = `
+		INSERT INTO qms_quotas
+			(user_id, resource_type, quota, usage, plan_name, effective_start, effective_end, fetched_on)
+		SELECT u.id, $2, $3, $7, $4, $5, $6, CURRENT_TIMESTAMP
+		FROM users u
+		WHERE u.username = $1
+		ON CONFLICT (user_id, resource_type) DO UPDATE SET
+			quota = EXCLUDED.quota,
+			usage = EXCLUDED.usage,
+			plan_name = EXCLUDED.plan_name,
+			effective_start = EXCLUDED.effective_start,
+			effective_end = EXCLUDED.effective_end,
+			fetched_on = EXCLUDED.fetched_on;
+	`
+	_, err := d.db.ExecContext(
+		context,
+		q,
+		quota.Username,
+		quota.ResourceType,
+		&quota.Quota,
+		quota.PlanName,
+		quota.EffectiveStart,
+		quota.EffectiveEnd,
+		&quota.Usage,
+	)
+	return err
+}
+
+// Remaining is the part of a user's quota for a resource type that hasn't
+// been used or held for running analyses. Total is the usage stored with the
+// quota.
+type Remaining struct {
+	Username     string      `db:"username" json:"username"`
+	ResourceType string      `db:"resource_type" json:"resource_type"`
+	Quota        apd.Decimal `db:"quota" json:"quota"`
+	Total        apd.Decimal `db:"total" json:"total"`
+	Held         apd.Decimal `db:"held" json:"held"`
+	Remaining    apd.Decimal `db:"remaining" json:"remaining"`
+	FetchedOn    time.Time   `db:"fetched_on" json:"fetched_on"`
+}
+
+// RemainingForUser returns the remaining part of the user's stored quota for
+// the resource type, calculated from the usage stored with the quota and the
+// user's holds in a single query. The local totals aren't used, because they
+// don't include the analysis usage that's added by QMS. Returns sql.ErrNoRows if no quota is stored for the user.
+func (d *Database) RemainingForUser(context context.Context, username, resourceType string) (*Remaining, error) {
+	var remaining Remaining
+
+	const q = `
+		SELECT
+			u.username,
+			q.resource_type,
+			q.quota,
+			q.usage total,
+			COALESCE(h.held, 0) held,
+			q.quota - q.usage - COALESCE(h.held, 0) remaining,
+			q.fetched_on
+		FROM users u
+		JOIN qms_quotas q ON q.user_id = u.id AND q.resource_type = $2
+		LEFT JOIN LATERAL (
+			SELECT sum(amount) held
+			FROM cpu_usage_holds
+			WHERE user_id = u.id
+			AND resource_type = $2
+			AND released_on IS NULL
+			AND expires_on > CURRENT_TIMESTAMP
+		) h ON true
+		WHERE u.username = $1
+		LIMIT 1;
+	`
+
+	err := d.db.QueryRowxContext(context, q, username, resourceType).StructScan(&remaining)
+	if err != nil {
+		return nil, err
+	}
+	return &remaining, nil
+}
+
+// QuotasForUser returns the quotas stored for the user, ordered by resource
+// type.
+func (d *Database) QuotasForUser(context context.Context, username string) ([]Quota, error) {
+	var quotas []Quota
+
+	const q = `
+		SELECT
+			q.user_id,
+			u.username,
+			q.resource_type,
+			q.quota,
+			q.usage,
+			q.plan_name,
+			q.effective_start,
+			q.effective_end,
+			q.fetched_on
+		FROM qms_quotas q
+		JOIN users u ON q.user_id = u.id
+		WHERE u.username = $1
+		ORDER BY q.resource_type;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var quota Quota
+		if err = rows.StructScan(&quota); err != nil {
+			return quotas, err
+		}
+		quotas = append(quotas, quota)
+	}
+
+	if err = rows.Err(); err != nil {
+		return quotas, err
+	}
+
+	return quotas, nil
+}
+
+// QuotasForResourceType returns every user's stored quota for the resource
+// type, ordered by username.
+func (d *Database) QuotasForResourceType(context context.Context, resourceType string) ([]Quota, error) {
+	var quotas []Quota
+
+	const q = `
+		SELECT
+			q.user_id,
+			u.username,
+			q.resource_type,
+			q.quota,
+			q.usage,
+			q.plan_name,
+			q.effective_start,
+			q.effective_end,
+			q.fetched_on
+		FROM qms_quotas q
+		JOIN users u ON q.user_id = u.id
+		WHERE q.resource_type = $1
+		ORDER BY u.username;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var quota Quota
+		if err = rows.StructScan(&quota); err != nil {
+			return quotas, err
+		}
+		quotas = append(quotas, quota)
+	}
+
+	if err = rows.Err(); err != nil {
+		return quotas, err
+	}
+
+	return quotas, nil
+}
+
+// QuotaRefreshUsers returns the users whose quotas need to be fetched from
+// QMS: the ones with a current total or usage sent to QMS whose quotas haven't
+// been stored, were fetched before the given time, or belong to a subscription
+// that has ended.
+func (d *Database) QuotaRefreshUsers(context context.Context, fetchedBefore time.Time) ([]User, error) {
+	var users []User
+
+	const q = `
+		SELECT u.id, u.username
+		FROM users u
+		WHERE (EXISTS (
+			SELECT 1 FROM cpu_usage_totals t
+			WHERE t.user_id = u.id
+			AND t.effective_range @> CURRENT_TIMESTAMP::timestamp
+		) OR EXISTS (
+			SELECT 1 FROM qms_sent_usage s
+			WHERE s.user_id = u.id
+		))
+		AND (
+			NOT EXISTS (
+				SELECT 1 FROM qms_quotas q
+				WHERE q.user_id = u.id
+			)
+			OR EXISTS (
+				SELECT 1 FROM qms_quotas q
+				WHERE q.user_id = u.id
+				AND (q.fetched_on < $1 OR q.effective_end <= CURRENT_TIMESTAMP)
+			)
+		)
+		ORDER BY u.username;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, fetchedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		if err = rows.StructScan(&user); err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
+}
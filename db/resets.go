@@ -0,0 +1,196 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+// ResetSchedule is a cron expression for when a user's CPU hours are reset,
+// which is used instead of the default schedule for the user.
+type ResetSchedule struct {
+	UserID      string    `db:"user_id" json:"user_id"`
+	Username    string    `db:"username" json:"username"`
+	Expression  string    `db:"expression" json:"expression"`
+	NextRun     null.Time `db:"next_run" json:"next_run"`
+	LastRun     null.Time `db:"last_run" json:"last_run"`
+	ScheduledBy string    `db:"scheduled_by" json:"scheduled_by"`
+	ScheduledOn time.Time `db:"scheduled_on" json:"scheduled_on"`
+}
+
+// SetResetSchedule adds or replaces the user's reset schedule.
+func (d *Database) SetResetSchedule(context context.Context, schedule *ResetSchedule) error {
+	const q = `
+		INSERT INTO cpu_usage_reset_schedules
+			(user_id, expression, next_run, scheduled_by)
+		VALUES
+			($1, $2, $3, $4)
+		ON CONFLICT (user_id) DO UPDATE SET
+			expression = EXCLUDED.expression,
+			next_run = EXCLUDED.next_run,
+			scheduled_by = EXCLUDED.scheduled_by,
+			scheduled_on = CURRENT_TIMESTAMP;
+	`
+	_, err := d.db.ExecContext(context, q, schedule.UserID, schedule.Expression, schedule.NextRun, schedule.ScheduledBy)
+	return err
+}
+
+// DeleteResetSchedule removes the user's reset schedule, so that the default
+// schedule applies to them again. Returns false if they didn't have one.
+func (d *Database) DeleteResetSchedule(context context.Context, userID string) (bool, error) {
+	const q = `
+		DELETE FROM cpu_usage_reset_schedules WHERE user_id = $1;
+	`
+	count, err := d.rowsAffected(context, q, userID)
+	return count > 0, err
+}
+
+// ResetSchedules returns every user's reset schedule, ordered by username.
+func (d *Database) ResetSchedules(context context.Context) ([]ResetSchedule, error) {
+	const q = `
+		SELECT
+			s.user_id,
+			u.username,
+			s.expression,
+			s.next_run,
+			s.last_run,
+			s.scheduled_by,
+			s.scheduled_on
+		FROM cpu_usage_reset_schedules s
+		JOIN users u ON s.user_id = u.id
+		ORDER BY u.username;
+	`
+	return d.resetSchedules(context, q)
+}
+
+// DueResetSchedules returns the reset schedules whose next run is at or before
+// the given time, ordered by their next run.
+func (d *Database) DueResetSchedules(context context.Context, at time.Time) ([]ResetSchedule, error) {
+	const q = `
+		SELECT
+			s.user_id,
+			u.username,
+			s.expression,
+			s.next_run,
+			s.last_run,
+			s.scheduled_by,
+			s.scheduled_on
+		FROM cpu_usage_reset_schedules s
+		JOIN users u ON s.user_id = u.id
+		WHERE s.next_run <= $1
+		ORDER BY s.next_run, u.username;
+	`
+	return d.resetSchedules(context, q, at)
+}
+
+// resetSchedules runs a query that selects reset schedules.
+func (d *Database) resetSchedules(context context.Context, q string, args ...interface{}) ([]ResetSchedule, error) {
+	var schedules []ResetSchedule
+
+	rows, err := d.db.QueryxContext(context, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schedule ResetSchedule
+		if err = rows.StructScan(&schedule); err != nil {
+			return schedules, err
+		}
+		schedules = append(schedules, schedule)
+	}
+
+	if err = rows.Err(); err != nil {
+		return schedules, err
+	}
+
+	return schedules, nil
+}
+
+// SetResetScheduleRun records that the user's scheduled reset ran at lastRun
+// and that the next one is at nextRun, which is null if the schedule doesn't
+// match any later time.
+func (d *Database) SetResetScheduleRun(context context.Context, userID string, lastRun time.Time, nextRun null.Time) error {
+	const q = `
+		UPDATE cpu_usage_reset_schedules
+		SET last_run = $2,
+			next_run = $3
+		WHERE user_id = $1;
+	`
+	_, err := d.db.ExecContext(context, q, userID, lastRun, nextRun)
+	return err
+}
+
+// LastResetRun returns the last time that the named schedule ran, or the zero
+// time if it hasn't.
+func (d *Database) LastResetRun(context context.Context, name string) (time.Time, error) {
+	var lastRun time.Time
+
+	const q = `
+		SELECT last_run FROM cpu_usage_reset_runs WHERE name = $1;
+	`
+
+	err := d.db.QueryRowxContext(context, q, name).Scan(&lastRun)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return lastRun, err
+}
+
+// SetLastResetRun records the last time that the named schedule ran.
+func (d *Database) SetLastResetRun(context context.Context, name string, lastRun time.Time) error {
+	const q = `
+		INSERT INTO cpu_usage_reset_runs (name, last_run)
+		VALUES ($1, $2)
+		ON CONFLICT (name) DO UPDATE SET last_run = EXCLUDED.last_run;
+	`
+	_, err := d.db.ExecContext(context, q, name, lastRun)
+	return err
+}
+
+// UnscheduledResetUsers returns the users with a current CPU hours total who
+// don't have their own reset schedule, ordered by username.
+func (d *Database) UnscheduledResetUsers(context context.Context) ([]User, error) {
+	var users []User
+
+	const q = `
+		SELECT u.id, u.username
+		FROM users u
+		WHERE EXISTS (
+			SELECT 1 FROM cpu_usage_totals t
+			WHERE t.user_id = u.id
+			AND t.resource_type = $1
+			AND t.allocation_source = $2
+			AND t.effective_range @> CURRENT_TIMESTAMP::timestamp
+		)
+		AND NOT EXISTS (
+			SELECT 1 FROM cpu_usage_reset_schedules s
+			WHERE s.user_id = u.id
+		)
+		ORDER BY u.username;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, DefaultResourceType, DefaultAllocationSource)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user User
+		if err = rows.StructScan(&user); err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return users, err
+	}
+
+	return users, nil
+}
@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/guregu/null"
+)
+
+// PublishRetry is a usage record that couldn't be sent to QMS and is waiting to
+// be sent again.
+type PublishRetry struct {
+	ID           string      `db:"id" json:"id"`
+	UserID       string      `db:"user_id" json:"user_id"`
+	Username     string      `db:"username" json:"username"`
+	AnalysisID   null.String `db:"analysis_id" json:"analysis_id"`
+	ResourceType string      `db:"resource_type" json:"resource_type"`
+	Unit         string      `db:"unit" json:"unit"`
+	Value        apd.Decimal `db:"value" json:"value"`
+	Attempts     int         `db:"attempts" json:"attempts"`
+	LastError    string      `db:"last_error" json:"last_error"`
+	NextAttempt  time.Time   `db:"next_attempt" json:"next_attempt"`
+	CreatedOn    time.Time   `db:"created_on" json:"created_on"`
+
+	// EffectiveDate is the time that the usage is attributed to in QMS. It's
+	// unset if the usage is attributed to the time it's sent.
+	EffectiveDate null.Time `db:"effective_date" json:"effective_date"`
+
+	// Cluster is the cluster that the usage was recorded on. It's empty if the
+	// cluster isn't known.
+	Cluster string `db:"cluster" json:"cluster"`
+}
+
+// QueuePublishRetry stores a usage record that couldn't be sent to QMS so that
+// it can be sent again. The analysis ID, effective date and cluster may be
+// empty.
+func (d *Database) QueuePublishRetry(context context.Context, username, analysisID, resourceType, unit string, value *apd.Decimal, effectiveDate null.Time, cluster, lastError string) error {
+	const q = `
+		INSERT INTO usage_publish_retries
+			(user_id, analysis_id, resource_type, unit, value, effective_date, cluster, last_error)
+		VALUES
+			((SELECT id FROM users WHERE username = $1), NULLIF($2, '')::uuid, $3, $4, $5, $6, $7, $8);
+	`
+	_, err := d.db.ExecContext(context, q, username, analysisID, resourceType, unit, value, effectiveDate, cluster, lastError)
+	return err
+}
+
+// DuePublishRetries returns up to limit of the usage records that are due to be
+// sent to QMS again, oldest first.
+func (d *Database) DuePublishRetries(context context.Context, limit int) ([]PublishRetry, error) {
+	var retries []PublishRetry
+
+	const q = `
+		SELECT
+			r.id,
+			r.user_id,
+			u.username,
+			r.analysis_id,
+			r.resource_type,
+			r.unit,
+			r.value,
+			r.attempts,
+			r.last_error,
+			r.next_attempt,
+			r.created_on,
+			r.effective_date,
+			r.cluster
+		FROM usage_publish_retries r
+		JOIN users u ON r.user_id = u.id
+		WHERE r.next_attempt <= CURRENT_TIMESTAMP
+		ORDER BY r.created_on, r.id
+		LIMIT $1;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var retry PublishRetry
+		if err = rows.StructScan(&retry); err != nil {
+			return retries, err
+		}
+		retries = append(retries, retry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return retries, err
+	}
+
+	return retries, nil
+}
+
+// PublishRetryFailed records another failed attempt to send a usage record and
+// schedules the next one.
+func (d *Database) PublishRetryFailed(context context.Context, id string, nextAttempt time.Time, lastError string) error {
+	const q = `
+		UPDATE usage_publish_retries
+		SET attempts = attempts + 1,
+			next_attempt = $2,
+			last_error = $3
+		WHERE id = $1;
+	`
+	_, err := d.db.ExecContext(context, q, id, nextAttempt, lastError)
+	return err
+}
+
+// DeletePublishRetry removes a usage record once it's been sent to QMS.
+func (d *Database) DeletePublishRetry(context context.Context, id string) error {
+	const q = `
+		DELETE FROM usage_publish_retries WHERE id = $1;
+	`
+	_, err := d.db.ExecContext(context, q, id)
+	return err
+}
+
+// PublishRetryCount returns the number of usage records waiting to be sent to
+// QMS again.
+func (d *Database) PublishRetryCount(context context.Context) (int64, error) {
+	var count int64
+	const q = `SELECT count(*) FROM usage_publish_retries;`
+	err := d.db.QueryRowxContext(context, q).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,27 @@
+package db
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/lib/pq"
+)
+
+// serializationFailure is the SQLSTATE returned when a transaction conflicts
+// with a concurrent one and has to be retried.
+const serializationFailure = "40001"
+
+// Retryable returns true if the error is a serialization failure. These are
+// expected under contention in serializable transactions, and the transaction
+// can simply be run again.
+func Retryable(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == serializationFailure
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return string(pqErr.Code) == serializationFailure
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+)
+
+// SentUsage is usage that QMS accepted for a user. Analysis usage is added to
+// the user's total by QMS rather than through the usage events, so this is the
+// only local record of it.
+type SentUsage struct {
+	Username      string
+	AnalysisID    string
+	ResourceType  string
+	Value         apd.Decimal
+	EffectiveDate time.Time
+}
+
+// RecordSentUsage records usage that QMS accepted and adds it to the usage
+// stored with the user's cached quota for the resource type, in a single
+// statement. The cached usage is replaced with the value from QMS the next time
+// the quota is fetched.
+func (d *Database) RecordSentUsage(context context.Context, usage *SentUsage) error {
+	const q = `
+		WITH sent AS (
+			INSERT INTO qms_sent_usage (user_id, resource_type, analysis_id, value, effective_date)
+			SELECT u.id, $2, NULLIF($3, '')::uuid, $4, $5
+			FROM users u
+			WHERE u.username = $1
+			RETURNING user_id, resource_type, value
+		)
+		UPDATE qms_quotas q
+		SET usage = q.usage + s.value
+		FROM sent s
+		WHERE q.user_id = s.user_id
+		AND q.resource_type = s.resource_type;
+	`
+	_, err := d.db.ExecContext(
+		context,
+		q,
+		usage.Username,
+		usage.ResourceType,
+		usage.AnalysisID,
+		&usage.Value,
+		usage.EffectiveDate,
+	)
+	return err
+}
+
+// SentUsageTotal returns the sum of the usage sent to QMS for the user and
+// resource type that takes effect within the total's period, counting only
+// the usage that was sent after since and no later than asOf. Also returns
+// when the last of it was sent, which is zero if none was.
+func (d *Database) SentUsageTotal(context context.Context, total *CPUHours, since, asOf time.Time) (*apd.Decimal, time.Time, error) {
+	var result struct {
+		Total  apd.Decimal `db:"total"`
+		SentOn *time.Time  `db:"sent_on"`
+	}
+
+	const q = `
+		SELECT
+			COALESCE(sum(value), 0) total,
+			max(sent_on) sent_on
+		FROM qms_sent_usage
+		WHERE user_id = $1
+		AND resource_type = $2
+		AND sent_on > $3::timestamp
+		AND sent_on <= $4::timestamp
+		AND effective_date >= $5::timestamp
+		AND effective_date < $6::timestamp;
+	`
+	err := d.db.QueryRowxContext(
+		context,
+		q,
+		total.UserID,
+		total.ResourceType,
+		since,
+		asOf,
+		total.EffectiveStart,
+		total.EffectiveEnd,
+	).StructScan(&result)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	var sentOn time.Time
+	if result.SentOn != nil {
+		sentOn = *result.SentOn
+	}
+	return &result.Total, sentOn, nil
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/cockroachdb/apd"
+)
+
+// RecordSlurmJob records that a Slurm job has been ingested. Returns false if
+// the job was already recorded for the cluster, in which case nothing is
+// changed.
+func (d *Database) RecordSlurmJob(context context.Context, cluster, jobID, userID string, cpuHours *apd.Decimal) (bool, error) {
+	var id string
+
+	const q = `
+		INSERT INTO slurm_ingested_jobs
+			(cluster, job_id, user_id, cpu_hours)
+		VALUES
+			($1, $2, $3, $4)
+		ON CONFLICT (cluster, job_id) DO NOTHING
+		RETURNING job_id;
+	`
+	err := d.db.QueryRowxContext(context, q, cluster, jobID, userID, cpuHours).Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteSlurmJob removes the ingestion record for a Slurm job, allowing it to
+// be ingested again.
+func (d *Database) DeleteSlurmJob(context context.Context, cluster, jobID string) error {
+	const q = `
+		DELETE FROM slurm_ingested_jobs
+		WHERE cluster = $1
+		AND job_id = $2;
+	`
+	_, err := d.db.ExecContext(context, q, cluster, jobID)
+	return err
+}
@@ -0,0 +1,256 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/guregu/null"
+)
+
+// Supplement is an amount of a resource granted to a user on top of their base
+// quota for a limited time, e.g. for a workshop. Usage that falls between
+// StartsOn and EndsOn is drawn from the supplement before it counts towards
+// the user's base total.
+type Supplement struct {
+	ID           string      `db:"id" json:"id"`
+	UserID       string      `db:"user_id" json:"user_id"`
+	Username     string      `db:"username" json:"username"`
+	ResourceType string      `db:"resource_type" json:"resource_type"`
+	Amount       apd.Decimal `db:"amount" json:"amount"`
+	Consumed     apd.Decimal `db:"consumed" json:"consumed"`
+	StartsOn     time.Time   `db:"starts_on" json:"starts_on"`
+	EndsOn       time.Time   `db:"ends_on" json:"ends_on"`
+	Reason       string      `db:"reason" json:"reason"`
+	GrantedBy    string      `db:"granted_by" json:"granted_by"`
+	GrantedOn    time.Time   `db:"granted_on" json:"granted_on"`
+	RevokedBy    null.String `db:"revoked_by" json:"revoked_by"`
+	RevokedOn    null.Time   `db:"revoked_on" json:"revoked_on"`
+}
+
+// GrantSupplement adds a supplement for the user and returns its ID.
+func (d *Database) GrantSupplement(context context.Context, supplement *Supplement) (string, error) {
+	var id string
+
+	const q = `
+		INSERT INTO cpu_usage_supplements
+			(user_id, resource_type, amount, starts_on, ends_on, reason, granted_by)
+		VALUES
+			($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id;
+	`
+
+	err := d.db.QueryRowxContext(
+		context,
+		q,
+		supplement.UserID,
+		supplement.ResourceType,
+		&supplement.Amount,
+		supplement.StartsOn,
+		supplement.EndsOn,
+		supplement.Reason,
+		supplement.GrantedBy,
+	).Scan(&id)
+	return id, err
+}
+
+// RevokeSupplement stops one of the user's supplements from being drawn from.
+// The amount that was already consumed is left in place. Returns false if the
+// user has no such supplement or it was already revoked.
+func (d *Database) RevokeSupplement(context context.Context, userID, id, revokedBy string) (bool, error) {
+	const q = `
+		UPDATE cpu_usage_supplements
+		SET revoked_by = $3,
+			revoked_on = CURRENT_TIMESTAMP
+		WHERE user_id = $1
+		AND id = $2
+		AND revoked_on IS NULL;
+	`
+	count, err := d.rowsAffected(context, q, userID, id, revokedBy)
+	return count > 0, err
+}
+
+// UserSupplements returns every supplement granted to the user, including the
+// revoked and expired ones, most recently granted first.
+func (d *Database) UserSupplements(context context.Context, userID string) ([]Supplement, error) {
+	const q = `
+		SELECT
+			s.id,
+			s.user_id,
+			u.username,
+			s.resource_type,
+			s.amount,
+			s.consumed,
+			s.starts_on,
+			s.ends_on,
+			s.reason,
+			s.granted_by,
+			s.granted_on,
+			s.revoked_by,
+			s.revoked_on
+		FROM cpu_usage_supplements s
+		JOIN users u ON s.user_id = u.id
+		WHERE s.user_id = $1
+		ORDER BY s.granted_on DESC, s.id;
+	`
+	return d.supplements(context, q, userID)
+}
+
+// AvailableSupplements returns the user's unrevoked supplements for the
+// resource type that are in effect at the given time and haven't been used up,
+// in the order they should be drawn from: the one that expires first comes
+// first.
+func (d *Database) AvailableSupplements(context context.Context, username, resourceType string, at time.Time) ([]Supplement, error) {
+	const q = `
+		SELECT
+			s.id,
+			s.user_id,
+			u.username,
+			s.resource_type,
+			s.amount,
+			s.consumed,
+			s.starts_on,
+			s.ends_on,
+			s.reason,
+			s.granted_by,
+			s.granted_on,
+			s.revoked_by,
+			s.revoked_on
+		FROM cpu_usage_supplements s
+		JOIN users u ON s.user_id = u.id
+		WHERE u.username = $1
+		AND s.resource_type = $2
+		AND s.starts_on <= $3
+		AND s.ends_on > $3
+		AND s.revoked_on IS NULL
+		AND s.consumed < s.amount
+		ORDER BY s.ends_on, s.granted_on, s.id;
+	`
+	return d.supplements(context, q, username, resourceType, at)
+}
+
+// supplements runs a query that selects supplements.
+func (d *Database) supplements(context context.Context, q string, args ...interface{}) ([]Supplement, error) {
+	var supplements []Supplement
+
+	rows, err := d.db.QueryxContext(context, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var supplement Supplement
+		if err = rows.StructScan(&supplement); err != nil {
+			return supplements, err
+		}
+		supplements = append(supplements, supplement)
+	}
+
+	if err = rows.Err(); err != nil {
+		return supplements, err
+	}
+
+	return supplements, nil
+}
+
+// ConsumeSupplement draws an amount from a supplement. Returns false if the
+// supplement has been revoked or doesn't have that much left, which can
+// happen if it was drawn from concurrently.
+func (d *Database) ConsumeSupplement(context context.Context, id string, amount *apd.Decimal) (bool, error) {
+	const q = `
+		UPDATE cpu_usage_supplements
+		SET consumed = consumed + $2
+		WHERE id = $1
+		AND revoked_on IS NULL
+		AND consumed + $2 <= amount;
+	`
+	count, err := d.rowsAffected(context, q, id, amount)
+	return count > 0, err
+}
+
+// UsageRecordKey identifies one of the usage records calculated for an
+// analysis. An analysis has a record per resource type, and a record is split
+// into parts with different effective dates when the analysis spans effective
+// periods. The effective date is zero for records that weren't split.
+type UsageRecordKey struct {
+	AnalysisID    string
+	ResourceType  string
+	EffectiveDate time.Time
+}
+
+// effectiveDate returns the effective date that's stored for the key. Records
+// that weren't split are stored with the Unix epoch, since the column is part
+// of a primary key and can't be null.
+func (k *UsageRecordKey) effectiveDate() time.Time {
+	if k.EffectiveDate.IsZero() {
+		return time.Unix(0, 0).UTC()
+	}
+	return k.EffectiveDate
+}
+
+// SupplementDraw is an amount drawn from a supplement to cover a usage record
+// for an analysis.
+type SupplementDraw struct {
+	SupplementID string      `db:"supplement_id" json:"supplement_id"`
+	Amount       apd.Decimal `db:"amount" json:"amount"`
+}
+
+// SupplementDraws returns the amounts that have already been drawn from
+// supplements to cover the usage record, so that a record that's calculated
+// again doesn't draw from them twice.
+func (d *Database) SupplementDraws(context context.Context, key *UsageRecordKey) ([]SupplementDraw, error) {
+	var draws []SupplementDraw
+
+	const q = `
+		SELECT supplement_id, amount
+		FROM cpu_usage_supplement_draws
+		WHERE analysis_id = $1
+		AND resource_type = $2
+		AND effective_date = $3;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, key.AnalysisID, key.ResourceType, key.effectiveDate())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var draw SupplementDraw
+		if err = rows.StructScan(&draw); err != nil {
+			return draws, err
+		}
+		draws = append(draws, draw)
+	}
+
+	if err = rows.Err(); err != nil {
+		return draws, err
+	}
+
+	return draws, nil
+}
+
+// ConsumeSupplementForRecord draws an amount from a supplement to cover a
+// usage record for an analysis, and records the draw in the same statement so
+// that one is never stored without the other. Returns false for the same
+// reasons as ConsumeSupplement. Drawing from the same supplement for the same
+// record twice fails.
+func (d *Database) ConsumeSupplementForRecord(context context.Context, id string, amount *apd.Decimal, key *UsageRecordKey) (bool, error) {
+	const q = `
+		WITH consumed AS (
+			UPDATE cpu_usage_supplements
+			SET consumed = consumed + $2
+			WHERE id = $1
+			AND revoked_on IS NULL
+			AND consumed + $2 <= amount
+			RETURNING id
+		)
+		INSERT INTO cpu_usage_supplement_draws
+			(analysis_id, resource_type, effective_date, supplement_id, amount)
+		SELECT $3, $4, $5, id, $2
+		FROM consumed;
+	`
+	count, err := d.rowsAffected(context, q, id, amount, key.AnalysisID, key.ResourceType, key.effectiveDate())
+	return count > 0, err
+}
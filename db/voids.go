@@ -0,0 +1,118 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/guregu/null"
+)
+
+// compensatingEventTypes maps each event type that can be voided to the event
+// type that reverses it.
+var compensatingEventTypes = map[EventType]EventType{
+	CPUHoursAdd:      CPUHoursSubtract,
+	CPUHoursSubtract: CPUHoursAdd,
+}
+
+// CompensatingEventType returns the event type that reverses events of the
+// given type. Returns false if events of the type can't be reversed.
+func CompensatingEventType(eventType EventType) (EventType, bool) {
+	compensating, ok := compensatingEventTypes[eventType]
+	return compensating, ok
+}
+
+// EventForUpdate returns the work item with the ID and locks it until the end
+// of the transaction.
+func (d *Database) EventForUpdate(context context.Context, id string) (*CPUUsageWorkItem, error) {
+	const q = `
+		SELECT
+			c.id,
+			c.record_date,
+			c.effective_date,
+			e.name event_type,
+			c.value,
+			c.created_by,
+			c.last_modified,
+			c.claimed,
+			c.claimed_by,
+			c.claimed_on,
+			c.claim_expires_on,
+			c.processed,
+			c.processing,
+			c.processed_on,
+			c.max_processing_attempts,
+			c.attempts,
+			c.priority,
+			c.resource_type,
+			c.allocation_source,
+			c.voided,
+			c.voided_by,
+			c.voided_on,
+			c.compensating_event_id,
+			c.dedup_key,
+			c.reason,
+			c.cluster
+		FROM cpu_usage_events c
+		JOIN cpu_usage_event_types e ON c.event_type_id = e.id
+		WHERE c.id = $1
+		FOR UPDATE OF c;
+	`
+	var workItem CPUUsageWorkItem
+	err := d.db.QueryRowxContext(context, q, id).StructScan(&workItem)
+	return &workItem, err
+}
+
+// AddCPUUsageEventReturningID adds a new usage event to the database with the
+// default values for the work queue fields and returns its ID. Returns
+// sql.ErrNoRows if the event has the same deduplication key as an existing
+// event, in which case it isn't added.
+func (d *Database) AddCPUUsageEventReturningID(context context.Context, event *CPUUsageEvent) (string, error) {
+	var id string
+
+	const q = `
+		INSERT INTO cpu_usage_events
+			(record_date, effective_date, event_type_id, value, created_by, priority, resource_type, allocation_source, dedup_key, reason, cluster)
+		VALUES
+			($1, $2, (SELECT id FROM cpu_usage_event_types WHERE name = $3), $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (dedup_key) DO NOTHING
+		RETURNING id;
+	`
+
+	event.withDefaults()
+	err := d.db.QueryRowxContext(
+		context,
+		q,
+		event.RecordDate,
+		event.EffectiveDate,
+		event.EventType,
+		event.Value,
+		event.CreatedBy,
+		event.Priority,
+		event.ResourceType,
+		event.AllocationSource,
+		event.DedupKey,
+		event.Reason,
+		event.Cluster,
+	).Scan(&id)
+	return id, err
+}
+
+// SetEventVoided marks an event as voided or not. The compensating event ID
+// should be set to the event that reverses the voided event, if there is one.
+func (d *Database) SetEventVoided(context context.Context, id string, voided bool, voidedBy string, compensatingEventID null.String) error {
+	const q = `
+		UPDATE cpu_usage_events
+		SET voided = $2,
+			voided_by = $3,
+			voided_on = $4,
+			compensating_event_id = $5
+		WHERE id = $1;
+	`
+
+	var (
+		by = null.NewString(voidedBy, voided)
+		on = null.NewTime(time.Now(), voided)
+	)
+	_, err := d.db.ExecContext(context, q, id, voided, by, on, compensatingEventID)
+	return err
+}
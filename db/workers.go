@@ -147,6 +147,18 @@ func (d *Database) RegisterWorker(context context.Context, workerName string, ex
 	return newID, err
 }
 
+// ActivateWorker marks a registered worker as active.
+func (d *Database) ActivateWorker(context context.Context, workerID string) error {
+	const q = `
+		UPDATE cpu_usage_workers
+		SET active = true,
+			activated_on = CURRENT_TIMESTAMP
+		WHERE id = $1;
+	`
+	_, err := d.db.ExecContext(context, q, workerID)
+	return err
+}
+
 // UnregisterWorker removes a worker from the database.
 func (d *Database) UnregisterWorker(context context.Context, workerID string) error {
 	const q = `
@@ -159,15 +171,18 @@ func (d *Database) UnregisterWorker(context context.Context, workerID string) er
 	return err
 }
 
-// RefreshWorkerRegistration updates the workers activation expiration date.
+// RefreshWorkerRegistration updates the workers activation expiration date. A
+// worker that was purged in the meantime is registered again as an active
+// worker, so that the calculations it has claimed don't look orphaned.
 func (d *Database) RefreshWorkerRegistration(context context.Context, workerID, workerName string, expirationInterval time.Duration) (*time.Time, error) {
 	const q = `
 		INSERT INTO cpu_usage_workers
-			(id, name, activation_expires_on)
+			(id, name, activation_expires_on, active, activated_on)
 		VALUES
-			($1, $3, $2)
-		ON CONFLICT (id) DO UPDATE 
-		SET activation_expires_on = $2;
+			($1, $3, $2, true, CURRENT_TIMESTAMP)
+		ON CONFLICT (id) DO UPDATE
+		SET activation_expires_on = $2,
+			active = true;
 	`
 	newTime := time.Now().Add(expirationInterval)
 	_, err := d.db.ExecContext(context, q, workerID, newTime, workerName)
@@ -175,10 +190,11 @@ func (d *Database) RefreshWorkerRegistration(context context.Context, workerID,
 }
 
 // PurgeExpiredWorkers clears out all workers whose registration has expired. Returns
-// the number of rows affected. Only purge workers (set their activation flag to false)
-// if they're not getting work, they're not actively working on something, and the
-// activation timestamp has passed.
-func (d *Database) PurgeExpiredWorkers(context context.Context) (int64, error) {
+// the workers that were purged, with only their IDs and names set. Only purge workers
+// (set their activation flag to false) if they're not getting work, they're not
+// actively working on something, and the activation timestamp has passed.
+func (d *Database) PurgeExpiredWorkers(context context.Context) ([]Worker, error) {
+	var workers []Worker
 	const q = `
 		DELETE FROM cpu_usage_workers 
 		WHERE NOT getting_work 
@@ -187,13 +203,28 @@ func (d *Database) PurgeExpiredWorkers(context context.Context) (int64, error) {
 			CURRENT_TIMESTAMP >= COALESCE(activation_expires_on, to_timestamp(0)) 
 			OR 
 			activation_expires_on = NULL 
-		);
+		)
+		RETURNING id, name;
 	`
-	result, err := d.db.ExecContext(context, q)
+	rows, err := d.db.QueryxContext(context, q)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	return result.RowsAffected()
+	defer rows.Close()
+
+	for rows.Next() {
+		var worker Worker
+		if err = rows.Scan(&worker.ID, &worker.Name); err != nil {
+			return workers, err
+		}
+		workers = append(workers, worker)
+	}
+
+	if err = rows.Err(); err != nil {
+		return workers, err
+	}
+
+	return workers, nil
 }
 
 // PurgeExpiredWorkSeekers clears out all workers that have been looking for work from
@@ -0,0 +1,356 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cockroachdb/apd"
+	"github.com/guregu/null"
+)
+
+// The statuses that work items can be filtered by.
+const (
+	WorkItemPending    = "pending"
+	WorkItemClaimed    = "claimed"
+	WorkItemProcessing = "processing"
+	WorkItemProcessed  = "processed"
+	WorkItemFailed     = "failed"
+	WorkItemVoided     = "voided"
+)
+
+// workItemStatusFilters maps each work item status to the condition that
+// selects work items with that status.
+var workItemStatusFilters = map[string]string{
+	WorkItemPending: `NOT c.claimed
+		AND NOT c.processed
+		AND NOT c.processing
+		AND NOT c.voided
+		AND c.attempts < c.max_processing_attempts`,
+	WorkItemClaimed:    `c.claimed AND NOT c.processing AND NOT c.processed`,
+	WorkItemProcessing: `c.processing`,
+	WorkItemProcessed:  `c.processed`,
+	WorkItemFailed:     `NOT c.processed AND NOT c.processing AND c.attempts >= c.max_processing_attempts`,
+	WorkItemVoided:     `c.voided`,
+}
+
+// ValidWorkItemStatus returns true if the work items can be filtered by the
+// status.
+func ValidWorkItemStatus(status string) bool {
+	_, ok := workItemStatusFilters[status]
+	return ok
+}
+
+// WorkItemsByStatus returns the work items with the given status, highest
+// priority first and then oldest first. An empty status returns all work items.
+// Only the work items recorded for the cluster are returned if it isn't empty.
+func (d *Database) WorkItemsByStatus(context context.Context, status, cluster string, limit, offset int) ([]CPUUsageWorkItem, error) {
+	var workItems []CPUUsageWorkItem
+
+	where := "TRUE"
+	if status != "" {
+		var ok bool
+		if where, ok = workItemStatusFilters[status]; !ok {
+			return nil, fmt.Errorf("unknown work item status %s", status)
+		}
+	}
+
+	q := fmt.Sprintf(`
+		SELECT
+			c.id,
+			c.record_date,
+			c.effective_date,
+			e.name event_type,
+			c.value,
+			c.created_by,
+			c.last_modified,
+			c.claimed,
+			c.claimed_by,
+			c.claimed_on,
+			c.claim_expires_on,
+			c.processed,
+			c.processing,
+			c.processed_on,
+			c.max_processing_attempts,
+			c.attempts,
+			c.priority,
+			c.resource_type,
+			c.allocation_source,
+			c.voided,
+			c.voided_by,
+			c.voided_on,
+			c.compensating_event_id,
+			c.dedup_key,
+			c.reason,
+			c.cluster
+		FROM cpu_usage_events c
+		JOIN cpu_usage_event_types e ON c.event_type_id = e.id
+		WHERE %s
+		AND ($3 = '' OR c.cluster = $3)
+		ORDER BY c.priority DESC, c.record_date, c.id
+		LIMIT $1
+		OFFSET $2;
+	`, where)
+
+	rows, err := d.db.QueryxContext(context, q, limit, offset, cluster)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var h CPUUsageWorkItem
+		if err = rows.StructScan(&h); err != nil {
+			return nil, err
+		}
+		workItems = append(workItems, h)
+	}
+
+	if err = rows.Err(); err != nil {
+		return workItems, err
+	}
+
+	return workItems, nil
+}
+
+// WorkItemHistoryEntry is a processed work item along with the user it was
+// recorded for, the name of the worker that processed it, and the user's total
+// after it was applied. The worker name and resulting total are null if they
+// weren't recorded.
+type WorkItemHistoryEntry struct {
+	CPUUsageWorkItem
+	Username       string       `db:"username" json:"username"`
+	WorkerName     null.String  `db:"worker_name" json:"worker_name"`
+	ResultingTotal *apd.Decimal `db:"resulting_total" json:"resulting_total"`
+}
+
+// WorkItemHistory returns a page of processed work items, most recently
+// processed first. Only the user's work items are returned if the username
+// isn't empty, and only the cluster's if the cluster isn't empty.
+func (d *Database) WorkItemHistory(context context.Context, username, cluster string, limit, offset int) ([]WorkItemHistoryEntry, error) {
+	var history []WorkItemHistoryEntry
+
+	const q = `
+		SELECT
+			c.id,
+			c.record_date,
+			c.effective_date,
+			e.name event_type,
+			c.value,
+			c.created_by,
+			c.last_modified,
+			c.claimed,
+			c.claimed_by,
+			c.claimed_on,
+			c.claim_expires_on,
+			c.processed,
+			c.processing,
+			c.processed_on,
+			c.max_processing_attempts,
+			c.attempts,
+			c.priority,
+			c.resource_type,
+			c.allocation_source,
+			c.voided,
+			c.voided_by,
+			c.voided_on,
+			c.compensating_event_id,
+			c.dedup_key,
+			c.reason,
+			c.cluster,
+			u.username,
+			w.name worker_name,
+			c.resulting_total
+		FROM cpu_usage_events c
+		JOIN cpu_usage_event_types e ON c.event_type_id = e.id
+		JOIN users u ON c.created_by = u.id
+		LEFT JOIN cpu_usage_workers w ON c.claimed_by = w.id
+		WHERE c.processed
+		AND ($1 = '' OR u.username = $1)
+		AND ($4 = '' OR c.cluster = $4)
+		ORDER BY c.processed_on DESC NULLS LAST, c.record_date DESC, c.id
+		LIMIT $2
+		OFFSET $3;
+	`
+
+	rows, err := d.db.QueryxContext(context, q, username, limit, offset, cluster)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry WorkItemHistoryEntry
+		if err = rows.StructScan(&entry); err != nil {
+			return history, err
+		}
+		history = append(history, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		return history, err
+	}
+
+	return history, nil
+}
+
+// WorkItemBacklog returns the number of work items waiting to be claimed.
+func (d *Database) WorkItemBacklog(context context.Context) (int64, error) {
+	var count int64
+
+	q := fmt.Sprintf(`
+		SELECT count(*)
+		FROM cpu_usage_events c
+		WHERE %s;
+	`, workItemStatusFilters[WorkItemPending])
+
+	err := d.db.QueryRowxContext(context, q).Scan(&count)
+	return count, err
+}
+
+// WorkItemCounts is the number of work items in each of the states that make
+// up the work queue's backlog.
+type WorkItemCounts struct {
+	Pending int64 `db:"pending" json:"pending"`
+	Claimed int64 `db:"claimed" json:"claimed"`
+	Failed  int64 `db:"failed" json:"failed"`
+}
+
+// CountWorkItems returns the number of pending, claimed, and failed work items.
+func (d *Database) CountWorkItems(context context.Context) (*WorkItemCounts, error) {
+	var counts WorkItemCounts
+
+	q := fmt.Sprintf(`
+		SELECT
+			count(*) FILTER (WHERE %s) pending,
+			count(*) FILTER (WHERE %s) claimed,
+			count(*) FILTER (WHERE %s) failed
+		FROM cpu_usage_events c
+		WHERE NOT c.processed;
+	`,
+		workItemStatusFilters[WorkItemPending],
+		workItemStatusFilters[WorkItemClaimed],
+		workItemStatusFilters[WorkItemFailed],
+	)
+
+	if err := d.db.QueryRowxContext(context, q).StructScan(&counts); err != nil {
+		return nil, err
+	}
+
+	return &counts, nil
+}
+
+// ClaimedWorkItems returns the work items claimed by each worker, keyed by
+// worker ID.
+func (d *Database) ClaimedWorkItems(context context.Context) (map[string][]CPUUsageWorkItem, error) {
+	claims := make(map[string][]CPUUsageWorkItem)
+
+	const q = `
+		SELECT
+			c.id,
+			c.record_date,
+			c.effective_date,
+			e.name event_type,
+			c.value,
+			c.created_by,
+			c.last_modified,
+			c.claimed,
+			c.claimed_by,
+			c.claimed_on,
+			c.claim_expires_on,
+			c.processed,
+			c.processing,
+			c.processed_on,
+			c.max_processing_attempts,
+			c.attempts,
+			c.priority,
+			c.resource_type,
+			c.allocation_source,
+			c.voided,
+			c.voided_by,
+			c.voided_on,
+			c.compensating_event_id,
+			c.dedup_key,
+			c.reason,
+			c.cluster
+		FROM cpu_usage_events c
+		JOIN cpu_usage_event_types e ON c.event_type_id = e.id
+		WHERE c.claimed
+		AND c.claimed_by IS NOT NULL
+		AND NOT c.processed
+		ORDER BY c.claimed_on;
+	`
+
+	rows, err := d.db.QueryxContext(context, q)
+	if err != nil {
+		return nil, err
+	}
+
+	for rows.Next() {
+		var h CPUUsageWorkItem
+		if err = rows.StructScan(&h); err != nil {
+			return nil, err
+		}
+		claims[h.ClaimedBy.String] = append(claims[h.ClaimedBy.String], h)
+	}
+
+	if err = rows.Err(); err != nil {
+		return claims, err
+	}
+
+	return claims, nil
+}
+
+// ExpireWorker deactivates a worker immediately and releases the work items it
+// claimed, so that they can be picked up by other workers. Returns false if the
+// worker doesn't exist.
+func (d *Database) ExpireWorker(context context.Context, workerID string) (bool, error) {
+	const q = `
+		UPDATE cpu_usage_workers
+		SET active = false,
+			getting_work = false,
+			working = false,
+			activation_expires_on = CURRENT_TIMESTAMP,
+			deactivated_on = CURRENT_TIMESTAMP
+		WHERE id = $1;
+	`
+
+	result, err := d.db.ExecContext(context, q, workerID)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if affected == 0 {
+		return false, nil
+	}
+
+	if _, err = d.ResetWorkClaimsForInactiveWorkers(context); err != nil {
+		return true, err
+	}
+
+	return true, nil
+}
+
+// ReleaseWorkClaim clears the claim on a work item that hasn't been processed
+// yet, so that another worker can claim it. Returns false if there's no such
+// unprocessed work item.
+func (d *Database) ReleaseWorkClaim(context context.Context, id string) (bool, error) {
+	const q = `
+		UPDATE cpu_usage_events
+		SET claimed = false,
+			claimed_by = NULL,
+			claimed_on = NULL,
+			claim_expires_on = NULL,
+			processing = false
+		WHERE id = $1
+		AND NOT processed;
+	`
+
+	result, err := d.db.ExecContext(context, q, id)
+	if err != nil {
+		return false, err
+	}
+	affected, err := result.RowsAffected()
+	return affected > 0, err
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() any { return runtime.NumGoroutine() }))
+}
+
+// diagnosticsHandler returns a handler for the pprof profiles and the expvar
+// variables. It's served on its own port so that it's never reachable through
+// the service's API routes.
+func diagnosticsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// serveDiagnostics serves the diagnostics endpoints on the port until the
+// listener fails.
+func serveDiagnostics(port int) {
+	log.Infof("serving diagnostics on port %d", port)
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: diagnosticsHandler(),
+	}
+	if err := server.ListenAndServe(); err != nil {
+		log.Errorf("the diagnostics listener stopped: %s", err)
+	}
+}
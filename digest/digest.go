@@ -0,0 +1,332 @@
+// Package digest sends each user a weekly summary of their CPU usage through
+// the DE notifications service.
+//
+// Once per interval, the composer looks for the most recent complete week,
+// which begins on Monday in UTC. Each user who ran analyses that ended during
+// that week and hasn't opted out is sent a notification with the CPU hours
+// they used, the quota they have left in QMS, and the analyses that used the
+// most hours. The hours are calculated the same way as the usage that's sent to
+// QMS, including billing weights. The digests that have been sent are recorded so that each user
+// receives at most one per week, even across restarts.
+//
+// Each digest is written in the locale that the user chose, or in the
+// configured default locale if they haven't chosen a supported one.
+package digest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/go-mod/pbinit"
+	"github.com/cyverse-de/go-mod/subjects"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/locale"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/periodic"
+	"github.com/cyverse-de/resource-usage-api/transport"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "digest"})
+
+// The notification type and email template used for the digests.
+const (
+	notificationType = "usage"
+	emailTemplate    = "usage_digest"
+)
+
+// Config contains the settings for the weekly usage digests.
+type Config struct {
+	// Interval is how often the most recent complete week is checked for
+	// digests that haven't been sent yet.
+	Interval time.Duration
+
+	// RoutingKey is the routing key that the notifications are published with.
+	RoutingKey string
+
+	// TopAnalyses is the number of analyses listed in each digest.
+	TopAnalyses int
+
+	// Email causes the notifications service to email the digest as well.
+	Email bool
+
+	// Domain is the domain suffix that's removed from usernames, since the
+	// notifications service identifies users by their short names.
+	Domain string
+
+	// DefaultLocale is the locale that digests are written for when the user
+	// hasn't chosen one. English is used if it's empty.
+	DefaultLocale string
+}
+
+// Analysis is one of the analyses listed in a digest.
+type Analysis struct {
+	ID      string  `json:"id"`
+	Name    string  `json:"name"`
+	AppName string  `json:"app_name"`
+	Hours   float64 `json:"hours"`
+}
+
+// Digest is the summary of a user's usage during a week. The locale, resource
+// name, and period label are included so that the email template doesn't need
+// to translate them.
+type Digest struct {
+	Locale         string     `json:"locale"`
+	WeekStart      time.Time  `json:"week_start"`
+	WeekEnd        time.Time  `json:"week_end"`
+	PeriodLabel    string     `json:"period_label"`
+	ResourceName   string     `json:"resource_name"`
+	Hours          float64    `json:"hours"`
+	Quota          *float64   `json:"quota"`
+	RemainingQuota *float64   `json:"remaining_quota"`
+	TopAnalyses    []Analysis `json:"top_analyses"`
+}
+
+// Notification is the request that's published to the notifications service.
+type Notification struct {
+	Type          string  `json:"type"`
+	User          string  `json:"user"`
+	Subject       string  `json:"subject"`
+	Message       string  `json:"message"`
+	Email         bool    `json:"email"`
+	EmailTemplate string  `json:"email_template"`
+	Payload       *Digest `json:"payload"`
+}
+
+// Calculator calculates the CPU hours charged for an analysis, so that the
+// digests report the same hours that were sent to QMS.
+type Calculator interface {
+	CPUHoursForAnalysis(context context.Context, analysisID string) (*apd.Decimal, *db.Analysis, error)
+}
+
+// Composer composes the weekly digests and publishes them.
+type Composer struct {
+	periodic.Task[*Config]
+
+	db        *db.Database
+	calc      Calculator
+	nc        *nats.EncodedConn
+	transport transport.Transport
+}
+
+// New returns a new *Composer. The NATS connection may be nil, in which case
+// the digests don't include the remaining quota.
+func New(config *Config, database *db.Database, calc Calculator, nc *nats.EncodedConn, t transport.Transport) *Composer {
+	return &Composer{
+		Task:      periodic.NewTask(config),
+		db:        database,
+		calc:      calc,
+		nc:        nc,
+		transport: t,
+	}
+}
+
+// lastCompleteWeek returns the start of the most recent complete week before
+// now. Weeks begin on Monday in UTC.
+func lastCompleteWeek(now time.Time) time.Time {
+	day := now.UTC().Truncate(24 * time.Hour)
+	sinceMonday := (int(day.Weekday()) + 6) % 7
+	return day.AddDate(0, 0, -sinceMonday-7)
+}
+
+// quota returns the user's CPU hours quota and usage from QMS. The quota is
+// nil if the user doesn't have one.
+func (c *Composer) quota(context context.Context, username string) (*float64, float64, error) {
+	request := pbinit.NewQMSRequestByUsername()
+	request.Username = username
+	_, span := pbinit.InitQMSRequestByUsername(request, subjects.QMSUserSummary)
+	defer span.End()
+
+	response := pbinit.NewSubscriptionResponse()
+	if err := gotelnats.Request(context, c.nc, subjects.QMSUserSummary, request, response); err != nil {
+		return nil, 0, err
+	}
+	if response.Subscription == nil {
+		return nil, 0, errors.New("QMS did not return a subscription")
+	}
+
+	var quota *float64
+	var usage float64
+	for _, q := range response.Subscription.Quotas {
+		if q.ResourceType != nil && q.ResourceType.Name == db.DefaultResourceType {
+			value := float64(q.Quota)
+			quota = &value
+		}
+	}
+	for _, u := range response.Subscription.Usages {
+		if u.ResourceType != nil && u.ResourceType.Name == db.DefaultResourceType {
+			usage = u.Usage
+		}
+	}
+
+	return quota, usage, nil
+}
+
+// analyses calculates the CPU hours for each of the user's analyses that ended
+// during the week, the same way they're calculated when usage is recorded, and
+// sets the user's total for the week. The analyses are returned with the ones
+// that used the most hours first.
+func (c *Composer) analyses(context context.Context, week time.Time, usage *db.WeeklyUsage) ([]Analysis, error) {
+	ended, err := c.db.DigestAnalyses(context, usage.UserID, week)
+	if err != nil {
+		return nil, err
+	}
+
+	bc := apd.BaseContext.WithPrecision(15)
+	total := apd.New(0, 0)
+	analyses := make([]Analysis, 0, len(ended))
+	for _, analysis := range ended {
+		hours, _, err := c.calc.CPUHoursForAnalysis(context, analysis.ID)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = bc.Add(total, total, hours); err != nil {
+			return nil, err
+		}
+		value, err := hours.Float64()
+		if err != nil {
+			return nil, err
+		}
+		analyses = append(analyses, Analysis{
+			ID:      analysis.ID,
+			Name:    analysis.Name,
+			AppName: analysis.AppName,
+			Hours:   value,
+		})
+	}
+	usage.Hours.Set(total)
+
+	sort.SliceStable(analyses, func(i, j int) bool {
+		return analyses[i].Hours > analyses[j].Hours
+	})
+	return analyses, nil
+}
+
+// compose builds the digest for the user's usage during the week. The
+// remaining quota is left out if QMS can't be reached.
+func (c *Composer) compose(context context.Context, config *Config, l *locale.Localizer, week time.Time, usage *db.WeeklyUsage) (*Digest, error) {
+	analyses, err := c.analyses(context, week, usage)
+	if err != nil {
+		return nil, err
+	}
+	hours, err := usage.Hours.Float64()
+	if err != nil {
+		return nil, err
+	}
+	if len(analyses) > config.TopAnalyses {
+		analyses = analyses[:config.TopAnalyses]
+	}
+
+	digest := &Digest{
+		Locale:       l.Locale(),
+		WeekStart:    week,
+		WeekEnd:      week.AddDate(0, 0, 7),
+		PeriodLabel:  l.Text(locale.WeekOf, l.Date(week)),
+		ResourceName: l.ResourceName(db.DefaultResourceType),
+		Hours:        hours,
+		TopAnalyses:  analyses,
+	}
+
+	if c.nc != nil {
+		quota, current, err := c.quota(context, usage.Username)
+		if err != nil {
+			log.WithContext(context).Warnf("unable to get the quota for %s from QMS, leaving it out of the digest: %s", usage.Username, err)
+		} else if quota != nil {
+			remaining := math.Max(*quota-current, 0)
+			digest.Quota, digest.RemainingQuota = quota, &remaining
+		}
+	}
+
+	return digest, nil
+}
+
+// send records and publishes a single user's digest. The record is removed
+// again if the digest can't be published, so that it's retried on the next
+// pass. It returns false if the digest had already been sent.
+func (c *Composer) send(context context.Context, config *Config, week time.Time, usage *db.WeeklyUsage) (bool, error) {
+	l := locale.New(usage.Locale.String, config.DefaultLocale)
+	digest, err := c.compose(context, config, l, week, usage)
+	if err != nil {
+		return false, err
+	}
+
+	added, err := c.db.AddDigest(context, usage.UserID, week, &usage.Hours)
+	if err != nil || !added {
+		return false, err
+	}
+
+	notification := &Notification{
+		Type:          notificationType,
+		User:          strings.TrimSuffix(usage.Username, "@"+config.Domain),
+		Subject:       l.Text(locale.DigestSubject, digest.PeriodLabel),
+		Message:       l.Text(locale.DigestMessage, l.Number(digest.Hours), digest.ResourceName, digest.PeriodLabel),
+		Email:         config.Email,
+		EmailTemplate: emailTemplate,
+		Payload:       digest,
+	}
+	data, err := json.Marshal(notification)
+	if err == nil {
+		err = c.transport.Send(context, config.RoutingKey, data)
+	}
+	if err != nil {
+		if deleteErr := c.db.DeleteDigest(context, usage.UserID, week); deleteErr != nil {
+			log.WithContext(context).Errorf("unable to remove the record of the unsent digest for %s: %s", usage.Username, deleteErr)
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Compose sends the digests for the week beginning at week to the users who
+// haven't received it yet. Failures for individual users are logged and don't
+// stop the others from being sent.
+func (c *Composer) Compose(context context.Context, week time.Time) error {
+	log := log.WithContext(context).WithFields(logrus.Fields{"context": "composing digests", "week": week.Format(time.DateOnly)})
+
+	config := c.Config()
+
+	usages, err := c.db.DigestRecipients(context, week)
+	if err != nil {
+		return err
+	}
+
+	var sent int
+	for i := range usages {
+		if context.Err() != nil {
+			return context.Err()
+		}
+		ok, err := c.send(context, config, week, &usages[i])
+		if err != nil {
+			log.Errorf("unable to send the usage digest to %s: %s", usages[i].Username, err)
+			continue
+		}
+		if ok {
+			sent++
+		}
+	}
+	if sent > 0 {
+		log.Infof("sent %d usage digests", sent)
+	}
+
+	return nil
+}
+
+// composeLastWeek sends the digests for the most recent complete week.
+func (c *Composer) composeLastWeek(context context.Context) error {
+	return c.Compose(context, lastCompleteWeek(time.Now()))
+}
+
+// Run sends the digests for the most recent complete week every configured
+// interval until the context is canceled.
+func (c *Composer) Run(context context.Context) {
+	c.RunEvery(context, log, func(config *Config) time.Duration { return config.Interval }, c.composeLastWeek)
+}
@@ -0,0 +1,170 @@
+// Package drift detects users whose CPU hours in QMS differ from their current
+// totals in the database.
+//
+// Once per interval, the comparer fetches the usage that QMS has recorded for
+// every user with a current CPU hours total and compares the two. Differences
+// larger than the tolerance are recorded so that they can be listed through
+// the admin API, and the recorded drift is cleared once the values match
+// again. Drift is only reported. The local totals don't include the usage that
+// calculations send straight to QMS, so they can't be used to correct it.
+package drift
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/go-mod/pbinit"
+	"github.com/cyverse-de/go-mod/subjects"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/ops"
+	"github.com/cyverse-de/resource-usage-api/periodic"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "drift"})
+
+// Config contains the settings for drift detection.
+type Config struct {
+	// Interval is how often every user's totals are compared with QMS.
+	Interval time.Duration
+
+	// Tolerance is the largest difference in CPU hours that isn't treated as
+	// drift. QMS stores usage as a float, so small differences are expected.
+	Tolerance float64
+}
+
+// Comparer records the differences between the local totals and QMS.
+type Comparer struct {
+	periodic.Task[*Config]
+
+	db     *db.Database
+	nc     *nats.EncodedConn
+	events *ops.Publisher
+}
+
+// New returns a new *Comparer.
+func New(config *Config, database *db.Database, nc *nats.EncodedConn) *Comparer {
+	return &Comparer{
+		Task: periodic.NewTask(config),
+		db:   database,
+		nc:   nc,
+	}
+}
+
+// SetEvents sets the publisher that newly detected drift is reported to.
+func (c *Comparer) SetEvents(events *ops.Publisher) {
+	c.events = events
+}
+
+// qmsUsage returns the usage of the resource type that QMS has recorded for
+// the user, or zero if it hasn't recorded any.
+func (c *Comparer) qmsUsage(context context.Context, username, resourceType string) (float64, error) {
+	request := pbinit.NewQMSRequestByUsername()
+	request.Username = username
+	_, span := pbinit.InitQMSRequestByUsername(request, subjects.QMSUserSummary)
+	defer span.End()
+
+	response := pbinit.NewSubscriptionResponse()
+	if err := gotelnats.Request(context, c.nc, subjects.QMSUserSummary, request, response); err != nil {
+		return 0, err
+	}
+	if response.Subscription == nil {
+		return 0, errors.New("QMS did not return a subscription")
+	}
+
+	for _, u := range response.Subscription.Usages {
+		if u.ResourceType != nil && u.ResourceType.Name == resourceType {
+			return u.Usage, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// Check compares one current total with QMS and records or clears its drift.
+func (c *Comparer) Check(context context.Context, total *db.CPUHours) error {
+	log := log.WithContext(context).WithFields(logrus.Fields{"context": "checking drift", "user": total.Username})
+	config := c.Config()
+
+	usage, err := c.qmsUsage(context, total.Username, total.ResourceType)
+	if err != nil {
+		return err
+	}
+	remote, err := apd.New(0, 0).SetFloat64(usage)
+	if err != nil {
+		return err
+	}
+
+	difference := apd.New(0, 0)
+	if _, err = apd.BaseContext.WithPrecision(15).Sub(difference, &total.Total, remote); err != nil {
+		return err
+	}
+	value, err := difference.Float64()
+	if err != nil {
+		return err
+	}
+
+	if value <= config.Tolerance && value >= -config.Tolerance {
+		return c.db.ClearUsageDrift(context, total.UserID, total.ResourceType)
+	}
+
+	log.Warnf("the total of %s differs from QMS's %s by %s", total.Total.Text('f'), remote.Text('f'), difference.Text('f'))
+	detected, err := c.db.SetUsageDrift(context, total.UserID, total.ResourceType, &total.Total, remote, difference)
+	if err != nil {
+		return err
+	}
+	if detected {
+		c.events.Publish(context, ops.DriftDetected, map[string]interface{}{
+			"username":      total.Username,
+			"resource_type": total.ResourceType,
+			"local_total":   total.Total.Text('f'),
+			"qms_total":     remote.Text('f'),
+			"difference":    difference.Text('f'),
+		})
+	}
+
+	return nil
+}
+
+// Compare checks every current CPU hours total against QMS. Failures for
+// individual users are logged and don't stop the others from being checked.
+func (c *Comparer) Compare(context context.Context) error {
+	log := log.WithContext(context)
+
+	totals, err := c.db.AdminAllCurrentCPUHours(context)
+	if err != nil {
+		return err
+	}
+
+	var checked int
+	for i := range totals {
+		if context.Err() != nil {
+			return context.Err()
+		}
+
+		// QMS only tracks CPU hours without allocation sources.
+		if totals[i].ResourceType != db.DefaultResourceType || totals[i].AllocationSource != db.DefaultAllocationSource {
+			continue
+		}
+
+		if err = c.Check(context, &totals[i]); err != nil {
+			log.Errorf("unable to compare the total for %s with QMS: %s", totals[i].Username, err)
+			continue
+		}
+		checked++
+	}
+	log.Debugf("compared %d totals with QMS", checked)
+
+	return nil
+}
+
+// Run compares the totals with QMS every configured interval until the context
+// is canceled.
+func (c *Comparer) Run(context context.Context) {
+	c.RunEvery(context, log, func(config *Config) time.Duration { return config.Interval }, c.Compare)
+}
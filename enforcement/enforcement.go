@@ -0,0 +1,210 @@
+// Package enforcement publishes enforcement events when usage updates push
+// users past their QMS quotas, so that other services can react, e.g. by no
+// longer launching new analyses for them.
+package enforcement
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/go-mod/pbinit"
+	"github.com/cyverse-de/go-mod/subjects"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/transport"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "enforcement"})
+
+// Config contains the settings for enforcement events.
+type Config struct {
+	// RoutingKey is the routing key that enforcement events are published with.
+	RoutingKey string
+
+	// GracePercentage is how far past the quota, as a percentage of it, usage
+	// may go before an enforcement event is published.
+	GracePercentage float64
+
+	// OverdraftAllowance is the amount of overdraft, in the resource type's
+	// units, that's tolerated past the grace percentage before an enforcement
+	// event is published.
+	OverdraftAllowance float64
+}
+
+// Event is published when a usage update pushes a user past the grace
+// threshold for one of their quotas.
+type Event struct {
+	Username        string    `json:"username"`
+	AnalysisID      string    `json:"analysis_id,omitempty"`
+	ResourceType    string    `json:"resource_type"`
+	Unit            string    `json:"unit"`
+	Usage           float64   `json:"usage"`
+	Quota           float64   `json:"quota"`
+	Percentage      float64   `json:"percentage"`
+	Overdraft       float64   `json:"overdraft"`
+	GracePercentage float64   `json:"grace_percentage"`
+	ExceededOn      time.Time `json:"exceeded_on"`
+}
+
+// Enforcer compares usage with the user's quotas in QMS after each usage
+// update.
+type Enforcer struct {
+	nc *nats.EncodedConn
+	db *db.Database
+
+	mutex     sync.Mutex
+	config    Config
+	transport transport.Transport
+}
+
+var _ cpuhours.Enforcer = (*Enforcer)(nil)
+
+// New returns a new *Enforcer that looks up quotas over the NATS connection
+// and records overdrafts in the database. Events are only published once a
+// transport has been set.
+func New(nc *nats.EncodedConn, db *db.Database, config Config) *Enforcer {
+	return &Enforcer{
+		nc:     nc,
+		db:     db,
+		config: config,
+	}
+}
+
+// SetTransport sets the transport that enforcement events are published on.
+// It can be called after usage updates have started arriving.
+func (e *Enforcer) SetTransport(t transport.Transport) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.transport = t
+}
+
+func (e *Enforcer) getTransport() transport.Transport {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.transport
+}
+
+// SetConfig replaces the enforcement settings. It can be called while usage
+// updates are arriving; updates that are already being checked keep using the
+// settings they started with.
+func (e *Enforcer) SetConfig(config Config) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.config = config
+}
+
+func (e *Enforcer) getConfig() Config {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.config
+}
+
+// quotaAndUsage returns the user's current quota and usage for a resource type
+// from QMS, along with the start of their subscription period. The quota is
+// zero if the user doesn't have one.
+func (e *Enforcer) quotaAndUsage(context context.Context, username, resourceType string) (float64, float64, time.Time, error) {
+	request := pbinit.NewQMSRequestByUsername()
+	request.Username = username
+	_, span := pbinit.InitQMSRequestByUsername(request, subjects.QMSUserSummary)
+	defer span.End()
+
+	response := pbinit.NewSubscriptionResponse()
+	if err := gotelnats.Request(context, e.nc, subjects.QMSUserSummary, request, response); err != nil {
+		return 0, 0, time.Time{}, err
+	}
+	if response.Subscription == nil {
+		return 0, 0, time.Time{}, errors.New("QMS did not return a subscription")
+	}
+
+	var quota, usage float64
+	for _, q := range response.Subscription.Quotas {
+		if q.ResourceType != nil && q.ResourceType.Name == resourceType {
+			quota = float64(q.Quota)
+		}
+	}
+	for _, u := range response.Subscription.Usages {
+		if u.ResourceType != nil && u.ResourceType.Name == resourceType {
+			usage = u.Usage
+		}
+	}
+
+	return quota, usage, response.Subscription.EffectiveStartDate.AsTime(), nil
+}
+
+// Enforce records the user's overdraft if the usage update took them past the
+// resource type's quota, and publishes an enforcement event if it pushed them
+// from below the enforcement threshold to at or above it. The threshold is the
+// quota plus the grace percentage and the overdraft allowance. Updates that
+// arrive once the user is already past the threshold don't publish another
+// event.
+func (e *Enforcer) Enforce(context context.Context, usage *cpuhours.UsageEvent) error {
+	config := e.getConfig()
+
+	quota, current, periodStart, err := e.quotaAndUsage(context, usage.Username, usage.ResourceType)
+	if err != nil {
+		return err
+	}
+	if quota <= 0 {
+		return nil
+	}
+
+	var overdraft float64
+	if current > quota {
+		overdraft = current - quota
+		value, err := apd.New(0, 0).SetFloat64(overdraft)
+		if err != nil {
+			return err
+		}
+		if err = e.db.SetOverdraft(context, usage.Username, usage.ResourceType, periodStart, value); err != nil {
+			return err
+		}
+	}
+
+	added, err := usage.Value.Float64()
+	if err != nil {
+		return err
+	}
+
+	threshold := quota*(1+config.GracePercentage/100) + config.OverdraftAllowance
+	if current < threshold || current-added >= threshold {
+		return nil
+	}
+
+	event := &Event{
+		Username:        usage.Username,
+		AnalysisID:      usage.AnalysisID,
+		ResourceType:    usage.ResourceType,
+		Unit:            usage.Unit,
+		Usage:           current,
+		Quota:           quota,
+		Percentage:      current / quota * 100,
+		Overdraft:       overdraft,
+		GracePercentage: config.GracePercentage,
+		ExceededOn:      usage.RecordedOn,
+	}
+
+	log.WithContext(context).WithFields(logrus.Fields{
+		"user":         usage.Username,
+		"resourceType": usage.ResourceType,
+	}).Infof("usage of %f exceeds the quota of %f, publishing an enforcement event", current, quota)
+
+	t := e.getTransport()
+	if t == nil {
+		return errors.New("no transport is available to publish the enforcement event")
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return t.Send(context, config.RoutingKey, data)
+}
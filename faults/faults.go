@@ -0,0 +1,53 @@
+// Package faults makes chosen operations fail at random, so that the paths
+// that recover from failures, such as the publish retries, the dead letter
+// queues, and the QMS reconciliation, can be exercised in staging.
+//
+// Faults are only injected by builds with the faults build tag:
+//
+//	go build -tags faults .
+//
+// In other builds Inject never fails and SetConfig does nothing, so the
+// injection points cost nothing in production.
+package faults
+
+import "errors"
+
+// Point identifies an operation that faults can be injected into.
+type Point string
+
+// The operations that faults can be injected into.
+const (
+	// DBCommit is the commit of a database transaction, or the execution of a
+	// statement outside of one.
+	DBCommit Point = "db_commit"
+
+	// AMQPPublish is the publication of an AMQP message.
+	AMQPPublish Point = "amqp_publish"
+
+	// QMSUpdate is a usage update sent to QMS.
+	QMSUpdate Point = "qms_update"
+)
+
+// ErrInjected is wrapped by the errors returned for injected faults.
+var ErrInjected = errors.New("injected fault")
+
+// Config contains the probability, from 0 to 1, that each operation fails.
+type Config struct {
+	DBCommit    float64
+	AMQPPublish float64
+	QMSUpdate   float64
+}
+
+// rate returns the probability that the operation fails.
+func (c *Config) rate(point Point) float64 {
+	switch point {
+	case DBCommit:
+		return c.DBCommit
+	case AMQPPublish:
+		return c.AMQPPublish
+	case QMSUpdate:
+		return c.QMSUpdate
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,49 @@
+//go:build faults
+
+package faults
+
+import (
+	"expvar"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "faults"})
+
+// Enabled is true if this build injects faults.
+const Enabled = true
+
+var (
+	mutex  sync.RWMutex
+	config Config
+
+	// injected counts the faults injected into each operation.
+	injected = expvar.NewMap("injected_faults")
+)
+
+// SetConfig replaces the probabilities that the operations fail.
+func SetConfig(c *Config) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	config = *c
+}
+
+// Inject returns an error wrapping ErrInjected with the configured probability
+// for the operation, and nil otherwise.
+func Inject(point Point) error {
+	mutex.RLock()
+	rate := config.rate(point)
+	mutex.RUnlock()
+
+	if rate <= 0 || rand.Float64() >= rate {
+		return nil
+	}
+
+	injected.Add(string(point), 1)
+	log.Warnf("injecting a fault into %s", point)
+	return fmt.Errorf("%w: %s", ErrInjected, point)
+}
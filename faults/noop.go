@@ -0,0 +1,14 @@
+//go:build !faults
+
+package faults
+
+// Enabled is true if this build injects faults.
+const Enabled = false
+
+// SetConfig does nothing, because this build doesn't inject faults.
+func SetConfig(*Config) {}
+
+// Inject always returns nil, because this build doesn't inject faults.
+func Inject(Point) error {
+	return nil
+}
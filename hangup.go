@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/cyverse-de/go-mod/cfg"
+	"github.com/cyverse-de/resource-usage-api/logging"
+)
+
+// reloadOnHangup resets the log level and applies the tunable settings
+// whenever the process receives a SIGHUP, until the context is canceled. The
+// configuration is read again and the level is set to log.level if it's set
+// there, or to the level given on the command line otherwise. It undoes log
+// level changes made through the admin API.
+func reloadOnHangup(context context.Context, settings *cfg.Settings, defaultLevel string, tuned *tunables) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+
+	for {
+		select {
+		case <-context.Done():
+			return
+		case <-hangups:
+		}
+
+		level := defaultLevel
+		config, err := cfg.Init(settings)
+		if err != nil {
+			log.Errorf("unable to read the configuration again: %s", err)
+		} else if configured := config.String("log.level"); configured != "" {
+			level = configured
+		}
+
+		previous := logging.Level()
+		if err = logging.SetLevel(level); err != nil {
+			log.Error(err)
+		} else {
+			log.Warnf("log level changed from %s to %s after SIGHUP", previous, logging.Level())
+		}
+
+		tuned.reload(settings)
+	}
+}
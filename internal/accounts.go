@@ -0,0 +1,195 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// AccountChangeRequest is the request body for the account rename and merge
+// endpoints.
+type AccountChangeRequest struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// AccountChangePage is a single page of the account change audit log.
+type AccountChangePage struct {
+	Changes []db.AccountChange `json:"changes"`
+	Limit   int                `json:"limit"`
+	Offset  int                `json:"offset"`
+}
+
+// performedBy returns the identity recorded in audit records for changes made
+// by the request.
+func performedBy(c echo.Context) string {
+	if user := actingUser(c); user != "" {
+		return user
+	}
+	if service := callerService(c); service != "" {
+		return service
+	}
+	return "admin"
+}
+
+// changeAccount moves usage between the users named in the request body
+// within a single transaction, using fn to do the moving, and records the
+// change in the audit log.
+func (a *App) changeAccount(c echo.Context, operation string, fn func(d *db.Database, change *db.AccountChange) error) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "account " + operation}).WithContext(context)
+
+	var request AccountChangeRequest
+	if err := bindBody(c, &request); err != nil {
+		return err
+	}
+	if request.From == "" || request.To == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "from and to must be set")
+	}
+	from, to := a.FixUsername(request.From), a.FixUsername(request.To)
+	if from == to {
+		return echo.NewHTTPError(http.StatusBadRequest, "from and to must be different users")
+	}
+
+	tx, err := a.database.BeginTxx(context, nil)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Error(err)
+		}
+	}()
+
+	d := db.New(tx)
+	change := &db.AccountChange{
+		Operation:    operation,
+		FromUsername: from,
+		ToUsername:   to,
+		PerformedBy:  performedBy(c),
+	}
+
+	if change.FromUserID, err = d.UserID(context, from); errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, ErrUserNotFound, "user not found: "+from)
+	} else if err != nil {
+		log.Error(err)
+		return err
+	}
+	if change.ToUserID, err = d.UserID(context, to); errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, ErrUserNotFound, "user not found: "+to)
+	} else if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if err = fn(d, change); err != nil {
+		return err
+	}
+	if change.EventsMoved, err = d.MoveUserEvents(context, change.FromUserID, change.ToUserID); err != nil {
+		log.Error(err)
+		return err
+	}
+	if change.IngestedJobsMoved, err = d.MoveSlurmIngestedJobs(context, change.FromUserID, change.ToUserID); err != nil {
+		log.Error(err)
+		return err
+	}
+	if change.RecordsMoved, err = d.MoveUserRecords(context, change.FromUserID, change.ToUserID); err != nil {
+		log.Error(err)
+		return err
+	}
+	if err = d.AddAccountChange(context, change); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if err = commit(tx); err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infof("%s of %s to %s by %s: %d totals moved, %d merged, %d events moved, %d ingested jobs moved, %d other records moved",
+		operation, from, to, change.PerformedBy,
+		change.TotalsMoved, change.TotalsMerged, change.EventsMoved, change.IngestedJobsMoved, change.RecordsMoved)
+
+	for _, username := range []string{from, to} {
+		if err = a.InvalidateTotals(context, username); err != nil {
+			log.Errorf("unable to invalidate the cached totals for %s: %s", username, err)
+		}
+	}
+
+	return respond(c, http.StatusOK, change)
+}
+
+// AdminRenameAccountHandler is an echo request handler that moves all of a
+// user's totals, events, work items, and the other records kept for them to
+// another user ID, such as after an
+// institutional username change. The destination user must not have any totals
+// yet; use the merge endpoint otherwise.
+func (a *App) AdminRenameAccountHandler(c echo.Context) error {
+	return a.changeAccount(c, db.AccountRename, func(d *db.Database, change *db.AccountChange) error {
+		context := c.Request().Context()
+
+		hasTotals, err := d.UserHasTotals(context, change.ToUserID)
+		if err != nil {
+			log.WithContext(context).Error(err)
+			return err
+		}
+		if hasTotals {
+			return echo.NewHTTPError(http.StatusConflict, "the destination user already has totals; merge the accounts instead")
+		}
+
+		change.TotalsMoved, err = d.MoveUserTotals(context, change.FromUserID, change.ToUserID)
+		if err != nil {
+			log.WithContext(context).Error(err)
+		}
+		return err
+	})
+}
+
+// AdminMergeAccountsHandler is an echo request handler that merges one user's
+// current totals into another's and moves the source user's events, work
+// items, and other records to the destination user.
+func (a *App) AdminMergeAccountsHandler(c echo.Context) error {
+	return a.changeAccount(c, db.AccountMerge, func(d *db.Database, change *db.AccountChange) error {
+		context := c.Request().Context()
+
+		var err error
+		change.TotalsMerged, change.TotalsMoved, err = d.MergeCurrentTotals(context, change.FromUserID, change.ToUserID)
+		if err != nil {
+			log.WithContext(context).Error(err)
+		}
+		return err
+	})
+}
+
+// AdminListAccountChangesHandler is an echo request handler that returns a page
+// of the account change audit log.
+func (a *App) AdminListAccountChangesHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "list account changes"}).WithContext(context)
+
+	limit, offset, err := pagination(c)
+	if err != nil {
+		return err
+	}
+
+	changes, err := db.New(a.database).AccountChanges(context, limit, offset)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if changes == nil {
+		changes = make([]db.AccountChange, 0)
+	}
+
+	return respond(c, http.StatusOK, &AccountChangePage{
+		Changes: changes,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
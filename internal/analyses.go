@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/google/uuid"
+	"github.com/guregu/null"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// The values accepted by the period query parameter of the analysis listing.
+const (
+	periodCurrent = "current"
+	periodAll     = "all"
+)
+
+// UserAnalysisPage is a single page of a user's analyses with their CPU hours.
+type UserAnalysisPage struct {
+	Analyses    []db.AnalysisUsage `json:"analyses"`
+	PeriodStart *time.Time         `json:"period_start"`
+	PeriodEnd   *time.Time         `json:"period_end"`
+	Cluster     string             `json:"cluster,omitempty"`
+	Sort        string             `json:"sort"`
+	Limit       int                `json:"limit"`
+	Offset      int                `json:"offset"`
+}
+
+func (p *UserAnalysisPage) csvHeader() []string {
+	return []string{
+		"id", "name", "app_id", "app_name", "job_type", "status", "start_date", "end_date",
+		"millicores_reserved", "hours", "cluster",
+	}
+}
+
+func (p *UserAnalysisPage) csvRecords() [][]string {
+	records := make([][]string, 0, len(p.Analyses))
+	for _, analysis := range p.Analyses {
+		records = append(records, []string{
+			analysis.ID,
+			analysis.Name,
+			analysis.AppID,
+			analysis.AppName,
+			analysis.JobType,
+			analysis.Status,
+			csvTime(analysis.StartDate),
+			csvTime(analysis.EndDate),
+			strconv.FormatInt(analysis.MillicoresReserved, 10),
+			decimalString(&analysis.Hours),
+			analysis.Cluster,
+		})
+	}
+	return records
+}
+
+// GetUserAnalyses is an echo request handler that returns a page of the user's
+// completed analyses with the CPU hours each one reserved. The period query
+// parameter is either current, for the analyses that ended during the user's
+// current usage period (the default), or all. The sort query parameter is
+// either end_date (the default) or hours, and both sort in descending order.
+// The cluster query parameter limits the listing to the analyses that ran on
+// that cluster.
+func (a *App) GetUserAnalyses(c echo.Context) error {
+	context := c.Request().Context()
+	user := a.FixUsername(c.Param("username"))
+	log := log.WithFields(logrus.Fields{"context": "get user analyses", "user": user}).WithContext(context)
+
+	limit, offset, err := pagination(c)
+	if err != nil {
+		return err
+	}
+
+	sort := c.QueryParam("sort")
+	if sort == "" {
+		sort = db.AnalysisUsageByEndDate
+	}
+	if sort != db.AnalysisUsageByEndDate && sort != db.AnalysisUsageByHours {
+		return echo.NewHTTPError(http.StatusBadRequest, "sort must be end_date or hours")
+	}
+
+	d := db.New(a.readDatabase)
+
+	userID, err := d.UserID(context, user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, ErrUserNotFound, "user not found")
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	page := &UserAnalysisPage{Cluster: c.QueryParam("cluster"), Sort: sort, Limit: limit, Offset: offset}
+
+	var from, to null.Time
+	switch c.QueryParam("period") {
+	case "", periodCurrent:
+		current, err := d.CurrentCPUHoursForUser(context, user)
+		if errors.Is(err, sql.ErrNoRows) {
+			return newAPIError(http.StatusNotFound, ErrNoTotals, "the user has no current usage period")
+		}
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		from, to = null.TimeFrom(current.EffectiveStart), null.TimeFrom(current.EffectiveEnd)
+		page.PeriodStart, page.PeriodEnd = &current.EffectiveStart, &current.EffectiveEnd
+	case periodAll:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "period must be current or all")
+	}
+
+	if page.Analyses, err = d.UserAnalysisUsage(context, userID, from, to, page.Cluster, sort, limit, offset); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if page.Analyses == nil {
+		page.Analyses = make([]db.AnalysisUsage, 0)
+	}
+
+	return respond(c, http.StatusOK, page)
+}
+
+// maxAnalysisHoursIDs is the largest number of analyses whose hours can be
+// looked up in a single request.
+const maxAnalysisHoursIDs = 1000
+
+// AnalysisHoursRequest is the request body for the bulk analysis hours
+// endpoint.
+type AnalysisHoursRequest struct {
+	AnalysisIDs []string `json:"analysis_ids"`
+}
+
+// AnalysisHoursResponse is the response body for the bulk analysis hours
+// endpoint. The analyses are in the order that their IDs were requested in,
+// and the IDs of the analyses that don't exist are listed in NotFound.
+type AnalysisHoursResponse struct {
+	Analyses []db.AnalysisHours `json:"analyses"`
+	NotFound []string           `json:"not_found"`
+}
+
+// AdminGetAnalysisHoursHandler is an echo request handler that returns the
+// CPU hours reserved by and charged for each of a list of analyses, so that
+// an analysis listing can show them without a request per analysis.
+func (a *App) AdminGetAnalysisHoursHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "get analysis hours"}).WithContext(context)
+
+	var request AnalysisHoursRequest
+	if err := bindBody(c, &request); err != nil {
+		return err
+	}
+	if len(request.AnalysisIDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "analysis_ids must be set")
+	}
+	if len(request.AnalysisIDs) > maxAnalysisHoursIDs {
+		return echo.NewHTTPError(http.StatusBadRequest, "at most 1000 analyses can be looked up at once")
+	}
+
+	var problems fieldErrors
+	ids := make([]string, 0, len(request.AnalysisIDs))
+	seen := make(map[string]bool)
+	for i, id := range request.AnalysisIDs {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			problems.add(fmt.Sprintf("analysis_ids.%d", i), "must be a UUID")
+			continue
+		}
+		if id = parsed.String(); !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	analyses, err := db.New(a.readDatabase).AnalysisHoursByID(context, ids)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	byID := make(map[string]*db.AnalysisHours, len(analyses))
+	for i := range analyses {
+		byID[analyses[i].ID] = &analyses[i]
+	}
+
+	response := &AnalysisHoursResponse{
+		Analyses: make([]db.AnalysisHours, 0, len(analyses)),
+		NotFound: make([]string, 0),
+	}
+	for _, id := range ids {
+		if analysis, ok := byID[id]; ok {
+			response.Analyses = append(response.Analyses, *analysis)
+		} else {
+			response.NotFound = append(response.NotFound, id)
+		}
+	}
+
+	return respond(c, http.StatusOK, response)
+}
@@ -0,0 +1,163 @@
+package internal
+
+import (
+	"encoding/csv"
+	"net/http"
+	"strconv"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// FlatUsagePage is a single page of denormalized usage rows.
+type FlatUsagePage struct {
+	Rows    []db.FlatUsageRow `json:"rows"`
+	Cluster string            `json:"cluster,omitempty"`
+	Limit   int               `json:"limit"`
+	Offset  int               `json:"offset"`
+}
+
+func (p *FlatUsagePage) csvHeader() []string {
+	return []string{
+		"analysis_id", "username", "app_id", "app_name", "job_type", "start_date", "end_date",
+		"millicores_reserved", "hours", "period_start", "period_end", "cluster",
+	}
+}
+
+func (p *FlatUsagePage) csvRecords() [][]string {
+	records := make([][]string, 0, len(p.Rows))
+	for _, row := range p.Rows {
+		records = append(records, []string{
+			row.AnalysisID,
+			row.Username,
+			row.AppID,
+			row.AppName,
+			row.JobType,
+			csvTime(row.StartDate),
+			csvTime(row.EndDate),
+			strconv.FormatInt(row.Millicores, 10),
+			decimalString(&row.Hours),
+			csvNullTime(row.PeriodStart),
+			csvNullTime(row.PeriodEnd),
+			row.Cluster,
+		})
+	}
+	return records
+}
+
+// WriteFlatUsageCSV writes denormalized usage rows to w in the same CSV format
+// as the flat usage endpoint. The header row is only written if header is true,
+// so that rows can be written a page at a time.
+func WriteFlatUsageCSV(w *csv.Writer, rows []db.FlatUsageRow, header bool) error {
+	page := &FlatUsagePage{Rows: rows}
+	if header {
+		if err := w.Write(page.csvHeader()); err != nil {
+			return err
+		}
+	}
+	return w.WriteAll(page.csvRecords())
+}
+
+// pagination extracts the limit and offset query parameters from the request,
+// applying the defaults and upper bound for the limit.
+func pagination(c echo.Context) (int, int, error) {
+	var (
+		limit  = defaultPageLimit
+		offset = 0
+		err    error
+	)
+
+	if v := c.QueryParam("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			return 0, 0, echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive integer")
+		}
+		if limit > maxPageLimit {
+			limit = maxPageLimit
+		}
+	}
+
+	if v := c.QueryParam("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return 0, 0, echo.NewHTTPError(http.StatusBadRequest, "offset must be a non-negative integer")
+		}
+	}
+
+	return limit, offset, nil
+}
+
+// AdminFlatUsageHandler is an echo request handler that returns a page of
+// denormalized usage rows suitable for ingestion by BI tools, optionally
+// limited to the cluster named in the cluster query parameter.
+func (a *App) AdminFlatUsageHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "flat usage analytics"}).WithContext(context)
+
+	limit, offset, err := pagination(c)
+	if err != nil {
+		return err
+	}
+
+	cluster := c.QueryParam("cluster")
+
+	d := db.New(a.readDatabase)
+	rows, err := d.AdminFlatUsage(context, cluster, limit, offset)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if rows == nil {
+		rows = make([]db.FlatUsageRow, 0)
+	}
+
+	return respond(c, http.StatusOK, &FlatUsagePage{
+		Rows:    rows,
+		Cluster: cluster,
+		Limit:   limit,
+		Offset:  offset,
+	})
+}
+
+// UsageStatsResponse is the response body for the platform statistics
+// endpoint.
+type UsageStatsResponse struct {
+	ResourceType     string `json:"resource_type"`
+	AllocationSource string `json:"allocation_source"`
+	*db.UsageStats
+}
+
+// AdminUsageStatsHandler is an echo request handler that returns aggregate
+// statistics over the current totals of every user: the total usage this
+// period, the number of active users, and the distribution of their usage. The
+// resource_type query parameter selects the resource type, which defaults to
+// CPU hours.
+func (a *App) AdminUsageStatsHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "usage statistics"}).WithContext(context)
+
+	resourceType := c.QueryParam("resource_type")
+	if resourceType == "" {
+		resourceType = db.DefaultResourceType
+	}
+	if !db.ValidResourceType(resourceType) {
+		return echo.NewHTTPError(http.StatusBadRequest, "unsupported resource type")
+	}
+
+	stats, err := db.New(a.readDatabase).AdminCurrentUsageStats(context, resourceType, db.DefaultAllocationSource)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return respond(c, http.StatusOK, &UsageStatsResponse{
+		ResourceType:     resourceType,
+		AllocationSource: db.DefaultAllocationSource,
+		UsageStats:       stats,
+	})
+}
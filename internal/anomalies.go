@@ -0,0 +1,44 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// AnomalyPage is a single page of detected usage anomalies.
+type AnomalyPage struct {
+	Anomalies []db.Anomaly `json:"anomalies"`
+	Limit     int          `json:"limit"`
+	Offset    int          `json:"offset"`
+}
+
+// AdminListAnomaliesHandler is an echo request handler that returns a page of
+// the days on which users' CPU usage was anomalously high, most recent first.
+func (a *App) AdminListAnomaliesHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "list anomalies"}).WithContext(context)
+
+	limit, offset, err := pagination(c)
+	if err != nil {
+		return err
+	}
+
+	anomalies, err := db.New(a.readDatabase).Anomalies(context, limit, offset)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if anomalies == nil {
+		anomalies = make([]db.Anomaly, 0)
+	}
+
+	return respond(c, http.StatusOK, &AnomalyPage{
+		Anomalies: anomalies,
+		Limit:     limit,
+		Offset:    offset,
+	})
+}
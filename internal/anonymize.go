@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMinimumCount is the number of distinct users that must have run an
+// app for it to be named in the anonymized export if no other minimum is
+// configured.
+const DefaultMinimumCount = 5
+
+// Anonymizer turns usage rows into rows that can be shared with researchers.
+// Usernames are replaced with salted hashes, which are stable for as long as
+// the salt is, so that one user's analyses can be followed through the data
+// without revealing who they are. Apps run by fewer than the minimum number of
+// users are suppressed, and times are truncated to the hour, so that neither
+// can be used to pick a user out.
+type Anonymizer struct {
+	salt     []byte
+	minCount int64
+}
+
+// NewAnonymizer returns an *Anonymizer that hashes usernames with the salt and
+// suppresses the apps run by fewer than minCount users. DefaultMinimumCount is
+// used if minCount isn't positive.
+func NewAnonymizer(salt string, minCount int64) *Anonymizer {
+	if minCount <= 0 {
+		minCount = DefaultMinimumCount
+	}
+	return &Anonymizer{salt: []byte(salt), minCount: minCount}
+}
+
+// userHash returns the salted hash that replaces the username.
+func (a *Anonymizer) userHash(username string) string {
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// AnonymizedUsageRow is a record of the CPU hours consumed by a single
+// analysis with nothing that identifies the user who ran it. The app ID and
+// name are empty if the app was suppressed.
+type AnonymizedUsageRow struct {
+	User          string      `json:"user"`
+	AppID         string      `json:"app_id"`
+	AppName       string      `json:"app_name"`
+	AppSuppressed bool        `json:"app_suppressed"`
+	JobType       string      `json:"job_type"`
+	StartHour     time.Time   `json:"start_hour"`
+	EndHour       time.Time   `json:"end_hour"`
+	Millicores    int64       `json:"millicores_reserved"`
+	Hours         apd.Decimal `json:"hours"`
+	Cluster       string      `json:"cluster"`
+}
+
+// Anonymize returns the anonymized versions of the rows.
+func (a *Anonymizer) Anonymize(rows []db.ResearchUsageRow) []AnonymizedUsageRow {
+	anonymized := make([]AnonymizedUsageRow, 0, len(rows))
+	for i := range rows {
+		row := &rows[i]
+		r := AnonymizedUsageRow{
+			User:       a.userHash(row.Username),
+			JobType:    row.JobType,
+			StartHour:  row.StartDate.Truncate(time.Hour),
+			EndHour:    row.EndDate.Truncate(time.Hour),
+			Millicores: row.Millicores,
+			Cluster:    row.Cluster,
+		}
+		r.Hours.Set(&row.Hours)
+		if row.AppUsers >= a.minCount {
+			r.AppID = row.AppID
+			r.AppName = row.AppName
+		} else {
+			r.AppSuppressed = true
+		}
+		anonymized = append(anonymized, r)
+	}
+	return anonymized
+}
+
+// AnonymizedUsagePage is a single page of anonymized usage rows.
+type AnonymizedUsagePage struct {
+	Rows         []AnonymizedUsageRow `json:"rows"`
+	Cluster      string               `json:"cluster,omitempty"`
+	MinimumCount int64                `json:"minimum_count"`
+	Limit        int                  `json:"limit"`
+	Offset       int                  `json:"offset"`
+}
+
+func (p *AnonymizedUsagePage) csvHeader() []string {
+	return []string{
+		"user", "app_id", "app_name", "app_suppressed", "job_type", "start_hour", "end_hour",
+		"millicores_reserved", "hours", "cluster",
+	}
+}
+
+func (p *AnonymizedUsagePage) csvRecords() [][]string {
+	records := make([][]string, 0, len(p.Rows))
+	for _, row := range p.Rows {
+		records = append(records, []string{
+			row.User,
+			row.AppID,
+			row.AppName,
+			strconv.FormatBool(row.AppSuppressed),
+			row.JobType,
+			csvTime(row.StartHour),
+			csvTime(row.EndHour),
+			strconv.FormatInt(row.Millicores, 10),
+			decimalString(&row.Hours),
+			row.Cluster,
+		})
+	}
+	return records
+}
+
+// WriteAnonymizedUsageCSV writes anonymized usage rows to w in the same CSV
+// format as the anonymized export endpoint. The header row is only written if
+// header is true, so that rows can be written a page at a time.
+func WriteAnonymizedUsageCSV(w *csv.Writer, rows []AnonymizedUsageRow, header bool) error {
+	page := &AnonymizedUsagePage{Rows: rows}
+	if header {
+		if err := w.Write(page.csvHeader()); err != nil {
+			return err
+		}
+	}
+	return w.WriteAll(page.csvRecords())
+}
+
+// AdminAnonymizedExportHandler is an echo request handler that returns a page
+// of anonymized usage rows for research, optionally limited to the cluster
+// named in the cluster query parameter. It responds with a 404 if no salt is
+// configured for the usernames.
+func (a *App) AdminAnonymizedExportHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "anonymized export"}).WithContext(context)
+
+	if a.anonymizer == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "the anonymized export isn't configured")
+	}
+
+	limit, offset, err := pagination(c)
+	if err != nil {
+		return err
+	}
+
+	cluster := c.QueryParam("cluster")
+
+	rows, err := db.New(a.readDatabase).AdminResearchUsage(context, cluster, limit, offset)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return respond(c, http.StatusOK, &AnonymizedUsagePage{
+		Rows:         a.anonymizer.Anonymize(rows),
+		Cluster:      cluster,
+		MinimumCount: a.anonymizer.minCount,
+		Limit:        limit,
+		Offset:       offset,
+	})
+}
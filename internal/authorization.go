@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/resource-usage-api/authz"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// qualifyPolicy returns a copy of the policy with the usernames in its rules
+// and user identities fully qualified, so that they can be compared with the
+// usernames in requests. Returns nil if the policy is nil.
+func (a *App) qualifyPolicy(policy *authz.Policy) *authz.Policy {
+	if policy == nil {
+		return nil
+	}
+
+	qualified := &authz.Policy{
+		Default: policy.Default,
+		Rules:   make([]authz.Rule, len(policy.Rules)),
+	}
+	for i, rule := range policy.Rules {
+		rule.Identities = append([]string(nil), rule.Identities...)
+		for j, identity := range rule.Identities {
+			if user, ok := strings.CutPrefix(identity, "user:"); ok && user != "*" {
+				rule.Identities[j] = "user:" + a.FixUsername(user)
+			}
+		}
+		rule.Usernames = append([]string(nil), rule.Usernames...)
+		for j, username := range rule.Usernames {
+			if username != authz.Self && username != "*" {
+				rule.Usernames[j] = a.FixUsername(username)
+			}
+		}
+		qualified.Rules[i] = rule
+	}
+
+	return qualified
+}
+
+// readOnlyRoutes are the routes that only read, even though they're requested
+// with methods that usually write, because their queries are too large for a
+// query string.
+var readOnlyRoutes = map[string]bool{
+	"/graphql":              true,
+	"/admin/analyses/hours": true,
+}
+
+// requestRoute returns the route that a request matched without its version
+// prefix, along with the scope that the request needs. Requests to the admin
+// routes need one of the admin scopes, and the rest need read or write
+// depending on the method. The read-only routes always need a read scope.
+func requestRoute(c echo.Context) (string, authz.Scope) {
+	route := c.Path()
+	if trimmed, ok := strings.CutPrefix(route, "/v1"); ok && (trimmed == "" || strings.HasPrefix(trimmed, "/")) {
+		route = trimmed
+	}
+
+	method := c.Request().Method
+	readOnly := method == http.MethodGet || method == http.MethodHead || readOnlyRoutes[route]
+
+	switch {
+	case strings.HasPrefix(route, "/admin/") && readOnly:
+		return route, authz.ScopeAdminRead
+	case strings.HasPrefix(route, "/admin/"):
+		return route, authz.ScopeAdminWrite
+	case readOnly:
+		return route, authz.ScopeRead
+	default:
+		return route, authz.ScopeWrite
+	}
+}
+
+// authorize is middleware that rejects the requests that the authorization
+// policy doesn't allow with a 403. It must run after identify. Every request
+// is allowed if there's no policy, and the root route is always allowed so
+// that health checks don't need a rule.
+func (a *App) authorize(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if a.policy == nil {
+			return next(c)
+		}
+
+		route, scope := requestRoute(c)
+		if route == "/" {
+			return next(c)
+		}
+
+		request := &authz.Request{
+			Service:    callerService(c),
+			ActingUser: actingUser(c),
+			Scope:      scope,
+			Route:      route,
+		}
+		if username := c.Param("username"); username != "" {
+			request.Username = a.FixUsername(username)
+		}
+
+		allowed, rule := a.policy.Allows(request)
+
+		log.WithFields(logrus.Fields{
+			"context":     "authz",
+			"route":       route,
+			"scope":       scope,
+			"service":     request.Service,
+			"acting_user": request.ActingUser,
+			"username":    request.Username,
+			"rule":        rule,
+			"allowed":     allowed,
+		}).WithContext(c.Request().Context()).Debug("authorization decided")
+
+		if !allowed {
+			return newAPIError(http.StatusForbidden, ErrForbidden, fmt.Sprintf("the caller is not allowed the %s scope for this request", scope))
+		}
+
+		return next(c)
+	}
+}
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/guregu/null"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// BillingWeightRequest is the request body for the billing weight creation
+// endpoint. The weight starts now if no start is given, and has no end if no
+// end is given.
+type BillingWeightRequest struct {
+	TargetType string      `json:"target_type"`
+	TargetID   string      `json:"target_id"`
+	Weight     json.Number `json:"weight"`
+	StartsOn   time.Time   `json:"starts_on"`
+	EndsOn     time.Time   `json:"ends_on"`
+	Reason     string      `json:"reason"`
+}
+
+// BillingWeightListing is the response body for the billing weight listing
+// endpoint.
+type BillingWeightListing struct {
+	Weights []db.BillingWeight `json:"weights"`
+}
+
+// BillingWeightResult is the response body for the billing weight creation
+// endpoint.
+type BillingWeightResult struct {
+	ID string `json:"id"`
+}
+
+// AdminAddBillingWeightHandler is an echo request handler that adds a billing
+// weight for an app or a tool. The CPU hours of the analyses that end while
+// it's in effect are multiplied by the weight. Weights for the same app or
+// tool can't overlap.
+func (a *App) AdminAddBillingWeightHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "add billing weight"}).WithContext(context)
+
+	var request BillingWeightRequest
+	if err := bindBody(c, &request); err != nil {
+		return err
+	}
+	if request.StartsOn.IsZero() {
+		request.StartsOn = time.Now()
+	}
+
+	var problems fieldErrors
+	if request.TargetType != db.BillingWeightApp && request.TargetType != db.BillingWeightTool {
+		problems.add("target_type", "must be app or tool")
+	}
+	if request.TargetID == "" {
+		problems.add("target_id", "must be set")
+	}
+	weight := parseDecimal(&problems, "weight", request.Weight)
+	if weight != nil && weight.Sign() < 0 {
+		problems.add("weight", "can't be negative")
+	}
+	if !request.EndsOn.IsZero() && !request.EndsOn.After(request.StartsOn) {
+		problems.add("ends_on", "must be after starts_on")
+	}
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	billingWeight := &db.BillingWeight{
+		TargetType: request.TargetType,
+		TargetID:   request.TargetID,
+		Weight:     *weight,
+		StartsOn:   request.StartsOn.UTC(),
+		EndsOn:     null.NewTime(request.EndsOn.UTC(), !request.EndsOn.IsZero()),
+		Reason:     request.Reason,
+		CreatedBy:  performedBy(c),
+	}
+	id, err := db.New(a.database).AddBillingWeight(context, billingWeight)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if id == "" {
+		return echo.NewHTTPError(http.StatusConflict, "the weight overlaps another weight for the same "+request.TargetType)
+	}
+	log.Infof("added a billing weight of %s for the %s %s starting at %s", billingWeight.Weight.String(),
+		billingWeight.TargetType, billingWeight.TargetID, billingWeight.StartsOn.Format(time.RFC3339))
+
+	return respond(c, http.StatusCreated, &BillingWeightResult{ID: id})
+}
+
+// AdminListBillingWeightsHandler is an echo request handler that lists the
+// billing weights, including the revoked and expired ones. The target_type
+// and target_id query parameters limit the listing to the weights for an app
+// or a tool.
+func (a *App) AdminListBillingWeightsHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "list billing weights"}).WithContext(context)
+
+	weights, err := db.New(a.readDatabase).BillingWeights(context, c.QueryParam("target_type"), c.QueryParam("target_id"))
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if weights == nil {
+		weights = make([]db.BillingWeight, 0)
+	}
+
+	return respond(c, http.StatusOK, &BillingWeightListing{Weights: weights})
+}
+
+// AdminRevokeBillingWeightHandler is an echo request handler that revokes a
+// billing weight. It isn't applied to the analyses calculated after it's
+// revoked, but the usage that was already weighted stays as it was.
+func (a *App) AdminRevokeBillingWeightHandler(c echo.Context) error {
+	context := c.Request().Context()
+	id := c.Param("id")
+	log := log.WithFields(logrus.Fields{"context": "revoke billing weight", "id": id}).WithContext(context)
+
+	revoked, err := db.New(a.database).RevokeBillingWeight(context, id, performedBy(c))
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if !revoked {
+		return echo.NewHTTPError(http.StatusNotFound, "no unrevoked billing weight found")
+	}
+	log.Infof("revoked billing weight %s", id)
+
+	return c.NoContent(http.StatusOK)
+}
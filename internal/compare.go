@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultComparedPeriods = 2
+	maxComparedPeriods     = 24
+)
+
+// ComparedPeriod is the CPU hours total for one of a user's effective periods.
+// PercentChange is the change from the period before it, and is nil if there's
+// no earlier period or its total was zero.
+type ComparedPeriod struct {
+	EffectiveStart time.Time `json:"effective_start"`
+	EffectiveEnd   time.Time `json:"effective_end"`
+	Total          float64   `json:"total"`
+	PercentChange  *float64  `json:"percent_change"`
+}
+
+// PeriodComparison compares a user's CPU hours totals across their most
+// recent effective periods. Periods are listed newest first, so the first one
+// is the current period.
+type PeriodComparison struct {
+	Username string           `json:"username"`
+	Periods  []ComparedPeriod `json:"periods"`
+}
+
+// percentChange returns the change from previous to current as a percentage of
+// previous, or nil if previous is zero.
+func percentChange(previous, current float64) *float64 {
+	if previous == 0 {
+		return nil
+	}
+	change := (current - previous) / previous * 100
+	return &change
+}
+
+// GetUserCPUComparison is an echo request handler that returns the user's CPU
+// hours totals for the periods query parameter number of most recent effective
+// periods, with the percentage change from each period to the next.
+func (a *App) GetUserCPUComparison(c echo.Context) error {
+	context := c.Request().Context()
+	user := a.FixUsername(c.Param("username"))
+	log := log.WithFields(logrus.Fields{"context": "compare user CPU periods", "user": user}).WithContext(context)
+
+	periods := defaultComparedPeriods
+	if v := c.QueryParam("periods"); v != "" {
+		var err error
+		if periods, err = strconv.Atoi(v); err != nil || periods < 2 {
+			return echo.NewHTTPError(http.StatusBadRequest, "periods must be an integer greater than 1")
+		}
+		if periods > maxComparedPeriods {
+			periods = maxComparedPeriods
+		}
+	}
+
+	totals, err := db.New(a.readDatabase).RecentTotalsForUser(context, user, db.DefaultResourceType, db.DefaultAllocationSource, periods)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if len(totals) == 0 {
+		return newAPIError(http.StatusNotFound, ErrNoTotals, "no CPU hours found for user")
+	}
+
+	comparison := &PeriodComparison{
+		Username: user,
+		Periods:  make([]ComparedPeriod, len(totals)),
+	}
+	for i := range totals {
+		total, err := totals[i].Total.Float64()
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		comparison.Periods[i] = ComparedPeriod{
+			EffectiveStart: totals[i].EffectiveStart,
+			EffectiveEnd:   totals[i].EffectiveEnd,
+			Total:          total,
+		}
+	}
+
+	// The totals are newest first, so each period is compared with the one
+	// that follows it in the list.
+	for i := 0; i < len(comparison.Periods)-1; i++ {
+		comparison.Periods[i].PercentChange = percentChange(comparison.Periods[i+1].Total, comparison.Periods[i].Total)
+	}
+
+	return respond(c, http.StatusOK, comparison)
+}
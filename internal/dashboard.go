@@ -0,0 +1,197 @@
+package internal
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/internal/summarizer"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// AlertState describes how close a user is to a quota.
+type AlertState string
+
+const (
+	AlertUnknown  AlertState = "unknown"
+	AlertOK       AlertState = "ok"
+	AlertWarning  AlertState = "warning"
+	AlertCritical AlertState = "critical"
+	AlertExceeded AlertState = "exceeded"
+)
+
+// The percentages of a quota at which the alert states begin.
+const (
+	warningPercentage  = 75.0
+	criticalPercentage = 90.0
+	exceededPercentage = 100.0
+)
+
+// alertState returns the alert state for a usage percentage. A nil percentage
+// means that the user has no quota for the resource type.
+func alertState(percentage *float64) AlertState {
+	switch {
+	case percentage == nil:
+		return AlertUnknown
+	case *percentage >= exceededPercentage:
+		return AlertExceeded
+	case *percentage >= criticalPercentage:
+		return AlertCritical
+	case *percentage >= warningPercentage:
+		return AlertWarning
+	default:
+		return AlertOK
+	}
+}
+
+// DashboardResource contains the usage information for a single resource type.
+type DashboardResource struct {
+	ResourceType string     `json:"resource_type"`
+	Unit         string     `json:"unit"`
+	Usage        float64    `json:"usage"`
+	Held         float64    `json:"held"`
+	Quota        *float64   `json:"quota"`
+	Percentage   *float64   `json:"percentage"`
+	Alert        AlertState `json:"alert"`
+}
+
+// Dashboard is the payload used by the Sonora usage widget.
+type Dashboard struct {
+	Username    string                `json:"username"`
+	PeriodStart *time.Time            `json:"period_start"`
+	PeriodEnd   *time.Time            `json:"period_end"`
+	Plan        *clients.Plan         `json:"plan"`
+	Resources   []DashboardResource   `json:"resources"`
+	Errors      []summarizer.APIError `json:"errors"`
+
+	// QuotasFetchedOn and QuotasStale describe the quotas' freshness when
+	// they're read from the locally stored copies.
+	QuotasFetchedOn *time.Time `json:"quotas_fetched_on,omitempty"`
+	QuotasStale     bool       `json:"quotas_stale,omitempty"`
+}
+
+// addResource adds a resource to the dashboard, calculating the percentage and
+// alert state if a quota is available.
+func (d *Dashboard) addResource(resourceType, unit string, usage float64, quota *float64) {
+	var percentage *float64
+
+	if quota != nil && *quota > 0 {
+		p := usage / *quota * 100
+		percentage = &p
+	}
+
+	d.Resources = append(d.Resources, DashboardResource{
+		ResourceType: resourceType,
+		Unit:         unit,
+		Usage:        usage,
+		Quota:        quota,
+		Percentage:   percentage,
+		Alert:        alertState(percentage),
+	})
+}
+
+// addHeld adds the amount held for running analyses to a resource on the
+// dashboard. Holds count against the quota, so the percentage and alert state
+// are recalculated from the usage plus the held amount.
+func (d *Dashboard) addHeld(resourceType string, held float64) {
+	for i := range d.Resources {
+		r := &d.Resources[i]
+		if r.ResourceType != resourceType {
+			continue
+		}
+		r.Held = held
+		if r.Quota != nil && *r.Quota > 0 {
+			p := (r.Usage + r.Held) / *r.Quota * 100
+			r.Percentage = &p
+			r.Alert = alertState(r.Percentage)
+		}
+	}
+}
+
+// newDashboard builds the dashboard payload from a user summary.
+func newDashboard(username string, summary *summarizer.UserSummary) *Dashboard {
+	dashboard := &Dashboard{
+		Username:  username,
+		Resources: make([]DashboardResource, 0),
+		Errors:    summary.Errors,
+
+		QuotasFetchedOn: summary.QuotasFetchedOn,
+		QuotasStale:     summary.QuotasStale,
+	}
+	if dashboard.Errors == nil {
+		dashboard.Errors = make([]summarizer.APIError, 0)
+	}
+
+	// The subscription has the quotas and usages for every resource type.
+	if summary.Subscription != nil {
+		sub := summary.Subscription
+		dashboard.PeriodStart = &sub.EffectiveStartDate
+		dashboard.PeriodEnd = &sub.EffectiveEndDate
+		dashboard.Plan = &sub.Plan
+
+		seen := make(map[string]bool)
+		for _, quota := range sub.Quotas {
+			var usage float64
+			if u := sub.ExtractUsage(quota.ResourceType.Name); u != nil {
+				usage = u.Usage
+			}
+			q := quota.Quota
+			dashboard.addResource(quota.ResourceType.Name, quota.ResourceType.Unit, usage, &q)
+			seen[quota.ResourceType.Name] = true
+		}
+		for _, usage := range sub.Usages {
+			if !seen[usage.ResourceType.Name] {
+				dashboard.addResource(usage.ResourceType.Name, usage.ResourceType.Unit, usage.Usage, nil)
+			}
+		}
+
+		return dashboard
+	}
+
+	// Without a subscription, only the locally known usages are available.
+	if summary.CPUUsage != nil {
+		if !summary.CPUUsage.EffectiveStart.IsZero() {
+			dashboard.PeriodStart = &summary.CPUUsage.EffectiveStart
+			dashboard.PeriodEnd = &summary.CPUUsage.EffectiveEnd
+		}
+		total, err := summary.CPUUsage.Total.Float64()
+		if err != nil {
+			log.Error(err)
+		}
+		dashboard.addResource(clients.ResourceTypeCPUHours, "cpu hours", total, nil)
+	}
+	if summary.DataUsage != nil {
+		dashboard.addResource(clients.ResourceTypeDataSize, "bytes", float64(summary.DataUsage.Total), nil)
+	}
+
+	return dashboard
+}
+
+// GetUserDashboard is an echo request handler that returns all of a user's
+// usages, quotas, and alert states in a single payload.
+func (a *App) GetUserDashboard(c echo.Context) error {
+	context := c.Request().Context()
+	user := a.FixUsername(c.Param("username"))
+	log := log.WithFields(logrus.Fields{"context": "get user dashboard", "user": user}).WithContext(context)
+
+	summary := a.loadSummary(c)
+	if summary == nil {
+		log.Error("unable to load the usage summary")
+		return newAPIError(http.StatusInternalServerError, ErrSummaryUnavailable, "unable to load the usage summary")
+	}
+
+	dashboard := newDashboard(user, summary)
+
+	// A failure to look up the holds shouldn't keep the rest of the dashboard
+	// from being displayed.
+	held, err := db.New(a.readDatabase).HeldAmount(context, user, db.ResourceTypeCPUHours)
+	if err != nil {
+		log.Errorf("unable to look up the held CPU hours: %s", err)
+	} else if h, err := held.Float64(); err == nil && h > 0 {
+		dashboard.addHeld(db.ResourceTypeCPUHours, h)
+	}
+
+	return respond(c, http.StatusOK, dashboard)
+}
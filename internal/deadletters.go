@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// errDeadLettersUnavailable is returned by the dead-letter endpoints when the
+// service isn't using the AMQP transport.
+var errDeadLettersUnavailable = echo.NewHTTPError(http.StatusNotFound, "dead-lettering is only available with the AMQP transport")
+
+// DeadLetterReplayResult is the response body for a dead-letter replay request.
+type DeadLetterReplayResult struct {
+	Replayed int `json:"replayed"`
+}
+
+// AdminListDeadLettersHandler is an echo request handler that returns the
+// messages in the dead-letter queue without removing them.
+func (a *App) AdminListDeadLettersHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "list dead letters"}).WithContext(context)
+
+	if a.amqpClient == nil {
+		return errDeadLettersUnavailable
+	}
+
+	limit, _, err := pagination(c)
+	if err != nil {
+		return err
+	}
+
+	deadLetters, err := a.amqpClient.DeadLetters(context, limit)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return respond(c, http.StatusOK, deadLetters)
+}
+
+// AdminReplayDeadLettersHandler is an echo request handler that moves messages
+// from the dead-letter queue back to the service's queue for processing.
+func (a *App) AdminReplayDeadLettersHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "replay dead letters"}).WithContext(context)
+
+	if a.amqpClient == nil {
+		return errDeadLettersUnavailable
+	}
+
+	limit, _, err := pagination(c)
+	if err != nil {
+		return err
+	}
+
+	replayed, err := a.amqpClient.ReplayDeadLetters(context, limit)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infof("replayed %d dead-lettered messages", replayed)
+
+	return respond(c, http.StatusOK, &DeadLetterReplayResult{Replayed: replayed})
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/internal/summarizer"
+	"github.com/labstack/echo/v4"
+)
+
+// decimalsParam is the query parameter that clients set to "string" to receive
+// decimal values as strings in plain notation. Decimals are otherwise encoded
+// however their types encode them by default, which can lose precision or use
+// scientific notation.
+const decimalsParam = "decimals"
+
+// wantsDecimalStrings returns true if the request asked for decimal values to
+// be encoded as strings.
+func wantsDecimalStrings(c echo.Context) bool {
+	return c.QueryParam(decimalsParam) == "string"
+}
+
+// decimalString formats a decimal value in plain notation without losing any
+// precision.
+func decimalString(d *apd.Decimal) string {
+	return d.Text('f')
+}
+
+// CPUHoursResponse is the decimal-safe representation of a CPU hours total.
+type CPUHoursResponse struct {
+	ID               string    `json:"id"`
+	UserID           string    `json:"user_id"`
+	Username         string    `json:"username"`
+	ResourceType     string    `json:"resource_type"`
+	AllocationSource string    `json:"allocation_source"`
+	Total            string    `json:"total"`
+	EffectiveStart   time.Time `json:"effective_start"`
+	EffectiveEnd     time.Time `json:"effective_end"`
+	LastModified     time.Time `json:"last_modified"`
+}
+
+// newCPUHoursResponse converts a CPU hours total to its decimal-safe
+// representation. Returns nil if the total is nil.
+func newCPUHoursResponse(cpuHours *db.CPUHours) *CPUHoursResponse {
+	if cpuHours == nil {
+		return nil
+	}
+	return &CPUHoursResponse{
+		ID:               cpuHours.ID,
+		UserID:           cpuHours.UserID,
+		Username:         cpuHours.Username,
+		ResourceType:     cpuHours.ResourceType,
+		AllocationSource: cpuHours.AllocationSource,
+		Total:            decimalString(&cpuHours.Total),
+		EffectiveStart:   cpuHours.EffectiveStart,
+		EffectiveEnd:     cpuHours.EffectiveEnd,
+		LastModified:     cpuHours.LastModified,
+	}
+}
+
+// UserSummaryResponse is the decimal-safe representation of a user summary.
+type UserSummaryResponse struct {
+	*summarizer.UserSummary
+	CPUUsage *CPUHoursResponse `json:"cpu_usage"`
+}
+
+// newUserSummaryResponse converts a user summary to its decimal-safe
+// representation.
+func newUserSummaryResponse(summary *summarizer.UserSummary) *UserSummaryResponse {
+	if summary == nil {
+		return nil
+	}
+	return &UserSummaryResponse{
+		UserSummary: summary,
+		CPUUsage:    newCPUHoursResponse(summary.CPUUsage),
+	}
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/locale"
+	"github.com/guregu/null"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// DigestPreferenceRequest is the request body for the digest preference
+// endpoint. Fields that aren't set are left unchanged. An empty locale clears
+// the user's choice, so that the default locale is used.
+type DigestPreferenceRequest struct {
+	OptedOut *bool   `json:"opted_out"`
+	Locale   *string `json:"locale"`
+}
+
+// GetUserDigestPreference is an echo request handler that returns whether the
+// user has opted out of the weekly usage digest, and the locale that it's
+// written for.
+func (a *App) GetUserDigestPreference(c echo.Context) error {
+	context := c.Request().Context()
+	user := a.FixUsername(c.Param("username"))
+	log := log.WithFields(logrus.Fields{"context": "get digest preference", "user": user}).WithContext(context)
+
+	d := db.New(a.readDatabase)
+
+	userID, err := d.UserID(context, user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, ErrUserNotFound, "user not found")
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	preference, err := d.DigestPreferenceForUser(context, userID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return respond(c, http.StatusOK, preference)
+}
+
+// SetUserDigestPreference is an echo request handler that opts the user out of
+// the weekly usage digest, or back into it, and sets the locale that it's
+// written for.
+func (a *App) SetUserDigestPreference(c echo.Context) error {
+	context := c.Request().Context()
+	user := a.FixUsername(c.Param("username"))
+	log := log.WithFields(logrus.Fields{"context": "set digest preference", "user": user}).WithContext(context)
+
+	var request DigestPreferenceRequest
+	if err := bindBody(c, &request); err != nil {
+		return err
+	}
+	if request.OptedOut == nil && request.Locale == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "opted_out or locale must be set")
+	}
+
+	var userLocale null.String
+	if request.Locale != nil && *request.Locale != "" {
+		matched, ok := locale.Match(*request.Locale)
+		if !ok {
+			var problems fieldErrors
+			problems.add("locale", "must be one of %s", strings.Join(locale.Supported(), ", "))
+			return problems.err()
+		}
+		userLocale = null.StringFrom(matched)
+	}
+
+	d := db.New(a.database)
+
+	userID, err := d.UserID(context, user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, ErrUserNotFound, "user not found")
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if request.OptedOut != nil {
+		if err = d.SetDigestOptOut(context, userID, *request.OptedOut); err != nil {
+			log.Error(err)
+			return err
+		}
+		log.Infof("set the usage digest opt-out to %t", *request.OptedOut)
+	}
+
+	if request.Locale != nil {
+		if err = d.SetLocale(context, userID, userLocale); err != nil {
+			log.Error(err)
+			return err
+		}
+		log.Infof("set the notification locale to %q", userLocale.String)
+	}
+
+	preference, err := d.DigestPreferenceForUser(context, userID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return respond(c, http.StatusOK, preference)
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// DriftPage is a single page of the totals that differ from QMS.
+type DriftPage struct {
+	Drift  []db.UsageDrift `json:"drift"`
+	Limit  int             `json:"limit"`
+	Offset int             `json:"offset"`
+}
+
+// AdminListQMSDriftHandler is an echo request handler that returns a page of
+// the current totals that differed from QMS when they were last compared,
+// largest difference first.
+func (a *App) AdminListQMSDriftHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "list QMS drift"}).WithContext(context)
+
+	limit, offset, err := pagination(c)
+	if err != nil {
+		return err
+	}
+
+	drift, err := db.New(a.readDatabase).UsageDrifts(context, limit, offset)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if drift == nil {
+		drift = make([]db.UsageDrift, 0)
+	}
+
+	return respond(c, http.StatusOK, &DriftPage{
+		Drift:  drift,
+		Limit:  limit,
+		Offset: offset,
+	})
+}
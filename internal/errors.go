@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// ErrorCode is a machine-readable identifier for the reason that a request
+// failed. Clients should check it rather than the message, which may change.
+type ErrorCode string
+
+const (
+	ErrBadRequest         ErrorCode = "bad_request"
+	ErrInvalidBody        ErrorCode = "invalid_body"
+	ErrInvalidField       ErrorCode = "invalid_field"
+	ErrUnauthorized       ErrorCode = "unauthorized"
+	ErrForbidden          ErrorCode = "forbidden"
+	ErrNotFound           ErrorCode = "not_found"
+	ErrUserNotFound       ErrorCode = "user_not_found"
+	ErrNoTotals           ErrorCode = "no_totals"
+	ErrNoQuota            ErrorCode = "no_quota"
+	ErrNotAcceptable      ErrorCode = "not_acceptable"
+	ErrConflict           ErrorCode = "conflict"
+	ErrConcurrentChange   ErrorCode = "concurrent_change"
+	ErrInProgress         ErrorCode = "in_progress"
+	ErrTooLarge           ErrorCode = "request_too_large"
+	ErrTooManyRequests    ErrorCode = "too_many_requests"
+	ErrSummaryUnavailable ErrorCode = "summary_unavailable"
+	ErrUnavailable        ErrorCode = "unavailable"
+	ErrInternal           ErrorCode = "internal_error"
+)
+
+// statusErrorCodes are the error codes used for errors that were returned
+// without one.
+var statusErrorCodes = map[int]ErrorCode{
+	http.StatusBadRequest:            ErrBadRequest,
+	http.StatusUnauthorized:          ErrUnauthorized,
+	http.StatusForbidden:             ErrForbidden,
+	http.StatusNotFound:              ErrNotFound,
+	http.StatusMethodNotAllowed:      ErrNotFound,
+	http.StatusNotAcceptable:         ErrNotAcceptable,
+	http.StatusConflict:              ErrConflict,
+	http.StatusRequestEntityTooLarge: ErrTooLarge,
+	http.StatusTooManyRequests:       ErrTooManyRequests,
+	http.StatusServiceUnavailable:    ErrUnavailable,
+}
+
+// retryableErrorCodes are the error codes of the failures that may succeed if
+// the request is sent again unchanged.
+var retryableErrorCodes = map[ErrorCode]bool{
+	ErrConcurrentChange:   true,
+	ErrInProgress:         true,
+	ErrTooManyRequests:    true,
+	ErrSummaryUnavailable: true,
+	ErrUnavailable:        true,
+}
+
+// ErrorEnvelope is the response body for every failed request. ErrorCode is
+// the HTTP status code, which is kept for older clients. Fields lists the
+// problems with individual fields of requests that failed validation.
+type ErrorEnvelope struct {
+	Code      ErrorCode    `json:"code"`
+	Message   string       `json:"message"`
+	ErrorCode int          `json:"error_code"`
+	TraceID   string       `json:"trace_id,omitempty"`
+	Retryable bool         `json:"retryable"`
+	Fields    []FieldError `json:"fields,omitempty"`
+}
+
+// apiError is an error returned by a handler that responds with a specific
+// error code.
+type apiError struct {
+	status  int
+	code    ErrorCode
+	message string
+	fields  []FieldError
+}
+
+// Error returns the error's message.
+func (e *apiError) Error() string {
+	return e.message
+}
+
+// newAPIError returns an error that responds with the HTTP status, error code,
+// and message.
+func newAPIError(status int, code ErrorCode, message string) error {
+	return &apiError{status: status, code: code, message: message}
+}
+
+// newErrorEnvelope returns the response body for an error.
+func newErrorEnvelope(err error) (int, *ErrorEnvelope) {
+	var (
+		ae *apiError
+		he *echo.HTTPError
+	)
+
+	envelope := &ErrorEnvelope{}
+	switch {
+	case db.Retryable(err):
+		envelope.ErrorCode = http.StatusServiceUnavailable
+		envelope.Code = ErrConcurrentChange
+		envelope.Message = "the request conflicted with a concurrent change; try again"
+	case errors.As(err, &ae):
+		envelope.ErrorCode = ae.status
+		envelope.Code = ae.code
+		envelope.Message = ae.message
+		envelope.Fields = ae.fields
+	case errors.As(err, &he):
+		envelope.ErrorCode = he.Code
+		envelope.Code = statusErrorCodes[he.Code]
+		switch m := he.Message.(type) {
+		case string:
+			envelope.Message = m
+		case error:
+			envelope.Message = m.Error()
+		default:
+			envelope.Message = http.StatusText(he.Code)
+		}
+	default:
+		envelope.ErrorCode = http.StatusInternalServerError
+		envelope.Message = err.Error()
+	}
+
+	if envelope.Code == "" {
+		envelope.Code = ErrInternal
+		if envelope.ErrorCode < http.StatusInternalServerError {
+			envelope.Code = ErrBadRequest
+		}
+	}
+	envelope.Retryable = retryableErrorCodes[envelope.Code]
+
+	return envelope.ErrorCode, envelope
+}
+
+// httpErrorHandler responds to every error with an ErrorEnvelope that includes
+// the request's trace ID so that failures can be found in the traces.
+func httpErrorHandler(err error, c echo.Context) {
+	if c.Response().Committed {
+		return
+	}
+
+	status, envelope := newErrorEnvelope(err)
+	if spanContext := trace.SpanContextFromContext(c.Request().Context()); spanContext.HasTraceID() {
+		envelope.TraceID = spanContext.TraceID().String()
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = c.JSON(status, envelope)
+	}
+	if err != nil {
+		log.WithContext(c.Request().Context()).Errorf("unable to send the error response: %s", err)
+	}
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// EstimateRequest is the request body for the CPU hours estimate endpoint.
+// Cores and RuntimeHours default to the averages of the app's past analyses
+// when an app ID is given and they're left out.
+type EstimateRequest struct {
+	Cores        float64 `json:"cores"`
+	RuntimeHours float64 `json:"runtime_hours"`
+	AppID        string  `json:"app_id"`
+}
+
+// Estimate is the projected CPU hours of an analysis that hasn't been launched
+// yet. Remaining is the user's quota less their usage and holds, and Covered
+// is whether it's enough for the projected hours. Both are nil if the user has
+// no CPU hours quota.
+type Estimate struct {
+	Username     string   `json:"username"`
+	Cores        float64  `json:"cores"`
+	RuntimeHours float64  `json:"runtime_hours"`
+	AppID        string   `json:"app_id,omitempty"`
+	Projected    float64  `json:"projected"`
+	Usage        float64  `json:"usage"`
+	Held         float64  `json:"held"`
+	Quota        *float64 `json:"quota"`
+	Remaining    *float64 `json:"remaining"`
+	Covered      *bool    `json:"covered"`
+}
+
+// EstimateUserCPUHours is an echo request handler that projects the CPU hours
+// that an analysis will use and reports whether the user's remaining quota
+// covers them, so that users can be warned before they launch something they
+// can't afford.
+func (a *App) EstimateUserCPUHours(c echo.Context) error {
+	context := c.Request().Context()
+	user := a.FixUsername(c.Param("username"))
+	log := log.WithFields(logrus.Fields{"context": "estimate user CPU hours", "user": user}).WithContext(context)
+
+	var request EstimateRequest
+	if err := bindBody(c, &request); err != nil {
+		return err
+	}
+	if request.Cores < 0 || request.RuntimeHours < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "cores and runtime_hours can't be negative")
+	}
+
+	d := db.New(a.readDatabase)
+
+	if request.AppID != "" && (request.Cores == 0 || request.RuntimeHours == 0) {
+		reservation, err := d.AppReservation(context, request.AppID)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		if reservation.Analyses > 0 {
+			if request.Cores == 0 {
+				request.Cores = reservation.MillicoresReserved / 1000
+			}
+			if request.RuntimeHours == 0 {
+				request.RuntimeHours = reservation.RuntimeHours
+			}
+		}
+	}
+	if request.Cores == 0 || request.RuntimeHours == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "cores and runtime_hours must be set unless the app has past analyses")
+	}
+
+	// The estimate is calculated the same way as the usage of a finished
+	// analysis so that the two agree.
+	now := time.Now().UTC()
+	runtime := time.Duration(request.RuntimeHours * float64(time.Hour))
+	projected, err := cpuhours.ReservedCPUHours(now, now.Add(runtime), int64(math.Round(request.Cores*1000)))
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	estimate := &Estimate{
+		Username:     user,
+		Cores:        request.Cores,
+		RuntimeHours: request.RuntimeHours,
+		AppID:        request.AppID,
+	}
+	if estimate.Projected, err = projected.Float64(); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	held, err := d.HeldAmount(context, user, db.ResourceTypeCPUHours)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if estimate.Held, err = held.Float64(); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	summary := a.loadSummary(c)
+	if summary == nil {
+		log.Error("unable to load the usage summary")
+		return newAPIError(http.StatusInternalServerError, ErrSummaryUnavailable, "unable to load the usage summary")
+	}
+	if summary.CPUUsage != nil {
+		if estimate.Usage, err = summary.CPUUsage.Total.Float64(); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	if summary.Subscription != nil {
+		for _, quota := range summary.Subscription.Quotas {
+			if quota.ResourceType.Name == clients.ResourceTypeCPUHours {
+				q := quota.Quota
+				estimate.Quota = &q
+			}
+		}
+	}
+
+	if estimate.Quota != nil {
+		remaining := math.Max(*estimate.Quota-estimate.Usage-estimate.Held, 0)
+		covered := remaining >= estimate.Projected
+		estimate.Remaining = &remaining
+		estimate.Covered = &covered
+	}
+
+	return respond(c, http.StatusOK, estimate)
+}
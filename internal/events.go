@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// maxReplayedEvents is the largest number of events that can be replayed in a
+// single request. Each one runs through the job status update handler before
+// the response is sent.
+const maxReplayedEvents = 100
+
+// EventReplayRequest is the request body for the event replay endpoint. Either
+// or both of ExternalID and ExternalIDs may be set. If State isn't set, the
+// most recently archived final state for each external ID is replayed, or
+// Completed if none was archived.
+type EventReplayRequest struct {
+	ExternalID  string             `json:"external_id"`
+	ExternalIDs []string           `json:"external_ids"`
+	State       messaging.JobState `json:"state"`
+}
+
+// EventReplayStatus is the outcome of replaying the event for one external ID.
+// State is empty if the state to replay couldn't be looked up.
+type EventReplayStatus struct {
+	ExternalID string             `json:"external_id"`
+	State      messaging.JobState `json:"state,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// ArchivedJobEventPage is a single page of archived job status updates.
+type ArchivedJobEventPage struct {
+	Events []db.ArchivedJobEvent `json:"events"`
+	Limit  int                   `json:"limit"`
+	Offset int                   `json:"offset"`
+}
+
+// EventReplayResult is the response body for the event replay endpoint.
+type EventReplayResult struct {
+	Replayed int                 `json:"replayed"`
+	Failed   int                 `json:"failed"`
+	Results  []EventReplayStatus `json:"results"`
+}
+
+// AdminReplayEventsHandler is an echo request handler that passes job status
+// updates for the external IDs in the request body through the same handler
+// as updates received from the message transport. It's used to reprocess
+// completions that were missed while the consumer was down. Analyses whose
+// usage was already recorded are skipped by the calculation intents. The
+// outcome is reported for each external ID, so one that fails doesn't stop the
+// rest from being replayed.
+func (a *App) AdminReplayEventsHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "replay events"}).WithContext(context)
+
+	if a.jobUpdateHandler == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "event replay isn't available")
+	}
+
+	var request EventReplayRequest
+	if err := bindBody(c, &request); err != nil {
+		return err
+	}
+
+	externalIDs := request.ExternalIDs
+	if request.ExternalID != "" {
+		externalIDs = append([]string{request.ExternalID}, externalIDs...)
+	}
+	if len(externalIDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "external_id or external_ids must be set")
+	}
+	if len(externalIDs) > maxReplayedEvents {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("at most %d events can be replayed at once", maxReplayedEvents))
+	}
+
+	if request.State != "" && request.State != messaging.SucceededState && request.State != messaging.FailedState {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("state must be %s or %s", messaging.SucceededState, messaging.FailedState),
+		)
+	}
+
+	d := db.New(a.database)
+	finalStates := []string{string(messaging.SucceededState), string(messaging.FailedState)}
+
+	result := &EventReplayResult{Results: make([]EventReplayStatus, 0, len(externalIDs))}
+	for _, externalID := range externalIDs {
+		status := EventReplayStatus{ExternalID: externalID}
+
+		state := request.State
+		if state == "" {
+			archived, err := d.LatestArchivedJobState(context, externalID, finalStates)
+			switch {
+			case err == nil:
+				state = messaging.JobState(archived)
+			case errors.Is(err, sql.ErrNoRows):
+				state = messaging.SucceededState
+			default:
+				log.Errorf("unable to look up the archived state for %s: %s", externalID, err)
+				status.Error = err.Error()
+				result.Failed++
+				result.Results = append(result.Results, status)
+				continue
+			}
+		}
+		status.State = state
+
+		if err := a.jobUpdateHandler(context, externalID, state); err != nil {
+			log.Errorf("unable to replay the %s event for %s: %s", state, externalID, err)
+			status.Error = err.Error()
+			result.Failed++
+		} else {
+			result.Replayed++
+		}
+		result.Results = append(result.Results, status)
+	}
+	log.Infof("replayed %d of %d events", result.Replayed, len(externalIDs))
+
+	return respond(c, http.StatusOK, result)
+}
+
+// AdminListArchivedEventsHandler is an echo request handler that returns a
+// page of the archived job status updates, most recent first. The updates can
+// be limited to a single job with the external_id query parameter.
+func (a *App) AdminListArchivedEventsHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "list archived events"}).WithContext(context)
+
+	limit, offset, err := pagination(c)
+	if err != nil {
+		return err
+	}
+
+	events, err := db.New(a.readDatabase).ArchivedJobEvents(context, c.QueryParam("external_id"), limit, offset)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if events == nil {
+		events = make([]db.ArchivedJobEvent, 0)
+	}
+
+	return respond(c, http.StatusOK, &ArchivedJobEventPage{
+		Events: events,
+		Limit:  limit,
+		Offset: offset,
+	})
+}
@@ -0,0 +1,215 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultForecastDays = 30
+	maxForecastDays     = 365
+)
+
+// forecastHorizonDays is how far ahead exhaustion dates are projected. Dates
+// further out than this are reported as never, which also keeps very slow rates
+// from overflowing a time.Duration.
+const forecastHorizonDays = 100 * 365
+
+// forecastZ is the z-score for the 95% confidence band around the usage rate.
+const forecastZ = 1.96
+
+// Forecast is a projection of when a user will run out of CPU hours at their
+// recent rate of usage. The exhaustion dates are nil if the user has no quota
+// or isn't using any CPU hours, or if the date is more than forecastHorizonDays
+// away. The latest exhaustion date is also nil if the lower bound of the usage
+// rate is zero or less.
+type Forecast struct {
+	Username            string     `json:"username"`
+	LookbackDays        int        `json:"lookback_days"`
+	DailyRate           float64    `json:"daily_rate"`
+	DailyRateLow        float64    `json:"daily_rate_low"`
+	DailyRateHigh       float64    `json:"daily_rate_high"`
+	Usage               float64    `json:"usage"`
+	Quota               *float64   `json:"quota"`
+	Remaining           *float64   `json:"remaining"`
+	DaysRemaining       *float64   `json:"days_remaining"`
+	EstimatedExhaustion *time.Time `json:"estimated_exhaustion"`
+	EarliestExhaustion  *time.Time `json:"earliest_exhaustion"`
+	LatestExhaustion    *time.Time `json:"latest_exhaustion"`
+}
+
+// dailyCPUHours returns the reserved CPU hours used on each of the days days
+// before now, oldest first, attributing each analysis to the day it ended.
+func (a *App) dailyCPUHours(c echo.Context, username string, days int, now time.Time) ([]float64, error) {
+	context := c.Request().Context()
+	d := db.New(a.readDatabase)
+
+	userID, err := d.UserID(context, username)
+	if err != nil {
+		return nil, err
+	}
+
+	from := now.Add(-time.Duration(days) * 24 * time.Hour)
+	analyses, err := d.AdminAllCalculableAnalyses(context, userID, from, now)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := make([]float64, days)
+	for _, analysis := range analyses {
+		day := int(analysis.EndDate.Sub(from) / (24 * time.Hour))
+		if day < 0 || day >= days {
+			continue
+		}
+		cpuHours, err := cpuhours.ReservedCPUHours(analysis.StartDate, analysis.EndDate, analysis.MillicoresReserved)
+		if err != nil {
+			return nil, err
+		}
+		value, err := cpuHours.Float64()
+		if err != nil {
+			return nil, err
+		}
+		usage[day] += value
+	}
+
+	return usage, nil
+}
+
+// usageTrend fits a line to cumulative daily usage with least squares and
+// returns its slope, which is the daily rate of usage, along with the slope's
+// standard error.
+func usageTrend(daily []float64) (float64, float64) {
+	n := float64(len(daily))
+	if n < 2 {
+		return 0, 0
+	}
+
+	cumulative := make([]float64, len(daily))
+	var sum, meanC float64
+	for i, v := range daily {
+		sum += v
+		cumulative[i] = sum
+		meanC += sum
+	}
+	meanC /= n
+	meanT := (n - 1) / 2
+
+	var sxy, sxx float64
+	for i, v := range cumulative {
+		dt := float64(i) - meanT
+		sxy += dt * (v - meanC)
+		sxx += dt * dt
+	}
+	slope := sxy / sxx
+	intercept := meanC - slope*meanT
+
+	if n < 3 {
+		return slope, 0
+	}
+
+	var residuals float64
+	for i, v := range cumulative {
+		r := v - (intercept + slope*float64(i))
+		residuals += r * r
+	}
+	stderr := math.Sqrt(residuals/(n-2)) / math.Sqrt(sxx)
+
+	return slope, stderr
+}
+
+// exhaustionDate returns when the remaining amount runs out at the daily rate,
+// or nil if it never does or doesn't within forecastHorizonDays.
+func exhaustionDate(now time.Time, remaining, rate float64) *time.Time {
+	if rate <= 0 {
+		return nil
+	}
+	days := remaining / rate
+	if math.IsNaN(days) || days > forecastHorizonDays {
+		return nil
+	}
+	date := now.Add(time.Duration(days * float64(24*time.Hour)))
+	return &date
+}
+
+// GetUserCPUForecast is an echo request handler that projects when the user
+// will run out of CPU hours based on their usage over the days query parameter
+// number of days.
+func (a *App) GetUserCPUForecast(c echo.Context) error {
+	context := c.Request().Context()
+	user := a.FixUsername(c.Param("username"))
+	log := log.WithFields(logrus.Fields{"context": "get user CPU forecast", "user": user}).WithContext(context)
+
+	days := defaultForecastDays
+	if v := c.QueryParam("days"); v != "" {
+		var err error
+		if days, err = strconv.Atoi(v); err != nil || days < 2 {
+			return echo.NewHTTPError(http.StatusBadRequest, "days must be an integer greater than 1")
+		}
+		if days > maxForecastDays {
+			days = maxForecastDays
+		}
+	}
+
+	now := time.Now().UTC()
+	daily, err := a.dailyCPUHours(c, user, days, now)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, ErrUserNotFound, "user not found")
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	rate, stderr := usageTrend(daily)
+	forecast := &Forecast{
+		Username:      user,
+		LookbackDays:  days,
+		DailyRate:     rate,
+		DailyRateLow:  math.Max(rate-forecastZ*stderr, 0),
+		DailyRateHigh: rate + forecastZ*stderr,
+	}
+
+	summary := a.loadSummary(c)
+	if summary == nil {
+		log.Error("unable to load the usage summary")
+		return newAPIError(http.StatusInternalServerError, ErrSummaryUnavailable, "unable to load the usage summary")
+	}
+	if summary.CPUUsage != nil {
+		if forecast.Usage, err = summary.CPUUsage.Total.Float64(); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	if summary.Subscription != nil {
+		for _, quota := range summary.Subscription.Quotas {
+			if quota.ResourceType.Name == clients.ResourceTypeCPUHours {
+				q := quota.Quota
+				forecast.Quota = &q
+			}
+		}
+	}
+
+	if forecast.Quota != nil {
+		remaining := math.Max(*forecast.Quota-forecast.Usage, 0)
+		forecast.Remaining = &remaining
+		if rate > 0 {
+			daysRemaining := remaining / rate
+			forecast.DaysRemaining = &daysRemaining
+		}
+		forecast.EstimatedExhaustion = exhaustionDate(now, remaining, forecast.DailyRate)
+		forecast.EarliestExhaustion = exhaustionDate(now, remaining, forecast.DailyRateHigh)
+		forecast.LatestExhaustion = exhaustionDate(now, remaining, forecast.DailyRateLow)
+	}
+
+	return respond(c, http.StatusOK, forecast)
+}
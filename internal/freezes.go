@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// FreezeRequest is the optional request body for the freeze endpoint.
+type FreezeRequest struct {
+	Reason string `json:"reason"`
+}
+
+// UnfreezeResult is the response body for the unfreeze endpoint.
+type UnfreezeResult struct {
+	Replayed int `json:"replayed"`
+}
+
+// FrozenUserListing is the response body for the frozen user listing endpoint.
+type FrozenUserListing struct {
+	Users []db.FrozenUser `json:"users"`
+}
+
+// pathUserID returns the ID of the user named in the request path.
+func (a *App) pathUserID(c echo.Context, d *db.Database) (string, string, error) {
+	username := a.FixUsername(c.Param("username"))
+	userID, err := d.UserID(c.Request().Context(), username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", newAPIError(http.StatusNotFound, ErrUserNotFound, "user not found")
+	}
+	return username, userID, err
+}
+
+// AdminFreezeAccrualHandler is an echo request handler that freezes accrual for
+// a user. Usage recorded for the user while they're frozen is parked until
+// they're unfrozen.
+func (a *App) AdminFreezeAccrualHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "freeze accrual"}).WithContext(context)
+
+	var request FreezeRequest
+	if c.Request().ContentLength != 0 {
+		if err := bindBody(c, &request); err != nil {
+			return err
+		}
+	}
+
+	d := db.New(a.database)
+	username, userID, err := a.pathUserID(c, d)
+	if err != nil {
+		return err
+	}
+
+	frozen, err := d.FreezeUser(context, userID, performedBy(c), request.Reason)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if !frozen {
+		return echo.NewHTTPError(http.StatusConflict, "accrual is already frozen for the user")
+	}
+	log.Infof("froze accrual for %s", username)
+
+	return c.NoContent(http.StatusOK)
+}
+
+// AdminUnfreezeAccrualHandler is an echo request handler that unfreezes accrual
+// for a user and applies the usage that was parked while they were frozen. It's
+// safe to call again if applying the parked usage fails.
+func (a *App) AdminUnfreezeAccrualHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "unfreeze accrual"}).WithContext(context)
+
+	d := db.New(a.database)
+	username, userID, err := a.pathUserID(c, d)
+	if err != nil {
+		return err
+	}
+
+	unfrozen, err := d.UnfreezeUser(context, userID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if unfrozen {
+		log.Infof("unfroze accrual for %s", username)
+	}
+
+	// Parked usage is replayed even if the user was already unfrozen so that
+	// the records left behind by a failed replay can be applied by trying again.
+	replayed, err := a.calculator.ReplayParkedUsage(context, userID)
+	if err != nil {
+		log.Errorf("applied %d parked usage records for %s before failing: %s", replayed, username, err)
+		return err
+	}
+	log.Infof("applied %d parked usage records for %s", replayed, username)
+
+	if err = a.InvalidateTotals(context, username); err != nil {
+		log.Errorf("unable to invalidate the cached totals for %s: %s", username, err)
+	}
+
+	return respond(c, http.StatusOK, &UnfreezeResult{Replayed: replayed})
+}
+
+// AdminListFrozenUsersHandler is an echo request handler that lists the users
+// whose accrual is frozen.
+func (a *App) AdminListFrozenUsersHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "list frozen users"}).WithContext(context)
+
+	users, err := db.New(a.database).FrozenUsers(context)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if users == nil {
+		users = make([]db.FrozenUser, 0)
+	}
+
+	return respond(c, http.StatusOK, &FrozenUserListing{Users: users})
+}
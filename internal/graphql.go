@@ -0,0 +1,206 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/graphql-go/graphql"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// GraphQLRequest is the body of a request to the GraphQL endpoint.
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// graphQLUser is the source value for the User type.
+type graphQLUser struct {
+	Username string
+}
+
+// graphQLAnalysis is the source value for the Analysis type.
+type graphQLAnalysis struct {
+	db.CalculableAnalysis
+	CPUHours *apd.Decimal
+}
+
+// sourceField returns a field that's resolved from its parent value. Decimal
+// values are resolved as strings so that no precision is lost.
+func sourceField[T any](fieldType graphql.Output, value func(v T) interface{}) *graphql.Field {
+	return &graphql.Field{
+		Type: fieldType,
+		Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+			return value(p.Source.(T)), nil
+		},
+	}
+}
+
+// graphQLSchema builds the schema served by the GraphQL endpoint.
+func (a *App) graphQLSchema() (graphql.Schema, error) {
+	totalType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Total",
+		Fields: graphql.Fields{
+			"id":               sourceField(graphql.String, func(v db.CPUHours) interface{} { return v.ID }),
+			"resourceType":     sourceField(graphql.String, func(v db.CPUHours) interface{} { return v.ResourceType }),
+			"allocationSource": sourceField(graphql.String, func(v db.CPUHours) interface{} { return v.AllocationSource }),
+			"total":            sourceField(graphql.String, func(v db.CPUHours) interface{} { return decimalString(&v.Total) }),
+			"effectiveStart":   sourceField(graphql.DateTime, func(v db.CPUHours) interface{} { return v.EffectiveStart }),
+			"effectiveEnd":     sourceField(graphql.DateTime, func(v db.CPUHours) interface{} { return v.EffectiveEnd }),
+			"lastModified":     sourceField(graphql.DateTime, func(v db.CPUHours) interface{} { return v.LastModified }),
+		},
+	})
+
+	eventType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Event",
+		Fields: graphql.Fields{
+			"id":            sourceField(graphql.String, func(v db.CPUUsageWorkItem) interface{} { return v.ID }),
+			"eventType":     sourceField(graphql.String, func(v db.CPUUsageWorkItem) interface{} { return string(v.EventType) }),
+			"recordDate":    sourceField(graphql.DateTime, func(v db.CPUUsageWorkItem) interface{} { return v.RecordDate }),
+			"effectiveDate": sourceField(graphql.DateTime, func(v db.CPUUsageWorkItem) interface{} { return v.EffectiveDate }),
+			"value":         sourceField(graphql.String, func(v db.CPUUsageWorkItem) interface{} { return decimalString(&v.Value) }),
+			"claimed":       sourceField(graphql.Boolean, func(v db.CPUUsageWorkItem) interface{} { return v.Claimed }),
+			"processed":     sourceField(graphql.Boolean, func(v db.CPUUsageWorkItem) interface{} { return v.Processed }),
+			"attempts":      sourceField(graphql.Int, func(v db.CPUUsageWorkItem) interface{} { return v.Attempts }),
+			"priority":      sourceField(graphql.Int, func(v db.CPUUsageWorkItem) interface{} { return v.Priority }),
+			"resourceType":  sourceField(graphql.String, func(v db.CPUUsageWorkItem) interface{} { return v.ResourceType }),
+			"voided":        sourceField(graphql.Boolean, func(v db.CPUUsageWorkItem) interface{} { return v.Voided }),
+		},
+	})
+
+	analysisType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Analysis",
+		Fields: graphql.Fields{
+			"id":                 sourceField(graphql.String, func(v graphQLAnalysis) interface{} { return v.ID }),
+			"startDate":          sourceField(graphql.DateTime, func(v graphQLAnalysis) interface{} { return v.StartDate }),
+			"endDate":            sourceField(graphql.DateTime, func(v graphQLAnalysis) interface{} { return v.EndDate }),
+			"millicoresReserved": sourceField(graphql.Int, func(v graphQLAnalysis) interface{} { return v.MillicoresReserved }),
+			"cpuHours":           sourceField(graphql.String, func(v graphQLAnalysis) interface{} { return decimalString(v.CPUHours) }),
+		},
+	})
+
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"username": sourceField(graphql.String, func(v graphQLUser) interface{} { return v.Username }),
+			"currentTotals": &graphql.Field{
+				Type:        graphql.NewList(totalType),
+				Description: "The user's current totals for every resource type and allocation source.",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return db.New(a.readDatabase).CurrentTotalsForUser(p.Context, p.Source.(graphQLUser).Username)
+				},
+			},
+			"totals": &graphql.Field{
+				Type:        graphql.NewList(totalType),
+				Description: "Every CPU hours total the user has had.",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return db.New(a.readDatabase).AllCPUHoursForUser(p.Context, p.Source.(graphQLUser).Username)
+				},
+			},
+			"events": &graphql.Field{
+				Type:        graphql.NewList(eventType),
+				Description: "The usage events recorded for the user.",
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return db.New(a.readDatabase).ListAllUserEvents(p.Context, p.Source.(graphQLUser).Username)
+				},
+			},
+			"analyses": &graphql.Field{
+				Type:        graphql.NewList(analysisType),
+				Description: "The user's completed analyses that reserved CPUs, with their CPU hours.",
+				Args: graphql.FieldConfigArgument{
+					"from": &graphql.ArgumentConfig{Type: graphql.DateTime},
+					"to":   &graphql.ArgumentConfig{Type: graphql.DateTime},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					from, _ := p.Args["from"].(time.Time)
+					to, ok := p.Args["to"].(time.Time)
+					if !ok {
+						to = time.Now()
+					}
+					return a.graphQLAnalyses(p.Context, p.Source.(graphQLUser).Username, from, to)
+				},
+			},
+		},
+	})
+
+	queryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"username": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (interface{}, error) {
+					return graphQLUser{Username: a.FixUsername(p.Args["username"].(string))}, nil
+				},
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: queryType})
+}
+
+// graphQLAnalyses returns the user's calculable analyses that ran between from
+// and to, along with their reserved CPU hours.
+func (a *App) graphQLAnalyses(context context.Context, username string, from, to time.Time) ([]graphQLAnalysis, error) {
+	d := db.New(a.readDatabase)
+
+	userID, err := d.UserID(context, username)
+	if err != nil {
+		return nil, err
+	}
+
+	analyses, err := d.AdminAllCalculableAnalyses(context, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]graphQLAnalysis, 0, len(analyses))
+	for _, analysis := range analyses {
+		cpuHours, err := cpuhours.ReservedCPUHours(analysis.StartDate, analysis.EndDate, analysis.MillicoresReserved)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, graphQLAnalysis{CalculableAnalysis: analysis, CPUHours: cpuHours})
+	}
+
+	return results, nil
+}
+
+// GraphQLHandler is an echo request handler that executes GraphQL queries
+// against users, totals, events, and analyses.
+func (a *App) GraphQLHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "graphql"}).WithContext(context)
+
+	var request GraphQLRequest
+	if c.Request().Method == http.MethodGet {
+		request.Query = c.QueryParam("query")
+		request.OperationName = c.QueryParam("operationName")
+	} else if err := bindBody(c, &request); err != nil {
+		return err
+	}
+	if request.Query == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "query must be set")
+	}
+
+	result := graphql.Do(graphql.Params{
+		Schema:         a.graphqlSchema,
+		RequestString:  request.Query,
+		OperationName:  request.OperationName,
+		VariableValues: request.Variables,
+		Context:        context,
+	})
+	if result.HasErrors() {
+		log.Debugf("GraphQL query returned errors: %v", result.Errors)
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// asOfParam is the query parameter that asks for a total as it was at a past
+// moment instead of as it is now.
+const asOfParam = "as_of"
+
+// HistoricalTotalResponse is the response body for the total endpoints when a
+// past moment is asked for. The total is the value that the total had at that
+// moment, and the last modified time is when that value was reached.
+type HistoricalTotalResponse struct {
+	*db.CPUHours
+	AsOf time.Time `json:"as_of"`
+}
+
+// DecimalHistoricalTotalResponse is the decimal-safe representation of a
+// HistoricalTotalResponse.
+type DecimalHistoricalTotalResponse struct {
+	*CPUHoursResponse
+	AsOf time.Time `json:"as_of"`
+}
+
+// parseAsOf parses the as_of query parameter, which is either an RFC 3339
+// timestamp or a date, which stands for midnight UTC at its start. Returns a
+// zero time if the parameter isn't set.
+func parseAsOf(c echo.Context) (time.Time, error) {
+	value := c.QueryParam(asOfParam)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	var problems fieldErrors
+	asOf, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		if asOf, err = time.Parse(time.DateOnly, value); err != nil {
+			problems.add(asOfParam, "must be an RFC 3339 timestamp or a date")
+			return time.Time{}, problems.err()
+		}
+	}
+	if asOf.After(time.Now()) {
+		problems.add(asOfParam, "can't be in the future")
+		return time.Time{}, problems.err()
+	}
+
+	return asOf.UTC(), nil
+}
+
+// replayLedger returns the value that a total had after the events in the
+// ledger were applied to it, along with when the last of them was applied.
+// The replay starts from the last event that recorded the resulting total, or
+// from zero at the start of the period if none did. Additions and subtractions
+// change the total, resets set it to their values, and the other event types
+// don't change it.
+func replayLedger(entries []db.LedgerEntry) (*apd.Decimal, time.Time, error) {
+	total := apd.New(0, 0)
+	var lastApplied time.Time
+
+	start := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].ResultingTotal != nil {
+			total.Set(entries[i].ResultingTotal)
+			lastApplied = entries[i].ProcessedOn
+			start = i + 1
+			break
+		}
+	}
+
+	bc := apd.BaseContext.WithPrecision(15)
+	for i := start; i < len(entries); i++ {
+		entry := &entries[i]
+		var err error
+		switch entry.EventType {
+		case db.CPUHoursAdd:
+			_, err = bc.Add(total, total, &entry.Value)
+		case db.CPUHoursSubtract:
+			_, err = bc.Sub(total, total, &entry.Value)
+		case db.CPUHoursReset:
+			total.Set(&entry.Value)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, lastApplied, err
+		}
+		lastApplied = entry.ProcessedOn
+	}
+
+	return total, lastApplied, nil
+}
+
+// lastReset returns when the last reset in the ledger was applied, or a zero
+// time if there wasn't one.
+func lastReset(entries []db.LedgerEntry) time.Time {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].EventType == db.CPUHoursReset {
+			return entries[i].ProcessedOn
+		}
+	}
+	return time.Time{}
+}
+
+// respondWithHistoricalTotal sends the user's total for the resource type and
+// allocation source as it was at a past moment, reconstructed from the usage
+// events that had been applied to it and the usage that had been sent to QMS
+// by then.
+func (a *App) respondWithHistoricalTotal(c echo.Context, user, resourceType, allocationSource string, asOf time.Time) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "historical total", "user": user, "as_of": asOf}).WithContext(context)
+
+	d := db.New(a.readDatabase)
+	total, err := d.TotalForUserAt(context, user, resourceType, allocationSource, asOf)
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, ErrNoTotals, fmt.Sprintf("no %s total found for user at %s", resourceType, asOf.Format(time.RFC3339)))
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	entries, err := d.Ledger(context, total, asOf)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	value, lastApplied, err := replayLedger(entries)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	// Analysis usage is added to the total by QMS, so it never appears in the
+	// ledger. The usage that was sent to QMS since the last reset is added to
+	// the replayed value instead. QMS has no allocation sources, so it only
+	// counts toward the default one.
+	if allocationSource == db.DefaultAllocationSource {
+		sent, sentOn, err := d.SentUsageTotal(context, total, lastReset(entries), asOf)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		if _, err = apd.BaseContext.WithPrecision(15).Add(value, value, sent); err != nil {
+			log.Error(err)
+			return err
+		}
+		if sentOn.After(lastApplied) {
+			lastApplied = sentOn
+		}
+	}
+
+	total.Total.Set(value)
+	total.LastModified = total.EffectiveStart
+	if !lastApplied.IsZero() {
+		total.LastModified = lastApplied
+	}
+
+	if wantsDecimalStrings(c) {
+		return respond(c, http.StatusOK, &DecimalHistoricalTotalResponse{CPUHoursResponse: newCPUHoursResponse(total), AsOf: asOf})
+	}
+	return respond(c, http.StatusOK, &HistoricalTotalResponse{CPUHours: total, AsOf: asOf})
+}
@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// HoldListing is the response body for the holds listing endpoint. Held is the
+// total of the holds, which counts against the user's CPU hours quota.
+type HoldListing struct {
+	Username string    `json:"username"`
+	Held     float64   `json:"held"`
+	Holds    []db.Hold `json:"holds"`
+}
+
+// GetUserCPUHolds is an echo request handler that lists the holds that are
+// placed for the user's running analyses.
+func (a *App) GetUserCPUHolds(c echo.Context) error {
+	context := c.Request().Context()
+	user := a.FixUsername(c.Param("username"))
+	log := log.WithFields(logrus.Fields{"context": "list user CPU holds", "user": user}).WithContext(context)
+
+	holds, err := db.New(a.readDatabase).ActiveHolds(context, user)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	listing := &HoldListing{
+		Username: user,
+		Holds:    holds,
+	}
+	for i := range holds {
+		if holds[i].ResourceType != db.ResourceTypeCPUHours {
+			continue
+		}
+		amount, err := holds[i].Amount.Float64()
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		listing.Held += amount
+	}
+
+	if listing.Holds == nil {
+		listing.Holds = make([]db.Hold, 0)
+	}
+
+	return respond(c, http.StatusOK, listing)
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// actingUserHeader is the request header that services use to name the user
+// they're making a request on behalf of.
+const actingUserHeader = "X-Acting-User"
+
+// The keys used to store the caller's identity in the request context.
+const (
+	callerServiceKey = "caller-service"
+	actingUserKey    = "acting-user"
+)
+
+// callerService returns the name of the service making the request, which is
+// the common name of its verified client certificate. Returns an empty string
+// if the caller didn't present a verified certificate.
+func callerService(c echo.Context) string {
+	tlsState := c.Request().TLS
+	if tlsState == nil || len(tlsState.VerifiedChains) == 0 || len(tlsState.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return tlsState.VerifiedChains[0][0].Subject.CommonName
+}
+
+// actingUser returns the user that the request is being made on behalf of, or
+// an empty string if the caller isn't acting for another user.
+func actingUser(c echo.Context) string {
+	if user, ok := c.Get(actingUserKey).(string); ok {
+		return user
+	}
+	return ""
+}
+
+// identify records who is making each request. Requests with the
+// X-Acting-User header are rejected unless the caller presented a verified
+// client certificate for one of the services allowed to impersonate users.
+// Every request is logged for auditing with both the calling service and the
+// user it's acting for.
+func (a *App) identify(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		service := callerService(c)
+		c.Set(callerServiceKey, service)
+
+		if user := c.Request().Header.Get(actingUserHeader); user != "" {
+			if service == "" || !a.impersonators[service] {
+				return echo.NewHTTPError(http.StatusForbidden, "the caller is not allowed to act on behalf of other users")
+			}
+			c.Set(actingUserKey, a.FixUsername(user))
+		}
+
+		log.WithFields(logrus.Fields{
+			"context":     "audit",
+			"method":      c.Request().Method,
+			"path":        c.Request().URL.Path,
+			"service":     service,
+			"acting_user": actingUser(c),
+		}).WithContext(c.Request().Context()).Info("request received")
+
+		return next(c)
+	}
+}
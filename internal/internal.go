@@ -1,15 +1,27 @@
 package internal
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/cyverse-de/resource-usage-api/amqp"
+	"github.com/cyverse-de/resource-usage-api/authz"
+	"github.com/cyverse-de/resource-usage-api/backlog"
+	"github.com/cyverse-de/resource-usage-api/cache"
 	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/faults"
 	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/ops"
+	"github.com/cyverse-de/resource-usage-api/transport"
+	"github.com/graphql-go/graphql"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 	"github.com/nats-io/nats.go"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -19,9 +31,13 @@ import (
 
 var log = logging.Log.WithFields(logrus.Fields{"package": "internal"})
 
+// gzipMinLength is the size in bytes below which responses aren't compressed.
+const gzipMinLength = 1024
+
 // App encapsulates the application logic.
 type App struct {
 	database            *sqlx.DB
+	readDatabase        *sqlx.DB
 	router              *echo.Echo
 	userSuffix          string
 	dataUsageClient     *clients.DataUsageAPI
@@ -30,6 +46,23 @@ type App struct {
 	amqpUsageRoutingKey string
 	qmsClient           *clients.QMSAPI
 	qmsEnabled          bool
+	totalsCache         *db.TotalsCache
+	sharedCache         *cache.Redis
+	graphqlSchema       graphql.Schema
+	cors                *CORSConfiguration
+	impersonators       map[string]bool
+	calculator          *cpuhours.CPUHours
+	jobUpdateHandler    transport.HandlerFn
+	dataUsageMaxAge     time.Duration
+	separateAdmin       bool
+	backlog             *backlog.Monitor
+	quotaMaxAge         time.Duration
+	missingTotals       string
+	maxBodySize         int64
+	simulator           *cpuhours.Simulator
+	policy              *authz.Policy
+	anonymizer          *Anonymizer
+	events              *ops.Publisher
 }
 
 // AppConfiguration contains the settings needed to configure the App.
@@ -42,6 +75,130 @@ type AppConfiguration struct {
 	AMQPUsageRoutingKey      string
 	QMSEnabled               bool
 	QMSBaseURL               string
+
+	// TotalsCacheTTL is how long current totals are cached. Zero disables
+	// caching.
+	TotalsCacheTTL time.Duration
+
+	// SharedCache is an optional cache shared by all replicas for totals and
+	// summaries.
+	SharedCache *cache.Redis
+
+	// ReadDatabase is a read-only replica used by the heavy read endpoints.
+	// If it's nil, those endpoints use the primary database.
+	ReadDatabase *sqlx.DB
+
+	// CORS contains the settings for cross-origin requests. If it's nil,
+	// cross-origin requests aren't allowed.
+	CORS *CORSConfiguration
+
+	// Impersonators are the common names of the client certificates for the
+	// services that may act on behalf of users with the X-Acting-User header.
+	Impersonators []string
+
+	// Calculator applies the usage parked while a user's accrual was frozen.
+	Calculator *cpuhours.CPUHours
+
+	// JobUpdateHandler processes the job status updates replayed through the
+	// admin API. It should be the handler used by the message transport.
+	JobUpdateHandler transport.HandlerFn
+
+	// DataUsageMaxAge is how old the locally stored data usage may be before
+	// the summaries call data-usage-api instead. Zero always calls it.
+	DataUsageMaxAge time.Duration
+
+	// SeparateAdmin leaves the admin routes off the router returned by Router
+	// so that they're only served by the one returned by AdminRouter.
+	SeparateAdmin bool
+
+	// Backlog is the monitor that decides whether backpressure is applied to
+	// the message consumers. If it's nil, the backlog endpoint counts the work
+	// items itself and never reports backpressure.
+	Backlog *backlog.Monitor
+
+	// QuotaMaxAge is how old the locally stored QMS quotas may be before
+	// they're reported as stale. The summaries use the stored quotas instead
+	// of calling QMS if it's set. Zero always calls QMS.
+	QuotaMaxAge time.Duration
+
+	// MissingTotals is the policy for reading a total that the user doesn't
+	// have: MissingTotalsNotFound or MissingTotalsZero. The default is
+	// MissingTotalsNotFound.
+	MissingTotals string
+
+	// MaxBodySize is the largest request body accepted, in bytes. Larger
+	// bodies are rejected with a 413. DefaultMaxBodySize is used if it's zero.
+	MaxBodySize int64
+
+	// Simulator recalculates usage under proposed calculation modes for the
+	// simulation endpoint. If it's nil, simulation isn't available.
+	Simulator *cpuhours.Simulator
+
+	// Policy decides which callers may make which requests. If it's nil, every
+	// request is allowed.
+	Policy *authz.Policy
+
+	// Anonymizer anonymizes the usage rows for the research export. If it's
+	// nil, the export isn't available.
+	Anonymizer *Anonymizer
+
+	// Events is told about the operationally significant changes made through
+	// the admin API, if it's set.
+	Events *ops.Publisher
+}
+
+// CORSConfiguration contains the settings for cross-origin requests from
+// browser-based clients.
+type CORSConfiguration struct {
+	// AllowedOrigins are the origins that may make cross-origin requests.
+	AllowedOrigins []string
+
+	// AllowedMethods are the HTTP methods allowed in cross-origin requests.
+	// The middleware's defaults are used if it's empty.
+	AllowedMethods []string
+
+	// AllowedHeaders are the request headers allowed in cross-origin requests.
+	// The headers that the client asks for are allowed if it's empty.
+	AllowedHeaders []string
+
+	// AllowCredentials allows cross-origin requests to include credentials.
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache the results of preflight requests.
+	MaxAge time.Duration
+}
+
+// InvalidateTotals removes the user's cached totals and summary. It should be
+// called when this instance changes any of the user's totals.
+func (a *App) InvalidateTotals(context context.Context, username string) error {
+	username = a.FixUsername(username)
+
+	if err := a.totalsCache.Invalidate(context, username); err != nil {
+		return err
+	}
+	if a.sharedCache != nil {
+		return a.sharedCache.Invalidate(context, summaryKeyPrefix+username)
+	}
+	return nil
+}
+
+// ListenForInvalidations drops the locally cached totals that other replicas
+// invalidate until the context is canceled. It does nothing if there's no
+// shared cache.
+func (a *App) ListenForInvalidations(context context.Context) {
+	if a.sharedCache == nil {
+		return
+	}
+	a.sharedCache.Subscribe(context, a.totalsCache.HandleInvalidation)
+}
+
+// commit commits the transaction, unless a fault is injected into database
+// commits. The caller's deferred rollback undoes the transaction in that case.
+func commit(tx *sqlx.Tx) error {
+	if err := faults.Inject(faults.DBCommit); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func (a *App) FixUsername(username string) string {
@@ -52,7 +209,7 @@ func (a *App) FixUsername(username string) string {
 }
 
 // New creates a new app instance for provided configuration.
-func New(db *sqlx.DB, config *AppConfiguration) (*App, error) {
+func New(database *sqlx.DB, config *AppConfiguration) (*App, error) {
 	// Create the client libraries for the downstream services.
 	dataUsageClient, err := clients.DataUsageAPIClient(config.DataUsageBaseURL)
 	if err != nil {
@@ -63,9 +220,26 @@ func New(db *sqlx.DB, config *AppConfiguration) (*App, error) {
 		return nil, errors.Wrap(err, "unable to create the QMS client")
 	}
 
+	var totalsCache *db.TotalsCache
+	if config.TotalsCacheTTL > 0 || config.SharedCache != nil {
+		totalsCache = db.NewTotalsCache(config.TotalsCacheTTL)
+		totalsCache.SetShared(config.SharedCache)
+	}
+
+	readDatabase := config.ReadDatabase
+	if readDatabase == nil {
+		readDatabase = database
+	}
+
+	impersonators := make(map[string]bool)
+	for _, name := range config.Impersonators {
+		impersonators[name] = true
+	}
+
 	// Create the app instance.
 	app := &App{
-		database:            db,
+		database:            database,
+		readDatabase:        readDatabase,
 		router:              echo.New(),
 		userSuffix:          config.UserSuffix,
 		dataUsageClient:     dataUsageClient,
@@ -74,6 +248,29 @@ func New(db *sqlx.DB, config *AppConfiguration) (*App, error) {
 		amqpUsageRoutingKey: config.AMQPUsageRoutingKey,
 		qmsClient:           qmsClient,
 		qmsEnabled:          config.QMSEnabled,
+		totalsCache:         totalsCache,
+		sharedCache:         config.SharedCache,
+		cors:                config.CORS,
+		impersonators:       impersonators,
+		calculator:          config.Calculator,
+		jobUpdateHandler:    config.JobUpdateHandler,
+		dataUsageMaxAge:     config.DataUsageMaxAge,
+		separateAdmin:       config.SeparateAdmin,
+		backlog:             config.Backlog,
+		quotaMaxAge:         config.QuotaMaxAge,
+		missingTotals:       config.MissingTotals,
+		maxBodySize:         config.MaxBodySize,
+		simulator:           config.Simulator,
+		anonymizer:          config.Anonymizer,
+		events:              config.Events,
+	}
+	if app.maxBodySize <= 0 {
+		app.maxBodySize = DefaultMaxBodySize
+	}
+	app.policy = app.qualifyPolicy(config.Policy)
+
+	if app.graphqlSchema, err = app.graphQLSchema(); err != nil {
+		return nil, errors.Wrap(err, "unable to build the GraphQL schema")
 	}
 
 	return app, nil
@@ -82,15 +279,144 @@ func (a *App) HelloHandler(c echo.Context) error {
 	return c.String(http.StatusOK, "Hello from resource-usage-api")
 }
 
+// notFound is an echo request handler that always responds with a 404.
+func notFound(c echo.Context) error {
+	return echo.ErrNotFound
+}
+
+// unversioned marks responses from the unversioned route aliases as deprecated
+// and points clients at the versioned route.
+func unversioned(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set("Deprecation", "true")
+		c.Response().Header().Set("Link", fmt.Sprintf("</v1%s>; rel=\"successor-version\"", c.Request().URL.Path))
+		return next(c)
+	}
+}
+
 func (a *App) Router() *echo.Echo {
 	a.router.Use(otelecho.Middleware("resource-usage-api"))
+	if a.cors != nil {
+		a.router.Use(middleware.CORSWithConfig(middleware.CORSConfig{
+			AllowOrigins:     a.cors.AllowedOrigins,
+			AllowMethods:     a.cors.AllowedMethods,
+			AllowHeaders:     a.cors.AllowedHeaders,
+			AllowCredentials: a.cors.AllowCredentials,
+			MaxAge:           int(a.cors.MaxAge.Seconds()),
+		}))
+	}
+	a.router.Use(middleware.GzipWithConfig(middleware.GzipConfig{MinLength: gzipMinLength}))
+	a.router.Use(a.identify, a.authorize)
+	a.router.Use(limitBodySize(a.maxBodySize), checkUUIDParams)
 
-	a.router.HTTPErrorHandler = logging.HTTPErrorHandler
+	a.router.HTTPErrorHandler = httpErrorHandler
 	a.router.GET("/", a.HelloHandler)
 
-	summaryRoute := a.router.Group("/summary/:username")
+	// The current API is served under /v1. The unversioned routes are kept as
+	// aliases for existing clients until they've moved to a versioned prefix.
+	a.registerV1Routes(a.router.Group("/v1"))
+	a.registerV1Routes(a.router.Group("", unversioned))
+	if a.separateAdmin {
+		// Without these, admin paths would be matched by the user routes.
+		a.router.Any("/v1/admin/*", notFound)
+		a.router.Any("/admin/*", notFound)
+	} else {
+		a.registerV1AdminRoutes(a.router.Group("/v1/admin"))
+		a.registerV1AdminRoutes(a.router.Group("/admin", unversioned))
+	}
+
+	return a.router
+}
+
+// AdminRouter returns a router that only serves the admin routes, along with
+// the diagnostics handler under /debug/ if it isn't nil. It's meant to be
+// served on a port that isn't reachable from outside the cluster.
+func (a *App) AdminRouter(diagnostics http.Handler) *echo.Echo {
+	router := echo.New()
+	router.Use(otelecho.Middleware("resource-usage-api"))
+	router.Use(middleware.GzipWithConfig(middleware.GzipConfig{MinLength: gzipMinLength}))
+	router.Use(a.identify, a.authorize)
+	router.Use(limitBodySize(a.maxBodySize), checkUUIDParams)
+
+	router.HTTPErrorHandler = httpErrorHandler
+	router.GET("/", a.HelloHandler)
+
+	a.registerV1AdminRoutes(router.Group("/v1/admin"))
+	a.registerV1AdminRoutes(router.Group("/admin", unversioned))
+	if diagnostics != nil {
+		router.Any("/debug/*", echo.WrapHandler(diagnostics))
+	}
+
+	return router
+}
+
+// registerV1Routes registers the version 1 API routes on a route group. Later
+// versions can register routes with different response shapes on their own
+// groups without changing these.
+func (a *App) registerV1Routes(g *echo.Group) {
+	g.GET("/graphql", a.GraphQLHandler)
+	g.POST("/graphql", a.GraphQLHandler)
+
+	summaryRoute := g.Group("/summary/:username")
 	summaryRoute.GET("/", a.GetUserSummary)
 	summaryRoute.GET("", a.GetUserSummary)
 
-	return a.router
+	userRoute := g.Group("/:username")
+	userRoute.GET("/dashboard", a.GetUserDashboard)
+	userRoute.GET("/analyses", a.GetUserAnalyses)
+	userRoute.GET("/cpu/total", a.GetUserCPUTotal)
+	userRoute.GET("/cpu/forecast", a.GetUserCPUForecast)
+	userRoute.GET("/cpu/compare", a.GetUserCPUComparison)
+	userRoute.GET("/cpu/holds", a.GetUserCPUHolds)
+	userRoute.POST("/cpu/estimate", a.EstimateUserCPUHours)
+	userRoute.GET("/cpu/remaining", a.GetUserCPURemaining)
+	userRoute.GET("/usages", a.GetUserUsages)
+	userRoute.GET("/usages/:resource", a.GetUserUsage)
+	userRoute.GET("/digest/preferences", a.GetUserDigestPreference)
+	userRoute.PUT("/digest/preferences", a.SetUserDigestPreference)
+}
+
+// registerV1AdminRoutes registers the version 1 admin routes on a route group,
+// which is served either alongside the other routes or on its own port.
+func (a *App) registerV1AdminRoutes(adminRoute *echo.Group) {
+	adminRoute.GET("/analytics/usage-flat", a.AdminFlatUsageHandler)
+	adminRoute.GET("/stats", a.AdminUsageStatsHandler)
+	adminRoute.GET("/export/openmetrics", a.AdminOpenMetricsExportHandler)
+	adminRoute.GET("/export/anonymized", a.AdminAnonymizedExportHandler)
+	adminRoute.POST("/simulate", a.AdminSimulateHandler)
+	adminRoute.GET("/amqp/dead-letters", a.AdminListDeadLettersHandler)
+	adminRoute.POST("/amqp/dead-letters/replay", a.AdminReplayDeadLettersHandler)
+	adminRoute.GET("/events", a.AdminListArchivedEventsHandler)
+	adminRoute.POST("/events/replay", a.AdminReplayEventsHandler)
+	adminRoute.GET("/workers", a.AdminListWorkersHandler)
+	adminRoute.DELETE("/workers/:id", a.AdminExpireWorkerHandler)
+	adminRoute.GET("/workitems", a.AdminListWorkItemsHandler)
+	adminRoute.POST("/workitems", a.AdminEnqueueWorkItemsHandler)
+	adminRoute.GET("/workitems/backlog", a.AdminWorkItemBacklogHandler)
+	adminRoute.GET("/workitems/history", a.AdminWorkItemHistoryHandler)
+	adminRoute.DELETE("/workitems/:id/claim", a.AdminReleaseWorkClaimHandler)
+	adminRoute.POST("/workitems/:id/void", a.AdminVoidEventHandler)
+	adminRoute.POST("/workitems/:id/unvoid", a.AdminUnvoidEventHandler)
+	adminRoute.GET("/log-level", a.AdminGetLogLevelHandler)
+	adminRoute.PUT("/log-level", a.AdminSetLogLevelHandler)
+	adminRoute.GET("/anomalies", a.AdminListAnomaliesHandler)
+	adminRoute.GET("/qms/drift", a.AdminListQMSDriftHandler)
+	adminRoute.POST("/analyses/hours", a.AdminGetAnalysisHoursHandler)
+	adminRoute.GET("/cpu/analyses/:id/provenance", a.AdminGetCalculationProvenanceHandler)
+	adminRoute.GET("/cpu/frozen", a.AdminListFrozenUsersHandler)
+	adminRoute.POST("/cpu/:username/freeze", a.AdminFreezeAccrualHandler)
+	adminRoute.POST("/cpu/:username/unfreeze", a.AdminUnfreezeAccrualHandler)
+	adminRoute.GET("/cpu/:username/supplements", a.AdminListSupplementsHandler)
+	adminRoute.POST("/cpu/:username/supplements", a.AdminGrantSupplementHandler)
+	adminRoute.DELETE("/cpu/:username/supplements/:id", a.AdminRevokeSupplementHandler)
+	adminRoute.PUT("/cpu/:username/reset-schedule", a.AdminSetResetScheduleHandler)
+	adminRoute.DELETE("/cpu/:username/reset-schedule", a.AdminDeleteResetScheduleHandler)
+	adminRoute.GET("/resets/schedules", a.AdminListResetSchedulesHandler)
+	adminRoute.GET("/billing-weights", a.AdminListBillingWeightsHandler)
+	adminRoute.POST("/billing-weights", a.AdminAddBillingWeightHandler)
+	adminRoute.DELETE("/billing-weights/:id", a.AdminRevokeBillingWeightHandler)
+	adminRoute.POST("/users/provision", a.AdminProvisionUsersHandler)
+	adminRoute.GET("/accounts/changes", a.AdminListAccountChangesHandler)
+	adminRoute.POST("/accounts/rename", a.AdminRenameAccountHandler)
+	adminRoute.POST("/accounts/merge", a.AdminMergeAccountsHandler)
 }
@@ -0,0 +1,42 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// LogLevel is the request and response body for the log level endpoints.
+type LogLevel struct {
+	Level string `json:"level"`
+}
+
+// AdminGetLogLevelHandler is an echo request handler that returns the current
+// log level.
+func (a *App) AdminGetLogLevelHandler(c echo.Context) error {
+	return respond(c, http.StatusOK, &LogLevel{Level: logging.Level()})
+}
+
+// AdminSetLogLevelHandler is an echo request handler that changes the log
+// level without restarting the service. The change only applies to the
+// instance that handles the request, and it lasts until the instance restarts
+// or receives a SIGHUP.
+func (a *App) AdminSetLogLevelHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "set log level"}).WithContext(context)
+
+	var request LogLevel
+	if err := bindBody(c, &request); err != nil {
+		return err
+	}
+
+	previous := logging.Level()
+	if err := logging.SetLevel(request.Level); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	log.Warnf("log level changed from %s to %s", previous, logging.Level())
+
+	return respond(c, http.StatusOK, &LogLevel{Level: logging.Level()})
+}
@@ -0,0 +1,142 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/csv"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/guregu/null"
+	"github.com/labstack/echo/v4"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// The media types that responses can be encoded as.
+const (
+	mimeJSON    = "application/json"
+	mimeMsgpack = "application/msgpack"
+	mimeCSV     = "text/csv"
+)
+
+// csvTable is implemented by response values that can be encoded as CSV.
+type csvTable interface {
+	csvHeader() []string
+	csvRecords() [][]string
+}
+
+// acceptedTypes returns the media types in an Accept header value that have a
+// non-zero quality, ordered from most to least preferred.
+func acceptedTypes(accept string) []string {
+	type accepted struct {
+		mediaType string
+		quality   float64
+	}
+
+	var types []accepted
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+
+		// Insert in order of quality, keeping the header's order for ties.
+		i := len(types)
+		for i > 0 && types[i-1].quality < quality {
+			i--
+		}
+		types = append(types, accepted{})
+		copy(types[i+1:], types[i:])
+		types[i] = accepted{mediaType: mediaType, quality: quality}
+	}
+
+	result := make([]string, len(types))
+	for i, t := range types {
+		result[i] = t.mediaType
+	}
+	return result
+}
+
+// negotiate returns the media type to encode the value as, or an empty string
+// if none of the types that the client accepts are available.
+func negotiate(accept string, value interface{}) string {
+	if accept == "" {
+		return mimeJSON
+	}
+
+	_, hasCSV := value.(csvTable)
+	for _, mediaType := range acceptedTypes(accept) {
+		switch mediaType {
+		case mimeJSON, "application/*", "*/*":
+			return mimeJSON
+		case mimeMsgpack, "application/x-msgpack":
+			return mimeMsgpack
+		case mimeCSV, "text/*":
+			if hasCSV {
+				return mimeCSV
+			}
+		}
+	}
+	return ""
+}
+
+// respond encodes the value as the best media type listed in the request's
+// Accept header. JSON and msgpack are always available, and CSV is available
+// for values that implement csvTable.
+func respond(c echo.Context, status int, value interface{}) error {
+	c.Response().Header().Add(echo.HeaderVary, echo.HeaderAccept)
+
+	switch negotiate(c.Request().Header.Get(echo.HeaderAccept), value) {
+	case mimeJSON:
+		return c.JSON(status, value)
+
+	case mimeMsgpack:
+		var buf bytes.Buffer
+		enc := msgpack.NewEncoder(&buf)
+		enc.SetCustomStructTag("json")
+		if err := enc.Encode(value); err != nil {
+			return err
+		}
+		return c.Blob(status, mimeMsgpack, buf.Bytes())
+
+	case mimeCSV:
+		table := value.(csvTable)
+		var buf bytes.Buffer
+		w := csv.NewWriter(&buf)
+		if err := w.Write(table.csvHeader()); err != nil {
+			return err
+		}
+		if err := w.WriteAll(table.csvRecords()); err != nil {
+			return err
+		}
+		return c.Blob(status, mimeCSV+"; charset=utf-8", buf.Bytes())
+
+	default:
+		return echo.NewHTTPError(http.StatusNotAcceptable, "the response can be encoded as application/json or application/msgpack, or as text/csv for tabular endpoints")
+	}
+}
+
+// csvTime formats a timestamp for a CSV record.
+func csvTime(t time.Time) string {
+	return t.Format(time.RFC3339Nano)
+}
+
+// csvNullTime formats a nullable timestamp for a CSV record. Null timestamps
+// are empty.
+func csvNullTime(t null.Time) string {
+	if !t.Valid {
+		return ""
+	}
+	return csvTime(t.Time)
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// mimeOpenMetrics is the media type of the OpenMetrics text exposition format.
+const mimeOpenMetrics = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// openMetricsCPUHours is the name of the metric family that the CPU hours
+// counters are exported as. OpenMetrics requires the unit to be a suffix of
+// the name.
+const openMetricsCPUHours = "resource_usage_cpu_hours"
+
+// openMetricsLabelEscaper escapes label values as required by OpenMetrics.
+var openMetricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeOpenMetricsCPUHours writes the usages stored with the users' quotas to b
+// as a counter family in the OpenMetrics text format, one counter per user. The
+// usages come from QMS, which is where analysis usage is added, so the local
+// totals can't be used. A counter's created timestamp is the start of the
+// subscription, which tells consumers that the counter was reset when a new
+// subscription began. QMS has no allocation sources, so every counter is
+// labeled with the default one.
+func writeOpenMetricsCPUHours(b *strings.Builder, quotas []db.Quota) {
+	fmt.Fprintf(b, "# TYPE %s counter\n", openMetricsCPUHours)
+	fmt.Fprintf(b, "# UNIT %s hours\n", openMetricsCPUHours)
+	fmt.Fprintf(b, "# HELP %s CPU hours used by each user in their current subscription.\n", openMetricsCPUHours)
+
+	for i := range quotas {
+		quota := &quotas[i]
+		labels := fmt.Sprintf(
+			`username="%s",allocation_source="%s"`,
+			openMetricsLabelEscaper.Replace(quota.Username),
+			openMetricsLabelEscaper.Replace(db.DefaultAllocationSource),
+		)
+
+		// Counters can't be negative, which a usage can be briefly if more was
+		// subtracted than had been added.
+		value := &quota.Usage
+		if value.Sign() < 0 {
+			value = apd.New(0, 0)
+		}
+
+		fmt.Fprintf(b, "%s_total{%s} %s\n", openMetricsCPUHours, labels, value.Text('f'))
+		fmt.Fprintf(b, "%s_created{%s} %d\n", openMetricsCPUHours, labels, quota.EffectiveStart.Unix())
+	}
+
+	b.WriteString("# EOF\n")
+}
+
+// AdminOpenMetricsExportHandler is an echo request handler that returns the
+// CPU hours used by every user as counters in the OpenMetrics text format, so
+// that chargeback and monitoring systems can scrape usage without a custom
+// integration. The usages are the ones stored with the quotas, which are kept
+// up to date by the quota refreshes and by the usage that's sent to QMS.
+func (a *App) AdminOpenMetricsExportHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "openmetrics export"}).WithContext(context)
+
+	quotas, err := db.New(a.readDatabase).QuotasForResourceType(context, db.ResourceTypeCPUHours)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	var b strings.Builder
+	writeOpenMetricsCPUHours(&b, quotas)
+
+	return c.Blob(http.StatusOK, mimeOpenMetrics, []byte(b.String()))
+}
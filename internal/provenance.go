@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// ProvenanceListing is the response body for the calculation provenance
+// endpoint.
+type ProvenanceListing struct {
+	AnalysisID   string                     `json:"analysis_id"`
+	Calculations []db.CalculationProvenance `json:"calculations"`
+}
+
+// AdminGetCalculationProvenanceHandler is an echo request handler that returns
+// the inputs used each time the analysis's usage was calculated, most recent
+// first.
+func (a *App) AdminGetCalculationProvenanceHandler(c echo.Context) error {
+	context := c.Request().Context()
+	id := c.Param("id")
+	log := log.WithFields(logrus.Fields{"context": "get calculation provenance", "analysisID": id}).WithContext(context)
+
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id must be set")
+	}
+
+	calculations, err := db.New(a.readDatabase).CalculationProvenanceForAnalysis(context, id)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if len(calculations) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "no calculations have been recorded for the analysis")
+	}
+
+	return respond(c, http.StatusOK, &ProvenanceListing{AnalysisID: id, Calculations: calculations})
+}
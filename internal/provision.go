@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/go-mod/pbinit"
+	"github.com/cyverse-de/go-mod/subjects"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// maxProvisionUsers is the largest number of users that can be provisioned in
+// a single request.
+const maxProvisionUsers = 1000
+
+// The statuses reported for each user by the provisioning endpoint.
+const (
+	provisionCreated        = "created"
+	provisionExists         = "exists"
+	provisionUserNotFound   = "user_not_found"
+	provisionNoSubscription = "no_subscription"
+	provisionFailed         = "failed"
+)
+
+// ProvisionRequest is the request body for the user provisioning endpoint.
+type ProvisionRequest struct {
+	Usernames []string `json:"usernames"`
+}
+
+// ProvisionResult is the outcome of provisioning a single user.
+type ProvisionResult struct {
+	Username       string     `json:"username"`
+	Status         string     `json:"status"`
+	EffectiveStart *time.Time `json:"effective_start,omitempty"`
+	EffectiveEnd   *time.Time `json:"effective_end,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// ProvisionResponse is the response body for the user provisioning endpoint.
+type ProvisionResponse struct {
+	Results []ProvisionResult `json:"results"`
+}
+
+// subscriptionPeriod returns the effective period of the user's current QMS
+// subscription. It returns sql.ErrNoRows if the user doesn't have one.
+func (a *App) subscriptionPeriod(context context.Context, username string) (time.Time, time.Time, error) {
+	request := pbinit.NewQMSRequestByUsername()
+	request.Username = username
+	_, span := pbinit.InitQMSRequestByUsername(request, subjects.QMSUserSummary)
+	defer span.End()
+
+	response := pbinit.NewSubscriptionResponse()
+	if err := gotelnats.Request(context, a.natsClient, subjects.QMSUserSummary, request, response); err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if response.Subscription == nil || response.Subscription.EffectiveStartDate == nil || response.Subscription.EffectiveEndDate == nil {
+		return time.Time{}, time.Time{}, sql.ErrNoRows
+	}
+
+	return response.Subscription.EffectiveStartDate.AsTime(), response.Subscription.EffectiveEndDate.AsTime(), nil
+}
+
+// provisionUser creates a zeroed current CPU hours total for the user covering
+// their subscription period, unless they already have a current total.
+func (a *App) provisionUser(context context.Context, d *db.Database, username string) ProvisionResult {
+	result := ProvisionResult{Username: username}
+
+	userID, err := d.UserID(context, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		result.Status = provisionUserNotFound
+		return result
+	}
+	if err != nil {
+		result.Status, result.Error = provisionFailed, err.Error()
+		return result
+	}
+
+	current, err := d.CurrentCPUHoursForUser(context, username)
+	if err == nil {
+		result.Status = provisionExists
+		result.EffectiveStart, result.EffectiveEnd = &current.EffectiveStart, &current.EffectiveEnd
+		return result
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		result.Status, result.Error = provisionFailed, err.Error()
+		return result
+	}
+
+	start, end, err := a.subscriptionPeriod(context, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		result.Status = provisionNoSubscription
+		return result
+	}
+	if err != nil {
+		result.Status, result.Error = provisionFailed, err.Error()
+		return result
+	}
+
+	total := &db.CPUHours{
+		UserID:         userID,
+		EffectiveStart: start,
+		EffectiveEnd:   end,
+	}
+	if err = d.InsertCurrentCPUHoursForUser(context, total); err != nil {
+		result.Status, result.Error = provisionFailed, err.Error()
+		return result
+	}
+
+	result.Status = provisionCreated
+	result.EffectiveStart, result.EffectiveEnd = &start, &end
+	return result
+}
+
+// AdminProvisionUsersHandler is an echo request handler that creates zeroed
+// current CPU hours totals for a list of users before they run their first
+// analyses. Each total covers the user's current QMS subscription period.
+// Users who already have a current total are left alone, and the outcome is
+// reported for each user.
+func (a *App) AdminProvisionUsersHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "provision users"}).WithContext(context)
+
+	var request ProvisionRequest
+	if err := bindBody(c, &request); err != nil {
+		return err
+	}
+	if len(request.Usernames) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "usernames must be set")
+	}
+	if len(request.Usernames) > maxProvisionUsers {
+		return echo.NewHTTPError(http.StatusBadRequest, "at most 1000 users can be provisioned at once")
+	}
+
+	d := db.New(a.database)
+	response := &ProvisionResponse{Results: make([]ProvisionResult, 0, len(request.Usernames))}
+	seen := make(map[string]bool)
+
+	var created int
+	for _, name := range request.Usernames {
+		username := a.FixUsername(name)
+		if name == "" || seen[username] {
+			continue
+		}
+		seen[username] = true
+
+		result := a.provisionUser(context, d, username)
+		switch result.Status {
+		case provisionCreated:
+			created++
+			if err := a.InvalidateTotals(context, username); err != nil {
+				log.Errorf("unable to invalidate the cached totals for %s: %s", username, err)
+			}
+		case provisionFailed:
+			log.Errorf("unable to provision %s: %s", username, result.Error)
+		}
+		response.Results = append(response.Results, result)
+	}
+	log.Infof("provisioned %d of %d users by %s", created, len(response.Results), performedBy(c))
+
+	return respond(c, http.StatusOK, response)
+}
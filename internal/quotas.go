@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/internal/summarizer"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// RemainingResponse is the response body for the remaining CPU hours endpoint.
+// Total is the usage that QMS reported with the quota plus the usage sent to it
+// since. Remaining is the quota less that total and the holds for running
+// analyses, and may be negative if the user is over their quota. QuotaStale is
+// true if the quota was fetched from QMS longer ago than the maximum age of
+// the local copies.
+type RemainingResponse struct {
+	Username       string    `json:"username"`
+	Quota          float64   `json:"quota"`
+	Total          float64   `json:"total"`
+	Held           float64   `json:"held"`
+	Remaining      float64   `json:"remaining"`
+	QuotaFetchedOn time.Time `json:"quota_fetched_on"`
+	QuotaStale     bool      `json:"quota_stale"`
+}
+
+// saveQuotas stores the quotas in the summary's subscription in the local
+// quota cache. Summaries whose quotas were read from the cache are skipped so
+// that the quotas don't look fresher than they are. Errors are logged, since
+// the summary is still usable.
+func (a *App) saveQuotas(c echo.Context, summary *summarizer.UserSummary) {
+	if summary == nil || summary.Subscription == nil || summary.QuotasFetchedOn != nil {
+		return
+	}
+
+	context := c.Request().Context()
+	sub := summary.Subscription
+	d := db.New(a.database)
+
+	for _, q := range sub.Quotas {
+		quota := &db.Quota{
+			Username:       a.FixUsername(c.Param("username")),
+			ResourceType:   q.ResourceType.Name,
+			PlanName:       sub.Plan.Name,
+			EffectiveStart: sub.EffectiveStartDate,
+			EffectiveEnd:   sub.EffectiveEndDate,
+		}
+		if _, err := quota.Quota.SetFloat64(q.Quota); err != nil {
+			log.WithContext(context).Errorf("unable to convert the %s quota: %s", q.ResourceType.Name, err)
+			continue
+		}
+		if usage := sub.ExtractUsage(q.ResourceType.Name); usage != nil {
+			if _, err := quota.Usage.SetFloat64(usage.Usage); err != nil {
+				log.WithContext(context).Errorf("unable to convert the %s usage: %s", q.ResourceType.Name, err)
+				continue
+			}
+		}
+		if err := d.SaveQuota(context, quota); err != nil {
+			log.WithContext(context).Errorf("unable to cache the %s quota: %s", q.ResourceType.Name, err)
+		}
+	}
+}
+
+// GetUserCPURemaining is an echo request handler that returns how many of the
+// user's CPU hours remain. It's called whenever an analysis is launched, so it
+// uses the locally cached quota and only asks QMS for it if it isn't cached.
+func (a *App) GetUserCPURemaining(c echo.Context) error {
+	context := c.Request().Context()
+	user := a.FixUsername(c.Param("username"))
+	log := log.WithFields(logrus.Fields{"context": "get user remaining CPU hours", "user": user}).WithContext(context)
+
+	remaining, err := db.New(a.readDatabase).RemainingForUser(context, user, db.ResourceTypeCPUHours)
+	if errors.Is(err, sql.ErrNoRows) && a.qmsEnabled {
+		// The quota is read back from the primary database, since the read
+		// replica may not have it yet.
+		a.saveQuotas(c, a.loadSummary(c))
+		remaining, err = db.New(a.database).RemainingForUser(context, user, db.ResourceTypeCPUHours)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return newAPIError(http.StatusNotFound, ErrNoQuota, "no CPU hours quota found for user")
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	response := &RemainingResponse{
+		Username:       remaining.Username,
+		QuotaFetchedOn: remaining.FetchedOn,
+		QuotaStale:     a.quotaMaxAge > 0 && time.Since(remaining.FetchedOn) > a.quotaMaxAge,
+	}
+	if response.Quota, err = remaining.Quota.Float64(); err != nil {
+		log.Error(err)
+		return err
+	}
+	if response.Total, err = remaining.Total.Float64(); err != nil {
+		log.Error(err)
+		return err
+	}
+	if response.Held, err = remaining.Held.Float64(); err != nil {
+		log.Error(err)
+		return err
+	}
+	if response.Remaining, err = remaining.Remaining.Float64(); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return respond(c, http.StatusOK, response)
+}
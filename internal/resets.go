@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/cron"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/guregu/null"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// ResetScheduleRequest is the request body for the reset schedule endpoint.
+type ResetScheduleRequest struct {
+	Expression string `json:"expression"`
+}
+
+// ResetScheduleListing is the response body for the reset schedule listing
+// endpoint.
+type ResetScheduleListing struct {
+	Schedules []db.ResetSchedule `json:"schedules"`
+}
+
+// AdminListResetSchedulesHandler is an echo request handler that lists every
+// user's own reset schedule.
+func (a *App) AdminListResetSchedulesHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "list reset schedules"}).WithContext(context)
+
+	schedules, err := db.New(a.database).ResetSchedules(context)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if schedules == nil {
+		schedules = make([]db.ResetSchedule, 0)
+	}
+
+	return respond(c, http.StatusOK, &ResetScheduleListing{Schedules: schedules})
+}
+
+// AdminSetResetScheduleHandler is an echo request handler that sets the cron
+// expression for when a user's CPU hours are reset, replacing the default
+// schedule for them.
+func (a *App) AdminSetResetScheduleHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "set reset schedule"}).WithContext(context)
+
+	var request ResetScheduleRequest
+	if err := bindBody(c, &request); err != nil {
+		return err
+	}
+	schedule, err := cron.Parse(request.Expression)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	next := schedule.Next(time.Now().UTC())
+	if next.IsZero() {
+		return echo.NewHTTPError(http.StatusBadRequest, "the expression doesn't match any time in the next few years")
+	}
+
+	d := db.New(a.database)
+	username, userID, err := a.pathUserID(c, d)
+	if err != nil {
+		return err
+	}
+
+	err = d.SetResetSchedule(context, &db.ResetSchedule{
+		UserID:      userID,
+		Expression:  request.Expression,
+		NextRun:     null.TimeFrom(next),
+		ScheduledBy: performedBy(c),
+	})
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infof("reset schedule for %s set to %q; next reset at %s", username, request.Expression, next.Format(time.RFC3339))
+
+	return c.NoContent(http.StatusOK)
+}
+
+// AdminDeleteResetScheduleHandler is an echo request handler that removes a
+// user's own reset schedule, so that the default schedule applies to them
+// again.
+func (a *App) AdminDeleteResetScheduleHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "delete reset schedule"}).WithContext(context)
+
+	d := db.New(a.database)
+	username, userID, err := a.pathUserID(c, d)
+	if err != nil {
+		return err
+	}
+
+	deleted, err := d.DeleteResetSchedule(context, userID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if !deleted {
+		return echo.NewHTTPError(http.StatusNotFound, "the user has no reset schedule")
+	}
+	log.Infof("reset schedule for %s removed", username)
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,271 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// maxSimulatedAnalyses is the largest number of analyses that a single
+// simulation will recalculate.
+const maxSimulatedAnalyses = 10000
+
+// SimulationRequest is the request body for the simulation endpoint. The
+// window contains the analyses that ended at or after Start and before End.
+// Modes maps job types to the proposed calculation modes, and Rates maps job
+// types to proposed multipliers for their CPU hours; job types that aren't
+// listed keep their current mode and a rate of 1. Quota is an optional
+// proposed CPU hours quota for every user.
+type SimulationRequest struct {
+	Start time.Time              `json:"start"`
+	End   time.Time              `json:"end"`
+	Users []string               `json:"users"`
+	Modes map[string]string      `json:"modes"`
+	Rates map[string]json.Number `json:"rates"`
+	Quota json.Number            `json:"quota"`
+}
+
+// SimulatedUser compares the CPU hours that a user was charged for the
+// analyses in the window with what they'd be charged under the proposal. The
+// quotas are nil if the user has no stored quota and none was proposed, and
+// the over quota flags compare the window's usage with them. Failed is the
+// number of analyses that couldn't be recalculated, which are left out of both
+// totals.
+type SimulatedUser struct {
+	Username          string   `json:"username"`
+	Analyses          int      `json:"analyses"`
+	Failed            int      `json:"failed"`
+	CurrentHours      float64  `json:"current_hours"`
+	ProposedHours     float64  `json:"proposed_hours"`
+	Delta             float64  `json:"delta"`
+	CurrentQuota      *float64 `json:"current_quota"`
+	ProposedQuota     *float64 `json:"proposed_quota"`
+	CurrentOverQuota  bool     `json:"current_over_quota"`
+	ProposedOverQuota bool     `json:"proposed_over_quota"`
+}
+
+// SimulationResult is the response body for the simulation endpoint.
+type SimulationResult struct {
+	Start         time.Time       `json:"start"`
+	End           time.Time       `json:"end"`
+	Analyses      int             `json:"analyses"`
+	Failed        int             `json:"failed"`
+	CurrentHours  float64         `json:"current_hours"`
+	ProposedHours float64         `json:"proposed_hours"`
+	Delta         float64         `json:"delta"`
+	Users         []SimulatedUser `json:"users"`
+}
+
+// simulatedTotals accumulates the current and proposed CPU hours of a user.
+type simulatedTotals struct {
+	user     SimulatedUser
+	current  apd.Decimal
+	proposed apd.Decimal
+}
+
+// AdminSimulateHandler is an echo request handler that recalculates the CPU
+// hours of the analyses in a historical window under proposed calculation
+// modes, rates, and quotas, and returns the difference from what each user was
+// charged. Nothing is recorded or sent to QMS.
+//
+// The current CPU hours are the ones last recorded for each analysis, or are
+// calculated with the configured mode if none were recorded. Analyses whose
+// mode isn't changing aren't recalculated.
+func (a *App) AdminSimulateHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "simulate"}).WithContext(context)
+
+	if a.simulator == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "simulation isn't available")
+	}
+
+	var request SimulationRequest
+	if err := bindBody(c, &request); err != nil {
+		return err
+	}
+
+	var problems fieldErrors
+	if request.Start.IsZero() {
+		problems.add("start", "must be set")
+	}
+	if request.End.IsZero() {
+		problems.add("end", "must be set")
+	} else if !request.End.After(request.Start) {
+		problems.add("end", "must be after start")
+	}
+
+	modes := make(map[string]cpuhours.Mode, len(request.Modes))
+	for jobType, m := range request.Modes {
+		mode := cpuhours.Mode(m)
+		if !a.simulator.Available(mode) {
+			problems.add("modes."+jobType, "the %s calculation mode isn't available", m)
+			continue
+		}
+		modes[jobType] = mode
+	}
+
+	rates := make(map[string]*apd.Decimal, len(request.Rates))
+	for jobType, r := range request.Rates {
+		field := "rates." + jobType
+		switch rate := parseDecimal(&problems, field, r); {
+		case rate == nil:
+		case rate.Sign() <= 0:
+			problems.add(field, "must be greater than zero")
+		default:
+			rates[jobType] = rate
+		}
+	}
+
+	var proposedQuota *float64
+	if request.Quota != "" {
+		switch quota := parseDecimal(&problems, "quota", request.Quota); {
+		case quota == nil:
+		case quota.Sign() < 0:
+			problems.add("quota", "can't be negative")
+		default:
+			value, _ := quota.Float64()
+			proposedQuota = &value
+		}
+	}
+
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	usernames := make([]string, len(request.Users))
+	for i, username := range request.Users {
+		usernames[i] = a.FixUsername(username)
+	}
+
+	d := db.New(a.readDatabase)
+	analyses, err := d.SimulationAnalyses(context, request.Start.UTC(), request.End.UTC(), usernames, maxSimulatedAnalyses+1)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if len(analyses) > maxSimulatedAnalyses {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("more than %d analyses ended in the window; narrow it or list the users to simulate", maxSimulatedAnalyses),
+		)
+	}
+
+	bc := apd.BaseContext.WithPrecision(15)
+	var (
+		order  []string
+		totals = make(map[string]*simulatedTotals)
+	)
+	for i := range analyses {
+		analysis := &analyses[i]
+
+		t, ok := totals[analysis.Username]
+		if !ok {
+			t = &simulatedTotals{user: SimulatedUser{Username: analysis.Username}}
+			totals[analysis.Username] = t
+			order = append(order, analysis.Username)
+		}
+
+		configured := a.simulator.ConfiguredMode(analysis.JobType)
+		proposedMode, ok := modes[analysis.JobType]
+		if !ok {
+			proposedMode = configured
+		}
+
+		current := analysis.Charged
+		if current == nil {
+			if current, err = a.simulator.Calculate(context, &analysis.Analysis, configured); err != nil {
+				log.Warnf("unable to calculate the current CPU hours for analysis %s: %s", analysis.ID, err)
+				t.user.Failed++
+				continue
+			}
+		}
+
+		proposed := current
+		if proposedMode != configured {
+			if proposed, err = a.simulator.Calculate(context, &analysis.Analysis, proposedMode); err != nil {
+				log.Warnf("unable to calculate the proposed CPU hours for analysis %s: %s", analysis.ID, err)
+				t.user.Failed++
+				continue
+			}
+		}
+		if rate, ok := rates[analysis.JobType]; ok {
+			rated := apd.New(0, 0)
+			if _, err = bc.Mul(rated, proposed, rate); err != nil {
+				log.Error(err)
+				return err
+			}
+			proposed = rated
+		}
+
+		if _, err = bc.Add(&t.current, &t.current, current); err != nil {
+			log.Error(err)
+			return err
+		}
+		if _, err = bc.Add(&t.proposed, &t.proposed, proposed); err != nil {
+			log.Error(err)
+			return err
+		}
+		t.user.Analyses++
+	}
+
+	result := &SimulationResult{
+		Start: request.Start.UTC(),
+		End:   request.End.UTC(),
+		Users: make([]SimulatedUser, 0, len(order)),
+	}
+	for _, username := range order {
+		t := totals[username]
+		user := &t.user
+
+		if user.CurrentHours, err = t.current.Float64(); err != nil {
+			log.Error(err)
+			return err
+		}
+		if user.ProposedHours, err = t.proposed.Float64(); err != nil {
+			log.Error(err)
+			return err
+		}
+		user.Delta = user.ProposedHours - user.CurrentHours
+
+		quotas, err := d.QuotasForUser(context, username)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		for _, quota := range quotas {
+			if quota.ResourceType != db.DefaultResourceType {
+				continue
+			}
+			value, err := quota.Quota.Float64()
+			if err != nil {
+				log.Error(err)
+				return err
+			}
+			user.CurrentQuota = &value
+		}
+		user.ProposedQuota = user.CurrentQuota
+		if proposedQuota != nil {
+			user.ProposedQuota = proposedQuota
+		}
+		user.CurrentOverQuota = user.CurrentQuota != nil && user.CurrentHours > *user.CurrentQuota
+		user.ProposedOverQuota = user.ProposedQuota != nil && user.ProposedHours > *user.ProposedQuota
+
+		result.Analyses += user.Analyses
+		result.Failed += user.Failed
+		result.CurrentHours += user.CurrentHours
+		result.ProposedHours += user.ProposedHours
+		result.Users = append(result.Users, *user)
+	}
+	result.Delta = result.ProposedHours - result.CurrentHours
+
+	log.Infof("simulated %d analyses for %d users", result.Analyses, len(result.Users))
+
+	return respond(c, http.StatusOK, result)
+}
@@ -0,0 +1,111 @@
+package summarizer
+
+import (
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/db"
+)
+
+// resourceTypeUnits are the units of the resource types that QMS has quotas
+// for. The locally stored quotas don't include them.
+var resourceTypeUnits = map[string]string{
+	clients.ResourceTypeCPUHours: "cpu hours",
+	clients.ResourceTypeDataSize: "bytes",
+}
+
+// CachedSummarizer builds the summary from the local usage totals and the
+// locally stored copies of the user's QMS quotas, so that QMS isn't called
+// while the request is handled. Users whose quotas haven't been stored yet
+// are summarized by the fallback summarizer instead.
+type CachedSummarizer struct {
+	DefaultSummarizer
+
+	// MaxAge is how old the stored quotas may be before the summary reports
+	// them as stale.
+	MaxAge time.Duration
+
+	// Fallback loads the summaries of users whose quotas aren't stored.
+	Fallback Summarizer
+}
+
+// LoadSummary aggregates and summarizes the user's resource usage information
+// along with their stored quotas.
+func (c *CachedSummarizer) LoadSummary() *UserSummary {
+	quotas, err := db.New(c.Database).QuotasForUser(c.Context, c.User)
+	if err != nil {
+		c.Log.WithContext(c.Context).Errorf("unable to load the stored quotas: %s", err)
+	}
+	if len(quotas) == 0 {
+		return c.Fallback.LoadSummary()
+	}
+
+	summary := c.DefaultSummarizer.LoadSummary()
+
+	// Every stored quota for a user comes from the same subscription, so the
+	// first one has the plan and the period for all of them.
+	first := &quotas[0]
+	summary.Subscription = &clients.Subscription{
+		EffectiveStartDate: first.EffectiveStart,
+		EffectiveEndDate:   first.EffectiveEnd,
+		User: clients.User{
+			ID:       first.UserID,
+			Username: first.Username,
+		},
+		Plan: clients.Plan{
+			Name: first.PlanName,
+		},
+		Quotas: make([]clients.Quota, 0),
+		Usages: make([]clients.Usage, 0),
+	}
+
+	fetchedOn := first.FetchedOn
+	for i := range quotas {
+		value, err := quotas[i].Quota.Float64()
+		if err != nil {
+			c.Log.WithContext(c.Context).Error(err)
+			continue
+		}
+		quotaFetchedOn := quotas[i].FetchedOn
+		summary.Subscription.Quotas = append(summary.Subscription.Quotas, clients.Quota{
+			Quota: value,
+			ResourceType: clients.ResourceType{
+				Name: quotas[i].ResourceType,
+				Unit: resourceTypeUnits[quotas[i].ResourceType],
+			},
+			LastModifiedAt: &quotaFetchedOn,
+		})
+		if quotaFetchedOn.Before(fetchedOn) {
+			fetchedOn = quotaFetchedOn
+		}
+	}
+
+	if summary.CPUUsage != nil {
+		if usage, err := summary.CPUUsage.Total.Float64(); err == nil {
+			lastModified := summary.CPUUsage.LastModified
+			summary.Subscription.Usages = append(summary.Subscription.Usages, clients.Usage{
+				Usage: usage,
+				ResourceType: clients.ResourceType{
+					Name: clients.ResourceTypeCPUHours,
+					Unit: resourceTypeUnits[clients.ResourceTypeCPUHours],
+				},
+				LastModifiedAt: &lastModified,
+			})
+		}
+	}
+	if summary.DataUsage != nil {
+		summary.Subscription.Usages = append(summary.Subscription.Usages, clients.Usage{
+			Usage: float64(summary.DataUsage.Total),
+			ResourceType: clients.ResourceType{
+				Name: clients.ResourceTypeDataSize,
+				Unit: resourceTypeUnits[clients.ResourceTypeDataSize],
+			},
+			LastModifiedAt: summary.DataUsage.LastModified,
+		})
+	}
+
+	summary.QuotasFetchedOn = &fetchedOn
+	summary.QuotasStale = c.MaxAge > 0 && time.Since(fetchedOn) > c.MaxAge
+
+	return summary
+}
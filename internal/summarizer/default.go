@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"net/http"
+	"time"
 
 	"github.com/cyverse-de/resource-usage-api/clients"
 	"github.com/cyverse-de/resource-usage-api/db"
@@ -18,7 +19,43 @@ type DefaultSummarizer struct {
 	User            string
 	OTelName        string
 	Database        *sqlx.DB
+	TotalsCache     *db.TotalsCache
 	DataUsageClient *clients.DataUsageAPI
+
+	// DataUsageMaxAge is how old the locally stored data usage may be before
+	// data-usage-api is called instead. The stored data usage isn't used if
+	// it's zero.
+	DataUsageMaxAge time.Duration
+}
+
+// storedDataUsage returns the user's locally stored data usage if it was
+// refreshed within the maximum age, or nil otherwise.
+func (d *DefaultSummarizer) storedDataUsage(ctx context.Context) *clients.UserDataUsage {
+	if d.DataUsageMaxAge <= 0 {
+		return nil
+	}
+
+	stored, err := db.New(d.Database).DataUsageTotalForUser(ctx, d.User)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			d.Log.WithContext(ctx).Error(err)
+		}
+		return nil
+	}
+	if time.Since(stored.RefreshedOn) > d.DataUsageMaxAge {
+		return nil
+	}
+
+	usage := &clients.UserDataUsage{
+		UserID:       stored.UserID,
+		Username:     stored.Username,
+		Total:        stored.Total,
+		LastModified: &stored.RefreshedOn,
+	}
+	if stored.MeasuredOn.Valid {
+		usage.Time = &stored.MeasuredOn.Time
+	}
+	return usage
 }
 
 // loadCPUUsage loads the user's CPU usage information from the DE database.
@@ -29,7 +66,7 @@ func (d *DefaultSummarizer) loadCPUUsage(summary *UserSummary) {
 
 	// Load the CPU usage information from the database.
 	database := db.New(d.Database)
-	cpuHours, err := database.CurrentCPUHoursForUser(ctx, d.User)
+	cpuHours, err := d.TotalsCache.CurrentCPUHoursForUser(ctx, database, d.User)
 	if err == sql.ErrNoRows {
 		cpuHours = &db.CPUHours{}
 		summary.Errors = append(
@@ -60,12 +97,20 @@ func (d *DefaultSummarizer) loadCPUUsage(summary *UserSummary) {
 	span.End()
 }
 
-// loadDataUsage loads the user's data store usage information from data-usage-api.
+// loadDataUsage loads the user's data store usage information from the local
+// copy if it's recent enough, or from data-usage-api otherwise.
 func (d *DefaultSummarizer) loadDataUsage(summary *UserSummary) {
 
 	// Start an OpenTelemetry span.
 	ctx, span := otel.Tracer(d.OTelName).Start(d.Context, "summary: data usage")
 
+	// Use the stored data usage information if it's recent enough.
+	if usage := d.storedDataUsage(ctx); usage != nil {
+		summary.DataUsage = usage
+		span.End()
+		return
+	}
+
 	// Obtain the data store usage information.
 	usage, err := d.DataUsageClient.GetUsageSummary(ctx, d.User)
 	if err != nil {
@@ -1,6 +1,8 @@
 package summarizer
 
 import (
+	"time"
+
 	"github.com/cyverse-de/resource-usage-api/clients"
 	"github.com/cyverse-de/resource-usage-api/db"
 )
@@ -26,7 +28,14 @@ type UserSummary struct {
 	CPUUsage     *db.CPUHours           `json:"cpu_usage"`
 	DataUsage    *clients.UserDataUsage `json:"data_usage"`
 	Subscription *clients.Subscription  `json:"subscription"`
+	Overdrafts   []db.Overdraft         `json:"overdrafts"`
 	Errors       []APIError             `json:"errors"`
+
+	// QuotasFetchedOn is when the quotas in the subscription were fetched
+	// from QMS if they were read from the local copies, and QuotasStale is
+	// true if that was longer ago than the copies' maximum age.
+	QuotasFetchedOn *time.Time `json:"quotas_fetched_on,omitempty"`
+	QuotasStale     bool       `json:"quotas_stale,omitempty"`
 }
 
 // The interface used to load the usage summary information.
@@ -104,13 +104,15 @@ func (s *SubscriptionSummarizer) LoadSummary() *UserSummary {
 				return nil
 			}
 			summary.CPUUsage = &db.CPUHours{
-				ID:             rUsage.Uuid,
-				UserID:         response.Subscription.User.Uuid,
-				Username:       response.Subscription.User.Username,
-				Total:          *ct,
-				EffectiveStart: response.Subscription.EffectiveStartDate.AsTime(),
-				EffectiveEnd:   response.Subscription.EffectiveEndDate.AsTime(),
-				LastModified:   *u.LastModifiedAt,
+				ID:               rUsage.Uuid,
+				UserID:           response.Subscription.User.Uuid,
+				Username:         response.Subscription.User.Username,
+				ResourceType:     db.DefaultResourceType,
+				AllocationSource: db.DefaultAllocationSource,
+				Total:            *ct,
+				EffectiveStart:   response.Subscription.EffectiveStartDate.AsTime(),
+				EffectiveEnd:     response.Subscription.EffectiveEndDate.AsTime(),
+				LastModified:     *u.LastModifiedAt,
 			}
 		}
 
@@ -139,10 +141,12 @@ func (s *SubscriptionSummarizer) LoadSummary() *UserSummary {
 
 	if summary.CPUUsage == nil {
 		summary.CPUUsage = &db.CPUHours{
-			EffectiveStart: response.Subscription.EffectiveStartDate.AsTime(),
-			EffectiveEnd:   response.Subscription.EffectiveEndDate.AsTime(),
-			UserID:         response.Subscription.User.Uuid,
-			Username:       response.Subscription.User.Username,
+			EffectiveStart:   response.Subscription.EffectiveStartDate.AsTime(),
+			EffectiveEnd:     response.Subscription.EffectiveEndDate.AsTime(),
+			UserID:           response.Subscription.User.Uuid,
+			Username:         response.Subscription.User.Username,
+			ResourceType:     db.DefaultResourceType,
+			AllocationSource: db.DefaultAllocationSource,
 		}
 	}
 
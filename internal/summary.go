@@ -1,8 +1,11 @@
 package internal
 
 import (
+	"encoding/json"
 	"net/http"
+	"time"
 
+	"github.com/cyverse-de/resource-usage-api/db"
 	"github.com/cyverse-de/resource-usage-api/internal/summarizer"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
@@ -10,33 +13,129 @@ import (
 
 const otelName = "github.com/cyverse-de/resource-usage-api/internal"
 
-// GetUserSummary is an echo request handler for requests to get a user's
-// resource usage and current plan (if QMS is enabled).
-func (a *App) GetUserSummary(c echo.Context) error {
+// summaryKeyPrefix is the prefix of the shared cache keys for summaries.
+const summaryKeyPrefix = "summary:"
+
+// summarizer returns the summarizer to use for the user named in the request.
+func (a *App) summarizer(c echo.Context) summarizer.Summarizer {
 	context := c.Request().Context()
 	user := c.Param("username")
 	log := log.WithFields(logrus.Fields{"context": "get user summary", "user": user}).WithContext(context)
 
-	// Create the summarizer instance.
-	var summarizerInstance summarizer.Summarizer
+	local := summarizer.DefaultSummarizer{
+		Context:         context,
+		Log:             log,
+		User:            a.FixUsername(user),
+		OTelName:        otelName,
+		Database:        a.readDatabase,
+		TotalsCache:     a.totalsCache,
+		DataUsageClient: a.dataUsageClient,
+		DataUsageMaxAge: a.dataUsageMaxAge,
+	}
+
 	if a.qmsEnabled {
-		summarizerInstance = &summarizer.SubscriptionSummarizer{
-			Context: c.Request().Context(),
+		subscription := &summarizer.SubscriptionSummarizer{
+			Context: context,
 			User:    a.FixUsername(user),
 			Client:  a.natsClient,
 		}
-	} else {
-		summarizerInstance = &summarizer.DefaultSummarizer{
-			Context:         c.Request().Context(),
-			Log:             log,
-			User:            a.FixUsername(user),
-			OTelName:        otelName,
-			Database:        a.database,
-			DataUsageClient: a.dataUsageClient,
+		if a.quotaMaxAge > 0 {
+			return &summarizer.CachedSummarizer{
+				DefaultSummarizer: local,
+				MaxAge:            a.quotaMaxAge,
+				Fallback:          subscription,
+			}
 		}
+		return subscription
+	}
+
+	return &local
+}
+
+// buildSummary loads the summary for the user named in the request along with
+// their overdrafts, and caches the quotas in it.
+func (a *App) buildSummary(c echo.Context) *summarizer.UserSummary {
+	summary := a.summarizer(c).LoadSummary()
+	if summary != nil {
+		a.addOverdrafts(c, summary)
+		a.saveQuotas(c, summary)
 	}
+	return summary
+}
+
+// addOverdrafts adds the user's overdrafts for the summary's period to the
+// summary.
+func (a *App) addOverdrafts(c echo.Context, summary *summarizer.UserSummary) {
+	context := c.Request().Context()
+
+	var periodStart time.Time
+	switch {
+	case summary.Subscription != nil:
+		periodStart = summary.Subscription.EffectiveStartDate
+	case summary.CPUUsage != nil:
+		periodStart = summary.CPUUsage.EffectiveStart
+	}
+
+	overdrafts, err := db.New(a.readDatabase).Overdrafts(context, a.FixUsername(c.Param("username")), periodStart)
+	if err != nil {
+		log.WithContext(context).Error(err)
+		summary.Errors = append(summary.Errors, summarizer.APIError{
+			Field:     "overdrafts",
+			Message:   err.Error(),
+			ErrorCode: http.StatusInternalServerError,
+		})
+	}
+	if overdrafts == nil {
+		overdrafts = make([]db.Overdraft, 0)
+	}
+	summary.Overdrafts = overdrafts
+}
 
+// loadSummary returns the summary for the user named in the request, using the
+// shared cache if there is one. Summaries that contain errors aren't cached.
+func (a *App) loadSummary(c echo.Context) *summarizer.UserSummary {
+	if a.sharedCache == nil {
+		return a.buildSummary(c)
+	}
+
+	context := c.Request().Context()
+	key := summaryKeyPrefix + a.FixUsername(c.Param("username"))
+	log := log.WithFields(logrus.Fields{"context": "cached summary", "key": key}).WithContext(context)
+
+	value, ok, err := a.sharedCache.Get(context, key)
+	if err != nil {
+		log.Errorf("unable to read the shared summary cache: %s", err)
+	}
+	if ok {
+		var summary summarizer.UserSummary
+		if err = json.Unmarshal(value, &summary); err == nil {
+			return &summary
+		}
+		log.Errorf("unable to decode a cached summary: %s", err)
+	}
+
+	summary := a.buildSummary(c)
+	if summary != nil && len(summary.Errors) == 0 {
+		value, err = json.Marshal(summary)
+		if err == nil {
+			err = a.sharedCache.Set(context, key, value)
+		}
+		if err != nil {
+			log.Errorf("unable to update the shared summary cache: %s", err)
+		}
+	}
+
+	return summary
+}
+
+// GetUserSummary is an echo request handler for requests to get a user's
+// resource usage and current plan (if QMS is enabled). Decimal values are
+// plain-notation strings if the decimals query parameter is set to "string".
+func (a *App) GetUserSummary(c echo.Context) error {
 	// Obtain the summary and send it to the caller.
-	summary := summarizerInstance.LoadSummary()
-	return c.JSON(http.StatusOK, &summary)
+	summary := a.loadSummary(c)
+	if wantsDecimalStrings(c) {
+		return respond(c, http.StatusOK, newUserSummaryResponse(summary))
+	}
+	return respond(c, http.StatusOK, &summary)
 }
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// SupplementRequest is the request body for the supplement grant endpoint.
+// The resource type defaults to CPU hours.
+type SupplementRequest struct {
+	ResourceType string      `json:"resource_type"`
+	Amount       json.Number `json:"amount"`
+	StartsOn     time.Time   `json:"starts_on"`
+	EndsOn       time.Time   `json:"ends_on"`
+	Reason       string      `json:"reason"`
+}
+
+// SupplementListing is the response body for the supplement listing endpoint.
+type SupplementListing struct {
+	Supplements []db.Supplement `json:"supplements"`
+}
+
+// SupplementGrantResult is the response body for the supplement grant
+// endpoint.
+type SupplementGrantResult struct {
+	ID string `json:"id"`
+}
+
+// AdminGrantSupplementHandler is an echo request handler that grants a user a
+// supplementary allocation, e.g. for a workshop. Usage attributed to a time
+// between the supplement's start and end is drawn from it before it counts
+// towards the user's base total.
+func (a *App) AdminGrantSupplementHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "grant supplement"}).WithContext(context)
+
+	var request SupplementRequest
+	if err := bindBody(c, &request); err != nil {
+		return err
+	}
+	if request.ResourceType == "" {
+		request.ResourceType = db.ResourceTypeCPUHours
+	}
+
+	var problems fieldErrors
+	if !db.ValidResourceType(request.ResourceType) {
+		problems.add("resource_type", "unsupported resource type")
+	}
+	amount := parseDecimal(&problems, "amount", request.Amount)
+	if amount != nil && amount.Sign() <= 0 {
+		problems.add("amount", "must be greater than zero")
+	}
+	if request.StartsOn.IsZero() {
+		problems.add("starts_on", "must be set")
+	}
+	if request.EndsOn.IsZero() {
+		problems.add("ends_on", "must be set")
+	} else if !request.EndsOn.After(request.StartsOn) {
+		problems.add("ends_on", "must be after starts_on")
+	}
+	if err := problems.err(); err != nil {
+		return err
+	}
+
+	d := db.New(a.database)
+	username, userID, err := a.pathUserID(c, d)
+	if err != nil {
+		return err
+	}
+
+	supplement := &db.Supplement{
+		UserID:       userID,
+		ResourceType: request.ResourceType,
+		Amount:       *amount,
+		StartsOn:     request.StartsOn.UTC(),
+		EndsOn:       request.EndsOn.UTC(),
+		Reason:       request.Reason,
+		GrantedBy:    performedBy(c),
+	}
+	id, err := d.GrantSupplement(context, supplement)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infof("granted %s %s to %s from %s to %s", supplement.Amount.String(), supplement.ResourceType, username,
+		supplement.StartsOn.Format(time.RFC3339), supplement.EndsOn.Format(time.RFC3339))
+
+	return respond(c, http.StatusCreated, &SupplementGrantResult{ID: id})
+}
+
+// AdminListSupplementsHandler is an echo request handler that lists every
+// supplement granted to a user, including the revoked and expired ones.
+func (a *App) AdminListSupplementsHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "list supplements"}).WithContext(context)
+
+	d := db.New(a.database)
+	_, userID, err := a.pathUserID(c, d)
+	if err != nil {
+		return err
+	}
+
+	supplements, err := d.UserSupplements(context, userID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if supplements == nil {
+		supplements = make([]db.Supplement, 0)
+	}
+
+	return respond(c, http.StatusOK, &SupplementListing{Supplements: supplements})
+}
+
+// AdminRevokeSupplementHandler is an echo request handler that revokes one of a
+// user's supplements. Nothing more is drawn from it, but the usage it already
+// covered stays covered.
+func (a *App) AdminRevokeSupplementHandler(c echo.Context) error {
+	context := c.Request().Context()
+	id := c.Param("id")
+	log := log.WithFields(logrus.Fields{"context": "revoke supplement", "id": id}).WithContext(context)
+
+	d := db.New(a.database)
+	username, userID, err := a.pathUserID(c, d)
+	if err != nil {
+		return err
+	}
+
+	revoked, err := d.RevokeSupplement(context, userID, id, performedBy(c))
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if !revoked {
+		return echo.NewHTTPError(http.StatusNotFound, "no unrevoked supplement found for the user")
+	}
+	log.Infof("revoked supplement %s for %s", id, username)
+
+	return c.NoContent(http.StatusOK)
+}
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// cpuHoursETag returns the entity tag for a CPU hours total. The tag is weak
+// because the representation depends on the decimals query parameter.
+func cpuHoursETag(cpuHours *db.CPUHours) string {
+	return fmt.Sprintf(`W/"%s-%d"`, cpuHours.ID, cpuHours.LastModified.UnixNano())
+}
+
+// etagMatches returns true if the If-None-Match header value matches the
+// entity tag using weak comparison.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// The policies for reading a total that the user doesn't have.
+const (
+	// MissingTotalsNotFound responds with a 404.
+	MissingTotalsNotFound = "not_found"
+
+	// MissingTotalsZero responds with a zero total that isn't stored.
+	MissingTotalsZero = "zero"
+)
+
+// createParam is the query parameter that clients set to "true" to create a
+// missing total covering the user's subscription period instead of applying
+// the missing totals policy.
+const createParam = "create"
+
+// TotalResponse is the response body for the total endpoints. Created is false
+// if the user doesn't have the total and a zero total was returned in its
+// place.
+type TotalResponse struct {
+	*db.CPUHours
+	Created bool `json:"created"`
+}
+
+// DecimalTotalResponse is the decimal-safe representation of a TotalResponse.
+type DecimalTotalResponse struct {
+	*CPUHoursResponse
+	Created bool `json:"created"`
+}
+
+// respondWithTotal sends a total in the representation that the client asked
+// for.
+func respondWithTotal(c echo.Context, total *db.CPUHours, created bool) error {
+	if wantsDecimalStrings(c) {
+		return respond(c, http.StatusOK, &DecimalTotalResponse{CPUHoursResponse: newCPUHoursResponse(total), Created: created})
+	}
+	return respond(c, http.StatusOK, &TotalResponse{CPUHours: total, Created: created})
+}
+
+// missingTotal responds to a request for a total that the user doesn't have.
+// The total is created if the request asks for it, and the missing totals
+// policy is applied otherwise.
+func (a *App) missingTotal(c echo.Context, user, resourceType, allocationSource string) error {
+	context := c.Request().Context()
+
+	if c.QueryParam(createParam) == "true" {
+		if resourceType != db.DefaultResourceType || allocationSource != db.DefaultAllocationSource {
+			return echo.NewHTTPError(http.StatusBadRequest, "totals can only be created for CPU hours in the default allocation source")
+		}
+
+		d := db.New(a.database)
+		result := a.provisionUser(context, d, user)
+		switch result.Status {
+		case provisionUserNotFound:
+			return newAPIError(http.StatusNotFound, ErrUserNotFound, "user not found")
+		case provisionNoSubscription:
+			return newAPIError(http.StatusNotFound, ErrNoTotals, "the user has no subscription to create a total for")
+		case provisionFailed:
+			return errors.New(result.Error)
+		}
+
+		// The total is read back from the primary database, since the read
+		// replica may not have it yet.
+		total, err := d.CurrentTotalForUser(context, user, resourceType, allocationSource)
+		if err != nil {
+			return err
+		}
+		return respondWithTotal(c, total, true)
+	}
+
+	if a.missingTotals == MissingTotalsZero {
+		total := &db.CPUHours{
+			Username:         user,
+			ResourceType:     resourceType,
+			AllocationSource: allocationSource,
+		}
+		return respondWithTotal(c, total, false)
+	}
+
+	return newAPIError(http.StatusNotFound, ErrNoTotals, fmt.Sprintf("no current %s total found for user", resourceType))
+}
+
+// GetUserCPUTotal is an echo request handler that returns the user's current
+// CPU hours total. The total is a plain-notation string if the decimals query
+// parameter is set to "string". Responds with 304 if the If-None-Match header
+// matches the total's ETag. Users without a current total are handled by
+// missingTotal. If the as_of query parameter is set, the total is the one that
+// the user had at that moment instead, reconstructed from the usage events.
+func (a *App) GetUserCPUTotal(c echo.Context) error {
+	context := c.Request().Context()
+	user := a.FixUsername(c.Param("username"))
+	log := log.WithFields(logrus.Fields{"context": "get user CPU total", "user": user}).WithContext(context)
+
+	asOf, err := parseAsOf(c)
+	if err != nil {
+		return err
+	}
+	if !asOf.IsZero() {
+		return a.respondWithHistoricalTotal(c, user, db.DefaultResourceType, db.DefaultAllocationSource, asOf)
+	}
+
+	d := db.New(a.readDatabase)
+	cpuHours, err := a.totalsCache.CurrentCPUHoursForUser(context, d, user)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a.missingTotal(c, user, db.DefaultResourceType, db.DefaultAllocationSource)
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	etag := cpuHoursETag(cpuHours)
+	c.Response().Header().Set("ETag", etag)
+	if ifNoneMatch := c.Request().Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return respondWithTotal(c, cpuHours, true)
+}
@@ -0,0 +1,95 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// UsageListing is the response body for the listing of a user's current
+// totals across resource types.
+type UsageListing struct {
+	Usages []db.CPUHours `json:"usages"`
+}
+
+// UsageResponseListing is the decimal-safe representation of a UsageListing.
+type UsageResponseListing struct {
+	Usages []*CPUHoursResponse `json:"usages"`
+}
+
+// GetUserUsages is an echo request handler that returns the user's current
+// totals for every resource type and allocation source. The totals are
+// plain-notation strings if the decimals query parameter is set to "string".
+func (a *App) GetUserUsages(c echo.Context) error {
+	context := c.Request().Context()
+	user := a.FixUsername(c.Param("username"))
+	log := log.WithFields(logrus.Fields{"context": "get user usages", "user": user}).WithContext(context)
+
+	totals, err := db.New(a.readDatabase).CurrentTotalsForUser(context, user)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if wantsDecimalStrings(c) {
+		listing := &UsageResponseListing{Usages: make([]*CPUHoursResponse, 0, len(totals))}
+		for i := range totals {
+			listing.Usages = append(listing.Usages, newCPUHoursResponse(&totals[i]))
+		}
+		return respond(c, http.StatusOK, listing)
+	}
+
+	if totals == nil {
+		totals = make([]db.CPUHours, 0)
+	}
+
+	return respond(c, http.StatusOK, &UsageListing{Usages: totals})
+}
+
+// GetUserUsage is an echo request handler that returns the user's current total
+// for the resource type in the request path. The allocation_source query
+// parameter selects the allocation source, which defaults to the default
+// source. The total is a plain-notation string if the decimals query parameter
+// is set to "string", and responds with 304 if the If-None-Match header matches
+// the total's ETag. Users without the total are handled by missingTotal.
+func (a *App) GetUserUsage(c echo.Context) error {
+	context := c.Request().Context()
+	user := a.FixUsername(c.Param("username"))
+	resourceType := c.Param("resource")
+	log := log.WithFields(logrus.Fields{
+		"context":      "get user usage",
+		"user":         user,
+		"resourceType": resourceType,
+	}).WithContext(context)
+
+	if !db.ValidResourceType(resourceType) {
+		return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("unknown resource type: %s", resourceType))
+	}
+
+	allocationSource := c.QueryParam("allocation_source")
+	if allocationSource == "" {
+		allocationSource = db.DefaultAllocationSource
+	}
+
+	total, err := db.New(a.readDatabase).CurrentTotalForUser(context, user, resourceType, allocationSource)
+	if errors.Is(err, sql.ErrNoRows) {
+		return a.missingTotal(c, user, resourceType, allocationSource)
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	etag := cpuHoursETag(total)
+	c.Response().Header().Set("ETag", etag)
+	if ifNoneMatch := c.Request().Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatches(ifNoneMatch, etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	return respondWithTotal(c, total, true)
+}
@@ -0,0 +1,183 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cockroachdb/apd"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// DefaultMaxBodySize is the largest request body accepted if no other limit is
+// configured.
+const DefaultMaxBodySize int64 = 1 << 20
+
+// uuidParams are the path parameters that must be UUIDs.
+var uuidParams = []string{"id"}
+
+// The bounds on the decimal values accepted in request bodies. They're well
+// beyond any real adjustment, and keep values that the database would reject
+// from getting that far.
+const (
+	maxDecimalIntegerDigits = 15
+	maxDecimalPlaces        = 15
+)
+
+// FieldError describes a problem with one field of a request. Field is the
+// path to the field in the request body, such as 3.value for the value of
+// the fourth entry in an array, or the name of a path or query parameter.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// fieldErrors collects the problems found while validating a request.
+type fieldErrors []FieldError
+
+// add records a problem with a field.
+func (f *fieldErrors) add(field, format string, args ...interface{}) {
+	*f = append(*f, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// err returns an error that responds with a 400 listing the problems, or nil
+// if there aren't any. At most maxReportedProblems are listed.
+func (f fieldErrors) err() error {
+	if len(f) == 0 {
+		return nil
+	}
+
+	fields := f
+	message := fmt.Sprintf("%s: %s", f[0].Field, f[0].Message)
+	if len(f) > 1 {
+		message = fmt.Sprintf("%d fields are invalid", len(f))
+	}
+	if len(fields) > maxReportedProblems {
+		fields = fields[:maxReportedProblems]
+	}
+
+	return &apiError{
+		status:  http.StatusBadRequest,
+		code:    ErrInvalidField,
+		message: message,
+		fields:  fields,
+	}
+}
+
+// bindBody decodes the request body into v. Bodies that are too large are
+// rejected with a 413, values of the wrong type with a 400 naming the field,
+// and anything else that can't be decoded with a 400.
+func bindBody(c echo.Context, v interface{}) error {
+	err := c.Bind(v)
+	if err == nil {
+		return nil
+	}
+
+	var (
+		he          *echo.HTTPError
+		maxBytesErr *http.MaxBytesError
+		typeErr     *json.UnmarshalTypeError
+	)
+	if errors.As(err, &he) && he.Internal != nil {
+		err = he.Internal
+	}
+	switch {
+	case errors.As(err, &maxBytesErr):
+		return newAPIError(http.StatusRequestEntityTooLarge, ErrTooLarge, fmt.Sprintf("the request body is larger than %d bytes", maxBytesErr.Limit))
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		var problems fieldErrors
+		problems.add(typeErr.Field, "must be a %s", jsonTypeName(typeErr.Type.Kind().String()))
+		return problems.err()
+	default:
+		return newAPIError(http.StatusBadRequest, ErrInvalidBody, "unable to parse the request body")
+	}
+}
+
+// jsonTypeName returns the name of the JSON type that a Go kind is decoded
+// from.
+func jsonTypeName(kind string) string {
+	switch {
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "number"
+	case kind == "bool":
+		return "boolean"
+	case kind == "slice", kind == "array":
+		return "array"
+	case kind == "struct", kind == "map":
+		return "object"
+	default:
+		return kind
+	}
+}
+
+// parseDecimal parses a number from a request body as a decimal. Unlike
+// decoding it as a float, it keeps every digit and fails for values that have
+// more digits than the totals can hold. Problems are recorded against the
+// field, and nil is returned for them.
+func parseDecimal(problems *fieldErrors, field string, n json.Number) *apd.Decimal {
+	if n == "" {
+		problems.add(field, "must be set")
+		return nil
+	}
+
+	d, _, err := apd.NewFromString(string(n))
+	if err != nil || d.Form != apd.Finite {
+		problems.add(field, "must be a decimal number")
+		return nil
+	}
+
+	// Trailing zeros don't count towards either limit.
+	reduced := apd.New(0, 0)
+	reduced.Reduce(d)
+	if integerDigits := reduced.NumDigits() + int64(reduced.Exponent); integerDigits > maxDecimalIntegerDigits {
+		problems.add(field, "must have at most %d digits before the decimal point", maxDecimalIntegerDigits)
+		return nil
+	}
+	if reduced.Exponent < -maxDecimalPlaces {
+		problems.add(field, "must have at most %d decimal places", maxDecimalPlaces)
+		return nil
+	}
+
+	return d
+}
+
+// limitBodySize is middleware that rejects request bodies larger than the
+// limit with a 413. Bodies without a declared length are cut off at the limit,
+// and reading past it fails.
+func limitBodySize(limit int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			request := c.Request()
+			if request.ContentLength > limit {
+				return newAPIError(http.StatusRequestEntityTooLarge, ErrTooLarge, fmt.Sprintf("the request body is larger than %d bytes", limit))
+			}
+			request.Body = http.MaxBytesReader(c.Response(), request.Body, limit)
+			return next(c)
+		}
+	}
+}
+
+// checkUUIDParams is middleware that responds with a 400 if any of the path
+// parameters that identify records by UUID aren't UUIDs, rather than letting
+// the database reject them.
+func checkUUIDParams(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var problems fieldErrors
+		for _, name := range uuidParams {
+			value := c.Param(name)
+			if value == "" {
+				continue
+			}
+			if _, err := uuid.Parse(value); err != nil {
+				problems.add(name, "must be a UUID")
+			}
+		}
+		if err := problems.err(); err != nil {
+			return err
+		}
+		return next(c)
+	}
+}
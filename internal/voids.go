@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/guregu/null"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// inFlight returns true if a worker has claimed the work item but hasn't
+// finished processing it.
+func inFlight(item *db.CPUUsageWorkItem) bool {
+	return item.Processing || (item.Claimed && !item.Processed)
+}
+
+// compensate enqueues an event that applies the item's value to the same user
+// with the given event type, and returns its ID.
+func compensate(c echo.Context, d *db.Database, item *db.CPUUsageWorkItem, eventType db.EventType) (null.String, error) {
+	id, err := d.AddCPUUsageEventReturningID(c.Request().Context(), &db.CPUUsageEvent{
+		RecordDate:    time.Now(),
+		EffectiveDate: item.EffectiveDate,
+		EventType:     eventType,
+		Value:         item.Value,
+		CreatedBy:     item.CreatedBy,
+		Priority:      db.PriorityInteractive,
+
+		ResourceType:     item.ResourceType,
+		AllocationSource: item.AllocationSource,
+		Cluster:          item.Cluster,
+	})
+	return null.StringFrom(id), err
+}
+
+// setVoided voids or restores the work item named in the request path within
+// a single transaction, using fn to enqueue whatever work is needed to keep
+// the user's totals consistent, and returns the updated work item.
+func (a *App) setVoided(c echo.Context, voided bool, fn func(d *db.Database, item *db.CPUUsageWorkItem) (null.String, error)) error {
+	context := c.Request().Context()
+	id := c.Param("id")
+	log := log.WithFields(logrus.Fields{"context": "set work item voided", "id": id, "voided": voided}).WithContext(context)
+
+	tx, err := a.database.BeginTxx(context, nil)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Error(err)
+		}
+	}()
+
+	d := db.New(tx)
+	item, err := d.EventForUpdate(context, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusNotFound, "work item not found")
+	}
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if item.Voided == voided {
+		if voided {
+			return echo.NewHTTPError(http.StatusConflict, "the work item is already voided")
+		}
+		return echo.NewHTTPError(http.StatusConflict, "the work item isn't voided")
+	}
+	if inFlight(item) {
+		return newAPIError(http.StatusConflict, ErrInProgress, "the work item is being processed; try again once it's finished")
+	}
+
+	compensatingEventID, err := fn(d, item)
+	if err != nil {
+		return err
+	}
+
+	by := performedBy(c)
+	if err = d.SetEventVoided(context, id, voided, by, compensatingEventID); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if err = commit(tx); err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infof("work item voided set to %t by %s", voided, by)
+
+	updated, err := db.New(a.database).Event(context, id)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	return respond(c, http.StatusOK, updated)
+}
+
+// AdminVoidEventHandler is an echo request handler that voids a usage event.
+// The event is kept for auditing. If it had already been applied, an event
+// that reverses it is enqueued; otherwise it's simply never applied.
+func (a *App) AdminVoidEventHandler(c echo.Context) error {
+	return a.setVoided(c, true, func(d *db.Database, item *db.CPUUsageWorkItem) (null.String, error) {
+		if !item.Processed {
+			return null.String{}, nil
+		}
+
+		eventType, ok := db.CompensatingEventType(item.EventType)
+		if !ok {
+			return null.String{}, echo.NewHTTPError(
+				http.StatusConflict,
+				fmt.Sprintf("%s events can't be voided once they've been applied", item.EventType),
+			)
+		}
+
+		id, err := compensate(c, d, item, eventType)
+		if err != nil {
+			log.WithContext(c.Request().Context()).Error(err)
+		}
+		return id, err
+	})
+}
+
+// AdminUnvoidEventHandler is an echo request handler that restores a voided
+// usage event. If an event reversing it was enqueued and hasn't been claimed
+// yet, that event is voided instead; if it was already applied, the original
+// event's value is enqueued again.
+func (a *App) AdminUnvoidEventHandler(c echo.Context) error {
+	return a.setVoided(c, false, func(d *db.Database, item *db.CPUUsageWorkItem) (null.String, error) {
+		context := c.Request().Context()
+
+		if !item.CompensatingEventID.Valid {
+			return null.String{}, nil
+		}
+
+		compensating, err := d.EventForUpdate(context, item.CompensatingEventID.String)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			log.WithContext(context).Error(err)
+			return null.String{}, err
+		}
+
+		switch {
+		case errors.Is(err, sql.ErrNoRows) || compensating.Voided:
+			// The reversal was removed or voided separately, so the original
+			// event is still in effect.
+		case inFlight(compensating):
+			return null.String{}, newAPIError(
+				http.StatusConflict,
+				ErrInProgress,
+				"the event reversing the work item is being processed; try again once it's finished",
+			)
+		case !compensating.Processed:
+			err = d.SetEventVoided(context, compensating.ID, true, performedBy(c), null.String{})
+		default:
+			_, err = compensate(c, d, item, item.EventType)
+		}
+		if err != nil {
+			log.WithContext(context).Error(err)
+		}
+		return null.String{}, err
+	})
+}
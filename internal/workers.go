@@ -0,0 +1,315 @@
+package internal
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/backlog"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/ops"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// WorkerClaim is a work item claimed by a worker along with the claim's age.
+type WorkerClaim struct {
+	db.CPUUsageWorkItem
+	ClaimAgeSeconds float64 `json:"claim_age_seconds"`
+}
+
+// WorkerStatus is a registered worker along with the work items it has claimed.
+type WorkerStatus struct {
+	db.Worker
+	Claims []WorkerClaim `json:"claims"`
+}
+
+// WorkerListing is the response body for the worker listing endpoint.
+type WorkerListing struct {
+	Workers []WorkerStatus `json:"workers"`
+	Backlog int64          `json:"backlog"`
+}
+
+// WorkItemPage is a single page of work items.
+type WorkItemPage struct {
+	WorkItems []db.CPUUsageWorkItem `json:"work_items"`
+	Status    string                `json:"status,omitempty"`
+	Cluster   string                `json:"cluster,omitempty"`
+	Backlog   int64                 `json:"backlog"`
+	Limit     int                   `json:"limit"`
+	Offset    int                   `json:"offset"`
+}
+
+func (p *WorkItemPage) csvHeader() []string {
+	return []string{
+		"id", "record_date", "effective_date", "event_type", "value", "created_by", "last_modified", "priority",
+		"claimed", "claimed_by", "claim_expires_on", "claimed_on", "processed", "processing", "processed_on",
+		"max_processing_attempts", "attempts", "resource_type", "allocation_source",
+		"voided", "voided_by", "voided_on", "compensating_event_id", "cluster",
+	}
+}
+
+func (p *WorkItemPage) csvRecords() [][]string {
+	records := make([][]string, 0, len(p.WorkItems))
+	for _, item := range p.WorkItems {
+		records = append(records, []string{
+			item.ID,
+			csvTime(item.RecordDate),
+			csvTime(item.EffectiveDate),
+			string(item.EventType),
+			decimalString(&item.Value),
+			item.CreatedBy,
+			item.LastModified,
+			strconv.Itoa(item.Priority),
+			strconv.FormatBool(item.Claimed),
+			item.ClaimedBy.String,
+			csvNullTime(item.ClaimExpiresOn),
+			csvNullTime(item.ClaimedOn),
+			strconv.FormatBool(item.Processed),
+			strconv.FormatBool(item.Processing),
+			csvNullTime(item.ProcessedOn),
+			strconv.Itoa(item.MaxProcessingAttempts),
+			strconv.Itoa(item.Attempts),
+			item.ResourceType,
+			item.AllocationSource,
+			strconv.FormatBool(item.Voided),
+			item.VoidedBy.String,
+			csvNullTime(item.VoidedOn),
+			item.CompensatingEventID.String,
+			item.Cluster.String,
+		})
+	}
+	return records
+}
+
+// claimAge returns the number of seconds since the work item was claimed.
+func claimAge(item *db.CPUUsageWorkItem, now time.Time) float64 {
+	if !item.ClaimedOn.Valid {
+		return 0
+	}
+	return now.Sub(item.ClaimedOn.Time).Seconds()
+}
+
+// AdminListWorkersHandler is an echo request handler that returns the
+// registered workers, the work items each has claimed, and the backlog depth.
+func (a *App) AdminListWorkersHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "list workers"}).WithContext(context)
+
+	d := db.New(a.database)
+
+	workers, err := d.ListWorkers(context)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	claims, err := d.ClaimedWorkItems(context)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	backlog, err := d.WorkItemBacklog(context)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	now := time.Now()
+	listing := &WorkerListing{
+		Workers: make([]WorkerStatus, 0, len(workers)),
+		Backlog: backlog,
+	}
+	for _, worker := range workers {
+		status := WorkerStatus{
+			Worker: worker,
+			Claims: make([]WorkerClaim, 0),
+		}
+		for _, item := range claims[worker.ID] {
+			status.Claims = append(status.Claims, WorkerClaim{
+				CPUUsageWorkItem: item,
+				ClaimAgeSeconds:  claimAge(&item, now),
+			})
+		}
+		listing.Workers = append(listing.Workers, status)
+	}
+
+	return respond(c, http.StatusOK, listing)
+}
+
+// AdminExpireWorkerHandler is an echo request handler that force-expires a
+// worker and releases its claims.
+func (a *App) AdminExpireWorkerHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "expire worker"}).WithContext(context)
+
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id must be set")
+	}
+
+	d := db.New(a.database)
+	found, err := d.ExpireWorker(context, id)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "worker not found")
+	}
+	log.Infof("force-expired worker %s", id)
+	a.events.Publish(context, ops.WorkerExpired, map[string]interface{}{
+		"worker_id":    id,
+		"forced":       true,
+		"performed_by": performedBy(c),
+	})
+
+	return c.NoContent(http.StatusOK)
+}
+
+// AdminListWorkItemsHandler is an echo request handler that returns a page of
+// work items, optionally filtered by the status and cluster query parameters.
+func (a *App) AdminListWorkItemsHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "list work items"}).WithContext(context)
+
+	limit, offset, err := pagination(c)
+	if err != nil {
+		return err
+	}
+
+	status := c.QueryParam("status")
+	if status != "" && !db.ValidWorkItemStatus(status) {
+		return echo.NewHTTPError(http.StatusBadRequest, "status must be one of pending, claimed, processing, processed, failed, or voided")
+	}
+
+	cluster := c.QueryParam("cluster")
+
+	d := db.New(a.database)
+
+	workItems, err := d.WorkItemsByStatus(context, status, cluster, limit, offset)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	backlog, err := d.WorkItemBacklog(context)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if workItems == nil {
+		workItems = make([]db.CPUUsageWorkItem, 0)
+	}
+
+	return respond(c, http.StatusOK, &WorkItemPage{
+		WorkItems: workItems,
+		Status:    status,
+		Cluster:   cluster,
+		Backlog:   backlog,
+		Limit:     limit,
+		Offset:    offset,
+	})
+}
+
+// AdminReleaseWorkClaimHandler is an echo request handler that force-expires
+// the claim on a work item so that another worker can pick it up.
+func (a *App) AdminReleaseWorkClaimHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "release work claim"}).WithContext(context)
+
+	id := c.Param("id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "id must be set")
+	}
+
+	d := db.New(a.database)
+	found, err := d.ReleaseWorkClaim(context, id)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if !found {
+		return echo.NewHTTPError(http.StatusNotFound, "unprocessed work item not found")
+	}
+	log.Infof("released the claim on work item %s", id)
+
+	return c.NoContent(http.StatusOK)
+}
+
+// AdminWorkItemBacklogHandler is an echo request handler that returns the
+// number of pending, claimed, and failed work items, along with whether the
+// message consumers are holding back their acknowledgements because too many
+// work items are pending.
+func (a *App) AdminWorkItemBacklogHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "work item backlog"}).WithContext(context)
+
+	if a.backlog != nil {
+		return respond(c, http.StatusOK, a.backlog.Status())
+	}
+
+	counts, err := db.New(a.database).CountWorkItems(context)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	now := time.Now()
+	return respond(c, http.StatusOK, &backlog.Status{
+		WorkItemCounts: *counts,
+		AckDelay:       time.Duration(0).String(),
+		CountedOn:      &now,
+	})
+}
+
+// WorkItemHistoryPage is a single page of processed work items.
+type WorkItemHistoryPage struct {
+	WorkItems []db.WorkItemHistoryEntry `json:"work_items"`
+	User      string                    `json:"user,omitempty"`
+	Cluster   string                    `json:"cluster,omitempty"`
+	Limit     int                       `json:"limit"`
+	Offset    int                       `json:"offset"`
+}
+
+// AdminWorkItemHistoryHandler is an echo request handler that returns a page
+// of processed work items, most recently processed first, optionally limited
+// to the user named in the user query parameter and the cluster named in the
+// cluster query parameter. Each item includes the worker that processed it and
+// the user's total afterwards.
+func (a *App) AdminWorkItemHistoryHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "work item history"}).WithContext(context)
+
+	limit, offset, err := pagination(c)
+	if err != nil {
+		return err
+	}
+
+	var user string
+	if v := c.QueryParam("user"); v != "" {
+		user = a.FixUsername(v)
+	}
+
+	cluster := c.QueryParam("cluster")
+
+	history, err := db.New(a.readDatabase).WorkItemHistory(context, user, cluster, limit, offset)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if history == nil {
+		history = make([]db.WorkItemHistoryEntry, 0)
+	}
+
+	return respond(c, http.StatusOK, &WorkItemHistoryPage{
+		WorkItems: history,
+		User:      user,
+		Cluster:   cluster,
+		Limit:     limit,
+		Offset:    offset,
+	})
+}
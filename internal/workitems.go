@@ -0,0 +1,162 @@
+package internal
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/guregu/null"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// maxEnqueuedWorkItems is the largest number of work items that can be
+// enqueued in a single request.
+const maxEnqueuedWorkItems = 1000
+
+// maxReportedProblems is the number of invalid fields that are described in
+// the response to a rejected request.
+const maxReportedProblems = 10
+
+// workItemOperations maps the operations accepted by the enqueue endpoint to
+// the event types of the work items that they enqueue.
+var workItemOperations = map[string]db.EventType{
+	"add":      db.CPUHoursAdd,
+	"subtract": db.CPUHoursSubtract,
+	"reset":    db.CPUHoursReset,
+}
+
+// WorkItemEntry is a single work item in a request to the enqueue endpoint. The
+// cluster is optional, and identifies where the usage being adjusted was
+// incurred.
+type WorkItemEntry struct {
+	Username  string      `json:"username"`
+	Operation string      `json:"operation"`
+	Value     json.Number `json:"value"`
+	Reason    string      `json:"reason"`
+	Cluster   string      `json:"cluster"`
+}
+
+// EnqueueResult is the response body for the work item enqueue endpoint.
+type EnqueueResult struct {
+	Enqueued int64 `json:"enqueued"`
+}
+
+// AdminEnqueueWorkItemsHandler is an echo request handler that enqueues a batch
+// of work items, e.g. to reset hundreds of course accounts at the end of a
+// semester. The request body is an array of WorkItemEntry values. Every entry
+// is validated before any are enqueued, and they're all enqueued in a single
+// transaction, so either the whole batch is enqueued or none of it is. The work
+// items are enqueued at backfill priority, so that a large batch doesn't hold
+// up the work items for analyses that are finishing.
+func (a *App) AdminEnqueueWorkItemsHandler(c echo.Context) error {
+	context := c.Request().Context()
+	log := log.WithFields(logrus.Fields{"context": "enqueue work items"}).WithContext(context)
+
+	var entries []WorkItemEntry
+	if err := bindBody(c, &entries); err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "at least one work item must be given")
+	}
+	if len(entries) > maxEnqueuedWorkItems {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("at most %d work items can be enqueued at once", maxEnqueuedWorkItems))
+	}
+
+	tx, err := a.database.BeginTxx(context, nil)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	defer func() {
+		if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+			log.Error(err)
+		}
+	}()
+
+	d := db.New(tx)
+
+	usernames := make([]string, len(entries))
+	for i := range entries {
+		usernames[i] = a.FixUsername(entries[i].Username)
+	}
+	userIDs, err := d.UserIDs(context, usernames)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	var problems fieldErrors
+
+	now := time.Now()
+	events := make([]db.CPUUsageEvent, 0, len(entries))
+	for i, entry := range entries {
+		field := func(name string) string { return fmt.Sprintf("%d.%s", i, name) }
+
+		eventType, ok := workItemOperations[strings.ToLower(entry.Operation)]
+		userID, found := userIDs[usernames[i]]
+		switch {
+		case entry.Username == "":
+			problems.add(field("username"), "must be set")
+		case !found:
+			problems.add(field("username"), "user not found: %s", entry.Username)
+		}
+		if !ok {
+			problems.add(field("operation"), "must be add, subtract, or reset")
+		}
+		if strings.TrimSpace(entry.Reason) == "" {
+			problems.add(field("reason"), "must be set")
+		}
+
+		// Resets don't need a value.
+		value := apd.New(0, 0)
+		if entry.Value != "" || eventType != db.CPUHoursReset {
+			value = parseDecimal(&problems, field("value"), entry.Value)
+		}
+		switch {
+		case value == nil:
+		case value.Sign() < 0:
+			problems.add(field("value"), "can't be negative")
+		case value.Sign() == 0 && eventType != db.CPUHoursReset:
+			problems.add(field("value"), "must be greater than zero")
+		}
+
+		if len(problems) > 0 {
+			continue
+		}
+		events = append(events, db.CPUUsageEvent{
+			RecordDate:    now,
+			EffectiveDate: now,
+			EventType:     eventType,
+			Value:         *value,
+			CreatedBy:     userID,
+			Priority:      db.PriorityBackfill,
+			Reason:        null.StringFrom(entry.Reason),
+			Cluster:       null.NewString(entry.Cluster, entry.Cluster != ""),
+		})
+	}
+
+	if err = problems.err(); err != nil {
+		return err
+	}
+
+	enqueued, err := d.InsertCPUUsageEvents(context, events)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if err = commit(tx); err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infof("%d work items enqueued by %s", enqueued, performedBy(c))
+
+	return respond(c, http.StatusCreated, &EnqueueResult{Enqueued: enqueued})
+}
@@ -0,0 +1,241 @@
+// Package jetstream is a messaging backend that consumes job status updates
+// from and publishes usage updates to NATS JetStream.
+package jetstream
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/transport"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "jetstream"})
+
+const otelName = "github.com/cyverse-de/resource-usage-api/jetstream"
+
+// requeueDelay is how long JetStream waits before redelivering a message that
+// failed with a transient error.
+const requeueDelay = 5 * time.Second
+
+// defaultAckWait is JetStream's own default for how long it waits for a
+// message to be acknowledged, used when AckWait isn't configured.
+const defaultAckWait = 30 * time.Second
+
+// defaultMaxAttempts is used when the maximum number of attempts isn't configured.
+const defaultMaxAttempts = 5
+
+// Configuration contains the settings for the JetStream backend.
+type Configuration struct {
+	// Stream is the JetStream stream that job status updates are published to.
+	Stream string
+
+	// Subject is the subject that job status updates are published on.
+	Subject string
+
+	// Durable is the name of the durable consumer. Every instance of the
+	// service shares it so that each update is processed once.
+	Durable string
+
+	// Workers is the maximum number of messages that are handled at the same
+	// time. Values less than 1 are treated as 1.
+	Workers int
+
+	// AckWait is how long JetStream waits for a message to be acknowledged
+	// before redelivering it. The wait is extended while a message is being
+	// handled, so it only needs to cover a stalled or lost instance.
+	AckWait time.Duration
+
+	// MaxAttempts is the number of times a message is delivered before
+	// JetStream gives up on it.
+	MaxAttempts int
+
+	// Archiver records each job status update that's consumed, if it's set.
+	Archiver transport.Archiver
+}
+
+// JetStream consumes job status updates from a JetStream stream.
+type JetStream struct {
+	js           nats.JetStreamContext
+	subscription *nats.Subscription
+	handler      transport.HandlerFn
+	archiver     transport.Archiver
+	workers      chan struct{}
+	ackWait      time.Duration
+}
+
+var _ transport.Transport = (*JetStream)(nil)
+
+// New creates a durable consumer for job status updates on the connection and
+// starts passing them to the handler.
+func New(nc *nats.Conn, config *Configuration, handler transport.HandlerFn) (*JetStream, error) {
+	js, err := nc.JetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	workers := config.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	ackWait := config.AckWait
+	if ackWait <= 0 {
+		ackWait = defaultAckWait
+	}
+	maxAttempts := config.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = defaultMaxAttempts
+	}
+
+	j := &JetStream{
+		js:       js,
+		handler:  handler,
+		archiver: config.Archiver,
+		workers:  make(chan struct{}, workers),
+		ackWait:  ackWait,
+	}
+
+	opts := []nats.SubOpt{
+		nats.Durable(config.Durable),
+		nats.ManualAck(),
+		nats.AckExplicit(),
+		nats.MaxDeliver(maxAttempts),
+		nats.MaxAckPending(workers),
+	}
+	if config.Stream != "" {
+		opts = append(opts, nats.BindStream(config.Stream))
+	}
+	if config.AckWait > 0 {
+		opts = append(opts, nats.AckWait(config.AckWait))
+	}
+
+	log.Debugf("subscribing to %s as %s", config.Subject, config.Durable)
+	j.subscription, err = js.QueueSubscribe(config.Subject, config.Durable, j.recv, opts...)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("done subscribing to %s as %s", config.Subject, config.Durable)
+
+	return j, nil
+}
+
+// recv handles a single message from the subscription.
+func (j *JetStream) recv(msg *nats.Msg) {
+	j.workers <- struct{}{}
+	go func() {
+		defer func() { <-j.workers }()
+
+		context := otel.GetTextMapPropagator().Extract(
+			context.Background(),
+			propagation.HeaderCarrier(http.Header(msg.Header)),
+		)
+		context, span := otel.Tracer(otelName).Start(context, msg.Subject+" process", trace.WithSpanKind(trace.SpanKindConsumer))
+		defer span.End()
+
+		stop := j.heartbeat(context, msg)
+		err := j.process(context, msg)
+		stop()
+
+		j.settle(context, msg, err)
+	}()
+}
+
+// heartbeat tells JetStream that the message is still being worked on every
+// third of the ack wait until the returned function is called, so that a
+// message whose handler waits on the database or QMS isn't redelivered to
+// another instance while it's still being handled.
+func (j *JetStream) heartbeat(context context.Context, msg *nats.Msg) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(j.ackWait / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := msg.InProgress(); err != nil {
+					log.WithContext(context).Errorf("unable to extend the ack wait for %s: %s", msg.Subject, err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// process parses and archives the job status update and passes it to the
+// handler.
+func (j *JetStream) process(context context.Context, msg *nats.Msg) error {
+	var log = log.WithContext(context)
+
+	log.Infof("%s is the body", string(msg.Data))
+
+	update, err := transport.ParseJobUpdate(msg.Data)
+	if err != nil {
+		return err
+	}
+
+	if j.archiver != nil {
+		if err = j.archiver.Archive(context, update, msg.Data); err != nil {
+			log.Errorf("unable to archive the job status update: %s", err)
+		}
+	}
+
+	return j.handler(context, update.Job.UUID, update.State)
+}
+
+// settle acknowledges, terminates, or schedules redelivery of the message
+// depending on the error returned while processing it.
+func (j *JetStream) settle(context context.Context, msg *nats.Msg, err error) {
+	var log = log.WithContext(context).WithFields(logrus.Fields{"subject": msg.Subject})
+
+	switch {
+	case err == nil:
+		err = msg.Ack()
+	case transport.IsPermanent(err):
+		log.Errorf("terminating delivery of message: %s", err)
+		err = msg.Term()
+	default:
+		log.Errorf("redelivering message after transient error: %s", err)
+		err = msg.NakWithDelay(requeueDelay)
+	}
+
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// Send publishes a message on a subject and waits for JetStream to acknowledge
+// it.
+func (j *JetStream) Send(context context.Context, subject string, data []byte) error {
+	msg := nats.NewMsg(subject)
+	msg.Data = data
+	msg.Header.Set("Content-Type", "application/json")
+	otel.GetTextMapPropagator().Inject(context, propagation.HeaderCarrier(http.Header(msg.Header)))
+
+	_, err := j.js.PublishMsg(msg, nats.Context(context))
+	return err
+}
+
+// Close stops consuming job status updates. The durable consumer is left in
+// place so that updates published in the meantime are delivered on restart.
+func (j *JetStream) Close() {
+	if err := j.subscription.Drain(); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,124 @@
+// Package kafka mirrors usage events to Kafka topics so that they can be
+// streamed into other systems.
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	kafkago "github.com/segmentio/kafka-go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "kafka"})
+
+// defaultWriteTimeout is used when no write timeout is configured.
+const defaultWriteTimeout = 10 * time.Second
+
+// Config contains the settings for the Kafka producer.
+type Config struct {
+	// Brokers are the addresses of the Kafka brokers.
+	Brokers []string
+
+	// UsageTopic receives every usage record that's calculated and sent to QMS.
+	UsageTopic string
+
+	// UpdatesTopic receives every usage update that QMS reports as committed.
+	UpdatesTopic string
+
+	// WriteTimeout is how long to wait for the brokers to acknowledge a message.
+	WriteTimeout time.Duration
+}
+
+// Producer writes usage events to Kafka. Messages are keyed by username, so
+// the events for a user stay in order within a partition.
+type Producer struct {
+	usage   *kafkago.Writer
+	updates *kafkago.Writer
+}
+
+var _ cpuhours.Mirror = (*Producer)(nil)
+
+func newWriter(config *Config, topic string) *kafkago.Writer {
+	if topic == "" {
+		return nil
+	}
+
+	timeout := config.WriteTimeout
+	if timeout <= 0 {
+		timeout = defaultWriteTimeout
+	}
+
+	return &kafkago.Writer{
+		Addr:         kafkago.TCP(config.Brokers...),
+		Topic:        topic,
+		Balancer:     &kafkago.Hash{},
+		RequiredAcks: kafkago.RequireAll,
+		WriteTimeout: timeout,
+
+		// Each event is written synchronously while its update is being
+		// published, so it's sent on its own rather than waiting up to the
+		// default batch timeout of a second for more messages.
+		BatchSize: 1,
+	}
+}
+
+// New returns a new *Producer. Events for a topic that isn't configured are
+// discarded.
+func New(config *Config) *Producer {
+	return &Producer{
+		usage:   newWriter(config, config.UsageTopic),
+		updates: newWriter(config, config.UpdatesTopic),
+	}
+}
+
+// MirrorUsage writes a usage event to the usage topic.
+func (p *Producer) MirrorUsage(context context.Context, event *cpuhours.UsageEvent) error {
+	if p.usage == nil {
+		return nil
+	}
+
+	value, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	return p.usage.WriteMessages(context, kafkago.Message{
+		Key:   []byte(event.Username),
+		Value: value,
+	})
+}
+
+// MirrorUpdate writes a committed QMS update to the updates topic.
+func (p *Producer) MirrorUpdate(context context.Context, update *qms.Update) error {
+	if p.updates == nil {
+		return nil
+	}
+
+	value, err := protojson.Marshal(update)
+	if err != nil {
+		return err
+	}
+
+	return p.updates.WriteMessages(context, kafkago.Message{
+		Key:   []byte(update.GetUser().GetUsername()),
+		Value: value,
+	})
+}
+
+// Close flushes any pending messages and closes the connections to the brokers.
+func (p *Producer) Close() {
+	for _, w := range []*kafkago.Writer{p.usage, p.updates} {
+		if w == nil {
+			continue
+		}
+		if err := w.Close(); err != nil {
+			log.Error(err)
+		}
+	}
+}
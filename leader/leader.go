@@ -0,0 +1,141 @@
+// Package leader elects a single instance of the service to run the background
+// tasks that must not run on more than one replica at a time.
+//
+// Leadership is held by keeping a session-level Postgres advisory lock on a
+// dedicated database connection. If the instance holding the lock goes away,
+// the database closes its session and releases the lock, and another instance
+// acquires it on its next attempt.
+package leader
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/jmoiron/sqlx"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "leader"})
+
+// Elector competes for leadership with the other instances that use the same
+// lock name.
+type Elector struct {
+	db       *sqlx.DB
+	name     string
+	key      int64
+	interval time.Duration
+
+	mutex   sync.Mutex
+	conn    *sql.Conn
+	leading bool
+}
+
+// lockKey converts a lock name to an advisory lock key.
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+// New returns a new *Elector for the lock name. Leadership is checked for and
+// verified every interval.
+func New(db *sqlx.DB, name string, interval time.Duration) *Elector {
+	return &Elector{
+		db:       db,
+		name:     name,
+		key:      lockKey(name),
+		interval: interval,
+	}
+}
+
+// IsLeader returns true if this instance currently holds the lock. A nil
+// *Elector is always the leader, so that tasks behave as they did on a single
+// instance when no election is configured.
+func (e *Elector) IsLeader() bool {
+	if e == nil {
+		return true
+	}
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.leading
+}
+
+// check verifies that the lock is still held or tries to acquire it.
+func (e *Elector) check(context context.Context) {
+	log := log.WithFields(logrus.Fields{"context": "leader election", "lock": e.name}).WithContext(context)
+
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.conn != nil {
+		err := e.conn.PingContext(context)
+		if err == nil {
+			return
+		}
+		log.Errorf("lost leadership: %s", err)
+		e.conn.Close()
+		e.conn = nil
+		e.leading = false
+	}
+
+	conn, err := e.db.Conn(context)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	var acquired bool
+	if err = conn.QueryRowContext(context, "SELECT pg_try_advisory_lock($1)", e.key).Scan(&acquired); err != nil {
+		log.Error(err)
+		conn.Close()
+		return
+	}
+	if !acquired {
+		conn.Close()
+		return
+	}
+
+	log.Info("acquired leadership")
+	e.conn = conn
+	e.leading = true
+}
+
+// release gives up leadership if this instance holds it.
+func (e *Elector) release() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.conn == nil {
+		return
+	}
+
+	if _, err := e.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", e.key); err != nil {
+		log.Error(err)
+	}
+	e.conn.Close()
+	e.conn = nil
+	e.leading = false
+}
+
+// Run competes for leadership until the context is canceled, at which point
+// leadership is released.
+func (e *Elector) Run(context context.Context) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	defer e.release()
+
+	for {
+		e.check(context)
+
+		select {
+		case <-context.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package locale translates the text of the notifications sent to users, such
+// as the weekly usage digests, into the language that each user prefers.
+//
+// Locales are identified by their base language, so preferences such as pt-BR
+// or es_MX are matched to pt and es. Text for a locale that isn't supported is
+// written in English.
+package locale
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default is the locale used when a user hasn't chosen one, or has chosen one
+// that isn't supported.
+const Default = "en"
+
+// Message identifies a piece of translated text.
+type Message string
+
+// The translated messages. Each one is a format string whose arguments are
+// described alongside it.
+const (
+	// DigestSubject is the subject of a weekly digest. It's given the period
+	// label for the week.
+	DigestSubject Message = "digest.subject"
+
+	// DigestMessage is the body of a weekly digest. It's given the formatted
+	// amount used, the resource name, and the period label for the week.
+	DigestMessage Message = "digest.message"
+
+	// WeekOf is the label for the week beginning on a date. It's given the
+	// formatted date.
+	WeekOf Message = "period.week_of"
+)
+
+// catalog contains the text and formatting rules for a locale.
+type catalog struct {
+	messages  map[Message]string
+	resources map[string]string
+	months    [12]string
+	decimal   string
+	date      func(c *catalog, t time.Time) string
+}
+
+// longDate formats a date as "2 de marzo de 2026", which is used by both Spanish
+// and Portuguese.
+func longDate(c *catalog, t time.Time) string {
+	return fmt.Sprintf("%d de %s de %d", t.Day(), c.months[t.Month()-1], t.Year())
+}
+
+var catalogs = map[string]*catalog{
+	"en": {
+		messages: map[Message]string{
+			DigestSubject: "Your CPU usage for the %s",
+			DigestMessage: "You used %s %s during the %s.",
+			WeekOf:        "week of %s",
+		},
+		resources: map[string]string{
+			"cpu.hours":   "CPU hours",
+			"gpu.hours":   "GPU hours",
+			"mem.gbhours": "memory GB hours",
+			"data.bytes":  "bytes of data storage",
+		},
+		decimal: ".",
+		date: func(_ *catalog, t time.Time) string {
+			return t.Format(time.DateOnly)
+		},
+	},
+	"es": {
+		messages: map[Message]string{
+			DigestSubject: "Su uso de CPU de la %s",
+			DigestMessage: "Usó %s %s durante la %s.",
+			WeekOf:        "semana del %s",
+		},
+		resources: map[string]string{
+			"cpu.hours":   "horas de CPU",
+			"gpu.hours":   "horas de GPU",
+			"mem.gbhours": "GB-hora de memoria",
+			"data.bytes":  "bytes de almacenamiento de datos",
+		},
+		months: [12]string{
+			"enero", "febrero", "marzo", "abril", "mayo", "junio",
+			"julio", "agosto", "septiembre", "octubre", "noviembre", "diciembre",
+		},
+		decimal: ",",
+		date:    longDate,
+	},
+	"pt": {
+		messages: map[Message]string{
+			DigestSubject: "Seu uso de CPU na %s",
+			DigestMessage: "Você usou %s %s durante a %s.",
+			WeekOf:        "semana de %s",
+		},
+		resources: map[string]string{
+			"cpu.hours":   "horas de CPU",
+			"gpu.hours":   "horas de GPU",
+			"mem.gbhours": "GB-hora de memória",
+			"data.bytes":  "bytes de armazenamento de dados",
+		},
+		months: [12]string{
+			"janeiro", "fevereiro", "março", "abril", "maio", "junho",
+			"julho", "agosto", "setembro", "outubro", "novembro", "dezembro",
+		},
+		decimal: ",",
+		date:    longDate,
+	},
+}
+
+// Supported returns the supported locales in alphabetical order.
+func Supported() []string {
+	locales := make([]string, 0, len(catalogs))
+	for name := range catalogs {
+		locales = append(locales, name)
+	}
+	sort.Strings(locales)
+	return locales
+}
+
+// Match returns the supported locale for a language tag such as pt-BR, and
+// false if there isn't one.
+func Match(tag string) (string, bool) {
+	base := strings.ToLower(strings.TrimSpace(tag))
+	if i := strings.IndexAny(base, "-_"); i >= 0 {
+		base = base[:i]
+	}
+	_, ok := catalogs[base]
+	return base, ok
+}
+
+// Localizer writes text for a single locale.
+type Localizer struct {
+	locale  string
+	catalog *catalog
+}
+
+// New returns a *Localizer for the locale that matches the language tag, or
+// for the fallback if none does. The default locale is used if neither is
+// supported.
+func New(tag, fallback string) *Localizer {
+	for _, t := range []string{tag, fallback} {
+		if name, ok := Match(t); ok {
+			return &Localizer{locale: name, catalog: catalogs[name]}
+		}
+	}
+	return &Localizer{locale: Default, catalog: catalogs[Default]}
+}
+
+// Locale returns the name of the locale that the text is written for.
+func (l *Localizer) Locale() string {
+	return l.locale
+}
+
+// Text returns a message formatted with the arguments.
+func (l *Localizer) Text(message Message, args ...interface{}) string {
+	format, ok := l.catalog.messages[message]
+	if !ok {
+		format = catalogs[Default].messages[message]
+	}
+	return fmt.Sprintf(format, args...)
+}
+
+// ResourceName returns the name of a resource type, such as "CPU hours" for
+// cpu.hours. The resource type itself is returned if it doesn't have a name.
+func (l *Localizer) ResourceName(resourceType string) string {
+	if name, ok := l.catalog.resources[resourceType]; ok {
+		return name
+	}
+	return resourceType
+}
+
+// Date formats the date part of a time.
+func (l *Localizer) Date(t time.Time) string {
+	return l.catalog.date(l.catalog, t)
+}
+
+// Number formats a number with two decimal places.
+func (l *Localizer) Number(value float64) string {
+	return strings.Replace(strconv.FormatFloat(value, 'f', 2, 64), ".", l.catalog.decimal, 1)
+}
@@ -1,6 +1,7 @@
 package logging
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/sirupsen/logrus"
@@ -10,32 +11,66 @@ var Log = logrus.WithFields(logrus.Fields{
 	"service": "resource-usage-api",
 })
 
-func SetupLogging(configuredLevel string) {
-	var level logrus.Level
-
-	formatter := new(logrus.TextFormatter)
-	formatter.TimestampFormat = "2006-01-02 15:04:05.9999"
-	formatter.FullTimestamp = true
-
-	switch configuredLevel {
+// parseLevel returns the logrus level with the given name.
+func parseLevel(name string) (logrus.Level, error) {
+	switch name {
 	case "trace":
-		level = logrus.TraceLevel
+		return logrus.TraceLevel, nil
 	case "debug":
-		level = logrus.DebugLevel
+		return logrus.DebugLevel, nil
 	case "info":
-		level = logrus.InfoLevel
+		return logrus.InfoLevel, nil
 	case "warn":
-		level = logrus.WarnLevel
+		return logrus.WarnLevel, nil
 	case "error":
-		level = logrus.ErrorLevel
+		return logrus.ErrorLevel, nil
 	case "fatal":
-		level = logrus.FatalLevel
+		return logrus.FatalLevel, nil
 	case "panic":
-		level = logrus.PanicLevel
+		return logrus.PanicLevel, nil
 	default:
+		return 0, fmt.Errorf("incorrect log level: %s", name)
+	}
+}
+
+func SetupLogging(configuredLevel string) {
+	formatter := new(logrus.TextFormatter)
+	formatter.TimestampFormat = "2006-01-02 15:04:05.9999"
+	formatter.FullTimestamp = true
+
+	level, err := parseLevel(configuredLevel)
+	if err != nil {
 		log.Fatal("incorrect log level")
 	}
 
 	Log.Logger.SetLevel(level)
 	Log.Logger.SetFormatter(formatter)
 }
+
+// SetLevel changes the log level while the service is running. The name must
+// be one of the levels accepted by SetupLogging.
+func SetLevel(name string) error {
+	level, err := parseLevel(name)
+	if err != nil {
+		return err
+	}
+	Log.Logger.SetLevel(level)
+	return nil
+}
+
+// ValidLevel returns an error if the name isn't one of the levels accepted by
+// SetupLogging.
+func ValidLevel(name string) error {
+	_, err := parseLevel(name)
+	return err
+}
+
+// Level returns the name of the current log level, in the form accepted by
+// SetLevel.
+func Level() string {
+	level := Log.Logger.GetLevel()
+	if level == logrus.WarnLevel {
+		return "warn"
+	}
+	return level.String()
+}
@@ -1,19 +1,45 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/cyverse-de/messaging/v9"
 	"github.com/cyverse-de/resource-usage-api/amqp"
+	"github.com/cyverse-de/resource-usage-api/anomaly"
+	"github.com/cyverse-de/resource-usage-api/archive"
+	"github.com/cyverse-de/resource-usage-api/backlog"
+	"github.com/cyverse-de/resource-usage-api/cache"
+	"github.com/cyverse-de/resource-usage-api/calculator"
+	"github.com/cyverse-de/resource-usage-api/clients"
 	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/datausage"
 	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/digest"
+	"github.com/cyverse-de/resource-usage-api/drift"
+	"github.com/cyverse-de/resource-usage-api/enforcement"
+	"github.com/cyverse-de/resource-usage-api/faults"
 	"github.com/cyverse-de/resource-usage-api/internal"
+	"github.com/cyverse-de/resource-usage-api/jetstream"
+	"github.com/cyverse-de/resource-usage-api/kafka"
+	"github.com/cyverse-de/resource-usage-api/leader"
 	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/migrations"
+	"github.com/cyverse-de/resource-usage-api/ops"
+	"github.com/cyverse-de/resource-usage-api/quotas"
+	"github.com/cyverse-de/resource-usage-api/resets"
+	"github.com/cyverse-de/resource-usage-api/slurm"
+	"github.com/cyverse-de/resource-usage-api/transport"
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/koanf"
 	"github.com/nats-io/nats.go"
@@ -25,41 +51,87 @@ import (
 	"github.com/cyverse-de/go-mod/otelutils"
 	"github.com/cyverse-de/go-mod/protobufjson"
 	"github.com/uptrace/opentelemetry-go-extra/otellogrus"
-	"github.com/uptrace/opentelemetry-go-extra/otelsql"
-	"github.com/uptrace/opentelemetry-go-extra/otelsqlx"
-	semconv "go.opentelemetry.io/otel/semconv/v1.7.0"
-
-	_ "expvar"
-
-	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const serviceName = "resource-usage-api"
 
 var log = logging.Log.WithFields(logrus.Fields{"package": "main"})
 
-func getHandler(dbClient *sqlx.DB, nc *nats.EncodedConn) amqp.HandlerFn {
-	dedb := db.New(dbClient)
-	cpuhours := cpuhours.New(dedb, nc)
+// dryRunSuffix is appended to the names of the AMQP queues and the JetStream
+// durable consumer in dry-run mode. A dry-run instance gets its own copy of
+// each job status update instead of taking updates from the instances that
+// charge for them.
+const dryRunSuffix = "-dry-run"
+
+// The supported values for the messaging.transport setting.
+const (
+	transportAMQP      = "amqp"
+	transportJetStream = "jetstream"
+)
 
-	return func(context context.Context, externalID string, state messaging.JobState) {
+// getHandler returns the handler for job status updates. The behaviors map the
+// lowercased job states to what's done when an update with that state arrives;
+// updates with states that aren't mapped are ignored.
+func getHandler(cpuhours *cpuhours.CPUHours, behaviors map[string]string) transport.HandlerFn {
+	return func(context context.Context, externalID string, state messaging.JobState) error {
 		var err error
 
-		log = log.WithFields(logrus.Fields{"externalID": externalID}).WithContext(context)
+		// The transport extracts the trace context from the message headers, so
+		// this span is a child of the span that published the update if there
+		// was one, and the root of a new trace otherwise.
+		context, span := otel.Tracer(serviceName).Start(context, "handle job status update", trace.WithAttributes(
+			attribute.String("job.external_id", externalID),
+			attribute.String("job.state", string(state)),
+		))
+		defer span.End()
+
+		log := log.WithFields(logrus.Fields{"externalID": externalID}).WithContext(context)
 
-		if state == messaging.FailedState || state == messaging.SucceededState {
+		switch behaviors[strings.ToLower(string(state))] {
+		case behaviorCalculate:
 			log.Debug("calculating CPU hours for analysis")
-			if err = cpuhours.CalculateForAnalysis(context, externalID); err != nil {
-				log.Error(err)
-			}
+			err = cpuhours.CalculateForAnalysis(context, externalID)
 			log.Debug("done calculating CPU hours for analysis")
-		} else {
+		case behaviorHold:
+			log.Debug("placing a hold for analysis")
+			err = cpuhours.PlaceHoldForAnalysis(context, externalID)
+			log.Debug("done placing a hold for analysis")
+		default:
 			log.Debugf("received status is %s, ignoring", state)
 		}
+
+		if err != nil {
+			log.Error(err)
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			return classifyError(err)
+		}
+
+		return nil
+	}
+}
+
+// classifyError marks errors that will recur no matter how many times the
+// message is processed as permanent. Everything else is assumed to be
+// transient, such as a database or NATS outage.
+func classifyError(err error) error {
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, cpuhours.ErrNoStartDate) {
+		return transport.Permanent(err)
 	}
+	return err
 }
 
 func main() {
+	// The admin subcommands have their own flags, so they're dispatched before
+	// the service's flags are parsed.
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		os.Exit(runAdmin(os.Args[2:]))
+	}
+
 	var (
 		err    error
 		config *koanf.Koanf
@@ -77,9 +149,27 @@ func main() {
 		listenPort      = flag.Int("port", 60000, "The port the service listens on for requests")
 		queue           = flag.String("queue", serviceName, "The AMQP queue name for this service")
 		reconnect       = flag.Bool("reconnect", false, "Whether the AMQP client should reconnect on failure")
+		amqpPrefetch    = flag.Int("amqp-prefetch", 16, "The maximum number of unacknowledged AMQP messages delivered to this service; 0 means unlimited")
+		amqpWorkers     = flag.Int("amqp-workers", 4, "The number of AMQP messages handled concurrently")
+		amqpAttempts    = flag.Int("amqp-max-attempts", 5, "The number of times a failing AMQP message is processed before it's dead-lettered")
+		publishTimeout  = flag.Duration("amqp-publish-timeout", 10*time.Second, "How long to wait for the AMQP broker to confirm a published message")
 		logLevel        = flag.String("log-level", "info", "One of trace, debug, info, warn, error, fatal, or panic.")
 		usageRoutingKey = flag.String("usage-routing-key", "qms.usages", "The routing key to use when sending usage updates over AMQP")
+		workerLifetime  = flag.Duration("worker-lifetime", 5*time.Minute, "How long this service's worker registration lasts without being refreshed")
+		recoveryPeriod  = flag.Duration("recovery-interval", time.Minute, "How often to refresh the worker registration and take over orphaned calculations")
+		maxAttempts     = flag.Int("max-calculation-attempts", 5, "The number of times a calculation is attempted before it's abandoned")
+		totalsCacheTTL  = flag.Duration("totals-cache-ttl", 10*time.Second, "How long current usage totals are cached; 0 disables caching")
+		migrate         = flag.Bool("migrate", false, "Apply the embedded database migrations at startup")
+		dryRun          = flag.Bool("dry-run", false, "Calculate and log usages without sending them anywhere or recording them")
+		leaderInterval  = flag.Duration("leader-interval", 15*time.Second, "How often to try to become, or confirm that this instance is, the leader for singleton background tasks")
+		httpTLSCert     = flag.String("http-tlscert", "", "Path to the TLS cert file for the HTTP listener; HTTPS is served if it's set")
+		httpTLSKey      = flag.String("http-tlskey", "", "Path to the TLS key file for the HTTP listener")
+		httpClientCA    = flag.String("http-tlsca", "", "Path to the CA file used to verify HTTP client certificates")
+		requireClient   = flag.Bool("http-require-client-cert", false, "Reject HTTPS clients that don't present a certificate signed by the HTTP client CA")
 		dataUsageBase   = flag.String("data-usage-base-url", "http://data-usage-api", "The base URL for contacting the data-usage-api service")
+		diagnosticsPort = flag.Int("diagnostics-port", 0, "The port that pprof profiles and expvar variables are served on; 0 disables them")
+		adminPort       = flag.Int("admin-port", 0, "The port that the admin routes, pprof profiles, and expvar variables are served on; 0 serves the admin routes on the main port")
+		adminAddress    = flag.String("admin-address", "", "The address of the interface that the admin port is bound to; all interfaces if it's empty")
 	)
 
 	flag.Parse()
@@ -93,6 +183,10 @@ func main() {
 	shutdown := otelutils.TracerProviderFromEnv(tracerCtx, serviceName, func(e error) { log.Fatal(e) })
 	defer shutdown()
 
+	if *diagnosticsPort > 0 {
+		go serveDiagnostics(*diagnosticsPort)
+	}
+
 	nats.RegisterEncoder("protojson", protobufjson.NewCodec(protobufjson.WithEmitUnpopulated()))
 
 	log.Infof("config path is %s", *configPath)
@@ -103,83 +197,96 @@ func main() {
 	log.Infof("NATS creds file is %s", *credsPath)
 	log.Infof("dotenv file is %s", *dotEnvPath)
 
-	config, err = cfg.Init(&cfg.Settings{
+	configSettings := &cfg.Settings{
 		EnvPrefix:   *envPrefix,
 		ConfigPath:  *configPath,
 		DotEnvPath:  *dotEnvPath,
 		StrictMerge: false,
 		FileType:    cfg.YAML,
-	})
+	}
+	config, err = cfg.Init(configSettings)
 	if err != nil {
 		log.Fatal(err)
 	}
 	log.Infof("done reading configuration from %s", *configPath)
 
-	dbURI := config.String("db.uri")
-	if dbURI == "" {
-		log.Fatal("db.uri must be set in the configuration file")
+	if problems := validateConfiguration(config, *envPrefix); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Error(problem)
+		}
+		log.Fatalf("found %d problems in the configuration", len(problems))
 	}
 
-	amqpURI := config.String("amqp.uri")
-	if amqpURI == "" {
-		log.Fatal("amqp.uri must be set in the configuration file")
+	if configuredLevel := config.String("log.level"); configuredLevel != "" {
+		if err = logging.SetLevel(configuredLevel); err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("log level from the configuration: %s", configuredLevel)
 	}
-
-	amqpExchange := config.String("amqp.exchange.name")
-	if amqpExchange == "" {
-		log.Fatal("amqp.exchange.name must be set in the configuration file")
+	tuned := &tunables{}
+	if faults.Enabled {
+		faultConfig := faultConfiguration(config)
+		faults.SetConfig(faultConfig)
+		tuned.faultConfig = faultConfig
+		log.Warnf(
+			"fault injection enabled: database commits %g, AMQP publishes %g, QMS updates %g",
+			faultConfig.DBCommit,
+			faultConfig.AMQPPublish,
+			faultConfig.QMSUpdate,
+		)
 	}
+	go reloadOnHangup(tracerCtx, configSettings, *logLevel, tuned)
 
-	amqpExchangeType := config.String("amqp.exchange.type")
-	if amqpExchangeType == "" {
-		log.Fatal("amqp.exchange.type must be set in the configuration file")
-	}
+	dbURI := config.String("db.uri")
 
-	userSuffix := config.String("users.domain")
-	if userSuffix == "" {
-		log.Fatal("users.domain must be set in the configuration file")
+	transportName := config.String("messaging.transport")
+	if transportName == "" {
+		transportName = transportAMQP
 	}
 
+	amqpURI := config.String("amqp.uri")
+	amqpExchange := config.String("amqp.exchange.name")
+	amqpExchangeType := config.String("amqp.exchange.type")
+	jetstreamSubject := config.String("jetstream.subject")
+	userSuffix := config.String("users.domain")
 	qmsEnabled := config.Bool("qms.enabled")
 	qmsBaseURL := config.String("qms.base")
+	natsCluster := config.String("nats.cluster")
+
+	if err = clients.ConfigureHTTP(httpConfiguration(config)); err != nil {
+		log.Fatal(err)
+	}
+
+	dbConfig := databaseConfig(config, dbURI)
 
-	if qmsEnabled {
-		if qmsBaseURL == "" {
-			log.Fatal("qms.base must be set in the configuration file if qms.enabled is true")
+	dbconn, err = db.Connect(dbConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Info("done connecting to the database")
+
+	var readDBConn *sqlx.DB
+	if replicaURI := config.String("db.replica_uri"); replicaURI != "" {
+		replicaConfig := *dbConfig
+		replicaConfig.URI = replicaURI
+		readDBConn, err = db.Connect(&replicaConfig)
+		if err != nil {
+			log.Fatal(err)
 		}
+		log.Info("done connecting to the read replica")
 	}
 
-	natsCluster := config.String("nats.cluster")
-	if natsCluster == "" {
-		log.Fatalf("The %sNATS_CLUSTER environment variable or nats.cluster configuration value must be set", *envPrefix)
+	if *migrate {
+		if err = migrations.Migrate(tracerCtx, dbconn.DB); err != nil {
+			log.Fatal(err)
+		}
+		log.Info("done migrating the database")
+	}
+	if err = migrations.CheckVersion(tracerCtx, dbconn.DB); err != nil {
+		log.Fatal(err)
 	}
 
-	dbconn = otelsqlx.MustConnect("postgres", dbURI,
-		otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
-	log.Info("done connecting to the database")
-	dbconn.SetMaxOpenConns(10)
-	dbconn.SetConnMaxIdleTime(time.Minute)
-
-	nc, err := nats.Connect(
-		natsCluster,
-		nats.UserCredentials(*credsPath),
-		nats.RootCAs(*caCert),
-		nats.ClientCert(*tlsCert, *tlsKey),
-		nats.RetryOnFailedConnect(true),
-		nats.MaxReconnects(*maxReconnects),
-		nats.ReconnectWait(time.Duration(*reconnectWait)*time.Second),
-		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
-			if err != nil {
-				log.Errorf("disconnected from nats: %s", err.Error())
-			}
-		}),
-		nats.ReconnectHandler(func(nc *nats.Conn) {
-			log.Infof("reconnected to %s", nc.ConnectedUrl())
-		}),
-		nats.ClosedHandler(func(nc *nats.Conn) {
-			log.Errorf("connection closed: %s", nc.LastError().Error())
-		}),
-	)
+	nc, err := connectNATS(natsCluster, *credsPath, *caCert, *tlsCert, *tlsKey, *maxReconnects, *reconnectWait)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -192,29 +299,413 @@ func main() {
 		log.Fatal(err)
 	}
 
-	amqpConfig := amqp.Configuration{
-		URI:           amqpURI,
-		Exchange:      amqpExchange,
-		ExchangeType:  amqpExchangeType,
-		Reconnect:     *reconnect,
-		Queue:         *queue,
-		PrefetchCount: 0,
+	dedb := db.New(dbconn)
+	calculatorConfig, err := calculatorConfiguration(config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	registry := calculator.NewRegistry()
+	if err = cpuhours.Register(registry, dedb, calculatorConfig); err != nil {
+		log.Fatal(err)
+	}
+
+	simulator, err := cpuhours.NewSimulator(dedb, calculatorConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	usageCalculator := cpuhours.New(dedb, natsClient, registry)
+	usageCalculator.SetDryRun(*dryRun)
+	if holdRuntime := config.Duration("holds.runtime"); holdRuntime > 0 {
+		log.Infof("analysis hold run time: %s", holdRuntime)
+		usageCalculator.SetHoldRuntime(holdRuntime)
+	}
+	if *dryRun {
+		log.Warn("dry-run mode is enabled; usages will not be sent to QMS, and job status updates are consumed with a separate queue or consumer")
 	}
 
-	log.Infof("AMQP exchange name: %s", amqpConfig.Exchange)
-	log.Infof("AMQP exchange type: %s", amqpConfig.ExchangeType)
-	log.Infof("AMQP reconnect: %v", amqpConfig.Reconnect)
-	log.Infof("AMQP queue name: %s", amqpConfig.Queue)
-	log.Infof("AMQP prefetch amount %d", amqpConfig.PrefetchCount)
+	if mode := config.String("usage_messages.mode"); mode != "" {
+		log.Infof("usage message mode: %s", mode)
+		log.Infof("usage message routing key: %s", *usageRoutingKey)
+		usageCalculator.SetMessages(&cpuhours.MessageConfig{
+			Mode:       cpuhours.MessageMode(mode),
+			RoutingKey: *usageRoutingKey,
+		})
+	}
+
+	if config.Bool("kafka.enabled") {
+		kafkaConfig := &kafka.Config{
+			Brokers:      config.Strings("kafka.brokers"),
+			UsageTopic:   config.String("kafka.usage_topic"),
+			UpdatesTopic: config.String("kafka.updates_topic"),
+			WriteTimeout: config.Duration("kafka.write_timeout"),
+		}
+		log.Infof("Kafka brokers: %s", strings.Join(kafkaConfig.Brokers, ", "))
+		log.Infof("Kafka usage topic: %s", kafkaConfig.UsageTopic)
+		log.Infof("Kafka updates topic: %s", kafkaConfig.UpdatesTopic)
+
+		producer := kafka.New(kafkaConfig)
+		defer producer.Close()
+		usageCalculator.SetMirror(producer)
+	}
+
+	var enforcer *enforcement.Enforcer
+	if config.Bool("enforcement.enabled") {
+		enforcementConfig := enforcementConfiguration(config)
+
+		log.Infof("enforcement routing key: %s", enforcementConfig.RoutingKey)
+		log.Infof("enforcement grace percentage: %f", enforcementConfig.GracePercentage)
+		log.Infof("enforcement overdraft allowance: %f", enforcementConfig.OverdraftAllowance)
+
+		enforcer = enforcement.New(natsClient, dedb, enforcementConfig)
+		tuned.enforcer, tuned.enforcerConfig = enforcer, enforcementConfig
+		usageCalculator.SetEnforcer(enforcer)
+	}
+
+	var events *ops.Publisher
+	if config.Bool("ops.enabled") {
+		opsRoutingKey := config.String("ops.routing_key")
+		if opsRoutingKey == "" {
+			opsRoutingKey = ops.DefaultRoutingKey
+		}
+		log.Infof("ops event routing key: %s", opsRoutingKey)
+		events = ops.New(serviceName, opsRoutingKey)
+	}
 
-	amqpClient, err := amqp.New(&amqpConfig, getHandler(dbconn, natsClient))
+	workerName, err := os.Hostname()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer amqpClient.Close()
-	log.Debug("after close")
+	workerID, err := dedb.RegisterWorker(tracerCtx, workerName, time.Now().Add(*workerLifetime))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = dedb.ActivateWorker(tracerCtx, workerID); err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("registered as worker %s (%s)", workerID, workerName)
+	usageCalculator.SetOwner(workerID)
+
+	elector := leader.New(dbconn, serviceName, *leaderInterval)
+	// A dry-run instance never becomes the leader, so the background tasks
+	// that change usage stay with the instances that charge for it.
+	if !*dryRun {
+		go elector.Run(tracerCtx)
+	}
+
+	recovery := cpuhours.NewRecovery(&cpuhours.RecoveryConfig{
+		WorkerID:    workerID,
+		WorkerName:  workerName,
+		Lifetime:    *workerLifetime,
+		Interval:    *recoveryPeriod,
+		MaxAttempts: *maxAttempts,
+	}, dedb, usageCalculator)
+	recovery.SetLeader(elector)
+	recovery.SetEvents(events)
+	go recovery.Run(tracerCtx)
+
+	// The retry queue also publishes the usage messages that couldn't be
+	// published, so it runs whenever usage messages are enabled.
+	if config.Bool("publish_retries.enabled") || config.String("usage_messages.mode") != "" {
+		retryConfig := retryConfiguration(config)
+
+		log.Infof("usage publish retry interval: %s", retryConfig.Interval)
+		log.Infof("usage publish retry base delay: %s", retryConfig.BaseDelay)
+		log.Infof("usage publish retry maximum delay: %s", retryConfig.MaxDelay)
+		log.Infof("usage publish retry batch size: %d", retryConfig.BatchSize)
+
+		usageCalculator.SetRetryPublishes(config.Bool("publish_retries.enabled"))
+		retryQueue := cpuhours.NewRetryQueue(retryConfig, dedb, usageCalculator)
+		retryQueue.SetLeader(elector)
+		tuned.retryQueue, tuned.retryConfig = retryQueue, retryConfig
+		go retryQueue.Run(tracerCtx)
+	}
+
+	archiveConfig := archiveConfiguration(config)
+	log.Infof("job status update archive retention: %s", archiveConfig.Retention)
+	log.Infof("job status update archive prune interval: %s", archiveConfig.Interval)
+
+	jobUpdateArchive := archive.New(archiveConfig, dedb)
+	jobUpdateArchive.SetLeader(elector)
+	tuned.archive, tuned.archiveConfig = jobUpdateArchive, archiveConfig
+	go jobUpdateArchive.Run(tracerCtx)
+
+	var monitor *backlog.Monitor
+	if config.Bool("backpressure.enabled") {
+		backlogConfig := backlogConfiguration(config)
+
+		log.Infof("work item backlog interval: %s", backlogConfig.Interval)
+		log.Infof("work item backlog threshold: %d", backlogConfig.Threshold)
+		log.Infof("work item backlog acknowledgement delay: %s", backlogConfig.AckDelay)
+
+		monitor = backlog.New(backlogConfig, dedb)
+		tuned.monitor, tuned.backlogConfig = monitor, backlogConfig
+		go monitor.Run(tracerCtx)
+	}
+
+	var (
+		dataUsageMaxAge time.Duration
+		syncer          *datausage.Syncer
+	)
+	if config.Bool("data_usage.sync.enabled") {
+		dataUsageConfig := dataUsageConfiguration(config)
+		dataUsageMaxAge = config.Duration("data_usage.max_age")
+		if dataUsageMaxAge == 0 {
+			dataUsageMaxAge = 2 * dataUsageConfig.Interval
+		}
+
+		log.Infof("data usage sync interval: %s", dataUsageConfig.Interval)
+		log.Infof("data usage maximum age: %s", dataUsageMaxAge)
+
+		dataUsageClient, err := clients.DataUsageAPIClient(*dataUsageBase)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		syncer = datausage.New(dataUsageConfig, dedb, dataUsageClient)
+		syncer.SetLeader(elector)
+		syncer.SetUserDomain(userSuffix)
+		tuned.syncer, tuned.dataUsageConfig = syncer, dataUsageConfig
+		go syncer.Run(tracerCtx)
+	}
 
-	log.Info("done connecting to the AMQP broker")
+	log.Infof("messaging transport: %s", transportName)
+
+	var (
+		amqpClient       *amqp.AMQP
+		messages         transport.Transport
+		jobUpdateHandler = getHandler(usageCalculator, stateBehaviors(config))
+	)
+	if transportName == transportAMQP {
+		amqpConfig := amqp.Configuration{
+			URI:            amqpURI,
+			Exchange:       amqpExchange,
+			ExchangeType:   amqpExchangeType,
+			Reconnect:      *reconnect,
+			Queue:          *queue,
+			PrefetchCount:  *amqpPrefetch,
+			Workers:        *amqpWorkers,
+			PublishTimeout: *publishTimeout,
+			MaxAttempts:    *amqpAttempts,
+			Archiver:       jobUpdateArchive,
+			Events:         events,
+		}
+		if monitor != nil {
+			amqpConfig.Backpressure = monitor
+		}
+
+		bindingHandlers := make(map[string]amqp.MessageHandlerFn)
+		if syncer != nil {
+			bindingHandlers[bindingHandlerDataUsage] = syncer.HandleEvent
+		}
+		if amqpConfig.Bindings, err = amqpBindings(config, bindingHandlers); err != nil {
+			log.Fatal(err)
+		}
+		if *dryRun {
+			amqpConfig.Queue += dryRunSuffix
+			for i := range amqpConfig.Bindings {
+				if amqpConfig.Bindings[i].Queue != "" {
+					amqpConfig.Bindings[i].Queue += dryRunSuffix
+				}
+			}
+		}
+
+		log.Infof("AMQP exchange name: %s", amqpConfig.Exchange)
+		log.Infof("AMQP exchange type: %s", amqpConfig.ExchangeType)
+		log.Infof("AMQP reconnect: %v", amqpConfig.Reconnect)
+		log.Infof("AMQP queue name: %s", amqpConfig.Queue)
+		log.Infof("AMQP prefetch amount %d", amqpConfig.PrefetchCount)
+		log.Infof("AMQP workers: %d", amqpConfig.Workers)
+		log.Infof("AMQP max attempts: %d", amqpConfig.MaxAttempts)
+
+		amqpClient, err = amqp.New(&amqpConfig, jobUpdateHandler)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer amqpClient.Close()
+		log.Debug("after close")
+		messages = amqpClient
+
+		log.Info("done connecting to the AMQP broker")
+	} else {
+		jetstreamConfig := jetstream.Configuration{
+			Stream:      config.String("jetstream.stream"),
+			Subject:     jetstreamSubject,
+			Durable:     config.String("jetstream.durable"),
+			Workers:     *amqpWorkers,
+			AckWait:     config.Duration("jetstream.ack_wait"),
+			MaxAttempts: *amqpAttempts,
+			Archiver:    jobUpdateArchive,
+		}
+		if jetstreamConfig.Durable == "" {
+			jetstreamConfig.Durable = serviceName
+		}
+		if *dryRun {
+			jetstreamConfig.Durable += dryRunSuffix
+		}
+
+		log.Infof("JetStream stream: %s", jetstreamConfig.Stream)
+		log.Infof("JetStream subject: %s", jetstreamConfig.Subject)
+		log.Infof("JetStream durable consumer: %s", jetstreamConfig.Durable)
+		log.Infof("JetStream workers: %d", jetstreamConfig.Workers)
+		log.Infof("JetStream max attempts: %d", jetstreamConfig.MaxAttempts)
+
+		jetstreamClient, err := jetstream.New(nc, &jetstreamConfig, jobUpdateHandler)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer jetstreamClient.Close()
+		messages = jetstreamClient
+
+		log.Info("done subscribing to JetStream")
+	}
+
+	if enforcer != nil {
+		enforcer.SetTransport(messages)
+	}
+	usageCalculator.SetMessageTransport(messages)
+
+	// The worker registered before there was a transport to report it with.
+	if events != nil {
+		events.SetTransport(messages)
+		events.Publish(tracerCtx, ops.WorkerRegistered, map[string]interface{}{
+			"worker_id":   workerID,
+			"worker_name": workerName,
+		})
+	}
+
+	if config.Bool("anomalies.enabled") {
+		anomalyConfig := anomalyConfiguration(config)
+
+		log.Infof("anomaly detection interval: %s", anomalyConfig.Interval)
+		log.Infof("anomaly baseline days: %d", anomalyConfig.BaselineDays)
+		log.Infof("anomaly factor: %f", anomalyConfig.Factor)
+		log.Infof("anomaly minimum CPU hours: %f", anomalyConfig.MinHours)
+		log.Infof("anomaly routing key: %s", anomalyConfig.RoutingKey)
+
+		detector := anomaly.New(anomalyConfig, dedb, messages)
+		detector.SetLeader(elector)
+		tuned.detector, tuned.anomalyConfig = detector, anomalyConfig
+		go detector.Run(tracerCtx)
+	}
+
+	if config.Bool("digests.enabled") {
+		digestConfig := digestConfiguration(config)
+
+		log.Infof("usage digest interval: %s", digestConfig.Interval)
+		log.Infof("usage digest routing key: %s", digestConfig.RoutingKey)
+		log.Infof("usage digest top analyses: %d", digestConfig.TopAnalyses)
+		log.Infof("usage digest email enabled: %t", digestConfig.Email)
+		if digestConfig.DefaultLocale != "" {
+			log.Infof("usage digest default locale: %s", digestConfig.DefaultLocale)
+		}
+
+		composer := digest.New(digestConfig, dedb, usageCalculator, natsClient, messages)
+		composer.SetLeader(elector)
+		tuned.composer, tuned.digestConfig = composer, digestConfig
+		go composer.Run(tracerCtx)
+	}
+
+	if config.Bool("slurm.enabled") {
+		slurmConfig := &slurm.Config{
+			Cluster:   config.String("slurm.cluster"),
+			SacctPath: config.String("slurm.sacct_path"),
+			Interval:  config.Duration("slurm.interval"),
+			Lookback:  config.Duration("slurm.lookback"),
+			Users:     config.StringMap("slurm.users"),
+			DryRun:    *dryRun,
+		}
+		if slurmConfig.SacctPath == "" {
+			slurmConfig.SacctPath = "sacct"
+		}
+		if slurmConfig.Interval == 0 {
+			slurmConfig.Interval = time.Hour
+		}
+		if slurmConfig.Lookback == 0 {
+			slurmConfig.Lookback = 24 * time.Hour
+		}
+
+		log.Infof("Slurm cluster: %s", slurmConfig.Cluster)
+		log.Infof("Slurm ingestion interval: %s", slurmConfig.Interval)
+		log.Infof("Slurm ingestion lookback: %s", slurmConfig.Lookback)
+		log.Infof("Slurm mapped users: %d", len(slurmConfig.Users))
+
+		ingester := slurm.New(slurmConfig, dedb, usageCalculator)
+		ingester.SetLeader(elector)
+		go ingester.Run(tracerCtx)
+	}
+
+	if config.Bool("qms_drift.enabled") {
+		driftConfig := driftConfiguration(config)
+
+		log.Infof("QMS drift comparison interval: %s", driftConfig.Interval)
+		log.Infof("QMS drift tolerance: %f", driftConfig.Tolerance)
+
+		comparer := drift.New(driftConfig, dedb, natsClient)
+		comparer.SetLeader(elector)
+		comparer.SetEvents(events)
+		tuned.comparer, tuned.driftConfig = comparer, driftConfig
+		go comparer.Run(tracerCtx)
+	}
+
+	var quotaMaxAge time.Duration
+	if config.Bool("qms_quotas.enabled") {
+		quotaConfig := quotaConfiguration(config)
+		quotaMaxAge = quotaConfig.MaxAge
+
+		log.Infof("QMS quota refresh interval: %s", quotaConfig.Interval)
+		log.Infof("QMS quota maximum age: %s", quotaConfig.MaxAge)
+
+		refresher := quotas.New(quotaConfig, dedb, natsClient)
+		refresher.SetLeader(elector)
+		tuned.refresher, tuned.quotaConfig = refresher, quotaConfig
+		go refresher.Run(tracerCtx)
+	}
+
+	if config.Bool("resets.enabled") {
+		resetConfig := resetConfiguration(config)
+
+		log.Infof("scheduled reset check interval: %s", resetConfig.Interval)
+		if resetConfig.Default != nil {
+			log.Infof("default reset schedule: %s", resetConfig.Default)
+		}
+
+		scheduler := resets.New(resetConfig, dedb)
+		scheduler.SetLeader(elector)
+		tuned.scheduler, tuned.resetConfig = scheduler, resetConfig
+		go scheduler.Run(tracerCtx)
+	}
+
+	if config.Bool("config_watch.enabled") {
+		go tuned.watch(tracerCtx, configSettings)
+	}
+
+	var sharedCache *cache.Redis
+	if redisURI := config.String("redis.uri"); redisURI != "" {
+		redisTTL := config.Duration("redis.ttl")
+		if redisTTL == 0 {
+			redisTTL = time.Minute
+		}
+		sharedCache, err = cache.NewRedis(redisURI, serviceName, redisTTL)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer sharedCache.Close()
+		log.Infof("Redis cache TTL: %s", redisTTL)
+	}
+
+	var corsConfig *internal.CORSConfiguration
+	if origins := config.Strings("cors.allowed_origins"); len(origins) > 0 {
+		corsConfig = &internal.CORSConfiguration{
+			AllowedOrigins:   origins,
+			AllowedMethods:   config.Strings("cors.allowed_methods"),
+			AllowedHeaders:   config.Strings("cors.allowed_headers"),
+			AllowCredentials: config.Bool("cors.allow_credentials"),
+			MaxAge:           config.Duration("cors.max_age"),
+		}
+		log.Infof("CORS allowed origins: %s", strings.Join(corsConfig.AllowedOrigins, ", "))
+	}
 
 	appConfig := &internal.AppConfiguration{
 		UserSuffix:          userSuffix,
@@ -224,13 +715,108 @@ func main() {
 		AMQPUsageRoutingKey: *usageRoutingKey,
 		QMSEnabled:          qmsEnabled,
 		QMSBaseURL:          qmsBaseURL,
+		ReadDatabase:        readDBConn,
+		TotalsCacheTTL:      *totalsCacheTTL,
+		SharedCache:         sharedCache,
+		CORS:                corsConfig,
+		Impersonators:       config.Strings("http.impersonators"),
+		Calculator:          usageCalculator,
+		JobUpdateHandler:    jobUpdateHandler,
+		DataUsageMaxAge:     dataUsageMaxAge,
+		SeparateAdmin:       *adminPort > 0,
+		Backlog:             monitor,
+		QuotaMaxAge:         quotaMaxAge,
+		MissingTotals:       config.String("totals.missing"),
+		MaxBodySize:         config.Int64("http.max_body_size"),
+		Simulator:           simulator,
+		Policy:              authorizationPolicy(config),
+		Anonymizer:          researchAnonymizer(config),
+		Events:              events,
+	}
+
+	if appConfig.MissingTotals != "" {
+		log.Infof("missing totals policy: %s", appConfig.MissingTotals)
+	}
+
+	if appConfig.MaxBodySize > 0 {
+		log.Infof("maximum request body size: %d bytes", appConfig.MaxBodySize)
+	}
+
+	if len(appConfig.Impersonators) > 0 {
+		log.Infof("services allowed to impersonate users: %s", strings.Join(appConfig.Impersonators, ", "))
+	}
+
+	if appConfig.Anonymizer != nil {
+		log.Info("anonymized research export enabled")
+	}
+
+	if appConfig.Policy != nil {
+		log.Infof("authorization policy: %d rules, default %s", len(appConfig.Policy.Rules), appConfig.Policy.Default)
 	}
 
 	app, err := internal.New(dbconn, appConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
+	go app.ListenForInvalidations(tracerCtx)
+	usageCalculator.SetInvalidator(app)
+
+	if *adminPort > 0 {
+		adminServer := &http.Server{
+			Addr:    net.JoinHostPort(*adminAddress, strconv.Itoa(*adminPort)),
+			Handler: app.AdminRouter(diagnosticsHandler()),
+		}
+		go func() {
+			log.Infof("serving the admin routes on %s", adminServer.Addr)
+			log.Fatal(adminServer.ListenAndServe())
+		}()
+	}
+
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%s", strconv.Itoa(*listenPort)),
+		Handler: app.Router(),
+	}
+
+	if *httpTLSCert == "" {
+		log.Infof("listening on port %d", *listenPort)
+		log.Fatal(server.ListenAndServe())
+	}
+
+	server.TLSConfig, err = httpTLSConfig(*httpClientCA, *requireClient)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Infof("listening for HTTPS on port %d", *listenPort)
+	log.Fatal(server.ListenAndServeTLS(*httpTLSCert, *httpTLSKey))
+}
+
+// httpTLSConfig returns the TLS settings for the HTTP listener. Client
+// certificates are verified against the CA file if one is given, and are
+// required if requireClientCert is true.
+func httpTLSConfig(clientCAPath string, requireClientCert bool) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if clientCAPath == "" {
+		if requireClientCert {
+			return nil, fmt.Errorf("a client CA file is required to verify client certificates")
+		}
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(clientCAPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAPath)
+	}
+
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
 
-	log.Infof("listening on port %d", *listenPort)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", strconv.Itoa(*listenPort)), app.Router()))
+	return tlsConfig, nil
 }
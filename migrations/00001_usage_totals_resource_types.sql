@@ -0,0 +1,14 @@
+-- +goose Up
+ALTER TABLE cpu_usage_totals
+    ADD COLUMN IF NOT EXISTS resource_type text NOT NULL DEFAULT 'cpu.hours',
+    ADD COLUMN IF NOT EXISTS allocation_source text NOT NULL DEFAULT 'default';
+
+CREATE INDEX IF NOT EXISTS cpu_usage_totals_user_resource_index
+    ON cpu_usage_totals (user_id, resource_type, allocation_source);
+
+-- +goose Down
+DROP INDEX IF EXISTS cpu_usage_totals_user_resource_index;
+
+ALTER TABLE cpu_usage_totals
+    DROP COLUMN IF EXISTS allocation_source,
+    DROP COLUMN IF EXISTS resource_type;
@@ -0,0 +1,12 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS slurm_ingested_jobs (
+    cluster text NOT NULL,
+    job_id text NOT NULL,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    cpu_hours numeric NOT NULL,
+    ingested_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (cluster, job_id)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS slurm_ingested_jobs;
@@ -0,0 +1,14 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS cpu_calculation_intents (
+    analysis_id uuid PRIMARY KEY REFERENCES jobs (id) ON DELETE CASCADE,
+    owner_id uuid REFERENCES cpu_usage_workers (id) ON DELETE SET NULL,
+    state text NOT NULL DEFAULT 'pending',
+    attempts integer NOT NULL DEFAULT 0,
+    last_modified timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS cpu_calculation_intents_state_index
+    ON cpu_calculation_intents (state);
+
+-- +goose Down
+DROP TABLE IF EXISTS cpu_calculation_intents;
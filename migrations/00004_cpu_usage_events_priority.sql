@@ -0,0 +1,13 @@
+-- +goose Up
+ALTER TABLE cpu_usage_events
+    ADD COLUMN IF NOT EXISTS priority integer NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS cpu_usage_events_claim_order_index
+    ON cpu_usage_events (priority DESC, record_date)
+    WHERE NOT claimed AND NOT processed;
+
+-- +goose Down
+DROP INDEX IF EXISTS cpu_usage_events_claim_order_index;
+
+ALTER TABLE cpu_usage_events
+    DROP COLUMN IF EXISTS priority;
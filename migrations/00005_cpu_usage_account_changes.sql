@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS cpu_usage_account_changes (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    operation text NOT NULL,
+    from_user_id uuid NOT NULL REFERENCES users (id),
+    to_user_id uuid NOT NULL REFERENCES users (id),
+    performed_by text NOT NULL,
+    performed_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    totals_moved bigint NOT NULL DEFAULT 0,
+    totals_merged bigint NOT NULL DEFAULT 0,
+    events_moved bigint NOT NULL DEFAULT 0,
+    ingested_jobs_moved bigint NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS cpu_usage_account_changes_performed_on_index
+    ON cpu_usage_account_changes (performed_on);
+
+-- +goose Down
+DROP TABLE IF EXISTS cpu_usage_account_changes;
@@ -0,0 +1,24 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS cpu_usage_frozen_users (
+    user_id uuid PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    frozen_by text NOT NULL,
+    frozen_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reason text NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS cpu_usage_parked_records (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    analysis_id uuid,
+    resource_type text NOT NULL,
+    unit text NOT NULL,
+    value numeric NOT NULL,
+    parked_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS cpu_usage_parked_records_user_index
+    ON cpu_usage_parked_records (user_id, parked_on);
+
+-- +goose Down
+DROP TABLE IF EXISTS cpu_usage_parked_records;
+DROP TABLE IF EXISTS cpu_usage_frozen_users;
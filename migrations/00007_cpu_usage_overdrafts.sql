@@ -0,0 +1,12 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS cpu_usage_overdrafts (
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    resource_type text NOT NULL,
+    period_start timestamp NOT NULL,
+    overdraft numeric NOT NULL DEFAULT 0,
+    last_modified timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, resource_type, period_start)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS cpu_usage_overdrafts;
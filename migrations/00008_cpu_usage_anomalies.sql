@@ -0,0 +1,16 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS cpu_usage_anomalies (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    day date NOT NULL,
+    usage numeric NOT NULL,
+    baseline numeric NOT NULL,
+    detected_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (user_id, day)
+);
+
+CREATE INDEX IF NOT EXISTS cpu_usage_anomalies_day_index
+    ON cpu_usage_anomalies (day);
+
+-- +goose Down
+DROP TABLE IF EXISTS cpu_usage_anomalies;
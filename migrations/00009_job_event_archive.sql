@@ -0,0 +1,17 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS job_event_archive (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    external_id text NOT NULL,
+    state text NOT NULL,
+    received_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    payload jsonb NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS job_event_archive_external_id_index
+    ON job_event_archive (external_id, received_on);
+
+CREATE INDEX IF NOT EXISTS job_event_archive_received_on_index
+    ON job_event_archive (received_on);
+
+-- +goose Down
+DROP TABLE IF EXISTS job_event_archive;
@@ -0,0 +1,13 @@
+-- +goose Up
+ALTER TABLE cpu_usage_events
+    ADD COLUMN IF NOT EXISTS voided boolean NOT NULL DEFAULT false,
+    ADD COLUMN IF NOT EXISTS voided_by text,
+    ADD COLUMN IF NOT EXISTS voided_on timestamp,
+    ADD COLUMN IF NOT EXISTS compensating_event_id uuid REFERENCES cpu_usage_events (id) ON DELETE SET NULL;
+
+-- +goose Down
+ALTER TABLE cpu_usage_events
+    DROP COLUMN IF EXISTS compensating_event_id,
+    DROP COLUMN IF EXISTS voided_on,
+    DROP COLUMN IF EXISTS voided_by,
+    DROP COLUMN IF EXISTS voided;
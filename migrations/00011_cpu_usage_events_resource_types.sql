@@ -0,0 +1,9 @@
+-- +goose Up
+ALTER TABLE cpu_usage_events
+    ADD COLUMN IF NOT EXISTS resource_type text NOT NULL DEFAULT 'cpu.hours',
+    ADD COLUMN IF NOT EXISTS allocation_source text NOT NULL DEFAULT 'default';
+
+-- +goose Down
+ALTER TABLE cpu_usage_events
+    DROP COLUMN IF EXISTS allocation_source,
+    DROP COLUMN IF EXISTS resource_type;
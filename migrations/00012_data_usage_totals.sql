@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS data_usage_totals (
+    user_id uuid PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    total bigint NOT NULL,
+    measured_on timestamp,
+    refreshed_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS data_usage_totals;
@@ -0,0 +1,15 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS qms_usage_drift (
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    resource_type text NOT NULL,
+    local_total numeric NOT NULL,
+    qms_total numeric NOT NULL,
+    difference numeric NOT NULL,
+    detected_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    checked_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    republished_on timestamp,
+    PRIMARY KEY (user_id, resource_type)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS qms_usage_drift;
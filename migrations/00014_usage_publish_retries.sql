@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS usage_publish_retries (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    analysis_id uuid,
+    resource_type text NOT NULL,
+    unit text NOT NULL,
+    value numeric NOT NULL,
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT '',
+    next_attempt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS usage_publish_retries_next_attempt_index
+    ON usage_publish_retries (next_attempt);
+
+-- +goose Down
+DROP TABLE IF EXISTS usage_publish_retries;
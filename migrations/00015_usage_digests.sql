@@ -0,0 +1,18 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS usage_digest_preferences (
+    user_id uuid PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    opted_out boolean NOT NULL DEFAULT false,
+    modified_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS usage_digests (
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    week date NOT NULL,
+    hours numeric NOT NULL,
+    sent_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, week)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS usage_digests;
+DROP TABLE IF EXISTS usage_digest_preferences;
@@ -0,0 +1,9 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS leader_leases (
+    name text PRIMARY KEY,
+    holder text NOT NULL,
+    expires_on timestamp NOT NULL
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS leader_leases;
@@ -0,0 +1,20 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS cpu_calculation_provenance (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    analysis_id uuid NOT NULL,
+    resource_type text NOT NULL,
+    unit text NOT NULL,
+    value numeric NOT NULL,
+    calculation_mode text NOT NULL,
+    millicores_reserved bigint NOT NULL,
+    start_date timestamp NOT NULL,
+    end_date timestamp NOT NULL,
+    code_version text NOT NULL,
+    calculated_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS cpu_calculation_provenance_analysis_id_index
+    ON cpu_calculation_provenance (analysis_id);
+
+-- +goose Down
+DROP TABLE IF EXISTS cpu_calculation_provenance;
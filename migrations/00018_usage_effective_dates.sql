@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE cpu_usage_parked_records ADD COLUMN IF NOT EXISTS effective_date timestamp;
+ALTER TABLE usage_publish_retries ADD COLUMN IF NOT EXISTS effective_date timestamp;
+
+-- +goose Down
+ALTER TABLE usage_publish_retries DROP COLUMN IF EXISTS effective_date;
+ALTER TABLE cpu_usage_parked_records DROP COLUMN IF EXISTS effective_date;
@@ -0,0 +1,23 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS cpu_usage_supplements (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    resource_type text NOT NULL,
+    amount numeric NOT NULL,
+    consumed numeric NOT NULL DEFAULT 0,
+    starts_on timestamp NOT NULL,
+    ends_on timestamp NOT NULL,
+    reason text NOT NULL DEFAULT '',
+    granted_by text NOT NULL,
+    granted_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    revoked_by text,
+    revoked_on timestamp,
+    CHECK (ends_on > starts_on),
+    CHECK (consumed <= amount)
+);
+
+CREATE INDEX IF NOT EXISTS cpu_usage_supplements_user_index
+    ON cpu_usage_supplements (user_id, resource_type, ends_on);
+
+-- +goose Down
+DROP TABLE IF EXISTS cpu_usage_supplements;
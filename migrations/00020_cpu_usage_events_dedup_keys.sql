@@ -0,0 +1,9 @@
+-- +goose Up
+ALTER TABLE cpu_usage_events ADD COLUMN IF NOT EXISTS dedup_key text;
+
+CREATE UNIQUE INDEX IF NOT EXISTS cpu_usage_events_dedup_key_index
+    ON cpu_usage_events (dedup_key);
+
+-- +goose Down
+DROP INDEX IF EXISTS cpu_usage_events_dedup_key_index;
+ALTER TABLE cpu_usage_events DROP COLUMN IF EXISTS dedup_key;
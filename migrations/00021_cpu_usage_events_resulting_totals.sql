@@ -0,0 +1,10 @@
+-- +goose Up
+ALTER TABLE cpu_usage_events ADD COLUMN IF NOT EXISTS resulting_total numeric;
+
+CREATE INDEX IF NOT EXISTS cpu_usage_events_history_index
+    ON cpu_usage_events (created_by, processed_on)
+    WHERE processed;
+
+-- +goose Down
+DROP INDEX IF EXISTS cpu_usage_events_history_index;
+ALTER TABLE cpu_usage_events DROP COLUMN IF EXISTS resulting_total;
@@ -0,0 +1,17 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS cpu_usage_holds (
+    analysis_id uuid PRIMARY KEY,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    resource_type text NOT NULL,
+    amount numeric NOT NULL,
+    placed_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_on timestamp NOT NULL,
+    released_on timestamp
+);
+
+CREATE INDEX IF NOT EXISTS cpu_usage_holds_user_index
+    ON cpu_usage_holds (user_id, resource_type)
+    WHERE released_on IS NULL;
+
+-- +goose Down
+DROP TABLE IF EXISTS cpu_usage_holds;
@@ -0,0 +1,14 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS qms_quotas (
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    resource_type text NOT NULL,
+    quota numeric NOT NULL,
+    plan_name text NOT NULL,
+    effective_start timestamp NOT NULL,
+    effective_end timestamp NOT NULL,
+    fetched_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, resource_type)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS qms_quotas;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE IF EXISTS cpu_usage_events ADD COLUMN IF NOT EXISTS reason text;
+
+-- +goose Down
+ALTER TABLE IF EXISTS cpu_usage_events DROP COLUMN IF EXISTS reason;
@@ -0,0 +1,21 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS cpu_usage_reset_schedules (
+    user_id uuid PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+    expression text NOT NULL,
+    next_run timestamp,
+    last_run timestamp,
+    scheduled_by text NOT NULL,
+    scheduled_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS cpu_usage_reset_schedules_next_run_index
+    ON cpu_usage_reset_schedules (next_run);
+
+CREATE TABLE IF NOT EXISTS cpu_usage_reset_runs (
+    name text PRIMARY KEY,
+    last_run timestamp NOT NULL
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS cpu_usage_reset_runs;
+DROP TABLE IF EXISTS cpu_usage_reset_schedules;
@@ -0,0 +1,11 @@
+-- +goose Up
+ALTER TABLE cpu_usage_events ADD COLUMN cluster text;
+CREATE INDEX cpu_usage_events_cluster_idx ON cpu_usage_events (cluster);
+
+ALTER TABLE cpu_calculation_provenance ADD COLUMN cluster text;
+
+-- +goose Down
+ALTER TABLE cpu_calculation_provenance DROP COLUMN cluster;
+
+DROP INDEX IF EXISTS cpu_usage_events_cluster_idx;
+ALTER TABLE cpu_usage_events DROP COLUMN cluster;
@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE IF EXISTS usage_digest_preferences ADD COLUMN IF NOT EXISTS locale text;
+
+-- +goose Down
+ALTER TABLE IF EXISTS usage_digest_preferences DROP COLUMN IF EXISTS locale;
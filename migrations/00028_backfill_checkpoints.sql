@@ -0,0 +1,16 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS backfill_checkpoints (
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    range_start timestamp NOT NULL,
+    range_end timestamp NOT NULL,
+    last_end_date timestamp,
+    last_analysis_id uuid,
+    processed integer NOT NULL DEFAULT 0,
+    started_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    completed_on timestamp,
+    PRIMARY KEY (user_id, range_start, range_end)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS backfill_checkpoints;
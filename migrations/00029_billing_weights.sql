@@ -0,0 +1,27 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS billing_weights (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    target_type text NOT NULL,
+    target_id text NOT NULL,
+    weight numeric NOT NULL,
+    starts_on timestamp NOT NULL,
+    ends_on timestamp,
+    reason text NOT NULL DEFAULT '',
+    created_by text NOT NULL,
+    created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    revoked_by text,
+    revoked_on timestamp,
+    CHECK (target_type IN ('app', 'tool')),
+    CHECK (weight >= 0),
+    CHECK (ends_on IS NULL OR ends_on > starts_on)
+);
+
+CREATE INDEX IF NOT EXISTS billing_weights_target_index
+    ON billing_weights (target_type, target_id, starts_on);
+
+ALTER TABLE cpu_calculation_provenance ADD COLUMN billing_weight numeric;
+
+-- +goose Down
+ALTER TABLE cpu_calculation_provenance DROP COLUMN billing_weight;
+
+DROP TABLE IF EXISTS billing_weights;
@@ -0,0 +1,10 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS usage_message_sequences (
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    resource_type text NOT NULL,
+    sequence bigint NOT NULL,
+    PRIMARY KEY (user_id, resource_type)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS usage_message_sequences;
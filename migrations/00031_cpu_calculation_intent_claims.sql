@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE cpu_calculation_intents ADD COLUMN claim_token uuid;
+
+-- +goose Down
+ALTER TABLE cpu_calculation_intents DROP COLUMN claim_token;
@@ -0,0 +1,13 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS cpu_usage_supplement_draws (
+    analysis_id uuid NOT NULL,
+    resource_type text NOT NULL,
+    effective_date timestamp NOT NULL,
+    supplement_id uuid NOT NULL REFERENCES cpu_usage_supplements (id) ON DELETE CASCADE,
+    amount numeric NOT NULL,
+    drawn_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (analysis_id, resource_type, effective_date, supplement_id)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS cpu_usage_supplement_draws;
@@ -0,0 +1,11 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS cpu_usage_record_publications (
+    analysis_id uuid NOT NULL,
+    resource_type text NOT NULL,
+    effective_date timestamp NOT NULL,
+    published_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (analysis_id, resource_type, effective_date)
+);
+
+-- +goose Down
+DROP TABLE IF EXISTS cpu_usage_record_publications;
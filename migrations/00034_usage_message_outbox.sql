@@ -0,0 +1,25 @@
+-- +goose Up
+CREATE TABLE IF NOT EXISTS usage_message_outbox (
+    id uuid NOT NULL DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    resource_type text NOT NULL,
+    sequence bigint NOT NULL,
+    type text NOT NULL,
+    analysis_id uuid,
+    unit text NOT NULL,
+    value numeric NOT NULL,
+    effective_date timestamp NOT NULL,
+    cluster text NOT NULL DEFAULT '',
+    attempts integer NOT NULL DEFAULT 0,
+    last_error text NOT NULL DEFAULT '',
+    next_attempt timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP + interval '1 minute',
+    created_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (id),
+    UNIQUE (user_id, resource_type, sequence)
+);
+
+CREATE INDEX IF NOT EXISTS usage_message_outbox_next_attempt_index
+    ON usage_message_outbox (next_attempt);
+
+-- +goose Down
+DROP TABLE IF EXISTS usage_message_outbox;
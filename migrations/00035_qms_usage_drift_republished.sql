@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE qms_usage_drift DROP COLUMN IF EXISTS republished_on;
+
+-- +goose Down
+ALTER TABLE qms_usage_drift ADD COLUMN IF NOT EXISTS republished_on timestamp;
@@ -0,0 +1,20 @@
+-- +goose Up
+ALTER TABLE qms_quotas ADD COLUMN IF NOT EXISTS usage numeric NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS qms_sent_usage (
+    id uuid PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    resource_type text NOT NULL,
+    analysis_id uuid,
+    value numeric NOT NULL,
+    effective_date timestamp NOT NULL,
+    sent_on timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS qms_sent_usage_user_index
+    ON qms_sent_usage (user_id, resource_type, effective_date);
+
+-- +goose Down
+DROP TABLE IF EXISTS qms_sent_usage;
+
+ALTER TABLE qms_quotas DROP COLUMN IF EXISTS usage;
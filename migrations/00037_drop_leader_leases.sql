@@ -0,0 +1,9 @@
+-- +goose Up
+DROP TABLE IF EXISTS leader_leases;
+
+-- +goose Down
+CREATE TABLE IF NOT EXISTS leader_leases (
+    name text PRIMARY KEY,
+    holder text NOT NULL,
+    expires_on timestamp NOT NULL
+);
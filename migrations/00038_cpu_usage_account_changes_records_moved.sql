@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE cpu_usage_account_changes ADD COLUMN IF NOT EXISTS records_moved bigint NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE cpu_usage_account_changes DROP COLUMN IF EXISTS records_moved;
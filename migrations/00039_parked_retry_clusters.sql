@@ -0,0 +1,7 @@
+-- +goose Up
+ALTER TABLE cpu_usage_parked_records ADD COLUMN IF NOT EXISTS cluster text NOT NULL DEFAULT '';
+ALTER TABLE usage_publish_retries ADD COLUMN IF NOT EXISTS cluster text NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE usage_publish_retries DROP COLUMN IF EXISTS cluster;
+ALTER TABLE cpu_usage_parked_records DROP COLUMN IF EXISTS cluster;
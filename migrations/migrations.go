@@ -0,0 +1,103 @@
+// Package migrations contains the schema migrations for the tables and columns
+// owned by this service. The tables shared with the rest of the Discovery
+// Environment are managed by the DE database migrations; these migrations only
+// extend them.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/pressly/goose/v3"
+	"github.com/pressly/goose/v3/database"
+	"github.com/pressly/goose/v3/lock"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "migrations"})
+
+//go:embed *.sql
+var migrationFiles embed.FS
+
+// versionTable records the migrations that have been applied. It's separate
+// from the DE's own version table so the two sets of migrations don't collide.
+const versionTable = "resource_usage_api_schema_version"
+
+// newProvider returns a goose provider for the embedded migrations.
+func newProvider(conn *sql.DB) (*goose.Provider, error) {
+	store, err := database.NewStore(database.DialectPostgres, versionTable)
+	if err != nil {
+		return nil, err
+	}
+
+	// The session lock keeps replicas that start at the same time from applying
+	// the same migrations concurrently.
+	locker, err := lock.NewPostgresSessionLocker()
+	if err != nil {
+		return nil, err
+	}
+
+	return goose.NewProvider("", conn, migrationFiles,
+		goose.WithStore(store),
+		goose.WithSessionLocker(locker),
+	)
+}
+
+// latestVersion returns the version of the newest embedded migration.
+func latestVersion(provider *goose.Provider) int64 {
+	var latest int64
+	for _, source := range provider.ListSources() {
+		if source.Version > latest {
+			latest = source.Version
+		}
+	}
+	return latest
+}
+
+// Migrate applies any embedded migrations that haven't been applied yet.
+func Migrate(context context.Context, conn *sql.DB) error {
+	provider, err := newProvider(conn)
+	if err != nil {
+		return err
+	}
+
+	results, err := provider.Up(context)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		log.Infof("applied migration %s in %s", result.Source.Path, result.Duration)
+	}
+
+	return nil
+}
+
+// CheckVersion returns an error if the schema version in the database doesn't
+// match the newest embedded migration. A schema that's behind needs to be
+// migrated, and a schema that's ahead was migrated by a newer release of the
+// service.
+func CheckVersion(context context.Context, conn *sql.DB) error {
+	provider, err := newProvider(conn)
+	if err != nil {
+		return err
+	}
+
+	current, err := provider.GetDBVersion(context)
+	if err != nil {
+		return fmt.Errorf("unable to determine the database schema version; run with --migrate to initialize it: %w", err)
+	}
+
+	expected := latestVersion(provider)
+	switch {
+	case current < expected:
+		return fmt.Errorf("the database schema is at version %d, but version %d is required; run with --migrate to update it", current, expected)
+	case current > expected:
+		return fmt.Errorf("the database schema is at version %d, which is newer than version %d supported by this release", current, expected)
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+// Package ops publishes messages when operationally significant things happen
+// inside the service, such as workers expiring or QMS drifting from the local
+// totals, so that an alerting pipeline can act on them without scraping the
+// logs.
+//
+// Every event is published with the same routing key, and consumers tell them
+// apart by their types.
+package ops
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/transport"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "ops"})
+
+// DefaultRoutingKey is the routing key that events are published with if no
+// other one is configured.
+const DefaultRoutingKey = "ops.resource-usage-api"
+
+// EventType identifies the kind of thing that happened.
+type EventType string
+
+// The kinds of events that are published.
+const (
+	// WorkerRegistered is published when a worker registers to process work
+	// items. The details contain the worker's ID and name.
+	WorkerRegistered EventType = "worker.registered"
+
+	// WorkerExpired is published when a worker's registration expires or is
+	// expired by an administrator. The details contain the worker's ID, its
+	// name if it's known, and whether the expiration was forced, along with
+	// who forced it.
+	WorkerExpired EventType = "worker.expired"
+
+	// DriftDetected is published when a user's usage in QMS starts to differ
+	// from their local total. The details contain the username, the resource
+	// type, both values, and their difference.
+	DriftDetected EventType = "qms.drift_detected"
+
+	// DeadLettered is published when a message is moved to the dead-letter
+	// queue. The details contain the queue it was consumed from, its routing
+	// key, the number of attempts, and the reason.
+	DeadLettered EventType = "amqp.dead_lettered"
+)
+
+// Event is the body of each published message.
+type Event struct {
+	Type    EventType              `json:"type"`
+	Service string                 `json:"service"`
+	Host    string                 `json:"host"`
+	Time    time.Time              `json:"time"`
+	Details map[string]interface{} `json:"details"`
+}
+
+// Publisher publishes events. A nil *Publisher, or one without a routing key or
+// a transport, drops them, so callers don't need to check whether events are
+// enabled.
+type Publisher struct {
+	mutex      sync.Mutex
+	service    string
+	host       string
+	routingKey string
+	transport  transport.Transport
+}
+
+// New returns a *Publisher that identifies the events as coming from the
+// service on this host and publishes them with the routing key.
+func New(service, routingKey string) *Publisher {
+	host, err := os.Hostname()
+	if err != nil {
+		log.Errorf("unable to get the hostname for the ops events: %s", err)
+	}
+	return &Publisher{
+		service:    service,
+		host:       host,
+		routingKey: routingKey,
+	}
+}
+
+// SetTransport sets the transport that events are published through. Events
+// published before it's set are dropped.
+func (p *Publisher) SetTransport(t transport.Transport) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.transport = t
+}
+
+// Publish sends an event. Failures are logged rather than returned, because
+// they shouldn't stop the operation that the event describes.
+func (p *Publisher) Publish(context context.Context, eventType EventType, details map[string]interface{}) {
+	if p == nil {
+		return
+	}
+
+	p.mutex.Lock()
+	routingKey, t := p.routingKey, p.transport
+	p.mutex.Unlock()
+	if routingKey == "" || t == nil {
+		return
+	}
+
+	log := log.WithFields(logrus.Fields{"context": "publishing ops event", "type": eventType}).WithContext(context)
+
+	data, err := json.Marshal(&Event{
+		Type:    eventType,
+		Service: p.service,
+		Host:    p.host,
+		Time:    time.Now().UTC(),
+		Details: details,
+	})
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	if err = t.Send(context, routingKey, data); err != nil {
+		log.Errorf("unable to publish the event: %s", err)
+	}
+}
@@ -0,0 +1,104 @@
+// Package periodic runs the service's background tasks once per interval.
+//
+// Most tasks only run on the instance that's the leader and have settings that
+// can be replaced while the service is running, including the interval. Task
+// holds that state for the types that run them, and Run is the loop that they
+// share.
+package periodic
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/leader"
+	"github.com/sirupsen/logrus"
+)
+
+// fallbackInterval is used if a task is started with an interval that isn't
+// positive. The configuration validation rejects those, so it only applies to
+// intervals that don't come from the configuration file.
+const fallbackInterval = time.Minute
+
+// Run calls the task right away and then once per interval until the context
+// is canceled. The task is skipped while the elector isn't the leader; a nil
+// elector is always the leader. The interval is read again after each run, so
+// a new interval takes effect after the next run. An interval that isn't
+// positive is logged and ignored. Errors returned by the task are logged.
+func Run(context context.Context, log *logrus.Entry, elector *leader.Elector, interval func() time.Duration, task func(context.Context) error) {
+	current := interval()
+	if current <= 0 {
+		log.WithContext(context).Errorf("the interval %s isn't positive, using %s", current, fallbackInterval)
+		current = fallbackInterval
+	}
+
+	ticker := time.NewTicker(current)
+	defer ticker.Stop()
+
+	for {
+		if elector.IsLeader() {
+			if err := task(context); err != nil {
+				log.WithContext(context).Error(err)
+			}
+		}
+
+		select {
+		case <-context.Done():
+			return
+		case <-ticker.C:
+		}
+
+		latest := interval()
+		if latest == current {
+			continue
+		}
+		if latest <= 0 {
+			log.WithContext(context).Errorf("ignoring the interval %s because it isn't positive", latest)
+			continue
+		}
+		current = latest
+		ticker.Reset(current)
+	}
+}
+
+// Task holds the state that the periodic tasks share: settings that can be
+// replaced while the task is running and the leader elector that limits it to
+// one instance. It's meant to be embedded in the type that runs the task.
+type Task[C any] struct {
+	mutex  sync.Mutex
+	config C
+	leader *leader.Elector
+}
+
+// NewTask returns a Task with the given settings.
+func NewTask[C any](config C) Task[C] {
+	return Task[C]{config: config}
+}
+
+// SetLeader sets the leader elector. The task only runs while this instance is
+// the leader.
+func (t *Task[C]) SetLeader(elector *leader.Elector) {
+	t.leader = elector
+}
+
+// SetConfig replaces the task's settings while it's running. Settings other
+// than the interval apply to the next run, and a new interval to the one
+// after.
+func (t *Task[C]) SetConfig(config C) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.config = config
+}
+
+// Config returns the task's current settings.
+func (t *Task[C]) Config() C {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.config
+}
+
+// RunEvery calls the task once per the interval returned for the current
+// settings, as described for Run, while this instance is the leader.
+func (t *Task[C]) RunEvery(context context.Context, log *logrus.Entry, interval func(C) time.Duration, task func(context.Context) error) {
+	Run(context, log, t.leader, func() time.Duration { return interval(t.Config()) }, task)
+}
@@ -0,0 +1,134 @@
+// Package quotas keeps a local copy of each user's QMS quotas so that quota
+// checks and the summary endpoints don't need to call QMS while handling a
+// request.
+//
+// Once per interval, the refresher fetches the subscription from QMS for every
+// user with a current total whose stored quotas are missing, older than the
+// maximum age, or from a subscription that has ended, and stores its quotas and
+// usages in the database.
+package quotas
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/go-mod/pbinit"
+	"github.com/cyverse-de/go-mod/subjects"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/periodic"
+	"github.com/nats-io/nats.go"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "quotas"})
+
+// Config contains the settings for quota refreshes.
+type Config struct {
+	// Interval is how often the stored quotas are checked.
+	Interval time.Duration
+
+	// MaxAge is how old a user's stored quotas may be before they're fetched
+	// again.
+	MaxAge time.Duration
+}
+
+// Refresher copies quotas from QMS into the database.
+type Refresher struct {
+	periodic.Task[*Config]
+
+	db *db.Database
+	nc *nats.EncodedConn
+}
+
+// New returns a new *Refresher.
+func New(config *Config, database *db.Database, nc *nats.EncodedConn) *Refresher {
+	return &Refresher{
+		Task: periodic.NewTask(config),
+		db:   database,
+		nc:   nc,
+	}
+}
+
+// Refresh fetches and stores the quotas for one user.
+func (r *Refresher) Refresh(context context.Context, username string) error {
+	request := pbinit.NewQMSRequestByUsername()
+	request.Username = username
+	_, span := pbinit.InitQMSRequestByUsername(request, subjects.QMSUserSummary)
+	defer span.End()
+
+	response := pbinit.NewSubscriptionResponse()
+	if err := gotelnats.Request(context, r.nc, subjects.QMSUserSummary, request, response); err != nil {
+		return err
+	}
+	sub := response.Subscription
+	if sub == nil {
+		return errors.New("QMS did not return a subscription")
+	}
+
+	for _, q := range sub.Quotas {
+		if q.ResourceType == nil {
+			continue
+		}
+		quota := &db.Quota{
+			Username:       username,
+			ResourceType:   q.ResourceType.Name,
+			EffectiveStart: sub.EffectiveStartDate.AsTime(),
+			EffectiveEnd:   sub.EffectiveEndDate.AsTime(),
+		}
+		if sub.Plan != nil {
+			quota.PlanName = sub.Plan.Name
+		}
+		if _, err := quota.Quota.SetFloat64(float64(q.Quota)); err != nil {
+			return err
+		}
+		for _, u := range sub.Usages {
+			if u.ResourceType != nil && u.ResourceType.Name == quota.ResourceType {
+				if _, err := quota.Usage.SetFloat64(u.Usage); err != nil {
+					return err
+				}
+				break
+			}
+		}
+		if err := r.db.SaveQuota(context, quota); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RefreshStale refreshes the stored quotas for every user whose quotas need
+// it. Failures for individual users are logged and don't stop the others from
+// being refreshed.
+func (r *Refresher) RefreshStale(context context.Context) error {
+	log := log.WithContext(context)
+
+	users, err := r.db.QuotaRefreshUsers(context, time.Now().Add(-r.Config().MaxAge))
+	if err != nil {
+		return err
+	}
+
+	var refreshed int
+	for i := range users {
+		if context.Err() != nil {
+			return context.Err()
+		}
+		if err = r.Refresh(context, users[i].Username); err != nil {
+			log.Errorf("unable to refresh the quotas for %s: %s", users[i].Username, err)
+			continue
+		}
+		refreshed++
+	}
+	log.Debugf("refreshed the quotas for %d of %d users", refreshed, len(users))
+
+	return nil
+}
+
+// Run refreshes the stored quotas once per interval until the context is
+// canceled.
+func (r *Refresher) Run(context context.Context) {
+	r.RunEvery(context, log, func(config *Config) time.Duration { return config.Interval }, r.RefreshStale)
+}
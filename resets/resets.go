@@ -0,0 +1,186 @@
+// Package resets enqueues the work items that reset users' CPU hours at the
+// boundaries of their usage periods, so that periodic plans reset without an
+// operator having to remember to do it.
+//
+// Users can have their own reset schedules, which are stored in the database
+// along with the time of each one's next run. Users with a current total who
+// don't have their own schedule are reset on the default schedule, if there
+// is one. The last run of the default schedule is stored in the database too,
+// so that a reset that came due while no instance was running is enqueued
+// once one starts again. Missed runs of a schedule are collapsed into a
+// single reset.
+//
+// Each reset has a deduplication key derived from the user and the scheduled
+// time, so a reset can't be enqueued twice even if leadership changes while
+// the resets are being enqueued.
+package resets
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/cron"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/periodic"
+	"github.com/guregu/null"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "resets"})
+
+// defaultScheduleName is the name that the default schedule's last run is
+// stored under.
+const defaultScheduleName = "default"
+
+// Config contains the settings for scheduled resets.
+type Config struct {
+	// Interval is how often the schedules are checked for resets that are
+	// due.
+	Interval time.Duration
+
+	// Default is the schedule for the users who don't have their own. If it's
+	// nil, only users with their own schedules are reset.
+	Default *cron.Schedule
+}
+
+// Scheduler enqueues the resets that are due.
+type Scheduler struct {
+	periodic.Task[*Config]
+
+	db *db.Database
+}
+
+// New returns a new *Scheduler.
+func New(config *Config, database *db.Database) *Scheduler {
+	return &Scheduler{
+		Task: periodic.NewTask(config),
+		db:   database,
+	}
+}
+
+// resetEvent returns the work item that resets the user's CPU hours at the
+// scheduled time. Scheduled resets are enqueued in bulk, but they're kept at
+// normal priority: work items with the same priority are processed in the
+// order they were recorded, and a reset processed after usage that was
+// recorded later would discard that usage.
+func resetEvent(userID string, at time.Time, expression string) db.CPUUsageEvent {
+	return db.CPUUsageEvent{
+		RecordDate:    time.Now(),
+		EffectiveDate: at,
+		EventType:     db.CPUHoursReset,
+		CreatedBy:     userID,
+		Priority:      db.PriorityNormal,
+		DedupKey:      null.StringFrom(db.ResetDedupKey(userID, at)),
+		Reason:        null.StringFrom(fmt.Sprintf("scheduled reset (%s)", expression)),
+	}
+}
+
+// nullTime returns a null time if t is zero.
+func nullTime(t time.Time) null.Time {
+	return null.NewTime(t, !t.IsZero())
+}
+
+// runUserSchedules enqueues the resets for the users whose own schedules are
+// due. Failures for individual users are logged and don't stop the others from
+// being reset.
+func (s *Scheduler) runUserSchedules(context context.Context, now time.Time) error {
+	log := log.WithContext(context)
+
+	due, err := s.db.DueResetSchedules(context, now)
+	if err != nil {
+		return err
+	}
+
+	for _, schedule := range due {
+		log := log.WithFields(logrus.Fields{"user": schedule.Username, "expression": schedule.Expression})
+
+		parsed, err := cron.Parse(schedule.Expression)
+		if err != nil {
+			log.Errorf("unable to parse the reset schedule: %s", err)
+			continue
+		}
+
+		at := schedule.NextRun.Time
+		event := resetEvent(schedule.UserID, at, schedule.Expression)
+		if _, err = s.db.AddCPUUsageEvent(context, &event); err != nil {
+			log.Errorf("unable to enqueue the scheduled reset: %s", err)
+			continue
+		}
+
+		next := parsed.Next(now)
+		if err = s.db.SetResetScheduleRun(context, schedule.UserID, at, nullTime(next)); err != nil {
+			log.Errorf("unable to record the scheduled reset: %s", err)
+			continue
+		}
+		log.Infof("enqueued the reset scheduled for %s", at.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// runDefaultSchedule enqueues the resets for the users without their own
+// schedules if the default schedule is due.
+func (s *Scheduler) runDefaultSchedule(context context.Context, now time.Time, schedule *cron.Schedule) error {
+	log := log.WithContext(context).WithFields(logrus.Fields{"expression": schedule.String()})
+
+	lastRun, err := s.db.LastResetRun(context, defaultScheduleName)
+	if err != nil {
+		return err
+	}
+
+	// Nothing is reset retroactively when the default schedule is first
+	// enabled.
+	if lastRun.IsZero() {
+		return s.db.SetLastResetRun(context, defaultScheduleName, now)
+	}
+
+	at := schedule.Next(lastRun)
+	if at.IsZero() || at.After(now) {
+		return nil
+	}
+	for next := schedule.Next(at); !next.IsZero() && !next.After(now); next = schedule.Next(next) {
+		at = next
+	}
+
+	users, err := s.db.UnscheduledResetUsers(context)
+	if err != nil {
+		return err
+	}
+
+	events := make([]db.CPUUsageEvent, len(users))
+	for i := range users {
+		events[i] = resetEvent(users[i].ID, at, schedule.String())
+	}
+	enqueued, err := s.db.InsertCPUUsageEvents(context, events)
+	if err != nil {
+		return err
+	}
+	if err = s.db.SetLastResetRun(context, defaultScheduleName, at); err != nil {
+		return err
+	}
+	log.Infof("enqueued %d resets scheduled for %s", enqueued, at.Format(time.RFC3339))
+
+	return nil
+}
+
+// Check enqueues every reset that's due.
+func (s *Scheduler) Check(context context.Context) error {
+	config := s.Config()
+	now := time.Now().UTC()
+
+	if err := s.runUserSchedules(context, now); err != nil {
+		return err
+	}
+	if config.Default != nil {
+		return s.runDefaultSchedule(context, now, config.Default)
+	}
+	return nil
+}
+
+// Run checks for resets that are due every configured interval until the
+// context is canceled.
+func (s *Scheduler) Run(context context.Context) {
+	s.RunEvery(context, log, func(config *Config) time.Duration { return config.Interval }, s.Check)
+}
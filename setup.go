@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/messaging/v9"
+	"github.com/cyverse-de/resource-usage-api/amqp"
+	"github.com/cyverse-de/resource-usage-api/authz"
+	"github.com/cyverse-de/resource-usage-api/clients"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/internal"
+	"github.com/knadh/koanf"
+	"github.com/nats-io/nats.go"
+)
+
+// databaseConfig returns the database connection settings from the
+// configuration.
+func databaseConfig(config *koanf.Koanf, dbURI string) *db.ConnectionConfig {
+	dbConfig := &db.ConnectionConfig{
+		Driver:           config.String("db.driver"),
+		URI:              dbURI,
+		MaxOpenConns:     10,
+		MaxIdleConns:     2,
+		ConnMaxLifetime:  config.Duration("db.conn_max_lifetime"),
+		ConnMaxIdleTime:  time.Minute,
+		StatementTimeout: config.Duration("db.statement_timeout"),
+		ApplicationName:  config.String("db.application_name"),
+	}
+	if config.Exists("db.max_open_conns") {
+		dbConfig.MaxOpenConns = config.Int("db.max_open_conns")
+	}
+	if config.Exists("db.max_idle_conns") {
+		dbConfig.MaxIdleConns = config.Int("db.max_idle_conns")
+	}
+	if config.Exists("db.conn_max_idle_time") {
+		dbConfig.ConnMaxIdleTime = config.Duration("db.conn_max_idle_time")
+	}
+	if dbConfig.ApplicationName == "" {
+		dbConfig.ApplicationName = serviceName
+	}
+
+	log.Infof("database driver: %s", dbConfig.Driver)
+	log.Infof("database max open connections: %d", dbConfig.MaxOpenConns)
+	log.Infof("database max idle connections: %d", dbConfig.MaxIdleConns)
+	log.Infof("database connection max lifetime: %s", dbConfig.ConnMaxLifetime)
+	log.Infof("database connection max idle time: %s", dbConfig.ConnMaxIdleTime)
+	log.Infof("database statement timeout: %s", dbConfig.StatementTimeout)
+
+	return dbConfig
+}
+
+// httpConfiguration returns the settings for the HTTP client used to call the
+// downstream services from the configuration.
+func httpConfiguration(config *koanf.Koanf) *clients.HTTPConfig {
+	httpConfig := &clients.HTTPConfig{
+		Timeout:               config.Duration("http_client.timeout"),
+		DialTimeout:           config.Duration("http_client.dial_timeout"),
+		TLSHandshakeTimeout:   config.Duration("http_client.tls_handshake_timeout"),
+		ResponseHeaderTimeout: config.Duration("http_client.response_header_timeout"),
+		IdleConnTimeout:       config.Duration("http_client.idle_conn_timeout"),
+		MaxIdleConns:          config.Int("http_client.max_idle_conns"),
+		MaxIdleConnsPerHost:   config.Int("http_client.max_idle_conns_per_host"),
+		Proxy:                 config.String("http_client.proxy"),
+	}
+	if httpConfig.Timeout == 0 {
+		httpConfig.Timeout = time.Minute
+	}
+	if httpConfig.MaxIdleConnsPerHost == 0 {
+		httpConfig.MaxIdleConnsPerHost = 10
+	}
+
+	log.Infof("HTTP client timeout: %s", httpConfig.Timeout)
+	log.Infof("HTTP client dial timeout: %s", httpConfig.DialTimeout)
+	log.Infof("HTTP client TLS handshake timeout: %s", httpConfig.TLSHandshakeTimeout)
+	log.Infof("HTTP client response header timeout: %s", httpConfig.ResponseHeaderTimeout)
+	log.Infof("HTTP client idle connection timeout: %s", httpConfig.IdleConnTimeout)
+	log.Infof("HTTP client max idle connections: %d", httpConfig.MaxIdleConns)
+	log.Infof("HTTP client max idle connections per host: %d", httpConfig.MaxIdleConnsPerHost)
+	log.Infof("HTTP client proxy: %s", httpConfig.Proxy)
+
+	return httpConfig
+}
+
+// The behaviors that job states can be mapped to in the job_states setting.
+const (
+	behaviorCalculate = "calculate"
+	behaviorHold      = "hold"
+	behaviorIgnore    = "ignore"
+)
+
+// defaultStateBehaviors are the job states that trigger calculation unless the
+// job_states setting says otherwise.
+var defaultStateBehaviors = map[string]string{
+	strings.ToLower(string(messaging.SucceededState)): behaviorCalculate,
+	strings.ToLower(string(messaging.FailedState)):    behaviorCalculate,
+}
+
+// inProgressStates are the job states of analyses that haven't ended. They
+// can't trigger calculation, since usage is only calculated once an analysis
+// has an end date, and only once per analysis.
+var inProgressStates = []messaging.JobState{
+	messaging.QueuedState,
+	messaging.SubmittedState,
+	messaging.RunningState,
+	messaging.ImpendingCancellationState,
+}
+
+// stateBehaviors returns the behavior for each job state, keyed by the
+// lowercased state. The job_states setting adds states to the defaults or
+// overrides them.
+func stateBehaviors(config *koanf.Koanf) map[string]string {
+	behaviors := make(map[string]string)
+	for state, behavior := range defaultStateBehaviors {
+		behaviors[state] = behavior
+	}
+	for state, behavior := range config.StringMap("job_states") {
+		behaviors[strings.ToLower(state)] = strings.ToLower(behavior)
+	}
+
+	states := make([]string, 0, len(behaviors))
+	for state := range behaviors {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	for _, state := range states {
+		log.Infof("job state %s: %s", state, behaviors[state])
+	}
+
+	return behaviors
+}
+
+// connectNATS connects to the NATS cluster with the given credentials and TLS
+// files.
+func connectNATS(natsCluster, credsPath, caCert, tlsCert, tlsKey string, maxReconnects, reconnectWait int) (*nats.Conn, error) {
+	return nats.Connect(
+		natsCluster,
+		nats.UserCredentials(credsPath),
+		nats.RootCAs(caCert),
+		nats.ClientCert(tlsCert, tlsKey),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(maxReconnects),
+		nats.ReconnectWait(time.Duration(reconnectWait)*time.Second),
+		nats.DisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if err != nil {
+				log.Errorf("disconnected from nats: %s", err.Error())
+			}
+		}),
+		nats.ReconnectHandler(func(nc *nats.Conn) {
+			log.Infof("reconnected to %s", nc.ConnectedUrl())
+		}),
+		nats.ClosedHandler(func(nc *nats.Conn) {
+			log.Errorf("connection closed: %s", nc.LastError().Error())
+		}),
+	)
+}
+
+// calculatorConfiguration returns the settings for the CPU hours calculators
+// from the configuration.
+func calculatorConfiguration(config *koanf.Koanf) (*cpuhours.Configuration, error) {
+	calculatorConfig := &cpuhours.Configuration{
+		Modes: make(map[string]cpuhours.Mode),
+	}
+	for jobType, mode := range config.StringMap("cpu.modes") {
+		calculatorConfig.Modes[jobType] = cpuhours.Mode(mode)
+	}
+	if prometheusBase := config.String("prometheus.base"); prometheusBase != "" {
+		prometheusClient, err := clients.PrometheusAPIClient(prometheusBase)
+		if err != nil {
+			return nil, err
+		}
+		viceNamespace := config.String("vice.namespace")
+		if viceNamespace == "" {
+			viceNamespace = "vice-apps"
+		}
+		calculatorConfig.ActualUsage = &cpuhours.ActualUsageConfig{
+			Client:    prometheusClient,
+			Namespace: viceNamespace,
+			Query:     config.String("prometheus.cpu_query"),
+		}
+		log.Infof("Prometheus base URL: %s", prometheusBase)
+		log.Infof("VICE namespace: %s", viceNamespace)
+	}
+
+	if config.Bool("condor.enabled") {
+		calculatorConfig.Condor = &cpuhours.CondorConfig{
+			HistoryPath: config.String("condor.history_path"),
+			Pool:        config.String("condor.pool"),
+			Schedd:      config.String("condor.schedd"),
+		}
+		if calculatorConfig.Condor.HistoryPath == "" {
+			calculatorConfig.Condor.HistoryPath = "condor_history"
+		}
+		log.Infof("HTCondor pool: %s", calculatorConfig.Condor.Pool)
+		log.Infof("HTCondor schedd: %s", calculatorConfig.Condor.Schedd)
+	}
+
+	return calculatorConfig, nil
+}
+
+// The handlers that AMQP bindings can name in the amqp.bindings setting.
+const (
+	// bindingHandlerDataUsage refreshes a user's stored data store usage when a
+	// data store event reports that it changed.
+	bindingHandlerDataUsage = "data_usage"
+)
+
+// amqpBindings returns the additional AMQP bindings from the amqp.bindings
+// setting. Each binding names one of the handlers in the map, and an error is
+// returned if a binding names one that isn't there.
+func amqpBindings(config *koanf.Koanf, handlers map[string]amqp.MessageHandlerFn) ([]amqp.Binding, error) {
+	var bindings []amqp.Binding
+
+	for i, settings := range config.Slices("amqp.bindings") {
+		name := settings.String("handler")
+		handler, ok := handlers[name]
+		if !ok {
+			return nil, fmt.Errorf("amqp.bindings.%d.handler %s isn't available", i, name)
+		}
+
+		binding := amqp.Binding{
+			Name:         settings.String("name"),
+			Exchange:     settings.String("exchange.name"),
+			ExchangeType: settings.String("exchange.type"),
+			Queue:        settings.String("queue"),
+			Keys:         settings.Strings("keys"),
+			Handler:      handler,
+		}
+		log.Infof("AMQP binding %s: %s handler for %s", binding.Name, name, strings.Join(binding.Keys, ", "))
+		bindings = append(bindings, binding)
+	}
+
+	return bindings, nil
+}
+
+// authorizationPolicy returns the authorization policy from the configuration,
+// or nil if authorization isn't enabled. Requests are denied unless a rule
+// allows them if no default is configured.
+func authorizationPolicy(config *koanf.Koanf) *authz.Policy {
+	if !config.Bool("authz.enabled") {
+		return nil
+	}
+
+	policy := &authz.Policy{Default: config.String("authz.default")}
+	if policy.Default == "" {
+		policy.Default = authz.DefaultDeny
+	}
+	for _, r := range config.Slices("authz.rules") {
+		rule := authz.Rule{
+			Name:       r.String("name"),
+			Identities: r.Strings("identities"),
+			Routes:     r.Strings("routes"),
+			Usernames:  r.Strings("usernames"),
+		}
+		for _, scope := range r.Strings("scopes") {
+			rule.Scopes = append(rule.Scopes, authz.Scope(scope))
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+
+	return policy
+}
+
+// researchAnonymizer returns the anonymizer for the research export from the
+// configuration, or nil if no salt is configured for the usernames.
+func researchAnonymizer(config *koanf.Koanf) *internal.Anonymizer {
+	salt := config.String("export.anonymize.salt")
+	if salt == "" {
+		return nil
+	}
+	return internal.NewAnonymizer(salt, config.Int64("export.anonymize.min_count"))
+}
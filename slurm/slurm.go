@@ -0,0 +1,253 @@
+// Package slurm ingests CPU usage from a Slurm cluster's accounting records.
+//
+// The adapter periodically runs sacct for a window of recently completed jobs,
+// keeps only the jobs that belong to mapped users, converts each job's CPU time
+// into CPU hours, and records the usage for the corresponding DE user. Each
+// Slurm job ID is recorded in the database so that overlapping query windows
+// never count the same job twice.
+package slurm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cockroachdb/apd"
+	"github.com/cyverse-de/resource-usage-api/calculator"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/db"
+	"github.com/cyverse-de/resource-usage-api/leader"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/cyverse-de/resource-usage-api/periodic"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "slurm"})
+
+// sacctTimeFormat is the timestamp layout accepted and emitted by sacct.
+const sacctTimeFormat = "2006-01-02T15:04:05"
+
+// UsageRecorder records resources consumed by a DE user.
+type UsageRecorder interface {
+	AddUsageRecord(context context.Context, username string, record *calculator.UsageRecord) error
+}
+
+// Config contains the settings for the Slurm ingestion adapter.
+type Config struct {
+	// Cluster is the name of the Slurm cluster. It's passed to sacct and is
+	// part of the key used to deduplicate jobs.
+	Cluster string
+
+	// SacctPath is the path to the sacct executable.
+	SacctPath string
+
+	// Interval is how often sacct is queried.
+	Interval time.Duration
+
+	// Lookback is how far back each query reaches. It should be longer than
+	// Interval so that jobs whose accounting records arrive late are picked up.
+	Lookback time.Duration
+
+	// Users maps Slurm usernames to DE usernames. Jobs for unmapped users are
+	// ignored.
+	Users map[string]string
+
+	// DryRun causes the jobs to be logged without being recorded.
+	DryRun bool
+}
+
+// Job is a completed Slurm job as reported by sacct.
+type Job struct {
+	JobID      string
+	User       string
+	CPUSeconds int64
+	End        time.Time
+}
+
+// CPUHours returns the CPU hours consumed by the job.
+func (j *Job) CPUHours() (*apd.Decimal, error) {
+	hours := apd.New(0, 0)
+	bc := apd.BaseContext.WithPrecision(15)
+	_, err := bc.Quo(hours, apd.New(j.CPUSeconds, 0), apd.New(3600, 0))
+	return hours, err
+}
+
+// Ingester pulls Slurm accounting records and records them as CPU usage.
+type Ingester struct {
+	config   *Config
+	db       *db.Database
+	recorder UsageRecorder
+	leader   *leader.Elector
+}
+
+// New returns a new *Ingester.
+func New(config *Config, database *db.Database, recorder UsageRecorder) *Ingester {
+	return &Ingester{
+		config:   config,
+		db:       database,
+		recorder: recorder,
+	}
+}
+
+// sacct runs sacct for jobs that ended between the two times and returns the
+// parsed results.
+func (i *Ingester) sacct(context context.Context, since, until time.Time) ([]Job, error) {
+	var stdout, stderr bytes.Buffer
+
+	args := []string{
+		"--allusers",
+		"--allocations",
+		"--noheader",
+		"--parsable2",
+		"--state=CD,F,TO,CA,OOM,NF",
+		"--format=JobID,User,CPUTimeRAW,End",
+		fmt.Sprintf("--starttime=%s", since.Format(sacctTimeFormat)),
+		fmt.Sprintf("--endtime=%s", until.Format(sacctTimeFormat)),
+	}
+	if i.config.Cluster != "" {
+		args = append(args, fmt.Sprintf("--clusters=%s", i.config.Cluster))
+	}
+
+	cmd := exec.CommandContext(context, i.config.SacctPath, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("sacct failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return ParseSacct(&stdout)
+}
+
+// ParseSacct parses the output of sacct run with --parsable2 --noheader and
+// --format=JobID,User,CPUTimeRAW,End. Jobs that haven't ended are skipped.
+func ParseSacct(output *bytes.Buffer) ([]Job, error) {
+	var jobs []Job
+
+	scanner := bufio.NewScanner(output)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		fields := strings.Split(line, "|")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("unexpected sacct output: %q", line)
+		}
+
+		if fields[3] == "" || fields[3] == "Unknown" {
+			continue
+		}
+
+		cpuSeconds, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPUTimeRAW for job %s: %w", fields[0], err)
+		}
+
+		end, err := time.ParseInLocation(sacctTimeFormat, fields[3], time.Local)
+		if err != nil {
+			return nil, fmt.Errorf("invalid End for job %s: %w", fields[0], err)
+		}
+
+		jobs = append(jobs, Job{
+			JobID:      fields[0],
+			User:       fields[1],
+			CPUSeconds: cpuSeconds,
+			End:        end,
+		})
+	}
+
+	return jobs, scanner.Err()
+}
+
+// ingestJob records the usage for a single job unless it has already been
+// ingested.
+func (i *Ingester) ingestJob(context context.Context, job *Job, username string) error {
+	log := log.WithFields(logrus.Fields{"jobID": job.JobID, "user": username}).WithContext(context)
+
+	userID, err := i.db.UserID(context, username)
+	if err != nil {
+		return fmt.Errorf("unable to look up user %s: %w", username, err)
+	}
+
+	cpuHours, err := job.CPUHours()
+	if err != nil {
+		return err
+	}
+
+	if i.config.DryRun {
+		log.Infof("dry run: would ingest %s CPU hours", cpuHours.String())
+		return nil
+	}
+
+	isNew, err := i.db.RecordSlurmJob(context, i.config.Cluster, job.JobID, userID, cpuHours)
+	if err != nil {
+		return err
+	}
+	if !isNew {
+		log.Debug("job was already ingested, skipping")
+		return nil
+	}
+
+	record := &calculator.UsageRecord{
+		ResourceType: cpuhours.ResourceType,
+		Unit:         cpuhours.Unit,
+		Value:        cpuHours,
+		Cluster:      i.config.Cluster,
+	}
+	if err = i.recorder.AddUsageRecord(context, username, record); err != nil {
+		// Forget the job so that the next run tries again.
+		if derr := i.db.DeleteSlurmJob(context, i.config.Cluster, job.JobID); derr != nil {
+			log.Error(derr)
+		}
+		return err
+	}
+
+	log.Infof("ingested %s CPU hours", cpuHours.String())
+
+	return nil
+}
+
+// SetLeader sets the election that decides whether this instance runs the
+// ingestion. Without one, every instance runs it.
+func (i *Ingester) SetLeader(elector *leader.Elector) {
+	i.leader = elector
+}
+
+// Ingest runs a single ingestion pass covering the configured lookback window.
+func (i *Ingester) Ingest(context context.Context) error {
+	log := log.WithFields(logrus.Fields{"context": "slurm ingestion", "cluster": i.config.Cluster}).WithContext(context)
+
+	until := time.Now()
+	since := until.Add(-i.config.Lookback)
+
+	jobs, err := i.sacct(context, since, until)
+	if err != nil {
+		return err
+	}
+	log.Debugf("sacct returned %d jobs", len(jobs))
+
+	for _, job := range jobs {
+		username, ok := i.config.Users[job.User]
+		if !ok {
+			continue
+		}
+
+		if err = i.ingestJob(context, &job, username); err != nil {
+			log.Error(err)
+		}
+	}
+
+	return nil
+}
+
+// Run performs an ingestion pass every configured interval until the context
+// is canceled.
+func (i *Ingester) Run(context context.Context) {
+	periodic.Run(context, log, i.leader, func() time.Duration { return i.config.Interval }, i.Ingest)
+}
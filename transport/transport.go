@@ -0,0 +1,92 @@
+// Package transport contains the pieces shared by the messaging backends that
+// deliver job status updates to the service and carry usage updates away from
+// it.
+package transport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/cyverse-de/messaging/v9"
+)
+
+// Transport is implemented by the messaging backends.
+type Transport interface {
+	// Send publishes a message with the given routing key or subject.
+	Send(context context.Context, key string, data []byte) error
+
+	// Close disconnects from the messaging system.
+	Close()
+}
+
+// HandlerFn processes a job status update. A nil return value causes the
+// message to be acknowledged. Errors wrapped with Permanent cause the message
+// to be dead-lettered, and all other errors cause it to be redelivered so that
+// it can be retried, until it has failed the configured number of times.
+type HandlerFn func(context context.Context, externalID string, state messaging.JobState) error
+
+// Archiver records the job status updates consumed by the service. Errors are
+// logged by the transports but don't prevent the update from being handled.
+type Archiver interface {
+	Archive(context context.Context, update *JobUpdate, body []byte) error
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks an error as one that won't go away if the message is
+// processed again.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err: err}
+}
+
+// IsPermanent returns true if the error was marked with Permanent.
+func IsPermanent(err error) bool {
+	var pe *permanentError
+	return errors.As(err, &pe)
+}
+
+type jobUpdateJob struct {
+	UUID     string `json:"uuid"`
+	CondorID string `json:"condor_id"` // not actually used for anything...yet.
+}
+
+// JobUpdate is the body of a job status update message.
+type JobUpdate struct {
+	Job     jobUpdateJob       `json:"Job"`
+	State   messaging.JobState `json:"State"`
+	Message string             `json:"Message"`
+	SentOn  string             `json:"SentOn"`
+	Sender  string             `json:"Sender"`
+}
+
+// ParseJobUpdate parses and validates the body of a job status update
+// message. The errors it returns are permanent.
+func ParseJobUpdate(body []byte) (*JobUpdate, error) {
+	var update JobUpdate
+
+	if err := json.Unmarshal(body, &update); err != nil {
+		return nil, Permanent(err)
+	}
+	if update.State == "" {
+		return nil, Permanent(errors.New("state was unset, dropping message"))
+	}
+	if update.Job.UUID == "" {
+		return nil, Permanent(errors.New("external ID was unset, dropping message"))
+	}
+
+	return &update, nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/cyverse-de/go-mod/cfg"
+	"github.com/cyverse-de/resource-usage-api/anomaly"
+	"github.com/cyverse-de/resource-usage-api/archive"
+	"github.com/cyverse-de/resource-usage-api/backlog"
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/cron"
+	"github.com/cyverse-de/resource-usage-api/datausage"
+	"github.com/cyverse-de/resource-usage-api/digest"
+	"github.com/cyverse-de/resource-usage-api/drift"
+	"github.com/cyverse-de/resource-usage-api/enforcement"
+	"github.com/cyverse-de/resource-usage-api/faults"
+	"github.com/cyverse-de/resource-usage-api/quotas"
+	"github.com/cyverse-de/resource-usage-api/resets"
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/providers/file"
+)
+
+// enforcementConfiguration returns the enforcement settings from the
+// configuration.
+func enforcementConfiguration(config *koanf.Koanf) enforcement.Config {
+	enforcementConfig := enforcement.Config{
+		RoutingKey:         config.String("enforcement.routing_key"),
+		GracePercentage:    config.Float64("enforcement.grace_percentage"),
+		OverdraftAllowance: config.Float64("enforcement.overdraft_allowance"),
+	}
+	if enforcementConfig.RoutingKey == "" {
+		enforcementConfig.RoutingKey = "qms.enforcement"
+	}
+	return enforcementConfig
+}
+
+// retryConfiguration returns the usage publish retry settings from the
+// configuration.
+func retryConfiguration(config *koanf.Koanf) *cpuhours.RetryConfig {
+	retryConfig := &cpuhours.RetryConfig{
+		Interval:  config.Duration("publish_retries.interval"),
+		BaseDelay: config.Duration("publish_retries.base_delay"),
+		MaxDelay:  config.Duration("publish_retries.max_delay"),
+		BatchSize: config.Int("publish_retries.batch_size"),
+	}
+	if retryConfig.Interval == 0 {
+		retryConfig.Interval = time.Minute
+	}
+	if retryConfig.BaseDelay == 0 {
+		retryConfig.BaseDelay = 30 * time.Second
+	}
+	if retryConfig.MaxDelay == 0 {
+		retryConfig.MaxDelay = time.Hour
+	}
+	if retryConfig.BatchSize == 0 {
+		retryConfig.BatchSize = 100
+	}
+	return retryConfig
+}
+
+// archiveConfiguration returns the job status update archive settings from the
+// configuration.
+func archiveConfiguration(config *koanf.Koanf) *archive.Config {
+	archiveConfig := &archive.Config{
+		Retention: 90 * 24 * time.Hour,
+		Interval:  config.Duration("archive.prune_interval"),
+	}
+	if config.Exists("archive.retention") {
+		archiveConfig.Retention = config.Duration("archive.retention")
+	}
+	if archiveConfig.Interval == 0 {
+		archiveConfig.Interval = time.Hour
+	}
+	return archiveConfig
+}
+
+// anomalyConfiguration returns the anomaly detection settings from the
+// configuration.
+func anomalyConfiguration(config *koanf.Koanf) *anomaly.Config {
+	anomalyConfig := &anomaly.Config{
+		Interval:     config.Duration("anomalies.interval"),
+		BaselineDays: config.Int("anomalies.baseline_days"),
+		Factor:       config.Float64("anomalies.factor"),
+		MinHours:     config.Float64("anomalies.min_hours"),
+		RoutingKey:   config.String("anomalies.routing_key"),
+	}
+	if anomalyConfig.Interval == 0 {
+		anomalyConfig.Interval = time.Hour
+	}
+	if anomalyConfig.BaselineDays == 0 {
+		anomalyConfig.BaselineDays = 14
+	}
+	if anomalyConfig.Factor == 0 {
+		anomalyConfig.Factor = 10
+	}
+	if !config.Exists("anomalies.min_hours") {
+		anomalyConfig.MinHours = 10
+	}
+	return anomalyConfig
+}
+
+// driftConfiguration returns the QMS drift comparison settings from the
+// configuration.
+func driftConfiguration(config *koanf.Koanf) *drift.Config {
+	driftConfig := &drift.Config{
+		Interval:  config.Duration("qms_drift.interval"),
+		Tolerance: config.Float64("qms_drift.tolerance"),
+	}
+	if driftConfig.Interval == 0 {
+		driftConfig.Interval = time.Hour
+	}
+	if !config.Exists("qms_drift.tolerance") {
+		driftConfig.Tolerance = 0.01
+	}
+	return driftConfig
+}
+
+// quotaConfiguration returns the QMS quota refresh settings from the
+// configuration.
+func quotaConfiguration(config *koanf.Koanf) *quotas.Config {
+	quotaConfig := &quotas.Config{
+		Interval: config.Duration("qms_quotas.interval"),
+		MaxAge:   config.Duration("qms_quotas.max_age"),
+	}
+	if quotaConfig.Interval == 0 {
+		quotaConfig.Interval = 5 * time.Minute
+	}
+	if quotaConfig.MaxAge == 0 {
+		quotaConfig.MaxAge = time.Hour
+	}
+	return quotaConfig
+}
+
+// dataUsageConfiguration returns the data usage synchronization settings from
+// the configuration.
+func dataUsageConfiguration(config *koanf.Koanf) *datausage.Config {
+	dataUsageConfig := &datausage.Config{
+		Interval: config.Duration("data_usage.sync.interval"),
+	}
+	if dataUsageConfig.Interval == 0 {
+		dataUsageConfig.Interval = 15 * time.Minute
+	}
+	return dataUsageConfig
+}
+
+// digestConfiguration returns the weekly usage digest settings from the
+// configuration.
+func digestConfiguration(config *koanf.Koanf) *digest.Config {
+	digestConfig := &digest.Config{
+		Interval:      config.Duration("digests.interval"),
+		RoutingKey:    config.String("digests.routing_key"),
+		TopAnalyses:   config.Int("digests.top_analyses"),
+		Email:         config.Bool("digests.email"),
+		DefaultLocale: config.String("digests.default_locale"),
+		Domain:        config.String("users.domain"),
+	}
+	if digestConfig.Interval == 0 {
+		digestConfig.Interval = time.Hour
+	}
+	if digestConfig.RoutingKey == "" {
+		digestConfig.RoutingKey = "notifications.usage.digest"
+	}
+	if digestConfig.TopAnalyses == 0 {
+		digestConfig.TopAnalyses = 5
+	}
+	return digestConfig
+}
+
+// backlogConfiguration returns the work queue backlog monitor settings from
+// the configuration.
+func backlogConfiguration(config *koanf.Koanf) *backlog.Config {
+	backlogConfig := &backlog.Config{
+		Interval:  config.Duration("backpressure.interval"),
+		Threshold: config.Int64("backpressure.threshold"),
+		AckDelay:  config.Duration("backpressure.ack_delay"),
+	}
+	if backlogConfig.Interval == 0 {
+		backlogConfig.Interval = 30 * time.Second
+	}
+	if !config.Exists("backpressure.threshold") {
+		backlogConfig.Threshold = 10000
+	}
+	if backlogConfig.AckDelay == 0 {
+		backlogConfig.AckDelay = 5 * time.Second
+	}
+	return backlogConfig
+}
+
+// resetConfiguration returns the scheduled reset settings from the
+// configuration. The default schedule has already been checked by
+// validateConfiguration.
+func resetConfiguration(config *koanf.Koanf) *resets.Config {
+	resetConfig := &resets.Config{
+		Interval: config.Duration("resets.interval"),
+	}
+	if resetConfig.Interval == 0 {
+		resetConfig.Interval = time.Minute
+	}
+	if expression := config.String("resets.default_schedule"); expression != "" {
+		resetConfig.Default, _ = cron.Parse(expression)
+	}
+	return resetConfig
+}
+
+// faultConfiguration returns the probabilities that faults are injected into
+// each operation from the configuration. They only have an effect in builds
+// with the faults build tag.
+func faultConfiguration(config *koanf.Koanf) *faults.Config {
+	return &faults.Config{
+		DBCommit:    config.Float64("faults.db_commit"),
+		AMQPPublish: config.Float64("faults.amqp_publish"),
+		QMSUpdate:   config.Float64("faults.qms_update"),
+	}
+}
+
+// logChanges logs each field that differs between two settings structs, which
+// must have the same type.
+func logChanges(section string, previous, current interface{}) {
+	p := reflect.Indirect(reflect.ValueOf(previous))
+	c := reflect.Indirect(reflect.ValueOf(current))
+	for i := 0; i < c.NumField(); i++ {
+		pv, cv := p.Field(i).Interface(), c.Field(i).Interface()
+		if !reflect.DeepEqual(pv, cv) {
+			log.Infof("%s: %s changed from %v to %v", section, c.Type().Field(i).Name, pv, cv)
+		}
+	}
+}
+
+// tunables applies changes to the settings that can be changed without
+// restarting: the intervals, thresholds, and routing keys of the background
+// tasks, and the fault injection rates. Each task is only reconfigured if it's
+// running, and the rates only if the build injects faults.
+type tunables struct {
+	mutex sync.Mutex
+
+	enforcer       *enforcement.Enforcer
+	enforcerConfig enforcement.Config
+
+	retryQueue  *cpuhours.RetryQueue
+	retryConfig *cpuhours.RetryConfig
+
+	archive       *archive.Archive
+	archiveConfig *archive.Config
+
+	detector      *anomaly.Detector
+	anomalyConfig *anomaly.Config
+
+	comparer    *drift.Comparer
+	driftConfig *drift.Config
+
+	refresher   *quotas.Refresher
+	quotaConfig *quotas.Config
+
+	syncer          *datausage.Syncer
+	dataUsageConfig *datausage.Config
+
+	composer     *digest.Composer
+	digestConfig *digest.Config
+
+	monitor       *backlog.Monitor
+	backlogConfig *backlog.Config
+
+	scheduler   *resets.Scheduler
+	resetConfig *resets.Config
+
+	faultConfig *faults.Config
+}
+
+// apply reconfigures the running tasks with the settings from the
+// configuration and logs each setting that changed.
+func (t *tunables) apply(config *koanf.Koanf) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.enforcer != nil {
+		enforcerConfig := enforcementConfiguration(config)
+		logChanges("enforcement", t.enforcerConfig, enforcerConfig)
+		t.enforcer.SetConfig(enforcerConfig)
+		t.enforcerConfig = enforcerConfig
+	}
+	if t.retryQueue != nil {
+		retryConfig := retryConfiguration(config)
+		logChanges("publish retries", t.retryConfig, retryConfig)
+		t.retryQueue.SetConfig(retryConfig)
+		t.retryConfig = retryConfig
+	}
+	if t.archive != nil {
+		archiveConfig := archiveConfiguration(config)
+		logChanges("archive", t.archiveConfig, archiveConfig)
+		t.archive.SetConfig(archiveConfig)
+		t.archiveConfig = archiveConfig
+	}
+	if t.detector != nil {
+		anomalyConfig := anomalyConfiguration(config)
+		logChanges("anomalies", t.anomalyConfig, anomalyConfig)
+		t.detector.SetConfig(anomalyConfig)
+		t.anomalyConfig = anomalyConfig
+	}
+	if t.comparer != nil {
+		driftConfig := driftConfiguration(config)
+		logChanges("QMS drift", t.driftConfig, driftConfig)
+		t.comparer.SetConfig(driftConfig)
+		t.driftConfig = driftConfig
+	}
+	if t.refresher != nil {
+		quotaConfig := quotaConfiguration(config)
+		logChanges("QMS quotas", t.quotaConfig, quotaConfig)
+		t.refresher.SetConfig(quotaConfig)
+		t.quotaConfig = quotaConfig
+	}
+	if t.syncer != nil {
+		dataUsageConfig := dataUsageConfiguration(config)
+		logChanges("data usage", t.dataUsageConfig, dataUsageConfig)
+		t.syncer.SetConfig(dataUsageConfig)
+		t.dataUsageConfig = dataUsageConfig
+	}
+	if t.composer != nil {
+		digestConfig := digestConfiguration(config)
+		logChanges("digests", t.digestConfig, digestConfig)
+		t.composer.SetConfig(digestConfig)
+		t.digestConfig = digestConfig
+	}
+	if t.monitor != nil {
+		backlogConfig := backlogConfiguration(config)
+		logChanges("backpressure", t.backlogConfig, backlogConfig)
+		t.monitor.SetConfig(backlogConfig)
+		t.backlogConfig = backlogConfig
+	}
+	if t.scheduler != nil {
+		resetConfig := resetConfiguration(config)
+		logChanges("resets", t.resetConfig, resetConfig)
+		t.scheduler.SetConfig(resetConfig)
+		t.resetConfig = resetConfig
+	}
+	if t.faultConfig != nil {
+		faultConfig := faultConfiguration(config)
+		logChanges("faults", t.faultConfig, faultConfig)
+		faults.SetConfig(faultConfig)
+		t.faultConfig = faultConfig
+	}
+}
+
+// reload reads the configuration again and applies the tunable settings from
+// it. Nothing is applied if the configuration has problems.
+func (t *tunables) reload(settings *cfg.Settings) {
+	config, err := cfg.Init(settings)
+	if err != nil {
+		log.Errorf("unable to read the configuration again: %s", err)
+		return
+	}
+	if problems := validateConfiguration(config, settings.EnvPrefix); len(problems) > 0 {
+		for _, problem := range problems {
+			log.Error(problem)
+		}
+		log.Errorf("not applying the configuration because it has %d problems", len(problems))
+		return
+	}
+	t.apply(config)
+}
+
+// watch applies the tunable settings whenever the configuration file changes,
+// until the context is canceled.
+func (t *tunables) watch(context context.Context, settings *cfg.Settings) {
+	changes := make(chan struct{}, 1)
+	err := file.Provider(settings.ConfigPath).Watch(func(_ interface{}, err error) {
+		if err != nil {
+			log.Errorf("stopped watching the configuration file: %s", err)
+			return
+		}
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	})
+	if err != nil {
+		log.Errorf("unable to watch the configuration file %s: %s", settings.ConfigPath, err)
+		return
+	}
+
+	for {
+		select {
+		case <-context.Done():
+			return
+		case <-changes:
+			log.Infof("%s changed, applying the tunable settings", settings.ConfigPath)
+			t.reload(settings)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/resource-usage-api/cpuhours"
+	"github.com/cyverse-de/resource-usage-api/cron"
+	"github.com/cyverse-de/resource-usage-api/faults"
+	"github.com/cyverse-de/resource-usage-api/internal"
+	"github.com/cyverse-de/resource-usage-api/locale"
+	"github.com/cyverse-de/resource-usage-api/logging"
+	"github.com/knadh/koanf"
+)
+
+// durationKeys are the configuration settings that are read as durations.
+// koanf reads a duration that doesn't parse as zero, which would silently
+// select the default, so they're checked up front.
+var durationKeys = []string{
+	"anomalies.interval",
+	"archive.prune_interval",
+	"archive.retention",
+	"backpressure.ack_delay",
+	"backpressure.interval",
+	"cors.max_age",
+	"data_usage.max_age",
+	"data_usage.sync.interval",
+	"db.conn_max_idle_time",
+	"db.conn_max_lifetime",
+	"db.statement_timeout",
+	"digests.interval",
+	"holds.runtime",
+	"http_client.dial_timeout",
+	"http_client.idle_conn_timeout",
+	"http_client.response_header_timeout",
+	"http_client.timeout",
+	"http_client.tls_handshake_timeout",
+	"jetstream.ack_wait",
+	"kafka.write_timeout",
+	"publish_retries.base_delay",
+	"publish_retries.interval",
+	"publish_retries.max_delay",
+	"qms_drift.interval",
+	"qms_quotas.interval",
+	"qms_quotas.max_age",
+	"redis.ttl",
+	"resets.interval",
+	"slurm.interval",
+	"slurm.lookback",
+}
+
+// signedDurationKeys are the duration settings that may be negative. A
+// negative CORS maximum age tells browsers not to cache preflight responses.
+var signedDurationKeys = map[string]bool{
+	"cors.max_age": true,
+}
+
+// faultKeys are the configuration settings for the probabilities that faults
+// are injected into each operation.
+var faultKeys = []string{
+	"faults.amqp_publish",
+	"faults.db_commit",
+	"faults.qms_update",
+}
+
+// minAnonymizationSaltLength is the shortest salt accepted for the usernames
+// in the anonymized research export.
+const minAnonymizationSaltLength = 16
+
+// urlKeys are the configuration settings that must be absolute URLs if
+// they're set.
+var urlKeys = []string{
+	"amqp.uri",
+	"http_client.proxy",
+	"prometheus.base",
+	"qms.base",
+	"redis.uri",
+}
+
+// configValidator collects the problems found in the configuration.
+type configValidator struct {
+	config   *koanf.Koanf
+	problems []string
+}
+
+// problem records a problem with the configuration.
+func (v *configValidator) problem(format string, args ...interface{}) {
+	v.problems = append(v.problems, fmt.Sprintf(format, args...))
+}
+
+// require records a problem if the setting isn't set.
+func (v *configValidator) require(key, reason string) {
+	if v.config.String(key) == "" {
+		v.problem("%s must be set in the configuration file%s", key, reason)
+	}
+}
+
+// checkDuration records a problem if the setting is a string that can't be
+// parsed as a duration, or if it's negative. A duration of zero selects the
+// default, so the intervals that are used can't be negative or zero either.
+func (v *configValidator) checkDuration(key string) {
+	value, ok := v.config.Get(key).(string)
+	if ok && value != "" {
+		if _, err := time.ParseDuration(value); err != nil {
+			v.problem("%s must be a duration such as 90s or 15m: %q", key, value)
+			return
+		}
+	}
+	if v.config.Duration(key) < 0 && !signedDurationKeys[key] {
+		v.problem("%s can't be negative", key)
+	}
+}
+
+// checkURL records a problem if the setting is set but isn't an absolute URL.
+func (v *configValidator) checkURL(key string) {
+	value := v.config.String(key)
+	if value == "" {
+		return
+	}
+	parsed, err := url.Parse(value)
+	if err != nil || parsed.Scheme == "" {
+		v.problem("%s must be an absolute URL", key)
+	}
+}
+
+// checkBindings reports the problems with the additional AMQP bindings. Each
+// binding needs a name or a queue, at least one routing key, and a handler that
+// this service provides.
+func (v *configValidator) checkBindings() {
+	for i, settings := range v.config.Slices("amqp.bindings") {
+		if settings.String("name") == "" && settings.String("queue") == "" {
+			v.problem("amqp.bindings.%d must have a name or a queue", i)
+		}
+		if len(settings.Strings("keys")) == 0 {
+			v.problem("amqp.bindings.%d.keys must list at least one routing key", i)
+		}
+		switch handler := settings.String("handler"); handler {
+		case bindingHandlerDataUsage:
+			if !v.config.Bool("data_usage.sync.enabled") {
+				v.problem("data_usage.sync.enabled must be true if amqp.bindings.%d.handler is %s", i, handler)
+			}
+		default:
+			v.problem("amqp.bindings.%d.handler must be %s", i, bindingHandlerDataUsage)
+		}
+	}
+}
+
+// validateConfiguration checks the configuration for missing settings, values
+// that don't parse, and settings that depend on each other. It returns every
+// problem found rather than stopping at the first one.
+func validateConfiguration(config *koanf.Koanf, envPrefix string) []string {
+	v := &configValidator{config: config}
+
+	v.require("db.uri", "")
+	v.require("users.domain", "")
+	if config.String("nats.cluster") == "" {
+		v.problem("the %sNATS_CLUSTER environment variable or nats.cluster configuration value must be set", envPrefix)
+	}
+
+	// Only PostgreSQL is supported. The setting used to select CockroachDB,
+	// which can't run the queries on the usage totals' ranges.
+	if dialect := config.String("db.dialect"); dialect != "" && dialect != "postgres" {
+		v.problem("db.dialect is no longer supported; the service only runs on PostgreSQL")
+	}
+
+	switch config.String("messaging.transport") {
+	case "", transportAMQP:
+		v.require("amqp.uri", "")
+		v.require("amqp.exchange.name", "")
+		v.require("amqp.exchange.type", "")
+		v.checkBindings()
+	case transportJetStream:
+		v.require("jetstream.subject", " if messaging.transport is jetstream")
+	default:
+		v.problem("messaging.transport must be %s or %s", transportAMQP, transportJetStream)
+	}
+
+	if config.Bool("qms.enabled") {
+		v.require("qms.base", " if qms.enabled is true")
+	}
+	if config.Bool("qms_quotas.enabled") && !config.Bool("qms.enabled") {
+		v.problem("qms.enabled must be true if qms_quotas.enabled is true")
+	}
+	if config.Bool("kafka.enabled") && len(config.Strings("kafka.brokers")) == 0 {
+		v.problem("kafka.brokers must be set in the configuration file if kafka.enabled is true")
+	}
+
+	if expression := config.String("resets.default_schedule"); expression != "" {
+		if _, err := cron.Parse(expression); err != nil {
+			v.problem("resets.default_schedule is invalid: %s", err)
+		}
+	}
+
+	if config.Exists("http.max_body_size") && config.Int64("http.max_body_size") <= 0 {
+		v.problem("http.max_body_size must be a positive number of bytes")
+	}
+
+	// A short salt can be found by hashing guesses at known usernames.
+	if salt := config.String("export.anonymize.salt"); salt != "" && len(salt) < minAnonymizationSaltLength {
+		v.problem("export.anonymize.salt must be at least %d characters long", minAnonymizationSaltLength)
+	}
+	if config.Exists("export.anonymize.min_count") && config.Int64("export.anonymize.min_count") <= 0 {
+		v.problem("export.anonymize.min_count must be a positive number of users")
+	}
+
+	for _, key := range faultKeys {
+		if !config.Exists(key) {
+			continue
+		}
+		rate := config.Float64(key)
+		switch {
+		case rate < 0 || rate > 1:
+			v.problem("%s must be between 0 and 1", key)
+		case rate > 0 && !faults.Enabled:
+			v.problem("%s is set, but this build doesn't inject faults; build with -tags faults", key)
+		}
+	}
+
+	if policy := authorizationPolicy(config); policy != nil {
+		if err := policy.Validate(); err != nil {
+			v.problem("authz is invalid: %s", err)
+		}
+	}
+
+	if tag := config.String("digests.default_locale"); tag != "" {
+		if _, ok := locale.Match(tag); !ok {
+			v.problem("digests.default_locale must be one of %s", strings.Join(locale.Supported(), ", "))
+		}
+	}
+
+	if mode := config.String("usage_messages.mode"); mode != "" && !cpuhours.ValidMessageMode(cpuhours.MessageMode(mode)) {
+		v.problem("usage_messages.mode must be %s", cpuhours.MessagesDelta)
+	}
+
+	switch config.String("totals.missing") {
+	case "", internal.MissingTotalsNotFound, internal.MissingTotalsZero:
+	default:
+		v.problem("totals.missing must be %s or %s", internal.MissingTotalsNotFound, internal.MissingTotalsZero)
+	}
+
+	if level := config.String("log.level"); level != "" {
+		if err := logging.ValidLevel(level); err != nil {
+			v.problem("log.level is invalid: %s", err)
+		}
+	}
+
+	jobStates := config.StringMap("job_states")
+	states := make([]string, 0, len(jobStates))
+	for state := range jobStates {
+		states = append(states, state)
+	}
+	sort.Strings(states)
+	for _, state := range states {
+		inProgress := false
+		for _, s := range inProgressStates {
+			if strings.EqualFold(state, string(s)) {
+				inProgress = true
+			}
+		}
+		switch strings.ToLower(jobStates[state]) {
+		case behaviorIgnore:
+		case behaviorCalculate:
+			if inProgress {
+				v.problem("job_states.%s can't be %s because analyses in that state haven't ended", state, behaviorCalculate)
+			}
+		case behaviorHold:
+			if !inProgress {
+				v.problem("job_states.%s can't be %s because analyses in that state have ended", state, behaviorHold)
+			}
+		default:
+			v.problem("job_states.%s must be %s, %s, or %s", state, behaviorCalculate, behaviorHold, behaviorIgnore)
+		}
+	}
+
+	for _, key := range durationKeys {
+		v.checkDuration(key)
+	}
+	for _, key := range urlKeys {
+		v.checkURL(key)
+	}
+
+	return v.problems
+}